@@ -130,7 +130,7 @@ func (a *App) initializeDatabase() error {
 	var err error
 
 	// Make KV hub
-	a.driver, err = database.GetDatabaseDriver(a.cliParams)
+	a.driver, err = database.GetDatabaseDriver(a.cliParams, secretFields)
 	if err != nil {
 		return fmt.Errorf("could not get database driver: %w", err)
 	}
@@ -251,6 +251,30 @@ func (a *App) GetTwitchLoggedUser() (helix.User, error) {
 	return a.twitchManager.Client().GetLoggedUser()
 }
 
+func (a *App) GetTwitchBotAuthURL() string {
+	return a.twitchManager.Client().GetBotAuthorizationURL()
+}
+
+func (a *App) GetTwitchBotUser() (helix.User, error) {
+	return a.twitchManager.Client().GetBotUser()
+}
+
+func (a *App) ExportWatchTime() (string, error) {
+	var b bytes.Buffer
+	if err := a.loyaltyManager.ExportWatchTime(&b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (a *App) ExportStreamSessions(format string) (string, error) {
+	var b bytes.Buffer
+	if err := a.twitchManager.Sessions().Export(&b, twitch.StreamSessionExportFormat(format)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
 func (a *App) GetLastLogs() []LogEntry {
 	return lastLogs.Get()
 }
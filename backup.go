@@ -115,7 +115,7 @@ func (a *App) RestoreBackup(backupName string) error {
 	inStream := file
 
 	if a.driver == nil {
-		a.driver, err = database.GetDatabaseDriver(a.cliParams)
+		a.driver, err = database.GetDatabaseDriver(a.cliParams, secretFields)
 		if err != nil {
 			return fmt.Errorf("could not open database: %w", err)
 		}
@@ -6,10 +6,21 @@ import (
 	"git.sr.ht/~ashkeel/strimertul/utils"
 
 	"git.sr.ht/~ashkeel/strimertul/database"
+	"git.sr.ht/~ashkeel/strimertul/twitch"
+	"git.sr.ht/~ashkeel/strimertul/webserver"
 
 	"github.com/urfave/cli/v2"
 )
 
+// secretFields are the fields of database keys that are encrypted by the secrets layer and redacted from exports
+var secretFields = database.SecretFields{
+	twitch.ConfigKey:          {"api_client_secret", "webhook_secret"},
+	twitch.BotConfigKey:       {"oauth"},
+	twitch.AuthKey:            {"access_token", "refresh_token"},
+	twitch.BotAuthKey:         {"access_token", "refresh_token"},
+	webserver.ServerConfigKey: {"kv_password"},
+}
+
 func cliImport(ctx *cli.Context) error {
 	inStream := os.Stdin
 	fileArg := ctx.String("file")
@@ -27,7 +38,7 @@ func cliImport(ctx *cli.Context) error {
 		return fatalError(err, "could not decode import file")
 	}
 
-	driver, err := database.GetDatabaseDriver(ctx)
+	driver, err := database.GetDatabaseDriver(ctx, secretFields)
 	if err != nil {
 		return fatalError(err, "could not open database")
 	}
@@ -53,7 +64,7 @@ func cliRestore(ctx *cli.Context) error {
 		inStream = file
 	}
 
-	driver, err := database.GetDatabaseDriver(ctx)
+	driver, err := database.GetDatabaseDriver(ctx, secretFields)
 	if err != nil {
 		return fatalError(err, "could not open database")
 	}
@@ -79,12 +90,12 @@ func cliExport(ctx *cli.Context) error {
 		outStream = file
 	}
 
-	driver, err := database.GetDatabaseDriver(ctx)
+	driver, err := database.GetDatabaseDriver(ctx, secretFields)
 	if err != nil {
 		return fatalError(err, "could not open database")
 	}
 
-	err = driver.Export(outStream)
+	err = driver.Export(outStream, ctx.Bool("include-secrets"))
 	if err != nil {
 		return fatalError(err, "export failed")
 	}
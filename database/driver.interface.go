@@ -18,7 +18,7 @@ type DatabaseDriver interface {
 	Hub() *kv.Hub
 	Close() error
 	Import(map[string]string) error
-	Export(io.Writer) error
+	Export(w io.Writer, includeSecrets bool) error
 	Restore(io.Reader) error
 	Backup(io.Writer) error
 }
@@ -46,7 +46,16 @@ func getDatabaseDriverName(ctx *cli.Context) string {
 	return string(file)
 }
 
-func GetDatabaseDriver(ctx *cli.Context) (DatabaseDriver, error) {
+// GetSecretsOptions returns the secrets options from the command line flags
+func GetSecretsOptions(ctx *cli.Context) SecretsOptions {
+	return SecretsOptions{
+		Passphrase: ctx.String("secrets-passphrase"),
+		Keyfile:    ctx.String("secrets-keyfile"),
+	}
+}
+
+// GetDatabaseDriver opens the database, secrets are the fields to encrypt (if enabled with a passphrase or keyfile) and redact from exports
+func GetDatabaseDriver(ctx *cli.Context, secrets SecretFields) (DatabaseDriver, error) {
 	name := getDatabaseDriverName(ctx)
 	dbDirectory := ctx.String("database-dir")
 	logger := ctx.Context.Value(utils.ContextLogger).(*zap.Logger)
@@ -59,6 +68,10 @@ func GetDatabaseDriver(ctx *cli.Context) (DatabaseDriver, error) {
 		if err != nil {
 			return nil, cli.Exit(err.Error(), 64)
 		}
+		if err := db.SetupSecrets(GetSecretsOptions(ctx), secrets); err != nil {
+			_ = db.Close()
+			return nil, cli.Exit(err.Error(), 64)
+		}
 		return db, nil
 	default:
 		return nil, cli.Exit(fmt.Sprintf("Unknown database driver: %s", name), 64)
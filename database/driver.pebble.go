@@ -15,9 +15,13 @@ import (
 )
 
 type PebbleDatabase struct {
-	db     *pebble.DB
-	hub    *kv.Hub
-	logger *zap.Logger
+	db      *pebble.DB
+	hub     *kv.Hub
+	backend kv.Driver
+	logger  *zap.Logger
+
+	secrets      *Secrets
+	secretFields SecretFields
 }
 
 // NewPebble creates a new database driver instance with an underlying Pebble database
@@ -34,21 +38,58 @@ func NewPebble(directory string, logger *zap.Logger) (*PebbleDatabase, error) {
 	}
 
 	p := &PebbleDatabase{
-		db:     db,
-		hub:    nil,
-		logger: logger,
+		db:      db,
+		hub:     nil,
+		backend: pebble_driver.NewPebbleBackend(db, true),
+		logger:  logger,
 	}
 
 	return p, nil
 }
 
+// SetupSecrets enables encryption of secrets if a passphrase or keyfile is given, encrypting existing plaintext secrets.
+// The fields are also used for redacting secrets from exports.
+func (p *PebbleDatabase) SetupSecrets(options SecretsOptions, fields SecretFields) error {
+	p.secretFields = fields
+	if !options.Enabled() {
+		return CheckSecretsLocked(p.backend)
+	}
+
+	secrets, err := OpenSecrets(p.backend, options, fields)
+	if err != nil {
+		return err
+	}
+	p.secrets = secrets
+
+	migrated, err := secrets.MigrateSecrets(p.backend)
+	if err != nil {
+		return fmt.Errorf("could not encrypt existing secrets: %w", err)
+	}
+	if migrated > 0 {
+		p.logger.Info("Encrypted existing secrets", zap.Int("keys", migrated))
+	}
+	return nil
+}
+
 func (p *PebbleDatabase) Hub() *kv.Hub {
 	if p.hub == nil {
-		p.hub, _ = kv.NewHub(pebble_driver.NewPebbleBackend(p.db, true), kv.HubOptions{}, p.logger)
+		backend := p.backend
+		if p.secrets != nil {
+			backend = p.secrets.Wrap(backend)
+		}
+		p.hub, _ = kv.NewHub(backend, kv.HubOptions{}, p.logger)
 	}
 	return p.hub
 }
 
+// prepareImport makes sure secrets in imported entries are stored the same way as the database's
+func (p *PebbleDatabase) prepareImport(entries map[string]string) error {
+	if p.secrets != nil {
+		return p.secrets.PrepareImport(entries)
+	}
+	return p.secretFields.CheckImport(entries)
+}
+
 func (p *PebbleDatabase) Close() error {
 	if p.hub != nil {
 		p.hub.Close()
@@ -61,6 +102,10 @@ func (p *PebbleDatabase) Close() error {
 }
 
 func (p *PebbleDatabase) Import(entries map[string]string) error {
+	if err := p.prepareImport(entries); err != nil {
+		return err
+	}
+
 	batch := p.db.NewBatch()
 	for key, value := range entries {
 		err := batch.Set([]byte(key), []byte(value), &pebble.WriteOptions{})
@@ -71,8 +116,23 @@ func (p *PebbleDatabase) Import(entries map[string]string) error {
 	return batch.Commit(&pebble.WriteOptions{})
 }
 
-func (p *PebbleDatabase) Export(file io.Writer) error {
-	return p.Backup(file)
+func (p *PebbleDatabase) Export(file io.Writer, includeSecrets bool) error {
+	if includeSecrets && p.secrets == nil {
+		return ErrSecretsNotEncrypted
+	}
+
+	out, err := p.readAll()
+	if err != nil {
+		return err
+	}
+
+	if !includeSecrets {
+		delete(out, SecretsMetaKey)
+		for key, value := range out {
+			out[key] = p.secretFields.Redact(key, value)
+		}
+	}
+	return json.NewEncoder(file).Encode(out)
 }
 
 func (p *PebbleDatabase) Restore(file io.Reader) error {
@@ -81,6 +141,9 @@ func (p *PebbleDatabase) Restore(file io.Reader) error {
 	if err != nil {
 		return fmt.Errorf("could not decode backup: %w", err)
 	}
+	if err := p.prepareImport(in); err != nil {
+		return err
+	}
 
 	b := p.db.NewBatch()
 	for k, v := range in {
@@ -94,12 +157,21 @@ func (p *PebbleDatabase) Restore(file io.Reader) error {
 }
 
 func (p *PebbleDatabase) Backup(file io.Writer) error {
+	out, err := p.readAll()
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(file).Encode(out)
+}
+
+// readAll returns all keys as they are stored (with secrets encrypted, if enabled)
+func (p *PebbleDatabase) readAll() (map[string]string, error) {
 	snapshot := p.db.NewSnapshot()
 	defer utils.Close(snapshot, p.logger)
 
 	iter, err := snapshot.NewIter(&pebble.IterOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer utils.Close(iter, p.logger)
 
@@ -107,9 +179,9 @@ func (p *PebbleDatabase) Backup(file io.Writer) error {
 	for iter.First(); iter.Valid(); iter.Next() {
 		val, err := iter.ValueAndErr()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		out[string(iter.Key())] = string(val)
 	}
-	return json.NewEncoder(file).Encode(out)
+	return out, nil
 }
@@ -0,0 +1,464 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	kv "github.com/strimertul/kilovolt/v11"
+	"golang.org/x/crypto/argon2"
+)
+
+// SecretFields lists, for every key holding secrets, the fields of its JSON object that must be encrypted
+type SecretFields map[string][]string
+
+// SecretsOptions is where the key for encrypting secrets comes from, if both are empty the secrets layer is disabled
+type SecretsOptions struct {
+	// Passphrase to derive the key from
+	Passphrase string
+
+	// Path to a file with random data to derive the key from, it's created if missing
+	Keyfile string
+}
+
+// Enabled returns true if a passphrase or keyfile was given
+func (o SecretsOptions) Enabled() bool {
+	return o.Passphrase != "" || o.Keyfile != ""
+}
+
+const (
+	// SecretsMetaKey holds what's needed to check that the right passphrase or keyfile was given
+	SecretsMetaKey = "stul-meta/secrets"
+
+	// Encrypted values are saved as this prefix followed by nonce and ciphertext in base64
+	secretPrefix = "stul-secret:v1:"
+
+	secretsCheckValue = "strimertul"
+	keyfileSize       = 32
+)
+
+var (
+	// ErrWrongSecretsKey is returned when encrypted secrets can't be decrypted with the given passphrase or keyfile
+	ErrWrongSecretsKey = errors.New("could not decrypt secrets, wrong passphrase or keyfile")
+
+	// ErrSecretsLocked is returned when the database has encrypted secrets but no passphrase or keyfile was given
+	ErrSecretsLocked = errors.New("database has encrypted secrets, a passphrase or keyfile is needed to open it")
+
+	// ErrSecretsNotEncrypted is returned when exporting secrets without the secrets layer, as they would be in plaintext
+	ErrSecretsNotEncrypted = errors.New("secrets can only be exported encrypted, set a passphrase or keyfile first")
+)
+
+type secretsMeta struct {
+	Salt  []byte `json:"salt"`
+	Check string `json:"check"`
+}
+
+// Secrets encrypts and decrypts secret fields of database values
+type Secrets struct {
+	material []byte
+	meta     secretsMeta
+	aead     cipher.AEAD
+	fields   SecretFields
+}
+
+// OpenSecrets derives the key for encrypting secrets, checking it against the one used before if the backend has any.
+// It doesn't encrypt existing plaintext secrets, use MigrateSecrets for that.
+func OpenSecrets(backend kv.Driver, options SecretsOptions, fields SecretFields) (*Secrets, error) {
+	material, err := secretsMaterial(options)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := &Secrets{material: material, fields: fields}
+
+	saved, err := backend.Get(SecretsMetaKey)
+	switch {
+	case err == nil:
+		if err := secrets.useMeta(saved); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, kv.ErrorKeyNotFound):
+		// First time using the secrets layer, generate a new salt
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("could not generate salt: %w", err)
+		}
+		if err := secrets.setKey(salt); err != nil {
+			return nil, err
+		}
+		secrets.meta = secretsMeta{
+			Salt:  salt,
+			Check: secrets.seal(secretsCheckValue, SecretsMetaKey),
+		}
+		byt, err := json.Marshal(secrets.meta)
+		if err != nil {
+			return nil, err
+		}
+		if err := backend.Set(SecretsMetaKey, string(byt)); err != nil {
+			return nil, fmt.Errorf("could not save secrets info: %w", err)
+		}
+	default:
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// CheckSecretsLocked returns ErrSecretsLocked if the backend has encrypted secrets
+func CheckSecretsLocked(backend kv.Driver) error {
+	_, err := backend.Get(SecretsMetaKey)
+	switch {
+	case err == nil:
+		return ErrSecretsLocked
+	case errors.Is(err, kv.ErrorKeyNotFound):
+		return nil
+	default:
+		return err
+	}
+}
+
+func secretsMaterial(options SecretsOptions) ([]byte, error) {
+	if options.Passphrase != "" {
+		return []byte(options.Passphrase), nil
+	}
+
+	material, err := os.ReadFile(options.Keyfile)
+	if err == nil {
+		if len(material) == 0 {
+			return nil, fmt.Errorf("keyfile %s is empty", options.Keyfile)
+		}
+		return material, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read keyfile: %w", err)
+	}
+
+	// Create a new keyfile
+	material = make([]byte, keyfileSize)
+	if _, err := rand.Read(material); err != nil {
+		return nil, fmt.Errorf("could not generate keyfile: %w", err)
+	}
+	if err := os.WriteFile(options.Keyfile, material, 0o600); err != nil {
+		return nil, fmt.Errorf("could not write keyfile: %w", err)
+	}
+	return material, nil
+}
+
+func (s *Secrets) setKey(salt []byte) error {
+	key := argon2.IDKey(s.material, salt, 3, 64*1024, 4, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	s.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// useMeta sets up the key from saved secrets info, checking it's the right one
+func (s *Secrets) useMeta(saved string) error {
+	var meta secretsMeta
+	if err := json.Unmarshal([]byte(saved), &meta); err != nil {
+		return fmt.Errorf("could not decode secrets info: %w", err)
+	}
+	if err := s.setKey(meta.Salt); err != nil {
+		return err
+	}
+	check, err := s.open(meta.Check, SecretsMetaKey)
+	if err != nil || check != secretsCheckValue {
+		return ErrWrongSecretsKey
+	}
+	s.meta = meta
+	return nil
+}
+
+// seal encrypts a value, binding it to where it's stored
+func (s *Secrets) seal(plaintext string, location string) string {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Errorf("could not generate nonce: %w", err))
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(plaintext), []byte(location))
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func (s *Secrets) open(value string, location string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, secretPrefix))
+	if err != nil {
+		return "", ErrWrongSecretsKey
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", ErrWrongSecretsKey
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(location))
+	if err != nil {
+		return "", ErrWrongSecretsKey
+	}
+	return string(plaintext), nil
+}
+
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
+
+// secretObject is a JSON object whose values are kept as they are, so only secret fields get changed
+type secretObject map[string]jsoniter.RawMessage
+
+func parseSecretObject(value string) (secretObject, bool) {
+	var object secretObject
+	if err := json.Unmarshal([]byte(value), &object); err != nil {
+		return nil, false
+	}
+	return object, true
+}
+
+// stringField returns a field of the object if it's a non-empty string
+func (o secretObject) stringField(field string) (string, bool) {
+	raw, ok := o[field]
+	if !ok {
+		return "", false
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil || str == "" {
+		return "", false
+	}
+	return str, true
+}
+
+func (o secretObject) String() (string, error) {
+	byt, err := json.Marshal(o)
+	return string(byt), err
+}
+
+// transformFields applies fn to every non-empty secret string field of a value
+func (s *Secrets) transformFields(key string, value string, fn func(field string, value string) (string, error)) (string, error) {
+	fields, ok := s.fields[key]
+	if !ok {
+		return value, nil
+	}
+
+	object, ok := parseSecretObject(value)
+	if !ok {
+		// Not something we know how to handle, leave it as is
+		return value, nil
+	}
+
+	changed := false
+	for _, field := range fields {
+		str, ok := object.stringField(field)
+		if !ok {
+			continue
+		}
+		result, err := fn(field, str)
+		if err != nil {
+			return "", fmt.Errorf("%s in %s: %w", field, key, err)
+		}
+		if result != str {
+			object[field], err = json.Marshal(result)
+			if err != nil {
+				return "", err
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return value, nil
+	}
+
+	return object.String()
+}
+
+// Encrypt encrypts the secret fields of a value, fields that are already encrypted are left as they are
+func (s *Secrets) Encrypt(key string, value string) (string, error) {
+	return s.transformFields(key, value, func(field string, value string) (string, error) {
+		if isSealed(value) {
+			return value, nil
+		}
+		return s.seal(value, key+"."+field), nil
+	})
+}
+
+// Decrypt decrypts the secret fields of a value, plaintext fields are left as they are
+func (s *Secrets) Decrypt(key string, value string) (string, error) {
+	return s.transformFields(key, value, func(field string, value string) (string, error) {
+		if !isSealed(value) {
+			return value, nil
+		}
+		return s.open(value, key+"."+field)
+	})
+}
+
+// Redact removes the secret fields from a value
+func (fields SecretFields) Redact(key string, value string) string {
+	list, ok := fields[key]
+	if !ok {
+		return value
+	}
+
+	object, ok := parseSecretObject(value)
+	if !ok {
+		return value
+	}
+	for _, field := range list {
+		delete(object, field)
+	}
+	redacted, err := object.String()
+	if err != nil {
+		return value
+	}
+	return redacted
+}
+
+// MigrateSecrets encrypts secrets that are still saved as plaintext, returning how many keys were changed
+func (s *Secrets) MigrateSecrets(backend kv.Driver) (int, error) {
+	migrated := 0
+	for key := range s.fields {
+		value, err := backend.Get(key)
+		if err != nil {
+			if errors.Is(err, kv.ErrorKeyNotFound) {
+				continue
+			}
+			return migrated, err
+		}
+		encrypted, err := s.Encrypt(key, value)
+		if err != nil {
+			return migrated, err
+		}
+		if encrypted == value {
+			continue
+		}
+		if err := backend.Set(key, encrypted); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// PrepareImport makes imported entries use the current key: plaintext secrets are encrypted and secrets
+// encrypted with the same passphrase or keyfile but a different salt (e.g. exported from another database) are re-encrypted
+func (s *Secrets) PrepareImport(entries map[string]string) error {
+	source := s
+	if saved, ok := entries[SecretsMetaKey]; ok {
+		delete(entries, SecretsMetaKey)
+
+		var meta secretsMeta
+		if err := json.Unmarshal([]byte(saved), &meta); err != nil {
+			return fmt.Errorf("could not decode secrets info: %w", err)
+		}
+		if !bytes.Equal(meta.Salt, s.meta.Salt) {
+			source = &Secrets{material: s.material, fields: s.fields}
+			if err := source.useMeta(saved); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key := range s.fields {
+		value, ok := entries[key]
+		if !ok {
+			continue
+		}
+		decrypted, err := source.Decrypt(key, value)
+		if err != nil {
+			return err
+		}
+		entries[key], err = s.Encrypt(key, decrypted)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckImport returns ErrSecretsLocked if entries have encrypted secrets, for importing without the secrets layer
+func (fields SecretFields) CheckImport(entries map[string]string) error {
+	for key, list := range fields {
+		value, ok := entries[key]
+		if !ok {
+			continue
+		}
+		object, ok := parseSecretObject(value)
+		if !ok {
+			continue
+		}
+		for _, field := range list {
+			if str, ok := object.stringField(field); ok && isSealed(str) {
+				return ErrSecretsLocked
+			}
+		}
+	}
+	return nil
+}
+
+// Wrap returns a backend that transparently encrypts secrets when writing and decrypts them when reading
+func (s *Secrets) Wrap(backend kv.Driver) kv.Driver {
+	return &secretsBackend{Driver: backend, secrets: s}
+}
+
+type secretsBackend struct {
+	kv.Driver
+	secrets *Secrets
+}
+
+func (b *secretsBackend) Get(key string) (string, error) {
+	value, err := b.Driver.Get(key)
+	if err != nil {
+		return value, err
+	}
+	return b.secrets.Decrypt(key, value)
+}
+
+func (b *secretsBackend) GetBulk(keys []string) (map[string]string, error) {
+	values, err := b.Driver.GetBulk(keys)
+	if err != nil {
+		return values, err
+	}
+	return values, b.decryptAll(values)
+}
+
+func (b *secretsBackend) GetPrefix(prefix string) (map[string]string, error) {
+	values, err := b.Driver.GetPrefix(prefix)
+	if err != nil {
+		return values, err
+	}
+	return values, b.decryptAll(values)
+}
+
+func (b *secretsBackend) decryptAll(values map[string]string) error {
+	for key, value := range values {
+		decrypted, err := b.secrets.Decrypt(key, value)
+		if err != nil {
+			return err
+		}
+		values[key] = decrypted
+	}
+	return nil
+}
+
+func (b *secretsBackend) Set(key string, value string) error {
+	encrypted, err := b.secrets.Encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	return b.Driver.Set(key, encrypted)
+}
+
+func (b *secretsBackend) SetBulk(values map[string]string) error {
+	encrypted := make(map[string]string, len(values))
+	for key, value := range values {
+		var err error
+		encrypted[key], err = b.secrets.Encrypt(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return b.Driver.SetBulk(encrypted)
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kv "github.com/strimertul/kilovolt/v11"
+)
+
+var testSecretFields = SecretFields{
+	"test/config": {"password", "token"},
+}
+
+func TestSecretsEncryption(t *testing.T) {
+	store := kv.MakeBackend()
+	secrets, err := OpenSecrets(store, SecretsOptions{Passphrase: "hunter2"}, testSecretFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := secrets.Wrap(store)
+
+	value := `{"password":"secret","token":"","count":12345678.5,"name":"test"}`
+	if err := backend.Set("test/config", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Set("test/other", `{"password":"not a secret"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Secrets must not be stored as plaintext, everything else must be left alone
+	stored, err := store.Get("test/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, `"secret"`) || !strings.Contains(stored, secretPrefix) {
+		t.Fatalf("secret was not encrypted: %s", stored)
+	}
+	if !strings.Contains(stored, `"count":12345678.5`) || !strings.Contains(stored, `"token":""`) {
+		t.Fatalf("other fields were changed: %s", stored)
+	}
+	other, err := store.Get("test/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other != `{"password":"not a secret"}` {
+		t.Fatalf("key without secrets was changed: %s", other)
+	}
+
+	// Reading through the wrapper returns the plaintext
+	read, err := backend.Get("test/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, _ := parseSecretObject(read)
+	if password, _ := object.stringField("password"); password != "secret" {
+		t.Fatalf("expected decrypted password, got %s", read)
+	}
+	values, err := backend.GetPrefix("test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(values["test/config"], `"password":"secret"`) {
+		t.Fatalf("prefix read was not decrypted: %s", values["test/config"])
+	}
+
+	// Opening again with the same passphrase works, with a different one it doesn't
+	if _, err := OpenSecrets(store, SecretsOptions{Passphrase: "hunter2"}, testSecretFields); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSecrets(store, SecretsOptions{Passphrase: "hunter3"}, testSecretFields); !errors.Is(err, ErrWrongSecretsKey) {
+		t.Fatalf("expected wrong key error, got %v", err)
+	}
+	if err := CheckSecretsLocked(store); !errors.Is(err, ErrSecretsLocked) {
+		t.Fatalf("expected locked error, got %v", err)
+	}
+}
+
+func TestSecretsMigration(t *testing.T) {
+	store := kv.MakeBackend()
+	if err := store.Set("test/config", `{"password":"secret"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSecretsLocked(store); err != nil {
+		t.Fatal(err)
+	}
+
+	keyfile := filepath.Join(t.TempDir(), "strimertul.key")
+	secrets, err := OpenSecrets(store, SecretsOptions{Keyfile: keyfile}, testSecretFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(keyfile); err != nil || info.Size() != keyfileSize {
+		t.Fatalf("keyfile was not created: %v", err)
+	}
+
+	migrated, err := secrets.MigrateSecrets(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Fatalf("expected 1 migrated key, got %d", migrated)
+	}
+	stored, _ := store.Get("test/config")
+	if strings.Contains(stored, `"secret"`) {
+		t.Fatalf("secret was not encrypted: %s", stored)
+	}
+
+	// Already encrypted secrets are left alone
+	migrated, err = secrets.MigrateSecrets(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 0 {
+		t.Fatalf("expected no migrated keys, got %d", migrated)
+	}
+}
+
+func TestSecretsImport(t *testing.T) {
+	options := SecretsOptions{Passphrase: "hunter2"}
+
+	// Export from a database...
+	source := kv.MakeBackend()
+	sourceSecrets, err := OpenSecrets(source, options, testSecretFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sourceSecrets.Wrap(source).Set("test/config", `{"password":"secret"}`); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := source.GetPrefix("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ...and import it in another one, with a different salt
+	target := kv.MakeBackend()
+	targetSecrets, err := OpenSecrets(target, options, testSecretFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := targetSecrets.PrepareImport(entries); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries[SecretsMetaKey]; ok {
+		t.Fatal("secrets info must not be imported")
+	}
+	decrypted, err := targetSecrets.Decrypt("test/config", entries["test/config"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != `{"password":"secret"}` {
+		t.Fatalf("unexpected imported value: %s", decrypted)
+	}
+
+	// Importing encrypted secrets without the secrets layer is not allowed
+	entries, _ = source.GetPrefix("")
+	if err := testSecretFields.CheckImport(entries); !errors.Is(err, ErrSecretsLocked) {
+		t.Fatalf("expected locked error, got %v", err)
+	}
+}
+
+func TestSecretsRedaction(t *testing.T) {
+	redacted := testSecretFields.Redact("test/config", `{"password":"secret","name":"test"}`)
+	if redacted != `{"name":"test"}` {
+		t.Fatalf("unexpected redacted value: %s", redacted)
+	}
+	other := testSecretFields.Redact("test/other", `{"password":"secret"}`)
+	if other != `{"password":"secret"}` {
+		t.Fatalf("key without secrets was changed: %s", other)
+	}
+}
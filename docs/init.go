@@ -26,6 +26,7 @@ func addKeys(keyMap interfaces.KeyMap) {
 func init() {
 	// Put all enums here
 	utils.MergeMap(Enums, twitch.Enums)
+	utils.MergeMap(Enums, loyalty.Enums)
 	utils.MergeMap(Enums, enums)
 
 	// Put all keys here
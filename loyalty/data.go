@@ -12,7 +12,15 @@ type Config struct {
 		Amount        int64 `json:"amount" desc:"How many points to award every interval"`
 		ActivityBonus int64 `json:"activity_bonus" desc:"Extra points for active chatters"`
 	} `json:"points" desc:"Settings for distributing currency to online viewers"`
-	BanList []string `json:"banlist" desc:"Usernames to exclude from currency distribution"`
+	BanList []string `json:"banlist" desc:"Twitch user IDs (or logins) of viewers to exclude from currency distribution"`
+	Economy struct {
+		MaxBalance     int64   `json:"max_balance" desc:"Maximum balance a viewer can reach by earning points (0 for no limit)"`
+		DecayPercent   float64 `json:"decay_percent" desc:"Percentage of the balance removed every day from inactive viewers (0 to disable decay)"`
+		DecayAfterDays int64   `json:"decay_after_days" desc:"Days without activity after which a viewer's balance starts decaying"`
+	} `json:"economy" desc:"Settings for keeping the currency in check"`
+
+	// Chat message template for when a goal is reached, gets a GoalCompletedEventData as data
+	GoalCompletedMessage string `json:"goal_completed_message,omitempty" desc:"Chat message template to write when a community goal is reached (leave empty for default)"`
 }
 
 const RewardsKey = "loyalty/rewards"
@@ -28,6 +36,23 @@ type Reward struct {
 	Price         int64  `json:"price" desc:"How much does is cost"`
 	CustomRequest string `json:"required_info,omitempty" desc:"If present, reward requires user input and this field is the help text"`
 	Cooldown      int64  `json:"cooldown" desc:"Time in seconds to wait before this reward can be redeemed again"`
+
+	Stock            *int64 `json:"stock,omitempty" desc:"If set, how many more times the reward can be redeemed"`
+	MaxPerStream     int64  `json:"max_per_stream,omitempty" desc:"How many times a single viewer can redeem this reward in a stream (0 for unlimited)"`
+	UserCooldown     int64  `json:"user_cooldown,omitempty" desc:"Time in seconds a viewer must wait before redeeming this reward again"`
+	RequiresApproval bool   `json:"requires_approval,omitempty" desc:"If true, redeems stay pending until accepted by a moderator, points are refunded if rejected"`
+
+	Pricing *RewardPricing `json:"pricing,omitempty" desc:"If set, rules for changing the price dynamically"`
+}
+
+// Prices change all the time, so they are kept out of the reward list to not overwrite changes made to it
+const RewardPricesKey = "loyalty/reward-prices"
+
+type RewardPricing struct {
+	IncreasePerRedeem  int64 `json:"increase_per_redeem" desc:"How much the price goes up for every redeem in the current stream"`
+	DecayInterval      int64 `json:"decay_interval" desc:"Time in seconds after which one price increase is taken back (0 to never decay)"`
+	MaxPrice           int64 `json:"max_price,omitempty" desc:"Maximum price the reward can reach (0 for no limit)"`
+	SubscriberDiscount int64 `json:"subscriber_discount,omitempty" desc:"Discount for subscribers, as a percentage of the price"`
 }
 
 type Goal struct {
@@ -38,27 +63,116 @@ type Goal struct {
 	Image        string           `json:"image" desc:"Goal icon URL"`
 	TotalGoal    int64            `json:"total" desc:"How many points does the goal need to be met in total"`
 	Contributed  int64            `json:"contributed" desc:"How many points have been contributed so far"`
-	Contributors map[string]int64 `json:"contributors" desc:"Dictionary of how much every viewer has contributed"`
+	Contributors map[string]int64 `json:"contributors" desc:"Dictionary of how much every viewer has contributed, by Twitch user ID"`
+	Status       GoalStatus       `json:"status,omitempty" desc:"Current state of the goal"`
+	Deadline     *time.Time       `json:"deadline,omitempty" desc:"If set, the goal must be reached by this time or all contributions are refunded"`
+	Recurrence   int64            `json:"recurrence,omitempty" desc:"If set, time in seconds after which the goal restarts (counted from the deadline if set, otherwise from completion)"`
+	CompletedAt  *time.Time       `json:"completed_at,omitempty" desc:"When the goal was reached"`
+}
+
+type GoalStatus string
+
+const (
+	GoalStatusActive    GoalStatus = "active"
+	GoalStatusCompleted GoalStatus = "completed"
+	GoalStatusExpired   GoalStatus = "expired"
+)
+
+type GoalContribution struct {
+	UserID string `json:"user_id" desc:"Twitch user ID of the contributor"`
+	User   string `json:"user" desc:"Username of the contributor"`
+	Points int64  `json:"points" desc:"Points contributed"`
+}
+
+type GoalCompletedEventData struct {
+	Goal            Goal               `json:"goal" desc:"Goal that was reached"`
+	TopContributors []GoalContribution `json:"top_contributors" desc:"Viewers who contributed the most, in descending order"`
 }
 
 const PointsPrefix = "loyalty/points/"
 
 type PointsEntry struct {
-	Points int64 `json:"points" desc:"Currency balance"`
+	Points    int64     `json:"points" desc:"Currency balance"`
+	LastSeen  time.Time `json:"last_seen,omitempty" desc:"Last time the user was active (in chat or watching)"`
+	LastDecay time.Time `json:"last_decay,omitempty" desc:"Last time the balance was reduced by decay"`
+}
+
+// Points and watch time used to be keyed by login, which changes when a viewer renames
+const UserIDMigrationKey = "loyalty/user-id-migration"
+
+type UserIDMigration struct {
+	Date     time.Time `json:"date" desc:"When the data was migrated"`
+	Migrated int       `json:"migrated" desc:"How many viewers were moved to their user ID"`
+	NotFound []string  `json:"not_found" desc:"Logins that don't belong to any Twitch user anymore and were left as they were"`
+}
+
+const WatchTimePrefix = "loyalty/watch-time/"
+
+type WatchTimeEntry struct {
+	Total    int64     `json:"total" desc:"Total time spent watching streams, in seconds"`
+	Stream   int64     `json:"stream" desc:"Time spent watching the current (or last watched) stream, in seconds"`
+	StreamID string    `json:"stream_id" desc:"ID of the stream the stream watch time refers to"`
+	LastSeen time.Time `json:"last_seen" desc:"Last time the user was found in chat"`
 }
 
 const QueueKey = "loyalty/redeem-queue"
 
 type Redeem struct {
-	Username    string    `json:"username" desc:"Username of who redeemed the reward"`
-	DisplayName string    `json:"display_name" desc:"Display name of who redeemed the reward"`
-	Reward      Reward    `json:"reward" desc:"Reward that was redeemed"`
-	When        time.Time `json:"when" desc:"Time of the redeem"`
-	RequestText string    `json:"request_text" desc:"If the reward required user input it will be here"`
+	UserID      string       `json:"user_id" desc:"Twitch user ID of who redeemed the reward"`
+	Username    string       `json:"username" desc:"Username of who redeemed the reward"`
+	DisplayName string       `json:"display_name" desc:"Display name of who redeemed the reward"`
+	Reward      Reward       `json:"reward" desc:"Reward that was redeemed"`
+	When        time.Time    `json:"when" desc:"Time of the redeem"`
+	RequestText string       `json:"request_text" desc:"If the reward required user input it will be here"`
+	Price       int64        `json:"price,omitempty" desc:"Points spent on the redeem (held until accepted, if the reward requires approval)"`
+	Subscriber  bool         `json:"subscriber,omitempty" desc:"Whether the viewer was subscribed when redeeming"`
+	Status      RedeemStatus `json:"status,omitempty" desc:"Approval state of the redeem (empty if the reward doesn't require approval)"`
+}
+
+type RedeemStatus string
+
+const (
+	RedeemStatusPending  RedeemStatus = "pending"
+	RedeemStatusAccepted RedeemStatus = "accepted"
+)
+
+// Per-viewer redeem limits are saved so they survive restarts
+const RedeemLimitsKey = "loyalty/redeem-limits"
+
+type RedeemLimits struct {
+	StreamID      string               `json:"stream_id" desc:"ID of the stream the redeem counts refer to"`
+	StreamRedeems map[string]int64     `json:"stream_redeems" desc:"How many times viewers redeemed rewards in the stream, by <reward-id>/<user-id>"`
+	UserCooldowns map[string]time.Time `json:"user_cooldowns" desc:"Until when viewers can't redeem rewards again, by <reward-id>/<user-id>"`
 }
 
 const (
 	CreateRedeemRPC = "loyalty/@create-redeem"
 	RemoveRedeemRPC = "loyalty/@remove-redeem"
 	RedeemEvent     = "loyalty/ev/new-redeem"
+
+	AcceptRedeemRPC     = "loyalty/@accept-redeem"
+	RejectRedeemRPC     = "loyalty/@reject-redeem"
+	RedeemAcceptedEvent = "loyalty/ev/redeem-accepted"
+	RedeemRejectedEvent = "loyalty/ev/redeem-rejected"
+)
+
+const GoalCompletedEvent = "loyalty/ev/goal-completed"
+
+const (
+	DecayReportRPC = "loyalty/@decay-report"
+	DecayReportKey = "loyalty/decay-report"
 )
+
+type DecayReport struct {
+	Date    time.Time          `json:"date" desc:"When the report was generated"`
+	Total   int64              `json:"total" desc:"Total amount of points that would be removed"`
+	Entries []DecayReportEntry `json:"entries" desc:"Balances that would be affected by decay"`
+}
+
+type DecayReportEntry struct {
+	UserID   string    `json:"user_id" desc:"Twitch user ID"`
+	User     string    `json:"user" desc:"Username"`
+	Balance  int64     `json:"balance" desc:"Current balance"`
+	Decay    int64     `json:"decay" desc:"Points that would be removed"`
+	LastSeen time.Time `json:"last_seen" desc:"Last time the user was active"`
+}
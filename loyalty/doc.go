@@ -17,23 +17,73 @@ var Keys = interfaces.KeyMap{
 		Description: "List of available rewards",
 		Type:        reflect.TypeOf([]Reward{}),
 	},
+	RewardPricesKey: interfaces.KeyDef{
+		Description: "Current price of rewards with dynamic pricing (before subscriber discounts), by reward ID",
+		Type:        reflect.TypeOf(map[string]int64{}),
+	},
 	GoalsKey: interfaces.KeyDef{
 		Description: "List of all goals",
 		Type:        reflect.TypeOf([]Goal{}),
 	},
-	PointsPrefix + "<user>": interfaces.KeyDef{
-		Description: "Point entry for a given user",
+	PointsPrefix + "<user-id>": interfaces.KeyDef{
+		Description: "Point entry for a given user, by Twitch user ID",
 		Type:        reflect.TypeOf(PointsEntry{}),
 	},
+	WatchTimePrefix + "<user-id>": interfaces.KeyDef{
+		Description: "Watch time for a given user, by Twitch user ID",
+		Type:        reflect.TypeOf(WatchTimeEntry{}),
+	},
+	UserIDMigrationKey: interfaces.KeyDef{
+		Description: "Result of moving points and watch time saved by login to Twitch user IDs (only done once)",
+		Type:        reflect.TypeOf(UserIDMigration{}),
+	},
 	QueueKey: interfaces.KeyDef{
 		Description: "All pending redeems",
 		Type:        reflect.TypeOf([]Redeem{}),
 	},
+	RedeemLimitsKey: interfaces.KeyDef{
+		Description: "Per-stream redeem counts and per-viewer cooldowns of rewards",
+		Type:        reflect.TypeOf(RedeemLimits{}),
+	},
 	RedeemEvent: interfaces.KeyDef{
 		Description: "On reward redeemed",
 		Type:        reflect.TypeOf(Redeem{}),
 		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
 	},
+	AcceptRedeemRPC: interfaces.KeyDef{
+		Description: "Accept a redeem that is pending approval",
+		Type:        reflect.TypeOf(Redeem{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	RejectRedeemRPC: interfaces.KeyDef{
+		Description: "Reject a redeem that is pending approval, refunding the points",
+		Type:        reflect.TypeOf(Redeem{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	RedeemAcceptedEvent: interfaces.KeyDef{
+		Description: "On pending redeem accepted",
+		Type:        reflect.TypeOf(Redeem{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	RedeemRejectedEvent: interfaces.KeyDef{
+		Description: "On pending redeem rejected",
+		Type:        reflect.TypeOf(Redeem{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	DecayReportRPC: interfaces.KeyDef{
+		Description: "Generate a report of what point decay would do right now, without changing anything (written to " + DecayReportKey + ")",
+		Type:        reflect.TypeOf(""),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	DecayReportKey: interfaces.KeyDef{
+		Description: "Last generated point decay report",
+		Type:        reflect.TypeOf(DecayReport{}),
+	},
+	GoalCompletedEvent: interfaces.KeyDef{
+		Description: "On community goal reached",
+		Type:        reflect.TypeOf(GoalCompletedEventData{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
 	CreateRedeemRPC: interfaces.KeyDef{
 		Description: "Create a new pending redeem",
 		Type:        reflect.TypeOf(Redeem{}),
@@ -45,3 +95,19 @@ var Keys = interfaces.KeyMap{
 		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
 	},
 }
+
+var Enums = interfaces.EnumMap{
+	"RedeemStatus": interfaces.Enum{
+		Values: []any{
+			RedeemStatusPending,
+			RedeemStatusAccepted,
+		},
+	},
+	"GoalStatus": interfaces.Enum{
+		Values: []any{
+			GoalStatusActive,
+			GoalStatusCompleted,
+			GoalStatusExpired,
+		},
+	},
+}
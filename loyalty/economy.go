@@ -0,0 +1,147 @@
+package loyalty
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// How often to check balances for decay
+	decayCheckInterval = time.Hour
+
+	// Decay is applied at most once per day to each balance
+	decayPeriod = 24 * time.Hour
+
+	// How often activity from chat messages is saved for a user
+	seenUpdateInterval = 10 * time.Minute
+)
+
+// markSeen updates the last activity time of users
+func (m *Manager) markSeen(users []string, now time.Time) error {
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
+	entries := make(map[string]any)
+	for _, user := range users {
+		entry, _ := m.points.GetKey(user)
+		entry.LastSeen = now
+		m.points.SetKey(user, entry)
+		entries[PointsPrefix+user] = entry
+	}
+	if len(entries) < 1 {
+		return nil
+	}
+	return m.db.PutJSONBulk(entries)
+}
+
+// pointsDecay returns how many points would be removed from an entry by decay
+func pointsDecay(entry PointsEntry, now time.Time, config Config) int64 {
+	economy := config.Economy
+	if economy.DecayPercent <= 0 || entry.Points <= 0 {
+		return 0
+	}
+
+	// Balances are decayed at most once per period
+	if now.Sub(entry.LastDecay) < decayPeriod {
+		return 0
+	}
+
+	// We can't tell how long ago users without activity data were active (until it's seeded)
+	if entry.LastSeen.IsZero() {
+		return 0
+	}
+	if now.Sub(entry.LastSeen) < time.Duration(economy.DecayAfterDays)*24*time.Hour {
+		return 0
+	}
+
+	return int64(math.Ceil(float64(entry.Points) * min(economy.DecayPercent, 100) / 100))
+}
+
+// DecayReport returns what decay would remove from every balance on its next run, without applying it
+func (m *Manager) DecayReport(now time.Time) DecayReport {
+	config := m.Config.Get()
+	report := DecayReport{
+		Date:    now,
+		Entries: []DecayReportEntry{},
+	}
+	for user, entry := range m.points.Copy() {
+		decay := pointsDecay(entry, now, config)
+		if decay <= 0 {
+			continue
+		}
+		report.Total += decay
+		report.Entries = append(report.Entries, DecayReportEntry{
+			UserID:   user,
+			User:     m.loginForUserID(user),
+			Balance:  entry.Points,
+			Decay:    decay,
+			LastSeen: entry.LastSeen,
+		})
+	}
+	sort.Slice(report.Entries, func(i, j int) bool {
+		return report.Entries[i].Decay > report.Entries[j].Decay
+	})
+	return report
+}
+
+// applyDecay removes points from inactive users that haven't been decayed in the last day
+func (m *Manager) applyDecay(now time.Time) error {
+	config := m.Config.Get()
+	if !config.Enabled || config.Economy.DecayPercent <= 0 {
+		return nil
+	}
+
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
+	entries := make(map[string]any)
+	var total int64
+	decayed := 0
+	for user, entry := range m.points.Copy() {
+		// Balances saved before activity was tracked start counting from the first decay check
+		if entry.LastSeen.IsZero() {
+			entry.LastSeen = now
+			m.points.SetKey(user, entry)
+			entries[PointsPrefix+user] = entry
+			continue
+		}
+
+		decay := pointsDecay(entry, now, config)
+		if decay <= 0 {
+			continue
+		}
+		entry.Points -= decay
+		entry.LastDecay = now
+		m.points.SetKey(user, entry)
+		entries[PointsPrefix+user] = entry
+		total += decay
+		decayed++
+	}
+	if len(entries) < 1 {
+		return nil
+	}
+
+	if decayed > 0 {
+		m.logger.Info("Applied point decay to inactive users", zap.Int("users", decayed), zap.Int64("points", total))
+	}
+	return m.db.PutJSONBulk(entries)
+}
+
+func (m *Manager) runDecay() {
+	defer m.loops.Done()
+
+	for {
+		if err := m.applyDecay(time.Now()); err != nil {
+			m.logger.Error("Could not apply point decay", zap.Error(err))
+		}
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(decayCheckInterval):
+		}
+	}
+}
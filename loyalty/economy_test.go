@@ -0,0 +1,65 @@
+package loyalty
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPointsDecay(t *testing.T) {
+	manager, _ := newTestManager(t)
+
+	config := manager.Config.Get()
+	config.Enabled = true
+	config.Economy.DecayPercent = 10
+	config.Economy.DecayAfterDays = 7
+	manager.Config.Set(config)
+
+	now := time.Now()
+	manager.points.SetKey("inactive", PointsEntry{Points: 100, LastSeen: now.Add(-8 * 24 * time.Hour)})
+	manager.points.SetKey("active", PointsEntry{Points: 100, LastSeen: now.Add(-24 * time.Hour)})
+	manager.points.SetKey("unknown", PointsEntry{Points: 100})
+
+	report := manager.DecayReport(now)
+	if report.Total != 10 || len(report.Entries) != 1 || report.Entries[0].UserID != "inactive" {
+		t.Fatalf("unexpected decay report: %+v", report)
+	}
+
+	if err := manager.applyDecay(now); err != nil {
+		t.Fatal(err)
+	}
+	if points := manager.GetPoints("inactive"); points != 90 {
+		t.Fatalf("expected inactive balance to decay to 90, got %d", points)
+	}
+	if points := manager.GetPoints("active"); points != 100 {
+		t.Fatalf("active balance was decayed to %d", points)
+	}
+
+	// Balances without activity data start counting from the first check
+	unknown, _ := manager.points.GetKey("unknown")
+	if unknown.Points != 100 || !unknown.LastSeen.Equal(now) {
+		t.Fatalf("activity was not seeded: %+v", unknown)
+	}
+
+	// Decay only happens once a day, and the report must agree
+	later := now.Add(time.Hour)
+	if report := manager.DecayReport(later); report.Total != 0 || len(report.Entries) != 0 {
+		t.Fatalf("report includes balances decayed less than a day ago: %+v", report)
+	}
+	if err := manager.applyDecay(later); err != nil {
+		t.Fatal(err)
+	}
+	if points := manager.GetPoints("inactive"); points != 90 {
+		t.Fatalf("balance was decayed twice in a day, got %d", points)
+	}
+
+	nextDay := now.Add(25 * time.Hour)
+	if report := manager.DecayReport(nextDay); report.Total != 9 || len(report.Entries) != 1 {
+		t.Fatalf("unexpected decay report for the next day: %+v", report)
+	}
+
+	// Seeded balances decay once they've been inactive long enough
+	nextWeek := now.Add(8 * 24 * time.Hour)
+	if report := manager.DecayReport(nextWeek); report.Total != 29 || len(report.Entries) != 3 {
+		t.Fatalf("unexpected decay report for the next week: %+v", report)
+	}
+}
@@ -0,0 +1,168 @@
+package loyalty
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// How many contributors to include in goal completion events
+	goalTopContributors = 5
+
+	// How often to check goals for deadlines and resets
+	goalCheckInterval = time.Minute
+
+	defaultGoalCompletedMessage = `FallWinning The community goal "{{.Goal.Name}}" was reached! FallWinning`
+)
+
+func (m *Manager) runGoalScheduler() {
+	defer m.loops.Done()
+
+	for {
+		m.checkGoals(time.Now())
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(goalCheckInterval):
+		}
+	}
+}
+
+// checkGoals expires goals that are past their deadline and restarts recurring goals
+func (m *Manager) checkGoals(now time.Time) {
+	m.goalMux.Lock()
+	defer m.goalMux.Unlock()
+
+	goals := m.Goals.Copy()
+	changed := false
+	for i, goal := range goals {
+		if !goal.Enabled {
+			continue
+		}
+
+		// Goals with a deadline that wasn't met get refunded
+		if goal.Deadline != nil && now.After(*goal.Deadline) && goal.Status != GoalStatusCompleted && goal.Status != GoalStatusExpired {
+			if err := m.refundGoal(goal); err != nil {
+				m.logger.Error("Could not refund goal contributors", zap.String("goal", goal.ID), zap.Error(err))
+				continue
+			}
+			m.logger.Info("Goal has expired, contributions were refunded", zap.String("goal", goal.ID))
+			goal.Status = GoalStatusExpired
+			goal.Contributed = 0
+			goal.Contributors = make(map[string]int64)
+			changed = true
+		}
+
+		// Restart recurring goals once their time is up
+		if goal.Recurrence > 0 && (goal.Status == GoalStatusCompleted || goal.Status == GoalStatusExpired) {
+			if restartAt, ok := goalRestartTime(goal); ok && now.After(restartAt) {
+				goal = resetGoal(goal, now)
+				m.logger.Info("Recurring goal has been reset", zap.String("goal", goal.ID))
+				changed = true
+			}
+		}
+
+		goals[i] = goal
+	}
+
+	if !changed {
+		return
+	}
+	m.Goals.Set(goals)
+	if err := m.SaveGoals(); err != nil {
+		m.logger.Error("Could not save goals", zap.Error(err))
+	}
+}
+
+// refundGoal gives back to every contributor what they put into a goal
+func (m *Manager) refundGoal(goal Goal) error {
+	if len(goal.Contributors) < 1 {
+		return nil
+	}
+	return m.RefundPoints(goal.Contributors)
+}
+
+// goalRestartTime returns when a recurring goal should restart: at the deadline if it has one,
+// otherwise after the recurrence time has passed since completion
+func goalRestartTime(goal Goal) (time.Time, bool) {
+	if goal.Deadline != nil {
+		return *goal.Deadline, true
+	}
+	if goal.CompletedAt != nil {
+		return goal.CompletedAt.Add(time.Duration(goal.Recurrence) * time.Second), true
+	}
+	return time.Time{}, false
+}
+
+// resetGoal clears all contributions of a goal and moves its deadline forward (if any)
+func resetGoal(goal Goal, now time.Time) Goal {
+	goal.Status = GoalStatusActive
+	goal.Contributed = 0
+	goal.Contributors = make(map[string]int64)
+	goal.CompletedAt = nil
+	if goal.Deadline != nil {
+		deadline := *goal.Deadline
+		for !deadline.After(now) {
+			deadline = deadline.Add(time.Duration(goal.Recurrence) * time.Second)
+		}
+		goal.Deadline = &deadline
+	}
+	return goal
+}
+
+func (m *Manager) onGoalCompleted(goal Goal) {
+	data := GoalCompletedEventData{
+		Goal:            goal,
+		TopContributors: m.topContributors(goal, goalTopContributors),
+	}
+
+	if err := m.db.PutJSON(GoalCompletedEvent, data); err != nil {
+		m.logger.Error("Could not send goal completed event", zap.String("goal", goal.ID), zap.Error(err))
+	}
+
+	// Announce in chat, if possible
+	bot := m.twitchManager.Client().Bot
+	if bot == nil {
+		return
+	}
+	message := m.Config.Get().GoalCompletedMessage
+	if message == "" {
+		message = defaultGoalCompletedMessage
+	}
+	tpl, err := bot.MakeTemplate(message)
+	if err != nil {
+		m.logger.Error("Could not compile goal completed message template", zap.Error(err))
+		return
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		m.logger.Error("Could not execute goal completed message template", zap.Error(err))
+		return
+	}
+	bot.WriteMessage(buf.String())
+}
+
+// topContributors returns the viewers who contributed the most to a goal, in descending order
+func (m *Manager) topContributors(goal Goal, count int) []GoalContribution {
+	contributions := make([]GoalContribution, 0, len(goal.Contributors))
+	for user, points := range goal.Contributors {
+		contributions = append(contributions, GoalContribution{UserID: user, Points: points})
+	}
+	sort.Slice(contributions, func(i, j int) bool {
+		if contributions[i].Points == contributions[j].Points {
+			return contributions[i].UserID < contributions[j].UserID
+		}
+		return contributions[i].Points > contributions[j].Points
+	})
+	if len(contributions) > count {
+		contributions = contributions[:count]
+	}
+	for i := range contributions {
+		contributions[i].User = m.loginForUserID(contributions[i].UserID)
+	}
+	return contributions
+}
@@ -0,0 +1,114 @@
+package loyalty
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGoalContributionDeadline(t *testing.T) {
+	manager, _ := newTestManager(t)
+
+	deadline := time.Now().Add(-time.Minute)
+	manager.Goals.Set([]Goal{
+		{Enabled: true, ID: "goal", TotalGoal: 1000, Status: GoalStatusActive, Deadline: &deadline},
+	})
+	if err := manager.GivePoints(map[string]int64{"1": 500}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The scheduler might not have expired the goal yet, it must be rejected anyway
+	_, err := manager.PerformContribution(manager.GetGoal("goal"), "1", 100)
+	if !errors.Is(err, ErrGoalExpired) {
+		t.Fatalf("expected ErrGoalExpired, got %v", err)
+	}
+	if points := manager.GetPoints("1"); points != 500 {
+		t.Fatalf("points were taken for a rejected contribution, balance is %d", points)
+	}
+}
+
+func TestGoalExpiryRefund(t *testing.T) {
+	manager, _ := newTestManager(t)
+
+	deadline := time.Now().Add(time.Hour)
+	manager.Goals.Set([]Goal{
+		{Enabled: true, ID: "goal", TotalGoal: 1000, Status: GoalStatusActive, Deadline: &deadline},
+	})
+	if err := manager.GivePoints(map[string]int64{"1": 500, "2": 500}); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"1", "2"} {
+		if _, err := manager.PerformContribution(manager.GetGoal("goal"), user, 200); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "contributions", func() bool {
+		return manager.GetGoal("goal").Contributed == 400 && manager.GetPoints("1") == 300 && manager.GetPoints("2") == 300
+	})
+
+	manager.checkGoals(deadline.Add(time.Second))
+	waitFor(t, "goal to expire", func() bool {
+		goal := manager.GetGoal("goal")
+		return goal.Status == GoalStatusExpired && goal.Contributed == 0 && len(goal.Contributors) == 0
+	})
+	waitFor(t, "refunds", func() bool {
+		return manager.GetPoints("1") == 500 && manager.GetPoints("2") == 500
+	})
+
+	// Expired goals are only refunded once
+	manager.checkGoals(deadline.Add(time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if points := manager.GetPoints("1"); points != 500 {
+		t.Fatalf("user was refunded twice, balance is %d", points)
+	}
+}
+
+func TestGoalRecurrence(t *testing.T) {
+	manager, _ := newTestManager(t)
+
+	manager.Goals.Set([]Goal{
+		{Enabled: true, ID: "goal", TotalGoal: 100, Status: GoalStatusActive, Recurrence: 3600},
+	})
+	if err := manager.GivePoints(map[string]int64{"1": 500}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.PerformContribution(manager.GetGoal("goal"), "1", 100); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "goal to be completed", func() bool {
+		goal := manager.GetGoal("goal")
+		return goal.Status == GoalStatusCompleted && goal.CompletedAt != nil
+	})
+	completedAt := *manager.GetGoal("goal").CompletedAt
+
+	// Nothing happens until the recurrence time has passed
+	manager.checkGoals(completedAt.Add(time.Minute))
+	if status := manager.GetGoal("goal").Status; status != GoalStatusCompleted {
+		t.Fatalf("goal was reset too early, status is %s", status)
+	}
+
+	manager.checkGoals(completedAt.Add(time.Hour + time.Second))
+	waitFor(t, "goal to be reset", func() bool {
+		goal := manager.GetGoal("goal")
+		return goal.Status == GoalStatusActive && goal.Contributed == 0 && goal.CompletedAt == nil
+	})
+	if points := manager.GetPoints("1"); points != 400 {
+		t.Fatalf("completed goals must not be refunded, balance is %d", points)
+	}
+}
+
+func TestGoalRecurrenceWithDeadline(t *testing.T) {
+	manager, _ := newTestManager(t)
+
+	now := time.Now()
+	deadline := now.Add(-30 * time.Minute)
+	manager.Goals.Set([]Goal{
+		{Enabled: true, ID: "goal", TotalGoal: 100, Status: GoalStatusExpired, Deadline: &deadline, Recurrence: 3600},
+	})
+
+	manager.checkGoals(now)
+	goal := manager.GetGoal("goal")
+	if goal.Status != GoalStatusActive || goal.Deadline == nil || !goal.Deadline.Equal(deadline.Add(time.Hour)) {
+		t.Fatalf("goal was not restarted with a new deadline: %+v", goal)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"strings"
+	stdsync "sync"
 	"time"
 
 	"git.sr.ht/~ashkeel/strimertul/database"
@@ -21,12 +23,18 @@ var json = jsoniter.ConfigFastest
 var (
 	ErrRedeemNotFound     = errors.New("redeem not found")
 	ErrRedeemInCooldown   = errors.New("redeem is on cooldown")
+	ErrRedeemOutOfStock   = errors.New("reward is out of stock")
+	ErrRedeemLimitReached = errors.New("redeem limit per stream reached")
+	ErrRedeemNotPending   = errors.New("redeem is not pending approval")
+	ErrNotEnoughPoints    = errors.New("not enough points")
 	ErrGoalNotFound       = errors.New("goal not found")
 	ErrGoalAlreadyReached = errors.New("goal already reached")
+	ErrGoalExpired        = errors.New("goal has expired")
 )
 
 type Manager struct {
 	points               *sync.Map[string, PointsEntry]
+	watchTime            *sync.Map[string, WatchTimeEntry]
 	Config               *sync.RWSync[Config]
 	Rewards              *sync.Slice[Reward]
 	Goals                *sync.Slice[Goal]
@@ -34,11 +42,21 @@ type Manager struct {
 	db                   *database.LocalDBClient
 	logger               *zap.Logger
 	cooldowns            map[string]time.Time
+	userCooldowns        *sync.Map[string, time.Time]
+	streamRedeems        *sync.Map[string, int64]
+	streamRedeemsID      *sync.RWSync[string]
+	priceStates          *sync.Map[string, rewardPriceState]
+	rewardPrices         *sync.RWSync[map[string]int64]
+	redeemMux            stdsync.Mutex
+	goalMux              stdsync.Mutex
+	pointsMux            stdsync.Mutex // Held while changing points or watch time
 	banlist              map[string]bool
 	activeUsers          *sync.Map[string, bool]
+	userIDs              *sync.Map[string, string] // User IDs by login, for viewers seen in chat or looked up
 	twitchManager        *twitch.Manager
 	ctx                  context.Context
 	cancelFn             context.CancelFunc
+	loops                stdsync.WaitGroup
 	cancelSub            database.CancelFunc
 	restartTwitchHandler chan struct{}
 }
@@ -54,9 +72,16 @@ func NewManager(db *database.LocalDBClient, twitchManager *twitch.Manager, logge
 		logger:               logger,
 		db:                   db,
 		points:               sync.NewMap[string, PointsEntry](),
+		watchTime:            sync.NewMap[string, WatchTimeEntry](),
 		cooldowns:            make(map[string]time.Time),
+		userCooldowns:        sync.NewMap[string, time.Time](),
+		streamRedeems:        sync.NewMap[string, int64](),
+		streamRedeemsID:      sync.NewRWSync(""),
+		priceStates:          sync.NewMap[string, rewardPriceState](),
+		rewardPrices:         sync.NewRWSync(map[string]int64{}),
 		banlist:              make(map[string]bool),
 		activeUsers:          sync.NewMap[string, bool](),
+		userIDs:              sync.NewMap[string, string](),
 		twitchManager:        twitchManager,
 		ctx:                  ctx,
 		cancelFn:             cancelFn,
@@ -91,6 +116,15 @@ func NewManager(db *database.LocalDBClient, twitchManager *twitch.Manager, logge
 		}
 	}
 
+	var prices map[string]int64
+	if err := db.GetJSON(RewardPricesKey, &prices); err == nil {
+		loyalty.rewardPrices.Set(prices)
+	} else {
+		if !errors.Is(err, database.ErrEmptyKey) {
+			return nil, err
+		}
+	}
+
 	var queue []Redeem
 	if err := db.GetJSON(QueueKey, &queue); err == nil {
 		loyalty.Queue.Set(queue)
@@ -100,6 +134,21 @@ func NewManager(db *database.LocalDBClient, twitchManager *twitch.Manager, logge
 		}
 	}
 
+	var limits RedeemLimits
+	if err := db.GetJSON(RedeemLimitsKey, &limits); err == nil {
+		loyalty.streamRedeemsID.Set(limits.StreamID)
+		if limits.StreamRedeems != nil {
+			loyalty.streamRedeems.Set(limits.StreamRedeems)
+		}
+		if limits.UserCooldowns != nil {
+			loyalty.userCooldowns.Set(limits.UserCooldowns)
+		}
+	} else {
+		if !errors.Is(err, database.ErrEmptyKey) {
+			return nil, err
+		}
+	}
+
 	// Retrieve user points
 	points, err := db.GetAll(PointsPrefix)
 	if err != nil {
@@ -119,6 +168,25 @@ func NewManager(db *database.LocalDBClient, twitchManager *twitch.Manager, logge
 		loyalty.points.SetKey(k[len(PointsPrefix):], entry)
 	}
 
+	// Retrieve user watch time
+	watchTime, err := db.GetAll(WatchTimePrefix)
+	if err != nil {
+		if !errors.Is(err, database.ErrEmptyKey) {
+			return nil, err
+		}
+		watchTime = make(map[string]string)
+	}
+
+	for k, v := range watchTime {
+		var entry WatchTimeEntry
+		err := json.UnmarshalFromString(v, &entry)
+		if err != nil {
+			return nil, err
+		}
+
+		loyalty.watchTime.SetKey(k[len(WatchTimePrefix):], entry)
+	}
+
 	// SubscribePrefix for changes
 	err, loyalty.cancelSub = db.SubscribePrefix(loyalty.update, "loyalty/")
 	if err != nil {
@@ -130,6 +198,22 @@ func NewManager(db *database.LocalDBClient, twitchManager *twitch.Manager, logge
 	// Setup twitch integration
 	loyalty.SetupTwitch()
 
+	// Start goal deadline/reset checks
+	loyalty.loops.Add(1)
+	go loyalty.runGoalScheduler()
+
+	// Start keeping dynamic reward prices up to date
+	loyalty.loops.Add(1)
+	go loyalty.runPriceUpdater()
+
+	// Start point decay
+	loyalty.loops.Add(1)
+	go loyalty.runDecay()
+
+	// Move data saved before viewers were tracked by ID, anything saved from now on already uses IDs
+	loyalty.loops.Add(1)
+	go loyalty.runUserIDMigration(loyalty.savedUsers())
+
 	return loyalty, nil
 }
 
@@ -142,6 +226,9 @@ func (m *Manager) Close() error {
 	// Send cancellation
 	m.cancelFn()
 
+	// Wait for background checks to stop
+	m.loops.Wait()
+
 	// Teardown twitch integration
 	m.StopTwitch()
 
@@ -178,15 +265,29 @@ func (m *Manager) update(key, value string) {
 		if err == nil {
 			err = m.RemoveRedeem(redeem)
 		}
+	case AcceptRedeemRPC:
+		var redeem Redeem
+		err = json.UnmarshalFromString(value, &redeem)
+		if err == nil {
+			err = m.AcceptRedeem(redeem)
+		}
+	case RejectRedeemRPC:
+		var redeem Redeem
+		err = json.UnmarshalFromString(value, &redeem)
+		if err == nil {
+			err = m.RejectRedeem(redeem)
+		}
+	case DecayReportRPC:
+		err = m.db.PutJSON(DecayReportKey, m.DecayReport(time.Now()))
 	default:
 		// Check for prefix changes
 		switch {
 		// User point changed
 		case strings.HasPrefix(key, PointsPrefix):
-			var entry PointsEntry
-			err = json.UnmarshalFromString(value, &entry)
-			user := key[len(PointsPrefix):]
-			m.points.SetKey(user, entry)
+			err = reloadEntry(m, m.points, PointsPrefix, key[len(PointsPrefix):])
+		// User watch time changed
+		case strings.HasPrefix(key, WatchTimePrefix):
+			err = reloadEntry(m, m.watchTime, WatchTimePrefix, key[len(WatchTimePrefix):])
 		}
 	}
 	if err != nil {
@@ -196,6 +297,27 @@ func (m *Manager) update(key, value string) {
 	}
 }
 
+// reloadEntry updates the local copy of a user's points or watch time with what's saved.
+// Changes are notified in no particular order, the value they come with might be outdated
+// (e.g. the balance was changed again in the meantime), so it's read again while holding pointsMux
+func reloadEntry[T any](m *Manager, entries *sync.Map[string, T], prefix string, user string) error {
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
+	var entry T
+	err := m.db.GetJSON(prefix+user, &entry)
+	if errors.Is(err, database.ErrEmptyKey) {
+		// Removed keys (like logins moved to user IDs) come with no value
+		entries.DeleteKey(user)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries.SetKey(user, entry)
+	return nil
+}
+
 func (m *Manager) GetPoints(user string) int64 {
 	points, ok := m.points.GetKey(user)
 	if ok {
@@ -204,17 +326,41 @@ func (m *Manager) GetPoints(user string) int64 {
 	return 0
 }
 
+// setPoints changes the balance of a user, pointsMux must be held
 func (m *Manager) setPoints(user string, points int64) error {
-	entry := PointsEntry{
-		Points: points,
-	}
+	entry, _ := m.points.GetKey(user)
+	entry.Points = points
 	m.points.SetKey(user, entry)
 	return m.db.PutJSON(PointsPrefix+user, entry)
 }
 
 func (m *Manager) GivePoints(pointsToGive map[string]int64) error {
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
+	maxBalance := m.Config.Get().Economy.MaxBalance
+
 	// Add points to each user
 	for user, points := range pointsToGive {
+		balance := m.GetPoints(user)
+		newBalance := balance + points
+		// Earned points can't go over the cap (but balances over it are not reduced)
+		if maxBalance > 0 && newBalance > maxBalance {
+			newBalance = max(maxBalance, balance)
+		}
+		if err := m.setPoints(user, newBalance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RefundPoints gives back points that were spent, regardless of balance caps
+func (m *Manager) RefundPoints(pointsToRefund map[string]int64) error {
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
+	for user, points := range pointsToRefund {
 		balance := m.GetPoints(user)
 		if err := m.setPoints(user, balance+points); err != nil {
 			return err
@@ -224,6 +370,9 @@ func (m *Manager) GivePoints(pointsToGive map[string]int64) error {
 }
 
 func (m *Manager) TakePoints(pointsToTake map[string]int64) error {
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
 	// Add points to each user
 	for user, points := range pointsToTake {
 		balance := m.GetPoints(user)
@@ -234,6 +383,18 @@ func (m *Manager) TakePoints(pointsToTake map[string]int64) error {
 	return nil
 }
 
+// spendPoints takes points from a user only if their balance covers all of them
+func (m *Manager) spendPoints(user string, points int64) error {
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
+	balance := m.GetPoints(user)
+	if balance < points {
+		return ErrNotEnoughPoints
+	}
+	return m.setPoints(user, balance-points)
+}
+
 func (m *Manager) saveQueue() error {
 	return m.db.PutJSON(QueueKey, m.Queue.Get())
 }
@@ -267,34 +428,92 @@ func (m *Manager) AddRedeem(redeem Redeem) error {
 }
 
 func (m *Manager) PerformRedeem(redeem Redeem) error {
+	// Price check and payment must happen in one go
+	m.redeemMux.Lock()
+	defer m.redeemMux.Unlock()
+
+	// Use the latest version of the reward for limits (e.g. stock)
+	if current := m.GetReward(redeem.Reward.ID); current.ID != "" {
+		redeem.Reward = current
+	}
+
 	// Check cooldown
 	if time.Now().Before(m.GetRewardCooldown(redeem.Reward.ID)) {
 		return ErrRedeemInCooldown
 	}
+	if time.Now().Before(m.GetUserRewardCooldown(redeem.Reward.ID, redeem.UserID)) {
+		return ErrRedeemInCooldown
+	}
+
+	// Check limits
+	if redeem.Reward.Stock != nil && *redeem.Reward.Stock <= 0 {
+		return ErrRedeemOutOfStock
+	}
+	if redeem.Reward.MaxPerStream > 0 && m.streamRedeemCount(redeem.Reward.ID, redeem.UserID) >= redeem.Reward.MaxPerStream {
+		return ErrRedeemLimitReached
+	}
+
+	// Pay for the reward at its current price before anything else happens,
+	// the balance could be changing at the same time (e.g. goal contributions)
+	redeem.Price = m.GetRewardPrice(redeem.Reward, redeem.Subscriber)
+	if err := m.spendPoints(redeem.UserID, redeem.Price); err != nil {
+		return err
+	}
+
+	// Points are held until a moderator accepts or rejects the redeem
+	if redeem.Reward.RequiresApproval {
+		redeem.Status = RedeemStatusPending
+	}
 
 	// Add redeem
 	err := m.AddRedeem(redeem)
 	if err != nil {
+		if refundErr := m.RefundPoints(map[string]int64{redeem.UserID: redeem.Price}); refundErr != nil {
+			m.logger.Error("Could not refund failed redeem", zap.String("user-id", redeem.UserID), zap.Error(refundErr))
+		}
 		return err
 	}
 
-	// Remove points from user
-	return m.TakePoints(map[string]int64{redeem.Username: redeem.Reward.Price})
+	if err := m.trackUserRedeem(redeem); err != nil {
+		return err
+	}
+	m.bumpRewardPrice(redeem.Reward)
+	if err := m.updateRewardPrices(); err != nil {
+		return err
+	}
+	if redeem.Reward.Stock != nil {
+		if err := m.updateReward(redeem.Reward.ID, func(reward *Reward) {
+			if reward.Stock != nil {
+				stock := *reward.Stock - 1
+				reward.Stock = &stock
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *Manager) RemoveRedeem(redeem Redeem) error {
-	queue := m.Queue.Get()
-	for index, queued := range queue {
-		if queued.When == redeem.When && queued.Username == redeem.Username && queued.Reward.ID == redeem.Reward.ID {
-			// Remove redemption from list
-			m.Queue.Set(append(queue[:index], queue[index+1:]...))
-
-			// Save points
-			return m.saveQueue()
-		}
+	m.redeemMux.Lock()
+	defer m.redeemMux.Unlock()
+
+	queue := m.Queue.Copy()
+	index := findRedeem(queue, redeem)
+	if index < 0 {
+		return ErrRedeemNotFound
 	}
 
-	return ErrRedeemNotFound
+	// Redeems that were never accepted shouldn't cost anything
+	if queue[index].Status == RedeemStatusPending {
+		return m.rejectRedeem(redeem)
+	}
+
+	// Remove redemption from list
+	m.Queue.Set(append(queue[:index], queue[index+1:]...))
+
+	// Save points
+	return m.saveQueue()
 }
 
 func (m *Manager) SaveGoals() error {
@@ -302,26 +521,55 @@ func (m *Manager) SaveGoals() error {
 }
 
 func (m *Manager) ContributeGoal(goal Goal, user string, points int64) error {
-	goals := m.Goals.Get()
+	m.goalMux.Lock()
+	defer m.goalMux.Unlock()
+
+	return m.contributeGoal(goal, user, points)
+}
+
+func (m *Manager) contributeGoal(goal Goal, user string, points int64) error {
+	// Work on copies, the current goals might be read while we're updating them
+	goals := m.Goals.Copy()
 	for i, savedGoal := range goals {
 		if savedGoal.ID != goal.ID {
 			continue
 		}
+		goals[i].Contributors = maps.Clone(goals[i].Contributors)
+		if goals[i].Contributors == nil {
+			goals[i].Contributors = make(map[string]int64)
+		}
 		goals[i].Contributed += points
 		goals[i].Contributors[user] += points
+
+		// Check if the goal was reached with this contribution
+		completed := goals[i].Status != GoalStatusCompleted && goals[i].Contributed >= goals[i].TotalGoal
+		if completed {
+			now := time.Now()
+			goals[i].Status = GoalStatusCompleted
+			goals[i].CompletedAt = &now
+		}
+
 		m.Goals.Set(goals)
-		return m.SaveGoals()
+		if err := m.SaveGoals(); err != nil {
+			return err
+		}
+
+		if completed {
+			m.onGoalCompleted(goals[i])
+		}
+		return nil
 	}
 	return ErrGoalNotFound
 }
 
 func (m *Manager) PerformContribution(goal Goal, user string, points int64) (int64, error) {
-	// Get user balance
-	balance := m.GetPoints(user)
+	// Checks and payment must happen in one go
+	m.goalMux.Lock()
+	defer m.goalMux.Unlock()
 
-	// If user specified more points than they have, pick the maximum possible
-	if points > balance {
-		points = balance
+	// Use the latest version of the goal, it might have changed since it was picked
+	if current := m.GetGoal(goal.ID); current.ID != "" {
+		goal = current
 	}
 
 	// Check if goal was reached already
@@ -329,19 +577,32 @@ func (m *Manager) PerformContribution(goal Goal, user string, points int64) (int
 		return 0, ErrGoalAlreadyReached
 	}
 
+	// Check if goal can still be contributed to
+	if goal.Status == GoalStatusExpired || (goal.Deadline != nil && time.Now().After(*goal.Deadline)) {
+		return 0, ErrGoalExpired
+	}
+
 	// If remaining points are lower than what user is contributing, only take what's needed
 	remaining := goal.TotalGoal - goal.Contributed
 	if points > remaining {
 		points = remaining
 	}
 
-	// Remove points from user
-	if err := m.TakePoints(map[string]int64{user: points}); err != nil {
+	// Remove points from user, if they specified more points than they have, pick the maximum possible.
+	// The balance must be checked while holding the lock, a redeem could be spending it at the same time
+	m.pointsMux.Lock()
+	balance := m.GetPoints(user)
+	if points > balance {
+		points = max(balance, 0)
+	}
+	err := m.setPoints(user, balance-points)
+	m.pointsMux.Unlock()
+	if err != nil {
 		return 0, err
 	}
 
 	// Add points to goal
-	return points, m.ContributeGoal(goal, user, points)
+	return points, m.contributeGoal(goal, user, points)
 }
 
 func (m *Manager) GetReward(id string) Reward {
@@ -0,0 +1,128 @@
+package loyalty
+
+import (
+	"strings"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+	"git.sr.ht/~ashkeel/strimertul/twitch"
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
+	"git.sr.ht/~ashkeel/strimertul/webserver"
+)
+
+func newTestManager(t *testing.T) (*Manager, *database.LocalDBClient) {
+	db, _ := database.CreateInMemoryLocalClient(t)
+	t.Cleanup(func() { database.CleanupLocalClient(db) })
+
+	return newTestManagerWithDB(t, db), db
+}
+
+// newMockTwitchDB creates a database with Twitch set up to use the mock server,
+// the bot chats through the Twitch API so its messages are in the server requests
+func newMockTwitchDB(t *testing.T, server *mock.Server) *database.LocalDBClient {
+	db, _ := database.CreateInMemoryLocalClient(t)
+	t.Cleanup(func() { database.CleanupLocalClient(db) })
+
+	err := db.PutJSONBulk(map[string]any{
+		twitch.AuthKey: twitch.AuthResponse{
+			AccessToken:  mock.AccessToken,
+			RefreshToken: mock.RefreshToken,
+			ExpiresIn:    14400,
+			Time:         time.Now(),
+		},
+		twitch.ConfigKey: twitch.Config{
+			Enabled:          true,
+			EnableBot:        true,
+			APIClientID:      "mock",
+			APIClientSecret:  "mock",
+			EventSubEndpoint: server.EventSubURL(),
+			APIBaseURL:       server.APIBaseURL(),
+			AuthBaseURL:      server.AuthBaseURL(),
+		},
+		twitch.BotConfigKey: twitch.BotConfig{
+			Channel:       server.User.Login,
+			ChatTransport: twitch.ChatTransportEventSub,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestManagerWithDB creates a manager using an existing database, for checking what is kept on restart
+func newTestManagerWithDB(t *testing.T, db *database.LocalDBClient) *Manager {
+	logger := newTestLogger(t)
+
+	server, err := webserver.NewServer(db, logger, webserver.DefaultServerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	twitchManager, err := twitch.NewManager(db, server, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = twitchManager.Close() })
+
+	manager, err := NewManager(db, twitchManager, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = manager.Close() })
+
+	// Let the user ID migration check run before starting, since there is nothing to migrate
+	// it only saves that it's done
+	waitFor(t, "user ID migration", func() bool {
+		var migration UserIDMigration
+		return db.GetJSON(UserIDMigrationKey, &migration) == nil
+	})
+
+	return manager
+}
+
+// testLogWriter writes logs to the test until it's over, the Twitch bot connection
+// can only be stopped (not waited for) so it might still log something after that
+type testLogWriter struct {
+	t    *testing.T
+	mu   stdsync.Mutex
+	done bool
+}
+
+func (w *testLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.done {
+		w.t.Log(strings.TrimSuffix(string(p), "\n"))
+	}
+	return len(p), nil
+}
+
+func newTestLogger(t *testing.T) *zap.Logger {
+	writer := &testLogWriter{t: t}
+	// Cleanups run in reverse order, this one runs after the managers are closed
+	t.Cleanup(func() {
+		writer.mu.Lock()
+		defer writer.mu.Unlock()
+		writer.done = true
+	})
+	encoder := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	return zap.New(zapcore.NewCore(encoder, zapcore.AddSync(writer), zapcore.DebugLevel))
+}
+
+// waitFor waits until condition is true, changes made by the manager are also received back
+// from the database after a bit so checks must wait for things to settle
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
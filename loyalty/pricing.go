@@ -0,0 +1,114 @@
+package loyalty
+
+import (
+	"maps"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How often to refresh the current price of rewards with decaying prices
+const priceUpdateInterval = 10 * time.Second
+
+type rewardPriceState struct {
+	StreamID string
+	Steps    int64
+	Updated  time.Time
+}
+
+// priceSteps returns how many price increases are currently applied to a reward, after decay
+func (m *Manager) priceSteps(reward Reward, now time.Time) int64 {
+	if reward.Pricing == nil {
+		return 0
+	}
+	state, ok := m.priceStates.GetKey(reward.ID)
+	if !ok {
+		return 0
+	}
+
+	// Increases only last for the stream they happened in
+	stream, _ := m.twitchManager.Client().CurrentStream()
+	if state.StreamID != stream.ID {
+		return 0
+	}
+
+	steps := state.Steps
+	if reward.Pricing.DecayInterval > 0 {
+		steps -= int64(now.Sub(state.Updated) / (time.Duration(reward.Pricing.DecayInterval) * time.Second))
+	}
+	if steps < 0 {
+		return 0
+	}
+	return steps
+}
+
+// basePrice returns the price of a reward with dynamic pricing applied
+func (m *Manager) basePrice(reward Reward, now time.Time) int64 {
+	if reward.Pricing == nil {
+		return reward.Price
+	}
+	price := reward.Price + m.priceSteps(reward, now)*reward.Pricing.IncreasePerRedeem
+	if reward.Pricing.MaxPrice > 0 && price > reward.Pricing.MaxPrice {
+		price = reward.Pricing.MaxPrice
+	}
+	return price
+}
+
+// GetRewardPrice returns how much a reward costs right now for a viewer
+func (m *Manager) GetRewardPrice(reward Reward, subscriber bool) int64 {
+	price := m.basePrice(reward, time.Now())
+	if subscriber && reward.Pricing != nil && reward.Pricing.SubscriberDiscount > 0 {
+		price -= price * reward.Pricing.SubscriberDiscount / 100
+	}
+	return price
+}
+
+// bumpRewardPrice adds a price increase to a reward after it has been redeemed
+func (m *Manager) bumpRewardPrice(reward Reward) {
+	if reward.Pricing == nil || reward.Pricing.IncreasePerRedeem == 0 {
+		return
+	}
+	now := time.Now()
+	stream, _ := m.twitchManager.Client().CurrentStream()
+	m.priceStates.SetKey(reward.ID, rewardPriceState{
+		StreamID: stream.ID,
+		Steps:    m.priceSteps(reward, now) + 1,
+		Updated:  now,
+	})
+}
+
+func (m *Manager) runPriceUpdater() {
+	defer m.loops.Done()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(priceUpdateInterval):
+		}
+
+		m.redeemMux.Lock()
+		err := m.updateRewardPrices()
+		m.redeemMux.Unlock()
+		if err != nil {
+			m.logger.Error("Could not update reward prices", zap.Error(err))
+		}
+	}
+}
+
+// updateRewardPrices refreshes the current price of rewards with dynamic pricing, saving them only
+// if something changed. redeemMux must be held when calling this
+func (m *Manager) updateRewardPrices() error {
+	now := time.Now()
+	prices := make(map[string]int64)
+	for _, reward := range m.Rewards.Get() {
+		if reward.Pricing != nil {
+			prices[reward.ID] = m.basePrice(reward, now)
+		}
+	}
+	if maps.Equal(prices, m.rewardPrices.Get()) {
+		return nil
+	}
+	m.rewardPrices.Set(prices)
+	return m.db.PutJSON(RewardPricesKey, prices)
+}
@@ -0,0 +1,90 @@
+package loyalty
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDynamicPricing(t *testing.T) {
+	manager, db := newTestManager(t)
+
+	reward := Reward{Enabled: true, ID: "reward", Price: 100, Pricing: &RewardPricing{
+		IncreasePerRedeem:  50,
+		MaxPrice:           180,
+		SubscriberDiscount: 10,
+	}}
+	manager.Rewards.Set([]Reward{reward})
+	if err := manager.GivePoints(map[string]int64{"1": 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []int64{100, 150, 180} {
+		if price := manager.GetRewardPrice(reward, false); price != expected {
+			t.Fatalf("expected price to be %d, got %d", expected, price)
+		}
+		if err := manager.PerformRedeem(Redeem{UserID: "1", Username: "viewer", Reward: reward, When: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if price := manager.GetRewardPrice(reward, true); price != 162 {
+		t.Fatalf("expected subscriber price to be 162, got %d", price)
+	}
+
+	var prices map[string]int64
+	if err := db.GetJSON(RewardPricesKey, &prices); err != nil {
+		t.Fatal(err)
+	}
+	if prices["reward"] != 180 {
+		t.Fatalf("unexpected saved prices: %v", prices)
+	}
+}
+
+func TestRewardPriceUpdatesKeepRewardChanges(t *testing.T) {
+	manager, db := newTestManager(t)
+
+	reward := Reward{Enabled: true, ID: "reward", Name: "Reward", Price: 100, Pricing: &RewardPricing{
+		IncreasePerRedeem: 50,
+		DecayInterval:     60,
+	}}
+	if err := db.PutJSON(RewardsKey, []Reward{reward}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "rewards to be loaded", func() bool { return manager.GetReward("reward").ID != "" })
+	if err := manager.GivePoints(map[string]int64{"1": 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.PerformRedeem(Redeem{UserID: "1", Username: "viewer", Reward: reward, When: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reward is changed from the UI while its price is decaying
+	reward.Name = "Renamed reward"
+	if err := db.PutJSON(RewardsKey, []Reward{reward}); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := manager.priceStates.GetKey("reward")
+	state.Updated = state.Updated.Add(-time.Minute)
+	manager.priceStates.SetKey("reward", state)
+
+	manager.redeemMux.Lock()
+	err := manager.updateRewardPrices()
+	manager.redeemMux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prices map[string]int64
+	if err := db.GetJSON(RewardPricesKey, &prices); err != nil {
+		t.Fatal(err)
+	}
+	if prices["reward"] != 100 {
+		t.Fatalf("price did not decay: %v", prices)
+	}
+	var rewards []Reward
+	if err := db.GetJSON(RewardsKey, &rewards); err != nil {
+		t.Fatal(err)
+	}
+	if len(rewards) != 1 || rewards[0].Name != "Renamed reward" {
+		t.Fatalf("reward changes were overwritten: %+v", rewards)
+	}
+}
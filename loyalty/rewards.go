@@ -0,0 +1,181 @@
+package loyalty
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func userRewardKey(rewardID string, user string) string {
+	return rewardID + "/" + user
+}
+
+func (m *Manager) GetUserRewardCooldown(rewardID string, user string) time.Time {
+	cooldown, ok := m.userCooldowns.GetKey(userRewardKey(rewardID, user))
+	if !ok {
+		// Return zero time for a reward with no cooldown
+		return time.Time{}
+	}
+
+	return cooldown
+}
+
+// streamRedeemCount returns how many times a user has redeemed a reward in the current stream,
+// redeemMux must be held when calling this
+func (m *Manager) streamRedeemCount(rewardID string, user string) int64 {
+	m.checkStreamRedeems()
+	count, _ := m.streamRedeems.GetKey(userRewardKey(rewardID, user))
+	return count
+}
+
+// checkStreamRedeems clears per-stream redeem counts when a new stream starts
+func (m *Manager) checkStreamRedeems() {
+	stream, _ := m.twitchManager.Client().CurrentStream()
+	if m.streamRedeemsID.Get() == stream.ID {
+		return
+	}
+	m.streamRedeemsID.Set(stream.ID)
+	m.streamRedeems.Set(make(map[string]int64))
+	if err := m.saveRedeemLimits(); err != nil {
+		m.logger.Error("Could not save redeem limits", zap.Error(err))
+	}
+}
+
+// trackUserRedeem updates the per-user cooldown and redeem counts for a redeem
+func (m *Manager) trackUserRedeem(redeem Redeem) error {
+	// Redeems from before the user ID migration can't be tied to a viewer
+	if redeem.UserID == "" {
+		return nil
+	}
+	key := userRewardKey(redeem.Reward.ID, redeem.UserID)
+	if redeem.Reward.UserCooldown > 0 {
+		m.userCooldowns.SetKey(key, time.Now().Add(time.Second*time.Duration(redeem.Reward.UserCooldown)))
+	}
+	m.streamRedeems.SetKey(key, m.streamRedeemCount(redeem.Reward.ID, redeem.UserID)+1)
+	return m.saveRedeemLimits()
+}
+
+// untrackUserRedeem reverts the per-stream redeem count for a redeem that was rejected
+func (m *Manager) untrackUserRedeem(redeem Redeem) error {
+	if redeem.UserID == "" {
+		return nil
+	}
+	count := m.streamRedeemCount(redeem.Reward.ID, redeem.UserID)
+	if count < 1 {
+		return nil
+	}
+	m.streamRedeems.SetKey(userRewardKey(redeem.Reward.ID, redeem.UserID), count-1)
+	return m.saveRedeemLimits()
+}
+
+// saveRedeemLimits saves per-stream redeem counts and per-user cooldowns so they survive restarts
+func (m *Manager) saveRedeemLimits() error {
+	limits := RedeemLimits{
+		StreamID:      m.streamRedeemsID.Get(),
+		StreamRedeems: m.streamRedeems.Copy(),
+		UserCooldowns: make(map[string]time.Time),
+	}
+	now := time.Now()
+	for key, cooldown := range m.userCooldowns.Copy() {
+		if cooldown.After(now) {
+			limits.UserCooldowns[key] = cooldown
+		}
+	}
+	return m.db.PutJSON(RedeemLimitsKey, limits)
+}
+
+// updateReward changes a saved reward and saves the reward list
+func (m *Manager) updateReward(rewardID string, update func(*Reward)) error {
+	rewards := m.Rewards.Copy()
+	for i := range rewards {
+		if rewards[i].ID != rewardID {
+			continue
+		}
+		update(&rewards[i])
+		m.Rewards.Set(rewards)
+		return m.db.PutJSON(RewardsKey, rewards)
+	}
+	return nil
+}
+
+// findRedeem returns the index of a redeem in the queue, or -1 if not found
+func findRedeem(queue []Redeem, redeem Redeem) int {
+	for index, queued := range queue {
+		if queued.When.Equal(redeem.When) && queued.Username == redeem.Username && queued.Reward.ID == redeem.Reward.ID {
+			return index
+		}
+	}
+	return -1
+}
+
+// AcceptRedeem approves a redeem that is pending, the held points are spent for good
+func (m *Manager) AcceptRedeem(redeem Redeem) error {
+	m.redeemMux.Lock()
+	defer m.redeemMux.Unlock()
+
+	queue := m.Queue.Copy()
+	index := findRedeem(queue, redeem)
+	if index < 0 {
+		return ErrRedeemNotFound
+	}
+	if queue[index].Status != RedeemStatusPending {
+		return ErrRedeemNotPending
+	}
+
+	queue[index].Status = RedeemStatusAccepted
+	m.Queue.Set(queue)
+	if err := m.saveQueue(); err != nil {
+		return err
+	}
+
+	return m.db.PutJSON(RedeemAcceptedEvent, queue[index])
+}
+
+// RejectRedeem removes a redeem that is pending from the queue and refunds the held points
+func (m *Manager) RejectRedeem(redeem Redeem) error {
+	m.redeemMux.Lock()
+	defer m.redeemMux.Unlock()
+
+	return m.rejectRedeem(redeem)
+}
+
+func (m *Manager) rejectRedeem(redeem Redeem) error {
+	queue := m.Queue.Copy()
+	index := findRedeem(queue, redeem)
+	if index < 0 {
+		return ErrRedeemNotFound
+	}
+	rejected := queue[index]
+	if rejected.Status != RedeemStatusPending {
+		return ErrRedeemNotPending
+	}
+
+	// Remove redemption from list
+	m.Queue.Set(append(queue[:index], queue[index+1:]...))
+	if err := m.saveQueue(); err != nil {
+		return err
+	}
+
+	// Give back points and stock
+	if rejected.UserID != "" {
+		if err := m.RefundPoints(map[string]int64{rejected.UserID: rejected.Price}); err != nil {
+			return err
+		}
+	} else {
+		// The viewer's login could not be moved to a user ID, there is no balance to refund to
+		m.logger.Warn("Could not refund redeem without a user ID", zap.String("username", rejected.Username), zap.Int64("points", rejected.Price))
+	}
+	if err := m.untrackUserRedeem(rejected); err != nil {
+		return err
+	}
+	if err := m.updateReward(rejected.Reward.ID, func(reward *Reward) {
+		if reward.Stock != nil {
+			stock := *reward.Stock + 1
+			reward.Stock = &stock
+		}
+	}); err != nil {
+		return err
+	}
+
+	return m.db.PutJSON(RedeemRejectedEvent, rejected)
+}
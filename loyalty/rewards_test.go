@@ -0,0 +1,145 @@
+package loyalty
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedeemApproval(t *testing.T) {
+	manager, _ := newTestManager(t)
+
+	stock := int64(5)
+	reward := Reward{Enabled: true, ID: "reward", Price: 100, Stock: &stock, MaxPerStream: 1, RequiresApproval: true}
+	manager.Rewards.Set([]Reward{reward})
+	if err := manager.GivePoints(map[string]int64{"1": 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	redeem := Redeem{UserID: "1", Username: "viewer", Reward: reward, When: time.Now()}
+	if err := manager.PerformRedeem(redeem); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "points to be held", func() bool { return manager.GetPoints("1") == 900 })
+	if queue := manager.Queue.Get(); len(queue) != 1 || queue[0].Status != RedeemStatusPending {
+		t.Fatalf("redeem is not pending: %+v", queue)
+	}
+	if current := manager.GetReward("reward"); *current.Stock != 4 {
+		t.Fatalf("expected stock to be 4, got %d", *current.Stock)
+	}
+
+	// Rejecting gives back points, stock and the redeem
+	if err := manager.RejectRedeem(redeem); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "refund", func() bool {
+		return manager.GetPoints("1") == 1000 && len(manager.Queue.Get()) == 0 && *manager.GetReward("reward").Stock == 5
+	})
+
+	redeem.When = time.Now()
+	if err := manager.PerformRedeem(redeem); err != nil {
+		t.Fatalf("redeem limit was not reverted on reject: %s", err)
+	}
+	if err := manager.AcceptRedeem(redeem); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "redeem to be accepted", func() bool {
+		queue := manager.Queue.Get()
+		return len(queue) == 1 && queue[0].Status == RedeemStatusAccepted
+	})
+	if err := manager.RejectRedeem(redeem); !errors.Is(err, ErrRedeemNotPending) {
+		t.Fatalf("expected ErrRedeemNotPending, got %v", err)
+	}
+	if points := manager.GetPoints("1"); points != 900 {
+		t.Fatalf("accepted redeem was refunded, balance is %d", points)
+	}
+}
+
+func TestRedeemLimitsPersistence(t *testing.T) {
+	manager, db := newTestManager(t)
+
+	limited := Reward{Enabled: true, ID: "limited", Price: 10, MaxPerStream: 2}
+	cooldown := Reward{Enabled: true, ID: "cooldown", Price: 10, UserCooldown: 3600}
+	manager.Rewards.Set([]Reward{limited, cooldown})
+	if err := manager.GivePoints(map[string]int64{"1": 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(manager *Manager, reward Reward, expected error) {
+		t.Helper()
+		err := manager.PerformRedeem(Redeem{UserID: "1", Username: "viewer", Reward: reward, When: time.Now()})
+		if !errors.Is(err, expected) {
+			t.Fatalf("expected %v redeeming %s, got %v", expected, reward.ID, err)
+		}
+	}
+	check(manager, limited, nil)
+	check(manager, limited, nil)
+	check(manager, limited, ErrRedeemLimitReached)
+	check(manager, cooldown, nil)
+	check(manager, cooldown, ErrRedeemInCooldown)
+
+	var limits RedeemLimits
+	if err := db.GetJSON(RedeemLimitsKey, &limits); err != nil {
+		t.Fatal(err)
+	}
+	if limits.StreamRedeems[userRewardKey("limited", "1")] != 2 || limits.UserCooldowns[userRewardKey("cooldown", "1")].IsZero() {
+		t.Fatalf("unexpected saved limits: %+v", limits)
+	}
+
+	// Limits still apply after a restart
+	restarted := newTestManagerWithDB(t, db)
+	restarted.Rewards.Set([]Reward{limited, cooldown})
+	check(restarted, limited, ErrRedeemLimitReached)
+	check(restarted, cooldown, ErrRedeemInCooldown)
+}
+
+func TestConcurrentRedeemAndContribution(t *testing.T) {
+	manager, _ := newTestManager(t)
+
+	reward := Reward{Enabled: true, ID: "reward", Price: 100}
+	manager.Rewards.Set([]Reward{reward})
+
+	for i := 0; i < 20; i++ {
+		manager.Goals.Set([]Goal{{Enabled: true, ID: "goal", TotalGoal: 1000, Status: GoalStatusActive}})
+		manager.Queue.Set(nil)
+		if err := manager.GivePoints(map[string]int64{"1": 100 - manager.GetPoints("1")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Both spend the whole balance, only one of them can get it
+		var redeemErr error
+		var contributed int64
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			redeemErr = manager.PerformRedeem(Redeem{UserID: "1", Username: "viewer", Reward: reward, When: time.Now()})
+		}()
+		go func() {
+			defer wg.Done()
+			var err error
+			contributed, err = manager.PerformContribution(manager.GetGoal("goal"), "1", 100)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		if points := manager.GetPoints("1"); points != 0 {
+			t.Fatalf("expected balance to be 0, got %d", points)
+		}
+		if redeemErr == nil {
+			if contributed != 0 || len(manager.Queue.Get()) != 1 {
+				t.Fatalf("points were spent twice: contributed %d after redeeming", contributed)
+			}
+		} else {
+			if !errors.Is(redeemErr, ErrNotEnoughPoints) {
+				t.Fatalf("expected ErrNotEnoughPoints, got %v", redeemErr)
+			}
+			if contributed != 100 || len(manager.Queue.Get()) != 0 {
+				t.Fatalf("failed redeem left side effects: contributed %d, queue %+v", contributed, manager.Queue.Get())
+			}
+		}
+	}
+}
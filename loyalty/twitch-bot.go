@@ -20,8 +20,11 @@ const (
 	commandGoals      = "!goals"
 	commandBalance    = "!balance"
 	commandContribute = "!contribute"
+	commandWatchTime  = "!watchtime"
 )
 
+const templateWatchTime = "watchtime"
+
 func (m *Manager) SetupTwitch() {
 	bot := m.twitchManager.Client().Bot
 	if bot == nil {
@@ -58,6 +61,22 @@ func (m *Manager) SetupTwitch() {
 		Handler:     m.cmdContributeGoal,
 		Enabled:     true,
 	})
+	bot.RegisterCommand(commandWatchTime, twitch.BotCommand{
+		Description: "See how long you (or another viewer) have been watching",
+		Usage:       fmt.Sprintf("%s [user]", commandWatchTime),
+		AccessLevel: twitch.ALTEveryone,
+		Handler:     m.cmdWatchTime,
+		Enabled:     true,
+	})
+
+	// Add loyalty-based template functions, templates are rendered often so they must not call Twitch
+	bot.SetTemplateFunction(templateWatchTime, func(user string) string {
+		userID, ok := m.localUserID(user)
+		if !ok {
+			return formatWatchTime(0)
+		}
+		return formatWatchTime(m.GetWatchTime(userID).Total)
+	})
 
 	// Setup message handler for tracking user activity
 	bot.OnMessage.Add(m)
@@ -90,6 +109,7 @@ func (m *Manager) SetupTwitch() {
 			// Get user list
 			cursor := ""
 			var users []string
+			logins := make(map[string]string)
 			for {
 				userClient, err := client.GetUserClient(false)
 				if err != nil {
@@ -107,7 +127,9 @@ func (m *Manager) SetupTwitch() {
 					return
 				}
 				for _, user := range res.Data.Chatters {
-					users = append(users, user.UserLogin)
+					users = append(users, user.UserID)
+					logins[user.UserID] = user.UserLogin
+					m.userIDs.SetKey(user.UserLogin, user.UserID)
 				}
 				cursor = res.Data.Pagination.Cursor
 				if cursor == "" {
@@ -119,7 +141,7 @@ func (m *Manager) SetupTwitch() {
 			pointsToGive := make(map[string]int64)
 			for _, user := range users {
 				// Check if user is blocked
-				if m.IsBanned(user) {
+				if m.IsBanned(user, logins[user]) {
 					continue
 				}
 
@@ -140,6 +162,25 @@ func (m *Manager) SetupTwitch() {
 				err := m.GivePoints(pointsToGive)
 				if err != nil {
 					m.logger.Error("Error awarding loyalty points to user", zap.Error(err))
+				} else {
+					var total int64
+					for _, points := range pointsToGive {
+						total += points
+					}
+					m.twitchManager.Sessions().AddLoyaltyPoints(total)
+				}
+
+				// Everyone in chat counts as active for point decay
+				err = m.markSeen(users, time.Now())
+				if err != nil {
+					m.logger.Error("Error updating activity for users", zap.Error(err))
+				}
+
+				// Everyone in chat has been watching for the whole interval
+				stream, _ := client.CurrentStream()
+				err = m.AddWatchTime(users, time.Duration(config.Points.Interval)*time.Second, stream.ID)
+				if err != nil {
+					m.logger.Error("Error updating watch time for users", zap.Error(err))
 				}
 			}
 		}
@@ -155,6 +196,8 @@ func (m *Manager) StopTwitch() {
 		bot.RemoveCommand(commandBalance)
 		bot.RemoveCommand(commandGoals)
 		bot.RemoveCommand(commandContribute)
+		bot.RemoveCommand(commandWatchTime)
+		bot.RemoveTemplateFunction(templateWatchTime)
 
 		// Remove message handler
 		bot.OnMessage.Remove(m)
@@ -162,19 +205,28 @@ func (m *Manager) StopTwitch() {
 }
 
 func (m *Manager) HandleBotMessage(message irc.PrivateMessage) {
-	m.activeUsers.SetKey(message.User.Name, true)
+	m.activeUsers.SetKey(message.User.ID, true)
+
+	// Save activity for point decay (only every once in a while, chat is busy)
+	now := time.Now()
+	if entry, ok := m.points.GetKey(message.User.ID); ok && now.Sub(entry.LastSeen) > seenUpdateInterval {
+		if err := m.markSeen([]string{message.User.ID}, now); err != nil {
+			m.logger.Error("Error updating activity for user", zap.Error(err))
+		}
+	}
 }
 
 func (m *Manager) SetBanList(banned []string) {
 	m.banlist = make(map[string]bool)
 	for _, usr := range banned {
-		m.banlist[usr] = true
+		// Entries added after the user ID migration might still be logins
+		m.banlist[strings.ToLower(strings.TrimLeft(strings.TrimSpace(usr), "@"))] = true
 	}
 }
 
-func (m *Manager) IsBanned(user string) bool {
-	banned, ok := m.banlist[user]
-	return ok && banned
+// IsBanned returns true if the viewer is in the ban list, either by user ID or by login
+func (m *Manager) IsBanned(userID string, login string) bool {
+	return m.banlist[userID] || (login != "" && m.banlist[strings.ToLower(login)])
 }
 
 func (m *Manager) IsActive(user string) bool {
@@ -188,13 +240,45 @@ func (m *Manager) ResetActivity() {
 
 func (m *Manager) cmdBalance(bot *twitch.Bot, message irc.PrivateMessage) {
 	// Get user balance
-	balance := m.GetPoints(message.User.Name)
-	bot.Client.Say(message.Channel, fmt.Sprintf("%s: You have %d %s!", message.User.DisplayName, balance, m.Config.Get().Currency))
+	balance := m.GetPoints(message.User.ID)
+	bot.Say(message.Channel, fmt.Sprintf("%s: You have %d %s!", message.User.DisplayName, balance, m.Config.Get().Currency), twitch.MessagePriorityHigh)
+}
+
+func (m *Manager) cmdWatchTime(bot *twitch.Bot, message irc.PrivateMessage) {
+	user := message.User.ID
+	displayName := message.User.DisplayName
+
+	// Check if we're asking for someone else
+	parts := strings.Fields(message.Message)
+	if len(parts) > 1 {
+		displayName = strings.TrimLeft(parts[1], "@")
+		userID, err := m.UserIDForLogin(displayName)
+		if err != nil {
+			bot.Say(message.Channel, fmt.Sprintf("%s hasn't been watching yet!", displayName), twitch.MessagePriorityHigh)
+			return
+		}
+		user = userID
+	}
+
+	entry := m.GetWatchTime(user)
+	if entry.Total == 0 {
+		bot.Say(message.Channel, fmt.Sprintf("%s hasn't been watching yet!", displayName), twitch.MessagePriorityHigh)
+		return
+	}
+
+	// Only show stream time if it's from the ongoing stream
+	stream, live := m.twitchManager.Client().CurrentStream()
+	if live && entry.StreamID == stream.ID {
+		bot.Say(message.Channel, fmt.Sprintf("%s has been watching for %s this stream (%s in total)", displayName, formatWatchTime(entry.Stream), formatWatchTime(entry.Total)), twitch.MessagePriorityHigh)
+		return
+	}
+	bot.Say(message.Channel, fmt.Sprintf("%s has been watching for %s in total", displayName, formatWatchTime(entry.Total)), twitch.MessagePriorityHigh)
 }
 
 func (m *Manager) cmdRedeemReward(bot *twitch.Bot, message irc.PrivateMessage) {
 	parts := strings.Fields(message.Message)
 	if len(parts) < 2 {
+		m.listRewards(bot, message)
 		return
 	}
 	redeemID := parts[1]
@@ -211,12 +295,14 @@ func (m *Manager) cmdRedeemReward(bot *twitch.Bot, message irc.PrivateMessage) {
 	}
 
 	// Get user balance
-	balance := m.GetPoints(message.User.Name)
+	balance := m.GetPoints(message.User.ID)
 	config := m.Config.Get()
+	subscriber := isSubscriber(message.User)
 
 	// Check if user can afford the reward
-	if balance-reward.Price < 0 {
-		bot.Client.Say(message.Channel, fmt.Sprintf("I'm sorry %s but you cannot afford this (have %d %s, need %d)", message.User.DisplayName, balance, config.Currency, reward.Price))
+	price := m.GetRewardPrice(reward, subscriber)
+	if balance-price < 0 {
+		bot.Say(message.Channel, fmt.Sprintf("I'm sorry %s but you cannot afford this (have %d %s, need %d)", message.User.DisplayName, balance, config.Currency, price), twitch.MessagePriorityHigh)
 		return
 	}
 
@@ -227,30 +313,72 @@ func (m *Manager) cmdRedeemReward(bot *twitch.Bot, message irc.PrivateMessage) {
 
 	// Perform redeem
 	if err := m.PerformRedeem(Redeem{
+		UserID:      message.User.ID,
 		Username:    message.User.Name,
 		DisplayName: message.User.DisplayName,
 		When:        time.Now(),
 		Reward:      reward,
 		RequestText: text,
+		Subscriber:  subscriber,
 	}); err != nil {
 		switch err {
+		case ErrNotEnoughPoints:
+			// Price changed in the meantime
+			bot.Say(message.Channel, fmt.Sprintf("I'm sorry %s but you cannot afford this (have %d %s, need %d)", message.User.DisplayName, m.GetPoints(message.User.ID), config.Currency, m.GetRewardPrice(reward, subscriber)), twitch.MessagePriorityHigh)
 		case ErrRedeemInCooldown:
 			nextAvailable := m.GetRewardCooldown(reward.ID)
-			bot.Client.Say(message.Channel, fmt.Sprintf("%s: That reward is in cooldown (available in %s)", message.User.DisplayName,
-				time.Until(nextAvailable).Truncate(time.Second)))
+			if userCooldown := m.GetUserRewardCooldown(reward.ID, message.User.ID); userCooldown.After(nextAvailable) {
+				nextAvailable = userCooldown
+			}
+			bot.Say(message.Channel, fmt.Sprintf("%s: That reward is in cooldown (available in %s)", message.User.DisplayName,
+				time.Until(nextAvailable).Truncate(time.Second)), twitch.MessagePriorityHigh)
+		case ErrRedeemOutOfStock:
+			bot.Say(message.Channel, fmt.Sprintf("%s: That reward is out of stock!", message.User.DisplayName), twitch.MessagePriorityHigh)
+		case ErrRedeemLimitReached:
+			bot.Say(message.Channel, fmt.Sprintf("%s: You can't redeem that reward again this stream!", message.User.DisplayName), twitch.MessagePriorityHigh)
 		default:
 			m.logger.Error("Error while performing redeem", zap.Error(err))
 		}
 		return
 	}
 
-	bot.Client.Say(message.Channel, fmt.Sprintf("HolidayPresent %s has redeemed %s! (new balance: %d %s)", message.User.DisplayName, reward.Name, m.GetPoints(message.User.Name), config.Currency))
+	if reward.RequiresApproval {
+		bot.Say(message.Channel, fmt.Sprintf("%s: Your redeem of %s is waiting for approval, your %s will be refunded if it gets rejected", message.User.DisplayName, reward.Name, config.Currency), twitch.MessagePriorityHigh)
+		return
+	}
+
+	bot.Say(message.Channel, fmt.Sprintf("HolidayPresent %s has redeemed %s! (new balance: %d %s)", message.User.DisplayName, reward.Name, m.GetPoints(message.User.ID), config.Currency), twitch.MessagePriorityHigh)
+}
+
+// listRewards writes all the redeemable rewards with their current price
+func (m *Manager) listRewards(bot *twitch.Bot, message irc.PrivateMessage) {
+	subscriber := isSubscriber(message.User)
+	var rewards []string
+	for _, reward := range m.Rewards.Get() {
+		if !reward.Enabled {
+			continue
+		}
+		rewards = append(rewards, fmt.Sprintf("%s (%d) [id: %s]", reward.Name, m.GetRewardPrice(reward, subscriber), reward.ID))
+	}
+	if len(rewards) < 1 {
+		bot.Say(message.Channel, fmt.Sprintf("%s: There are no rewards available right now :(", message.User.DisplayName), twitch.MessagePriorityHigh)
+		return
+	}
+	bot.Say(message.Channel, fmt.Sprintf("Available rewards (in %s): %s | Redeem with <%s REWARDID>", m.Config.Get().Currency, strings.Join(rewards, " | "), commandRedeem), twitch.MessagePriorityHigh)
+}
+
+func isSubscriber(user irc.User) bool {
+	if _, ok := user.Badges["subscriber"]; ok {
+		return true
+	}
+	_, ok := user.Badges["founder"]
+	return ok
 }
 
 func (m *Manager) cmdGoalList(bot *twitch.Bot, message irc.PrivateMessage) {
 	goals := m.Goals.Get()
 	if len(goals) < 1 {
-		bot.Client.Say(message.Channel, fmt.Sprintf("%s: There are no active community goals right now :(!", message.User.DisplayName))
+		bot.Say(message.Channel, fmt.Sprintf("%s: There are no active community goals right now :(!", message.User.DisplayName), twitch.MessagePriorityHigh)
 		return
 	}
 	msg := "Current goals: "
@@ -261,7 +389,7 @@ func (m *Manager) cmdGoalList(bot *twitch.Bot, message irc.PrivateMessage) {
 		msg += fmt.Sprintf("%s (%d/%d %s) [id: %s] | ", goal.Name, goal.Contributed, goal.TotalGoal, m.Config.Get().Currency, goal.ID)
 	}
 	msg += " Contribute with <!contribute POINTS GOALID>"
-	bot.Client.Say(message.Channel, msg)
+	bot.Say(message.Channel, msg, twitch.MessagePriorityHigh)
 }
 
 func (m *Manager) cmdContributeGoal(bot *twitch.Bot, message irc.PrivateMessage) {
@@ -278,7 +406,7 @@ func (m *Manager) cmdContributeGoal(bot *twitch.Bot, message irc.PrivateMessage)
 			continue
 		}
 		hasGoals = true
-		if goal.Contributed < goal.TotalGoal {
+		if goal.Contributed < goal.TotalGoal && goal.Status != GoalStatusExpired {
 			goalIndex = index
 			break
 		}
@@ -287,9 +415,9 @@ func (m *Manager) cmdContributeGoal(bot *twitch.Bot, message irc.PrivateMessage)
 	// Do we not have any goal we can contribute to? Hooray I guess?
 	if goalIndex < 0 {
 		if hasGoals {
-			bot.Client.Say(message.Channel, fmt.Sprintf("%s: All active community goals have been reached already! NewRecord", message.User.DisplayName))
+			bot.Say(message.Channel, fmt.Sprintf("%s: All active community goals have been reached already! NewRecord", message.User.DisplayName), twitch.MessagePriorityHigh)
 		} else {
-			bot.Client.Say(message.Channel, fmt.Sprintf("%s: There are no active community goals right now :(!", message.User.DisplayName))
+			bot.Say(message.Channel, fmt.Sprintf("%s: There are no active community goals right now :(!", message.User.DisplayName), twitch.MessagePriorityHigh)
 		}
 		return
 	}
@@ -300,7 +428,7 @@ func (m *Manager) cmdContributeGoal(bot *twitch.Bot, message irc.PrivateMessage)
 		newPoints, err := strconv.ParseInt(parts[1], 10, 64)
 		if err == nil {
 			if newPoints <= 0 {
-				bot.Client.Say(message.Channel, fmt.Sprintf("Nice try %s SoBayed", message.User.DisplayName))
+				bot.Say(message.Channel, fmt.Sprintf("Nice try %s SoBayed", message.User.DisplayName), twitch.MessagePriorityHigh)
 				return
 			}
 			points = newPoints
@@ -321,7 +449,7 @@ func (m *Manager) cmdContributeGoal(bot *twitch.Bot, message irc.PrivateMessage)
 			}
 			// Invalid goal ID provided
 			if !found {
-				bot.Client.Say(message.Channel, fmt.Sprintf("%s: I couldn't find that goal ID :(", message.User.DisplayName))
+				bot.Say(message.Channel, fmt.Sprintf("%s: I couldn't find that goal ID :(", message.User.DisplayName), twitch.MessagePriorityHigh)
 				return
 			}
 		}
@@ -332,29 +460,33 @@ func (m *Manager) cmdContributeGoal(bot *twitch.Bot, message irc.PrivateMessage)
 
 	// Check if goal was reached already
 	if selectedGoal.Contributed >= selectedGoal.TotalGoal {
-		bot.Client.Say(message.Channel, fmt.Sprintf("%s: This goal was already reached! ヾ(•ω•`)o", message.User.DisplayName))
+		bot.Say(message.Channel, fmt.Sprintf("%s: This goal was already reached! ヾ(•ω•`)o", message.User.DisplayName), twitch.MessagePriorityHigh)
 		return
 	}
 
 	// Add points to goal
-	points, err := m.PerformContribution(selectedGoal, message.User.Name, points)
+	points, err := m.PerformContribution(selectedGoal, message.User.ID, points)
 	if err != nil {
-		m.logger.Error("Error while contributing to goal", zap.Error(err))
+		switch err {
+		case ErrGoalExpired:
+			bot.Say(message.Channel, fmt.Sprintf("%s: This goal has expired!", message.User.DisplayName), twitch.MessagePriorityHigh)
+		default:
+			m.logger.Error("Error while contributing to goal", zap.Error(err))
+		}
 		return
 	}
 	if points == 0 {
-		bot.Client.Say(message.Channel, fmt.Sprintf("%s: Sorry but you're broke", message.User.DisplayName))
+		bot.Say(message.Channel, fmt.Sprintf("%s: Sorry but you're broke", message.User.DisplayName), twitch.MessagePriorityHigh)
 		return
 	}
 
 	selectedGoal = m.Goals.Get()[goalIndex]
 	config := m.Config.Get()
 	newRemaining := selectedGoal.TotalGoal - selectedGoal.Contributed
-	bot.Client.Say(message.Channel, fmt.Sprintf("NewRecord %s contributed %d %s to \"%s\"!! Only %d %s left!", message.User.DisplayName, points, config.Currency, selectedGoal.Name, newRemaining, config.Currency))
-
-	// Check if goal was reached!
-	// TODO Replace this with sub from loyalty system or something?
+	// Goal completion is announced separately
 	if newRemaining <= 0 {
-		bot.Client.Say(message.Channel, fmt.Sprintf("FallWinning The community goal \"%s\" was reached! FallWinning", selectedGoal.Name))
+		bot.Say(message.Channel, fmt.Sprintf("NewRecord %s contributed %d %s to \"%s\"!!", message.User.DisplayName, points, config.Currency, selectedGoal.Name), twitch.MessagePriorityHigh)
+		return
 	}
+	bot.Say(message.Channel, fmt.Sprintf("NewRecord %s contributed %d %s to \"%s\"!! Only %d %s left!", message.User.DisplayName, points, config.Currency, selectedGoal.Name, newRemaining, config.Currency), twitch.MessagePriorityHigh)
 }
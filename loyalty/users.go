@@ -0,0 +1,323 @@
+package loyalty
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+
+	"go.uber.org/zap"
+)
+
+// How long to wait before trying the user ID migration again when Twitch can't be reached
+const userIDMigrationRetryInterval = time.Minute
+
+// UserIDForLogin returns the Twitch user ID of a viewer from their login,
+// looking in the known viewers first and asking Twitch otherwise
+func (m *Manager) UserIDForLogin(login string) (string, error) {
+	login = normalizeLogin(login)
+	if id, ok := m.localUserID(login); ok {
+		return id, nil
+	}
+
+	ids, err := m.twitchManager.Client().UserIDsForLogins([]string{login})
+	if err != nil {
+		return "", err
+	}
+	id, ok := ids[login]
+	if !ok {
+		return "", fmt.Errorf("user %s not found", login)
+	}
+	m.userIDs.SetKey(login, id)
+	return id, nil
+}
+
+// localUserID returns the user ID of a viewer that was in chat or looked up already, without asking Twitch
+func (m *Manager) localUserID(login string) (string, bool) {
+	login = normalizeLogin(login)
+	if id, ok := m.userIDs.GetKey(login); ok {
+		return id, true
+	}
+
+	if bot := m.twitchManager.Client().Bot; bot != nil {
+		if viewer, err := bot.Viewers.GetByLogin(login); err == nil {
+			m.userIDs.SetKey(login, viewer.ID)
+			return viewer.ID, true
+		}
+	}
+	return "", false
+}
+
+func normalizeLogin(login string) string {
+	return strings.ToLower(strings.TrimLeft(strings.TrimSpace(login), "@"))
+}
+
+// loginForUserID returns the last known login of a viewer, or the ID itself if the viewer is unknown
+func (m *Manager) loginForUserID(userID string) string {
+	bot := m.twitchManager.Client().Bot
+	if bot == nil {
+		return userID
+	}
+	viewer, err := bot.Viewers.Get(userID)
+	if err != nil {
+		return userID
+	}
+	return viewer.Login
+}
+
+// savedUsers returns every user that loyalty data is saved for, used before the user ID migration
+// when they are all logins
+func (m *Manager) savedUsers() map[string]bool {
+	saved := make(map[string]bool)
+	for user := range m.points.Copy() {
+		saved[user] = true
+	}
+	for user := range m.watchTime.Copy() {
+		saved[user] = true
+	}
+	for _, goal := range m.Goals.Get() {
+		for user := range goal.Contributors {
+			saved[user] = true
+		}
+	}
+	for _, user := range m.Config.Get().BanList {
+		saved[user] = true
+	}
+	for _, redeem := range m.Queue.Get() {
+		if redeem.UserID == "" {
+			saved[redeem.Username] = true
+		}
+	}
+	return saved
+}
+
+func (m *Manager) runUserIDMigration(saved map[string]bool) {
+	defer m.loops.Done()
+
+	for {
+		err := m.migrateUserIDs(saved)
+		if err == nil {
+			return
+		}
+		m.logger.Warn("Could not move loyalty data to user IDs, will try again later", zap.Error(err))
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(userIDMigrationRetryInterval):
+		}
+	}
+}
+
+// migrateUserIDs moves points, watch time, goal contributions, the ban list and pending redeems
+// from the viewer's login to their user ID. This only ever runs once, saved are the users that
+// had data when the manager started (data saved since then is already keyed by ID).
+func (m *Manager) migrateUserIDs(saved map[string]bool) error {
+	var migration UserIDMigration
+	err := m.db.GetJSON(UserIDMigrationKey, &migration)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, database.ErrEmptyKey) {
+		return err
+	}
+
+	// Collect every login we need an ID for
+	found := make(map[string]bool)
+	for user := range saved {
+		found[strings.ToLower(user)] = true
+	}
+	var logins []string
+	for login := range found {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+
+	ids := make(map[string]string)
+	if len(logins) > 0 {
+		ids, err = m.twitchManager.Client().UserIDsForLogins(logins)
+		if err != nil {
+			return err
+		}
+	}
+	userID := func(user string) (string, bool) {
+		if !saved[user] {
+			return "", false
+		}
+		id, ok := ids[strings.ToLower(user)]
+		return id, ok
+	}
+
+	if err := m.migratePoints(userID); err != nil {
+		return fmt.Errorf("could not migrate points: %w", err)
+	}
+	if err := m.migrateWatchTime(userID); err != nil {
+		return fmt.Errorf("could not migrate watch time: %w", err)
+	}
+	if err := m.migrateGoals(userID); err != nil {
+		return fmt.Errorf("could not migrate goal contributions: %w", err)
+	}
+	if err := m.migrateQueue(userID); err != nil {
+		return fmt.Errorf("could not migrate redeem queue: %w", err)
+	}
+	if err := m.migrateBanList(userID); err != nil {
+		return fmt.Errorf("could not migrate ban list: %w", err)
+	}
+
+	migration = UserIDMigration{
+		Date:     time.Now(),
+		Migrated: len(ids),
+		NotFound: []string{},
+	}
+	for _, login := range logins {
+		if _, ok := ids[login]; !ok {
+			migration.NotFound = append(migration.NotFound, login)
+		}
+	}
+	m.logger.Info("Moved loyalty data to user IDs", zap.Int("users", migration.Migrated), zap.Strings("not-found", migration.NotFound))
+	return m.db.PutJSON(UserIDMigrationKey, migration)
+}
+
+func (m *Manager) migratePoints(userID func(string) (string, bool)) error {
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
+	entries := make(map[string]any)
+	var old []string
+	for user, entry := range m.points.Copy() {
+		id, ok := userID(user)
+		if !ok {
+			continue
+		}
+		// Viewers might have earned points under their ID before the migration could run
+		merged, _ := m.points.GetKey(id)
+		merged.Points += entry.Points
+		if entry.LastSeen.After(merged.LastSeen) {
+			merged.LastSeen = entry.LastSeen
+		}
+		if entry.LastDecay.After(merged.LastDecay) {
+			merged.LastDecay = entry.LastDecay
+		}
+		m.points.SetKey(id, merged)
+		entries[PointsPrefix+id] = merged
+		old = append(old, user)
+	}
+	if len(entries) < 1 {
+		return nil
+	}
+	if err := m.db.PutJSONBulk(entries); err != nil {
+		return err
+	}
+	for _, user := range old {
+		m.points.DeleteKey(user)
+		if err := m.db.RemoveKey(PointsPrefix + user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) migrateWatchTime(userID func(string) (string, bool)) error {
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
+	entries := make(map[string]any)
+	var old []string
+	for user, entry := range m.watchTime.Copy() {
+		id, ok := userID(user)
+		if !ok {
+			continue
+		}
+		merged, _ := m.watchTime.GetKey(id)
+		merged.Total += entry.Total
+		switch {
+		case merged.StreamID == entry.StreamID:
+			merged.Stream += entry.Stream
+		case entry.LastSeen.After(merged.LastSeen):
+			merged.StreamID = entry.StreamID
+			merged.Stream = entry.Stream
+		}
+		if entry.LastSeen.After(merged.LastSeen) {
+			merged.LastSeen = entry.LastSeen
+		}
+		m.watchTime.SetKey(id, merged)
+		entries[WatchTimePrefix+id] = merged
+		old = append(old, user)
+	}
+	if len(entries) < 1 {
+		return nil
+	}
+	if err := m.db.PutJSONBulk(entries); err != nil {
+		return err
+	}
+	for _, user := range old {
+		m.watchTime.DeleteKey(user)
+		if err := m.db.RemoveKey(WatchTimePrefix + user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) migrateGoals(userID func(string) (string, bool)) error {
+	m.goalMux.Lock()
+	defer m.goalMux.Unlock()
+
+	goals := m.Goals.Copy()
+	changed := false
+	for i, goal := range goals {
+		contributors := make(map[string]int64)
+		for user, points := range goal.Contributors {
+			if id, ok := userID(user); ok {
+				user = id
+				changed = true
+			}
+			contributors[user] += points
+		}
+		goals[i].Contributors = contributors
+	}
+	if !changed {
+		return nil
+	}
+	m.Goals.Set(goals)
+	return m.SaveGoals()
+}
+
+func (m *Manager) migrateQueue(userID func(string) (string, bool)) error {
+	queue := m.Queue.Get()
+	changed := false
+	for i, redeem := range queue {
+		if redeem.UserID != "" {
+			continue
+		}
+		if id, ok := userID(redeem.Username); ok {
+			queue[i].UserID = id
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	m.Queue.Set(queue)
+	return m.saveQueue()
+}
+
+func (m *Manager) migrateBanList(userID func(string) (string, bool)) error {
+	config := m.Config.Get()
+	config.BanList = append([]string{}, config.BanList...)
+	changed := false
+	for i, user := range config.BanList {
+		if id, ok := userID(user); ok {
+			config.BanList[i] = id
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	// Saving the config reloads it (and the ban list) through the key subscription
+	return m.db.PutJSON(ConfigKey, config)
+}
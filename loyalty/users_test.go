@@ -0,0 +1,64 @@
+package loyalty
+
+import (
+	"testing"
+	"time"
+
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
+)
+
+func TestBanList(t *testing.T) {
+	manager := &Manager{}
+	manager.SetBanList([]string{"1234", "@SomeViewer "})
+
+	if !manager.IsBanned("1234", "migrated") {
+		t.Fatal("expected viewer to be banned by user ID")
+	}
+	if !manager.IsBanned("5678", "someviewer") {
+		t.Fatal("expected viewer to be banned by login")
+	}
+	if manager.IsBanned("5678", "") || manager.IsBanned("9999", "other") {
+		t.Fatal("viewer is not in the ban list")
+	}
+}
+
+func TestUserIDMigration(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	// Twitch must be reachable to look up logins
+	db := newMockTwitchDB(t, server)
+
+	// Logins can be all digits, anything saved before the migration is a login
+	err := db.PutJSONBulk(map[string]any{
+		PointsPrefix + "viewer": PointsEntry{Points: 100},
+		PointsPrefix + "12345":  PointsEntry{Points: 50},
+		QueueKey: []Redeem{
+			{Username: "viewer", Reward: Reward{ID: "reward"}, When: time.Now(), Price: 10, Status: RedeemStatusPending},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := newTestManagerWithDB(t, db)
+
+	waitFor(t, "points to be moved", func() bool {
+		points := manager.points.Copy()
+		return len(points) == 2 && points["mock-viewer"].Points == 100 && points["mock-12345"].Points == 50
+	})
+	queue := manager.Queue.Get()
+	if len(queue) != 1 || queue[0].UserID != "mock-viewer" {
+		t.Fatalf("redeem was not moved to the user ID: %+v", queue)
+	}
+
+	// Redeems that could not be moved have no balance to refund to
+	unknown := Redeem{Username: "gone", Reward: Reward{ID: "reward"}, When: time.Now(), Price: 10, Status: RedeemStatusPending}
+	manager.Queue.Set(append(manager.Queue.Copy(), unknown))
+	if err := manager.RejectRedeem(unknown); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manager.points.GetKey(""); ok {
+		t.Fatal("points were refunded to an empty user ID")
+	}
+}
@@ -0,0 +1,100 @@
+package loyalty
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+func (m *Manager) GetWatchTime(user string) WatchTimeEntry {
+	entry, ok := m.watchTime.GetKey(user)
+	if ok {
+		return entry
+	}
+	return WatchTimeEntry{}
+}
+
+// AddWatchTime adds the given duration to the watch time of every user in the list.
+// The per-stream counter is reset for users whose last tracked stream is not the current one.
+func (m *Manager) AddWatchTime(users []string, duration time.Duration, streamID string) error {
+	m.pointsMux.Lock()
+	defer m.pointsMux.Unlock()
+
+	now := time.Now()
+	seconds := int64(duration / time.Second)
+
+	entries := make(map[string]any)
+	for _, user := range users {
+		entry := m.GetWatchTime(user)
+		if entry.StreamID != streamID {
+			entry.StreamID = streamID
+			entry.Stream = 0
+		}
+		entry.Stream += seconds
+		entry.Total += seconds
+		entry.LastSeen = now
+
+		m.watchTime.SetKey(user, entry)
+		entries[WatchTimePrefix+user] = entry
+	}
+
+	if len(entries) < 1 {
+		return nil
+	}
+	return m.db.PutJSONBulk(entries)
+}
+
+// ExportWatchTime writes the watch time of all users as CSV, sorted by total watch time
+func (m *Manager) ExportWatchTime(out io.Writer) error {
+	type row struct {
+		user  string
+		entry WatchTimeEntry
+	}
+	var rows []row
+	for user, entry := range m.watchTime.Copy() {
+		rows = append(rows, row{user, entry})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].entry.Total > rows[j].entry.Total
+	})
+
+	writer := csv.NewWriter(out)
+	if err := writer.Write([]string{"user_id", "user", "total_seconds", "stream_seconds", "stream_id", "last_seen"}); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		err := writer.Write([]string{
+			r.user,
+			m.loginForUserID(r.user),
+			strconv.FormatInt(r.entry.Total, 10),
+			strconv.FormatInt(r.entry.Stream, 10),
+			r.entry.StreamID,
+			r.entry.LastSeen.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// formatWatchTime formats an amount of seconds in a human-readable way (e.g. "1d 3h 20m")
+func formatWatchTime(seconds int64) string {
+	duration := time.Duration(seconds) * time.Second
+	days := int64(duration.Hours()) / 24
+	hours := int64(duration.Hours()) % 24
+	minutes := int64(duration.Minutes()) % 60
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
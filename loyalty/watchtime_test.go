@@ -0,0 +1,185 @@
+package loyalty
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+
+	irc "github.com/gempir/go-twitch-irc/v4"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nicklaw5/helix/v2"
+
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
+)
+
+func TestAddWatchTime(t *testing.T) {
+	manager, db := newTestManager(t)
+
+	if err := manager.AddWatchTime([]string{"1", "2"}, 5*time.Minute, "stream-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.AddWatchTime([]string{"1"}, 5*time.Minute, "stream-1"); err != nil {
+		t.Fatal(err)
+	}
+	if entry := manager.GetWatchTime("1"); entry.Total != 600 || entry.Stream != 600 || entry.StreamID != "stream-1" {
+		t.Fatalf("watch time was not added up: %+v", entry)
+	}
+	if entry := manager.GetWatchTime("2"); entry.Total != 300 || entry.Stream != 300 {
+		t.Fatalf("watch time was not added up: %+v", entry)
+	}
+
+	// A new stream starts counting from zero, the total keeps going
+	if err := manager.AddWatchTime([]string{"1"}, time.Minute, "stream-2"); err != nil {
+		t.Fatal(err)
+	}
+	entry := manager.GetWatchTime("1")
+	if entry.Total != 660 || entry.Stream != 60 || entry.StreamID != "stream-2" {
+		t.Fatalf("stream watch time was not reset: %+v", entry)
+	}
+
+	var saved WatchTimeEntry
+	if err := db.GetJSON(WatchTimePrefix+"1", &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Total != 660 || saved.Stream != 60 {
+		t.Fatalf("watch time was not saved: %+v", saved)
+	}
+}
+
+func TestFormatWatchTime(t *testing.T) {
+	tests := []struct {
+		seconds  int64
+		expected string
+	}{
+		{0, "0m"},
+		{59, "0m"},
+		{20 * 60, "20m"},
+		{3*3600 + 20*60, "3h 20m"},
+		{24 * 3600, "1d 0h 0m"},
+		{27*3600 + 20*60 + 30, "1d 3h 20m"},
+	}
+	for _, test := range tests {
+		if result := formatWatchTime(test.seconds); result != test.expected {
+			t.Errorf("expected %d seconds to be %q, got %q", test.seconds, test.expected, result)
+		}
+	}
+}
+
+func TestExportWatchTime(t *testing.T) {
+	manager, _ := newTestManager(t)
+
+	if err := manager.AddWatchTime([]string{"1", "2"}, time.Minute, "stream-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.AddWatchTime([]string{"2"}, time.Hour, "stream-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := manager.ExportWatchTime(&out); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected header and 2 rows, got %v", rows)
+	}
+	if strings.Join(rows[0], ",") != "user_id,user,total_seconds,stream_seconds,stream_id,last_seen" {
+		t.Fatalf("unexpected header: %v", rows[0])
+	}
+	// Sorted by total watch time, viewers that aren't known are shown by ID
+	if rows[1][0] != "2" || rows[1][1] != "2" || rows[1][2] != "3660" || rows[1][3] != "3660" || rows[1][4] != "stream-1" {
+		t.Fatalf("unexpected first row: %v", rows[1])
+	}
+	if rows[2][0] != "1" || rows[2][2] != "60" {
+		t.Fatalf("unexpected second row: %v", rows[2])
+	}
+	if _, err := time.Parse(time.RFC3339, rows[1][5]); err != nil {
+		t.Fatalf("invalid last seen time: %s", err)
+	}
+}
+
+func TestWatchTimeCommand(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+	server.SetStreams([]helix.Stream{{ID: "stream-1", UserID: server.User.ID, UserLogin: server.User.Login}})
+
+	manager := newTestManagerWithDB(t, newMockTwitchDB(t, server))
+	client := manager.twitchManager.Client()
+	waitFor(t, "stream to be live", client.IsLive)
+	bot := client.Bot
+
+	// Viewer IDs in the mock are their login with a prefix
+	if err := manager.AddWatchTime([]string{"mock-viewer"}, 90*time.Minute, "stream-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.AddWatchTime([]string{"mock-regular"}, 2*time.Hour, "stream-0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.AddWatchTime([]string{"mock-stranger"}, 10*time.Minute, "stream-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	message := func(userID string, name string, text string) irc.PrivateMessage {
+		return irc.PrivateMessage{
+			User:    irc.User{ID: userID, Name: name, DisplayName: name},
+			Channel: server.User.Login,
+			Message: text,
+		}
+	}
+	manager.cmdWatchTime(bot, message("mock-viewer", "Viewer", "!watchtime"))
+	manager.cmdWatchTime(bot, message("mock-viewer", "Viewer", "!watchtime @regular"))
+	manager.cmdWatchTime(bot, message("mock-viewer", "Viewer", "!watchtime newcomer"))
+
+	expected := []string{
+		"Viewer has been watching for 1h 30m this stream (1h 30m in total)",
+		"regular has been watching for 2h 0m in total",
+		"newcomer hasn't been watching yet!",
+	}
+	var sent []string
+	waitFor(t, "command responses", func() bool {
+		sent = nil
+		for _, request := range server.Requests() {
+			if request.Path != "/chat/messages" {
+				continue
+			}
+			var body struct {
+				Message string `json:"message"`
+			}
+			if err := jsoniter.Unmarshal(request.Body, &body); err != nil {
+				t.Fatal(err)
+			}
+			sent = append(sent, body.Message)
+		}
+		return len(sent) >= len(expected)
+	})
+	for i, text := range expected {
+		if sent[i] != text {
+			t.Fatalf("expected response %q, got %q", text, sent[i])
+		}
+	}
+
+	// Templates only use viewers that are already known, they are rendered too often to ask Twitch
+	// (which would find the stranger's ID)
+	tpl, err := bot.MakeTemplate(`{{ watchtime "@Regular" }} {{ watchtime "stranger" }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := tpl.Execute(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "2h 0m 0m" {
+		t.Fatalf("unexpected template output: %q", out.String())
+	}
+
+	// The function is gone with the loyalty commands
+	manager.StopTwitch()
+	if _, err := bot.MakeTemplate(`{{ watchtime "regular" }}`); err == nil {
+		t.Fatal("watchtime function is still available after stopping")
+	}
+}
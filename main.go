@@ -54,6 +54,8 @@ func main() {
 			&cli.StringFlag{Name: "backup-dir", Aliases: []string{"b-dir"}, Usage: "specify backup directory", Value: "backups"},
 			&cli.IntFlag{Name: "backup-interval", Aliases: []string{"b-i"}, Usage: "specify backup interval (in minutes, 0 to disable)", Value: 60},
 			&cli.IntFlag{Name: "max-backups", Aliases: []string{"b-max"}, Usage: "maximum number of backups to keep, older ones will be deleted, set to 0 to keep all", Value: 20},
+			&cli.StringFlag{Name: "secrets-passphrase", Usage: "encrypt secrets (tokens, passwords) in the database with a key derived from this passphrase", EnvVars: []string{"STRIMERTUL_SECRETS_PASSPHRASE"}},
+			&cli.StringFlag{Name: "secrets-keyfile", Usage: "encrypt secrets (tokens, passwords) in the database with a key derived from this file, it will be created if missing", EnvVars: []string{"STRIMERTUL_SECRETS_KEYFILE"}},
 		},
 		Commands: []*cli.Command{
 			{
@@ -71,6 +73,7 @@ func main() {
 				ArgsUsage: "[-f output.json]",
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "file", Aliases: []string{"f"}, Usage: "file to save to", DefaultText: "STDOUT"},
+					&cli.BoolFlag{Name: "include-secrets", Usage: "include secrets in the export (encrypted, requires a passphrase or keyfile), they are left out otherwise"},
 				},
 				Action: cliExport,
 			},
@@ -0,0 +1,60 @@
+package twitch
+
+import (
+	stdsync "sync"
+	"time"
+)
+
+// ChatActivity holds chat metrics over a sliding window of time
+type ChatActivity struct {
+	// Length of the window (in minutes)
+	Window int `json:"window" desc:"Length of the window (in minutes)"`
+
+	// Chat messages sent in the window
+	Messages int `json:"messages" desc:"Chat messages sent in the window"`
+
+	// Unique chatters that sent at least one message in the window
+	Chatters int `json:"chatters" desc:"Unique chatters that sent at least one message in the window"`
+}
+
+type activityEntry struct {
+	time time.Time
+	user string
+}
+
+// activityTracker keeps track of chat messages to compute activity metrics over a sliding window
+type activityTracker struct {
+	mu      stdsync.Mutex
+	entries []activityEntry
+}
+
+func (t *activityTracker) Add(user string, when time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, activityEntry{time: when, user: user})
+}
+
+// Activity returns the metrics for the last window minutes, forgetting messages that are older
+func (t *activityTracker) Activity(now time.Time, window int) ChatActivity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	start := now.Add(-time.Duration(window) * time.Minute)
+	chatters := make(map[string]struct{})
+	entries := t.entries[:0]
+	for _, entry := range t.entries {
+		// Messages can be added slightly out of order, so check all of them
+		if entry.time.Before(start) {
+			continue
+		}
+		entries = append(entries, entry)
+		chatters[entry.user] = struct{}{}
+	}
+	t.entries = entries
+
+	return ChatActivity{
+		Window:   window,
+		Messages: len(entries),
+		Chatters: len(chatters),
+	}
+}
@@ -0,0 +1,35 @@
+package twitch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActivityTracker(t *testing.T) {
+	now := time.Date(2023, 11, 12, 15, 0, 0, 0, time.UTC)
+	tracker := activityTracker{}
+	tracker.Add("old", now.Add(-6*time.Minute))
+	tracker.Add("user1", now.Add(-4*time.Minute))
+	tracker.Add("user1", now.Add(-3*time.Minute))
+	tracker.Add("user2", now.Add(-2*time.Minute))
+	tracker.Add("user1", now.Add(-30*time.Second))
+
+	activity := tracker.Activity(now, 5)
+	if activity.Messages != 4 {
+		t.Errorf("expected 4 messages, got %d", activity.Messages)
+	}
+	if activity.Chatters != 2 {
+		t.Errorf("expected 2 chatters, got %d", activity.Chatters)
+	}
+
+	// Old messages are forgotten
+	activity = tracker.Activity(now, 10)
+	if activity.Messages != 4 {
+		t.Errorf("expected messages out of the window to be removed, got %d", activity.Messages)
+	}
+
+	activity = tracker.Activity(now, 1)
+	if activity.Messages != 1 || activity.Chatters != 1 {
+		t.Errorf("expected 1 message from 1 chatter, got %d from %d", activity.Messages, activity.Chatters)
+	}
+}
@@ -0,0 +1,394 @@
+package twitch
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+var ErrAlertNotFound = errors.New("alert not found")
+
+// AlertQueue holds alerts until an overlay has shown them, one at a time
+type AlertQueue struct {
+	db     *database.LocalDBClient
+	logger *zap.Logger
+
+	mu             sync.Mutex
+	queue          []Alert
+	history        []Alert
+	hypeTrainLevel int
+	lastID         int64
+
+	cancelSubs []database.CancelFunc
+}
+
+func NewAlertQueue(db *database.LocalDBClient, logger *zap.Logger) *AlertQueue {
+	queue := &AlertQueue{
+		db:      db,
+		logger:  logger,
+		queue:   []Alert{},
+		history: []Alert{},
+	}
+
+	// Restore alerts that weren't shown before the last shutdown
+	if err := db.GetJSON(AlertQueueKey, &queue.queue); err != nil && !errors.Is(err, database.ErrEmptyKey) {
+		logger.Warn("Could not load alert queue", zap.Error(err))
+	}
+	if err := db.GetJSON(AlertHistoryKey, &queue.history); err != nil && !errors.Is(err, database.ErrEmptyKey) {
+		logger.Warn("Could not load alert history", zap.Error(err))
+	}
+	if len(queue.queue) > 0 {
+		queue.publishCurrent()
+	}
+
+	subscriptions := map[string]func(string){
+		EventSubEventKey: queue.onEventSubEvent,
+		AckAlertRPC: func(value string) {
+			queue.handleRPC(AckAlertRPC, value, queue.Ack)
+		},
+		SkipAlertRPC: func(value string) {
+			queue.handleRPC(SkipAlertRPC, value, queue.Skip)
+		},
+		ReplayAlertRPC: func(value string) {
+			queue.handleRPC(ReplayAlertRPC, value, queue.Replay)
+		},
+	}
+	for key, handler := range subscriptions {
+		err, cancel := db.SubscribeKey(key, handler)
+		if err != nil {
+			logger.Error("Could not setup alert queue subscription", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		queue.cancelSubs = append(queue.cancelSubs, cancel)
+	}
+
+	return queue
+}
+
+func (q *AlertQueue) handleRPC(key string, value string, fn func(string) error) {
+	var id string
+	if err := json.UnmarshalFromString(value, &id); err != nil {
+		q.logger.Warn("Invalid alert RPC payload", zap.String("key", key), zap.Error(err))
+		return
+	}
+	if err := fn(id); err != nil {
+		q.logger.Warn("Could not process alert RPC", zap.String("key", key), zap.String("alert-id", id), zap.Error(err))
+	}
+}
+
+// Current returns the alert that should be on screen, the second value is false if the queue is empty
+func (q *AlertQueue) Current() (Alert, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queue) < 1 {
+		return Alert{}, false
+	}
+	return q.queue[0], true
+}
+
+// Pending returns all alerts waiting to be shown, including the current one
+func (q *AlertQueue) Pending() []Alert {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Alert{}, q.queue...)
+}
+
+// Push adds an alert at the end of the queue
+func (q *AlertQueue) Push(alert Alert) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if alert.ID == "" {
+		// Clocks might not have enough resolution for alerts that come in at the same time
+		q.lastID = max(q.lastID+1, time.Now().UnixNano())
+		alert.ID = strconv.FormatInt(q.lastID, 36)
+	}
+	q.queue = append(q.queue, alert)
+	if len(q.queue) > AlertQueueMaxSize {
+		// Drop the oldest alerts that aren't currently on screen
+		dropped := len(q.queue) - AlertQueueMaxSize
+		q.logger.Warn("Alert queue is full, dropping oldest alerts", zap.Int("dropped", dropped))
+		q.queue = append(q.queue[:1], q.queue[1+dropped:]...)
+	}
+
+	// If it's the only alert, it goes on screen right away
+	if len(q.queue) == 1 {
+		q.publishCurrent()
+	}
+	return q.save()
+}
+
+// Ack marks the current alert as shown and moves on to the next one
+func (q *AlertQueue) Ack(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Only the alert on screen can be acknowledged
+	if len(q.queue) < 1 || q.queue[0].ID != id {
+		return ErrAlertNotFound
+	}
+	q.remove(0, false)
+	return q.save()
+}
+
+// Skip removes an alert from the queue without showing it, if no ID is given the current alert is skipped
+func (q *AlertQueue) Skip(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for index, alert := range q.queue {
+		if id != "" && alert.ID != id {
+			continue
+		}
+		q.remove(index, true)
+		return q.save()
+	}
+	return ErrAlertNotFound
+}
+
+// Replay adds a copy of an alert that was already shown at the end of the queue
+func (q *AlertQueue) Replay(id string) error {
+	q.mu.Lock()
+	var replay *Alert
+	for _, alert := range q.history {
+		if alert.ID == id {
+			found := alert
+			replay = &found
+			break
+		}
+	}
+	q.mu.Unlock()
+	if replay == nil {
+		return ErrAlertNotFound
+	}
+
+	replay.ID = ""
+	replay.Replay = true
+	replay.Skipped = false
+	return q.Push(*replay)
+}
+
+// remove takes an alert out of the queue and into the history, must be called with the lock held
+func (q *AlertQueue) remove(index int, skipped bool) {
+	alert := q.queue[index]
+	alert.Skipped = skipped
+	q.queue = append(q.queue[:index], q.queue[index+1:]...)
+
+	q.history = append(q.history, alert)
+	if len(q.history) > AlertHistorySize {
+		q.history = q.history[len(q.history)-AlertHistorySize:]
+	}
+
+	// Removing the current alert puts the next one on screen
+	if index == 0 && len(q.queue) > 0 {
+		q.publishCurrent()
+	}
+}
+
+func (q *AlertQueue) publishCurrent() {
+	if err := q.db.PutJSON(AlertEventKey, q.queue[0]); err != nil {
+		q.logger.Error("Could not publish alert", zap.String("key", AlertEventKey), zap.Error(err))
+	}
+}
+
+func (q *AlertQueue) save() error {
+	return q.db.PutJSONBulk(map[string]any{
+		AlertQueueKey:   q.queue,
+		AlertHistoryKey: q.history,
+	})
+}
+
+func (q *AlertQueue) onEventSubEvent(value string) {
+	var notification NotificationMessagePayload
+	if err := json.UnmarshalFromString(value, &notification); err != nil {
+		q.logger.Warn("Error parsing EventSub notification for alert queue", zap.Error(err))
+		return
+	}
+
+	alert, ok, err := q.normalize(notification)
+	if err != nil {
+		q.logger.Warn("Error parsing EventSub event for alert queue", zap.String("type", notification.Subscription.Type), zap.Error(err))
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if err := q.Push(alert); err != nil {
+		q.logger.Error("Could not save alert queue", zap.Error(err))
+	}
+}
+
+// normalize converts an EventSub notification to an alert, the second value is false for notifications that are not alerts
+func (q *AlertQueue) normalize(notification NotificationMessagePayload) (Alert, bool, error) {
+	alert := Alert{
+		Date:  notification.Date,
+		Event: notification,
+	}
+	if alert.Date.IsZero() {
+		alert.Date = time.Now()
+	}
+	event := notification.Event
+
+	switch notification.Subscription.Type {
+	case helix.EventSubTypeChannelFollow:
+		var ev helix.EventSubChannelFollowEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		alert.Type = AlertTypeFollow
+		alert.User, alert.UserID = ev.UserName, ev.UserID
+	case helix.EventSubTypeChannelSubscription:
+		var ev helix.EventSubChannelSubscribeEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		// Gifted subscriptions are already announced by the gift alert, one for the whole batch
+		if ev.IsGift {
+			return alert, false, nil
+		}
+		alert.Type = AlertTypeSubscription
+		alert.User, alert.UserID = ev.UserName, ev.UserID
+		alert.Amount = 1
+		alert.Variation = "new"
+	case helix.EventSubTypeChannelSubscriptionMessage:
+		var ev helix.EventSubChannelSubscriptionMessageEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		alert.Type = AlertTypeSubscription
+		alert.User, alert.UserID = ev.UserName, ev.UserID
+		alert.Amount = ev.CumulativeMonths
+		alert.Message = ev.Message.Text
+		alert.Variation = "resub"
+	case helix.EventSubTypeChannelSubscriptionGift:
+		var ev helix.EventSubChannelSubscriptionGiftEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		alert.Type = AlertTypeGiftSub
+		if ev.IsAnonymous {
+			alert.Variation = "anonymous"
+		} else {
+			alert.User, alert.UserID = ev.UserName, ev.UserID
+		}
+		alert.Amount = ev.Total
+	case helix.EventSubTypeChannelRaid:
+		var ev helix.EventSubChannelRaidEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		alert.Type = AlertTypeRaid
+		alert.User, alert.UserID = ev.FromBroadcasterUserName, ev.FromBroadcasterUserID
+		alert.Amount = ev.Viewers
+	case helix.EventSubTypeChannelCheer:
+		var ev helix.EventSubChannelCheerEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		alert.Type = AlertTypeCheer
+		if ev.IsAnonymous {
+			alert.Variation = "anonymous"
+		} else {
+			alert.User, alert.UserID = ev.UserName, ev.UserID
+		}
+		alert.Amount = ev.Bits
+		alert.Message = ev.Message
+	case helix.EventSubTypeChannelPointsCustomRewardRedemptionAdd:
+		var ev helix.EventSubChannelPointsCustomRewardRedemptionEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		alert.Type = AlertTypeRedemption
+		alert.User, alert.UserID = ev.UserName, ev.UserID
+		alert.Amount = ev.Reward.Cost
+		alert.Message = ev.UserInput
+		alert.Variation = ev.Reward.Title
+	case helix.EventSubTypeHypeTrainBegin, helix.EventSubTypeHypeTrainProgress:
+		ev := helix.EventSubHypeTrainProgressEvent{Level: 1}
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		// Only starting and reaching a new level are alerts, not every contribution
+		q.mu.Lock()
+		begin := notification.Subscription.Type == helix.EventSubTypeHypeTrainBegin
+		if begin {
+			q.hypeTrainLevel = 0
+		}
+		levelUp := ev.Level > q.hypeTrainLevel
+		q.hypeTrainLevel = max(q.hypeTrainLevel, ev.Level)
+		q.mu.Unlock()
+		if !levelUp {
+			return alert, false, nil
+		}
+		alert.Type = AlertTypeHypeTrain
+		alert.Amount = ev.Level
+		alert.Variation = "level"
+		if begin {
+			alert.Variation = "begin"
+		}
+	case helix.EventSubTypeHypeTrainEnd:
+		var ev helix.EventSubHypeTrainEndEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		q.mu.Lock()
+		q.hypeTrainLevel = 0
+		q.mu.Unlock()
+		alert.Type = AlertTypeHypeTrain
+		alert.Amount = ev.Level
+		alert.Variation = "end"
+	case helix.EventSubTypeChannelPollEnd:
+		var ev helix.EventSubChannelPollEndEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		if ev.Status != "completed" {
+			return alert, false, nil
+		}
+		var winner helix.PollChoice
+		for _, choice := range ev.Choices {
+			alert.Amount += choice.Votes
+			if choice.Votes > winner.Votes {
+				winner = choice
+			}
+		}
+		alert.Type = AlertTypePoll
+		alert.Message = ev.Title
+		alert.Variation = winner.Title
+	case helix.EventSubTypeChannelPredictionEnd:
+		var ev helix.EventSubChannelPredictionEndEvent
+		if err := json.Unmarshal(event, &ev); err != nil {
+			return alert, false, err
+		}
+		if ev.Status != "resolved" {
+			return alert, false, nil
+		}
+		for _, outcome := range ev.Outcomes {
+			alert.Amount += outcome.ChannelPoints
+			if outcome.ID == ev.WinningOutcomeID {
+				alert.Variation = outcome.Title
+			}
+		}
+		alert.Type = AlertTypePrediction
+		alert.Message = ev.Title
+	default:
+		return alert, false, nil
+	}
+
+	return alert, true, nil
+}
+
+func (q *AlertQueue) Close() {
+	for _, cancel := range q.cancelSubs {
+		if cancel != nil {
+			cancel()
+		}
+	}
+}
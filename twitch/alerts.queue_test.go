@@ -0,0 +1,87 @@
+package twitch
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+func TestAlertQueue(t *testing.T) {
+	client, _ := database.CreateInMemoryLocalClient(t)
+	defer database.CleanupLocalClient(client)
+
+	queue := NewAlertQueue(client, zaptest.NewLogger(t))
+	defer queue.Close()
+
+	for _, user := range []string{"first", "second", "third"} {
+		if err := queue.Push(Alert{Type: AlertTypeFollow, User: user}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	current, ok := queue.Current()
+	if !ok || current.User != "first" {
+		t.Fatalf("expected first alert to be on screen, got %+v", current)
+	}
+
+	// Only the alert on screen can be acknowledged
+	pending := queue.Pending()
+	if err := queue.Ack(pending[1].ID); !errors.Is(err, ErrAlertNotFound) {
+		t.Fatalf("expected acknowledging a queued alert to fail, got %v", err)
+	}
+	if err := queue.Ack(current.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skipping with no ID skips the current alert
+	if err := queue.Skip(""); err != nil {
+		t.Fatal(err)
+	}
+	current, _ = queue.Current()
+	if current.User != "third" {
+		t.Fatalf("expected third alert to be on screen, got %+v", current)
+	}
+
+	var saved Alert
+	if err := client.GetJSON(AlertEventKey, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.ID != current.ID {
+		t.Fatalf("expected current alert to be published, got %+v", saved)
+	}
+
+	// Replays go at the end of the queue
+	if err := queue.Replay(pending[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	pending = queue.Pending()
+	if len(pending) != 2 || pending[1].User != "first" || !pending[1].Replay {
+		t.Fatalf("expected replayed alert at the end of the queue, got %+v", pending)
+	}
+}
+
+func TestAlertQueueGiftedSubscriptions(t *testing.T) {
+	client, _ := database.CreateInMemoryLocalClient(t)
+	defer database.CleanupLocalClient(client)
+
+	queue := NewAlertQueue(client, zaptest.NewLogger(t))
+	defer queue.Close()
+
+	// A gift bomb sends one gift event and a subscribe event for every recipient
+	queue.onEventSubEvent(`{"subscription":{"type":"channel.subscription.gift"},"event":{"user_id":"1","user_name":"Gifter","total":3}}`)
+	for _, user := range []string{"2", "3", "4"} {
+		queue.onEventSubEvent(`{"subscription":{"type":"channel.subscribe"},"event":{"user_id":"` + user + `","is_gift":true}}`)
+	}
+	queue.onEventSubEvent(`{"subscription":{"type":"channel.subscribe"},"event":{"user_id":"5","user_name":"Subscriber","is_gift":false}}`)
+
+	pending := queue.Pending()
+	if len(pending) != 2 {
+		t.Fatalf("expected one gift and one subscription alert, got %+v", pending)
+	}
+	if pending[0].Type != AlertTypeGiftSub || pending[0].Amount != 3 || pending[1].Type != AlertTypeSubscription || pending[1].User != "Subscriber" {
+		t.Fatalf("unexpected alerts: %+v", pending)
+	}
+}
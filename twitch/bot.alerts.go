@@ -3,6 +3,7 @@ package twitch
 import (
 	"bytes"
 	"math/rand"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -20,6 +21,7 @@ type eventSubNotification struct {
 	Subscription helix.EventSubSubscription `json:"subscription"`
 	Challenge    string                     `json:"challenge"`
 	Event        jsoniter.RawMessage        `json:"event" desc:"Event payload, as JSON object"`
+	Synthetic    bool                       `json:"synthetic"`
 }
 
 type subscriptionVariation struct {
@@ -44,6 +46,27 @@ type cheerVariation struct {
 	Messages  []string `json:"messages" desc:"List of message to write on cheer, one at random will be picked"`
 }
 
+type redemptionVariation struct {
+	Reward   *string  `json:"reward,omitempty" desc:"Title or ID of the reward to get this message for"`
+	MinCost  *int     `json:"min_cost,omitempty" desc:"Minimum reward cost to get this message"`
+	Messages []string `json:"messages" desc:"List of message to write on redemption, one at random will be picked"`
+}
+
+type hypeTrainVariation struct {
+	MinLevel *int     `json:"min_level,omitempty" desc:"Minimum hype train level to get this message"`
+	Messages []string `json:"messages" desc:"List of message to write on hype train level up, one at random will be picked"`
+}
+
+type pollVariation struct {
+	MinVotes *int     `json:"min_votes,omitempty" desc:"Minimum number of total votes to get this message"`
+	Messages []string `json:"messages" desc:"List of message to write when a poll ends, one at random will be picked"`
+}
+
+type predictionVariation struct {
+	MinPoints *int     `json:"min_points,omitempty" desc:"Minimum amount of channel points wagered to get this message"`
+	Messages  []string `json:"messages" desc:"List of message to write when a prediction is resolved, one at random will be picked"`
+}
+
 type BotAlertsConfig struct {
 	Follow struct {
 		Enabled  bool     `json:"enabled" desc:"Enable chat message alert on follow"`
@@ -69,6 +92,52 @@ type BotAlertsConfig struct {
 		Messages   []string         `json:"messages" desc:"List of message to write on cheer, one at random will be picked"`
 		Variations []cheerVariation `json:"variations"`
 	} `json:"cheer"`
+	Redemption struct {
+		Enabled    bool                  `json:"enabled" desc:"Enable chat message alert on channel point redemption"`
+		Messages   []string              `json:"messages" desc:"List of message to write on channel point redemption, one at random will be picked"`
+		Variations []redemptionVariation `json:"variations"`
+	} `json:"redemption"`
+	HypeTrain struct {
+		Enabled     bool                 `json:"enabled" desc:"Enable chat message alert on hype train start and level up"`
+		Messages    []string             `json:"messages" desc:"List of message to write on hype train start and level up, one at random will be picked"`
+		Variations  []hypeTrainVariation `json:"variations"`
+		EndMessages []string             `json:"end_messages" desc:"List of message to write when the hype train ends, one at random will be picked"`
+	} `json:"hype_train"`
+	Poll struct {
+		Enabled    bool            `json:"enabled" desc:"Enable chat message alert when a poll ends"`
+		Messages   []string        `json:"messages" desc:"List of message to write when a poll ends, one at random will be picked"`
+		Variations []pollVariation `json:"variations"`
+	} `json:"poll"`
+	Prediction struct {
+		Enabled    bool                  `json:"enabled" desc:"Enable chat message alert when a prediction is resolved"`
+		Messages   []string              `json:"messages" desc:"List of message to write when a prediction is resolved, one at random will be picked"`
+		Variations []predictionVariation `json:"variations"`
+	} `json:"prediction"`
+	StreamOnline struct {
+		Enabled  bool     `json:"enabled" desc:"Enable chat message alert when the stream starts"`
+		Messages []string `json:"messages" desc:"List of message to write when the stream starts, one at random will be picked"`
+	} `json:"stream_online"`
+	StreamOffline struct {
+		Enabled  bool     `json:"enabled" desc:"Enable chat message alert when the stream ends"`
+		Messages []string `json:"messages" desc:"List of message to write when the stream ends, one at random will be picked"`
+	} `json:"stream_offline"`
+
+	// Channels to write alerts in (leave empty for the main channel)
+	Channels []string `json:"channels,omitempty" desc:"Channels to write alerts in (leave empty for the main channel)"`
+}
+
+// PollEndAlertData is the data available to poll alert templates
+type PollEndAlertData struct {
+	helix.EventSubChannelPollEndEvent
+	Winner     helix.PollChoice
+	TotalVotes int
+}
+
+// PredictionEndAlertData is the data available to prediction alert templates
+type PredictionEndAlertData struct {
+	helix.EventSubChannelPredictionEndEvent
+	Winner      helix.EventSubOutcome
+	TotalPoints int
 }
 
 type (
@@ -84,6 +153,13 @@ const (
 	templateTypeRaid         templateType = "raid"
 	templateTypeCheer        templateType = "cheer"
 	templateTypeGift         templateType = "gift"
+	templateTypeRedemption   templateType = "redemption"
+	templateTypeHypeTrain    templateType = "hype_train"
+	templateTypeHypeTrainEnd templateType = "hype_train_end"
+	templateTypePoll         templateType = "poll"
+	templateTypePrediction   templateType = "prediction"
+	templateTypeOnline       templateType = "stream_online"
+	templateTypeOffline      templateType = "stream_offline"
 )
 
 type BotAlertsModule struct {
@@ -97,6 +173,9 @@ type BotAlertsModule struct {
 
 	pendingMux  sync.Mutex
 	pendingSubs map[string]subMixedEvent
+
+	hypeTrainMux   sync.Mutex
+	hypeTrainLevel int
 }
 
 func SetupAlerts(bot *Bot) *BotAlertsModule {
@@ -167,9 +246,9 @@ func (m *BotAlertsModule) onEventSubEvent(value string) {
 		messageID := rand.Intn(len(m.Config.Follow.Messages))
 		// Pick compiled template or fallback to plain text
 		if tpl, ok := m.templates[templateTypeFollow][m.Config.Follow.Messages[messageID]]; ok {
-			writeTemplate(m.bot, tpl, &followEv)
+			writeTemplate(m.bot, tpl, &followEv, MessagePriorityNormal, m.Config.Channels...)
 		} else {
-			m.bot.WriteMessage(m.Config.Follow.Messages[messageID])
+			m.writeMessage(m.Config.Follow.Messages[messageID])
 		}
 		// Compile template and send
 	case helix.EventSubTypeChannelRaid:
@@ -189,7 +268,7 @@ func (m *BotAlertsModule) onEventSubEvent(value string) {
 		tpl, ok := m.templates[templateTypeRaid][m.Config.Raid.Messages[messageID]]
 		if !ok {
 			// Broken template!
-			m.bot.WriteMessage(m.Config.Raid.Messages[messageID])
+			m.writeMessage(m.Config.Raid.Messages[messageID])
 			return
 		}
 		// If we have variations, get the available variations and pick the one with the highest minimum viewers that are met
@@ -203,7 +282,7 @@ func (m *BotAlertsModule) onEventSubEvent(value string) {
 			tpl = m.replaceWithVariation(tpl, templateTypeRaid, variation.Messages)
 		}
 		// Compile template and send
-		writeTemplate(m.bot, tpl, &raidEv)
+		writeTemplate(m.bot, tpl, &raidEv, MessagePriorityNormal, m.Config.Channels...)
 	case helix.EventSubTypeChannelCheer:
 		// Only process if we care about bits
 		if !m.Config.Cheer.Enabled {
@@ -221,7 +300,7 @@ func (m *BotAlertsModule) onEventSubEvent(value string) {
 		tpl, ok := m.templates[templateTypeCheer][m.Config.Cheer.Messages[messageID]]
 		if !ok {
 			// Broken template!
-			m.bot.WriteMessage(m.Config.Raid.Messages[messageID])
+			m.writeMessage(m.Config.Raid.Messages[messageID])
 			return
 		}
 		// If we have variations, get the available variations and pick the one with the highest minimum amount that is met
@@ -235,7 +314,7 @@ func (m *BotAlertsModule) onEventSubEvent(value string) {
 			tpl = m.replaceWithVariation(tpl, templateTypeCheer, variation.Messages)
 		}
 		// Compile template and send
-		writeTemplate(m.bot, tpl, &cheerEv)
+		writeTemplate(m.bot, tpl, &cheerEv, MessagePriorityNormal, m.Config.Channels...)
 	case helix.EventSubTypeChannelSubscription:
 		// Only process if we care about subscriptions
 		if !m.Config.Subscription.Enabled {
@@ -279,7 +358,7 @@ func (m *BotAlertsModule) onEventSubEvent(value string) {
 		tpl, ok := m.templates[templateTypeGift][m.Config.GiftSub.Messages[messageID]]
 		if !ok {
 			// Broken template!
-			m.bot.WriteMessage(m.Config.GiftSub.Messages[messageID])
+			m.writeMessage(m.Config.GiftSub.Messages[messageID])
 			return
 		}
 		// If we have variations, loop through all the available variations and pick the one with the highest minimum cumulative total that are met
@@ -303,12 +382,206 @@ func (m *BotAlertsModule) onEventSubEvent(value string) {
 			}
 		}
 		// Compile template and send
-		writeTemplate(m.bot, tpl, &giftEv)
+		writeTemplate(m.bot, tpl, &giftEv, MessagePriorityNormal, m.Config.Channels...)
+	case helix.EventSubTypeChannelPointsCustomRewardRedemptionAdd:
+		// Only process if we care about redemptions
+		if !m.Config.Redemption.Enabled {
+			return
+		}
+		var redemptionEv helix.EventSubChannelPointsCustomRewardRedemptionEvent
+		err := json.Unmarshal(ev.Event, &redemptionEv)
+		if err != nil {
+			m.bot.logger.Warn("Error parsing redemption event", zap.Error(err))
+			return
+		}
+		m.onRedemption(redemptionEv)
+	case helix.EventSubTypeHypeTrainBegin, helix.EventSubTypeHypeTrainProgress:
+		// Only process if we care about hype trains
+		if !m.Config.HypeTrain.Enabled {
+			return
+		}
+		// Begin events are the same as progress ones, minus the level (which is always 1)
+		hypeEv := helix.EventSubHypeTrainProgressEvent{Level: 1}
+		err := json.Unmarshal(ev.Event, &hypeEv)
+		if err != nil {
+			m.bot.logger.Warn("Error parsing hype train event", zap.Error(err))
+			return
+		}
+		m.onHypeTrainProgress(hypeEv, ev.Subscription.Type == helix.EventSubTypeHypeTrainBegin)
+	case helix.EventSubTypeHypeTrainEnd:
+		// Only process if we care about hype trains
+		if !m.Config.HypeTrain.Enabled {
+			return
+		}
+		var hypeEv helix.EventSubHypeTrainEndEvent
+		err := json.Unmarshal(ev.Event, &hypeEv)
+		if err != nil {
+			m.bot.logger.Warn("Error parsing hype train end event", zap.Error(err))
+			return
+		}
+		m.hypeTrainMux.Lock()
+		m.hypeTrainLevel = 0
+		m.hypeTrainMux.Unlock()
+		m.writeAlert(templateTypeHypeTrainEnd, m.Config.HypeTrain.EndMessages, nil, &hypeEv)
+	case helix.EventSubTypeChannelPollEnd:
+		// Only process if we care about polls
+		if !m.Config.Poll.Enabled {
+			return
+		}
+		var pollEv helix.EventSubChannelPollEndEvent
+		err := json.Unmarshal(ev.Event, &pollEv)
+		if err != nil {
+			m.bot.logger.Warn("Error parsing poll end event", zap.Error(err))
+			return
+		}
+		m.onPollEnd(pollEv)
+	case helix.EventSubTypeChannelPredictionEnd:
+		// Only process if we care about predictions
+		if !m.Config.Prediction.Enabled {
+			return
+		}
+		var predictionEv helix.EventSubChannelPredictionEndEvent
+		err := json.Unmarshal(ev.Event, &predictionEv)
+		if err != nil {
+			m.bot.logger.Warn("Error parsing prediction end event", zap.Error(err))
+			return
+		}
+		m.onPredictionEnd(predictionEv)
+	case helix.EventSubTypeStreamOnline:
+		// Only process if we care about the stream starting
+		if !m.Config.StreamOnline.Enabled {
+			return
+		}
+		var onlineEv helix.EventSubStreamOnlineEvent
+		err := json.Unmarshal(ev.Event, &onlineEv)
+		if err != nil {
+			m.bot.logger.Warn("Error parsing stream online event", zap.Error(err))
+			return
+		}
+		m.writeAlert(templateTypeOnline, m.Config.StreamOnline.Messages, nil, &onlineEv)
+	case helix.EventSubTypeStreamOffline:
+		// Only process if we care about the stream ending
+		if !m.Config.StreamOffline.Enabled {
+			return
+		}
+		var offlineEv helix.EventSubStreamOfflineEvent
+		err := json.Unmarshal(ev.Event, &offlineEv)
+		if err != nil {
+			m.bot.logger.Warn("Error parsing stream offline event", zap.Error(err))
+			return
+		}
+		m.writeAlert(templateTypeOffline, m.Config.StreamOffline.Messages, nil, &offlineEv)
 	}
 }
 
+func (m *BotAlertsModule) onRedemption(redemptionEv helix.EventSubChannelPointsCustomRewardRedemptionEvent) {
+	// Variations for a specific reward take precedence over the ones based on cost
+	variation := getBestValidVariation(m.Config.Redemption.Variations, func(variation redemptionVariation) int {
+		if variation.Reward != nil && (*variation.Reward == redemptionEv.Reward.ID || strings.EqualFold(*variation.Reward, redemptionEv.Reward.Title)) {
+			return 1
+		}
+		return 0
+	})
+	if variation.Messages == nil {
+		variation = getBestValidVariation(m.Config.Redemption.Variations, func(variation redemptionVariation) int {
+			if variation.Reward == nil && variation.MinCost != nil && redemptionEv.Reward.Cost >= *variation.MinCost {
+				// Offset by one so free rewards can still have a variation
+				return *variation.MinCost + 1
+			}
+			return 0
+		})
+	}
+	m.writeAlert(templateTypeRedemption, m.Config.Redemption.Messages, variation.Messages, &redemptionEv)
+}
+
+func (m *BotAlertsModule) onHypeTrainProgress(hypeEv helix.EventSubHypeTrainProgressEvent, begin bool) {
+	// Only write on start and when a new level is reached, not on every contribution
+	m.hypeTrainMux.Lock()
+	if begin {
+		m.hypeTrainLevel = 0
+	}
+	if hypeEv.Level <= m.hypeTrainLevel {
+		m.hypeTrainMux.Unlock()
+		return
+	}
+	m.hypeTrainLevel = hypeEv.Level
+	m.hypeTrainMux.Unlock()
+
+	variation := getBestValidVariation(m.Config.HypeTrain.Variations, func(variation hypeTrainVariation) int {
+		if variation.MinLevel != nil && hypeEv.Level >= *variation.MinLevel {
+			return *variation.MinLevel
+		}
+		return 0
+	})
+	m.writeAlert(templateTypeHypeTrain, m.Config.HypeTrain.Messages, variation.Messages, &hypeEv)
+}
+
+func (m *BotAlertsModule) onPollEnd(pollEv helix.EventSubChannelPollEndEvent) {
+	// Archived and terminated polls have no winner to announce
+	if pollEv.Status != "completed" {
+		return
+	}
+
+	data := PollEndAlertData{EventSubChannelPollEndEvent: pollEv}
+	for _, choice := range pollEv.Choices {
+		data.TotalVotes += choice.Votes
+		if choice.Votes > data.Winner.Votes {
+			data.Winner = choice
+		}
+	}
+
+	variation := getBestValidVariation(m.Config.Poll.Variations, func(variation pollVariation) int {
+		if variation.MinVotes != nil && data.TotalVotes >= *variation.MinVotes {
+			return *variation.MinVotes + 1
+		}
+		return 0
+	})
+	m.writeAlert(templateTypePoll, m.Config.Poll.Messages, variation.Messages, &data)
+}
+
+func (m *BotAlertsModule) onPredictionEnd(predictionEv helix.EventSubChannelPredictionEndEvent) {
+	// Canceled predictions have no winner to announce
+	if predictionEv.Status != "resolved" {
+		return
+	}
+
+	data := PredictionEndAlertData{EventSubChannelPredictionEndEvent: predictionEv}
+	for _, outcome := range predictionEv.Outcomes {
+		data.TotalPoints += outcome.ChannelPoints
+		if outcome.ID == predictionEv.WinningOutcomeID {
+			data.Winner = outcome
+		}
+	}
+
+	variation := getBestValidVariation(m.Config.Prediction.Variations, func(variation predictionVariation) int {
+		if variation.MinPoints != nil && data.TotalPoints >= *variation.MinPoints {
+			return *variation.MinPoints + 1
+		}
+		return 0
+	})
+	m.writeAlert(templateTypePrediction, m.Config.Prediction.Messages, variation.Messages, &data)
+}
+
+// writeAlert picks a random message (from the variation's, if any) and writes it to chat
+func (m *BotAlertsModule) writeAlert(templateType templateType, messages []string, variation []string, data any) {
+	if len(messages) < 1 {
+		return
+	}
+	// Pick a random message from base set
+	messageID := rand.Intn(len(messages))
+	tpl, ok := m.templates[templateType][messages[messageID]]
+	if !ok {
+		// Broken template!
+		m.writeMessage(messages[messageID])
+		return
+	}
+	tpl = m.replaceWithVariation(tpl, templateType, variation)
+	// Compile template and send
+	writeTemplate(m.bot, tpl, data, MessagePriorityNormal, m.Config.Channels...)
+}
+
 func (m *BotAlertsModule) replaceWithVariation(tpl *template.Template, templateType templateType, messages []string) *template.Template {
-	if messages != nil {
+	if len(messages) > 0 {
 		messageID := rand.Intn(len(messages))
 		// Make sure the template is valid
 		if temp, ok := m.templates[templateType][messages[messageID]]; ok {
@@ -398,7 +671,7 @@ func (m *BotAlertsModule) processPendingSub(user string) {
 
 	// If template is broken, write it as is (soft fail, plus we raise attention I guess?)
 	if !ok {
-		m.bot.WriteMessage(m.Config.Subscription.Messages[messageID])
+		m.writeMessage(m.Config.Subscription.Messages[messageID])
 		return
 	}
 
@@ -421,7 +694,7 @@ func (m *BotAlertsModule) processPendingSub(user string) {
 		})
 		tpl = m.replaceWithVariation(tpl, templateTypeSubscription, variation.Messages)
 	}
-	writeTemplate(m.bot, tpl, sub)
+	writeTemplate(m.bot, tpl, sub, MessagePriorityNormal, m.Config.Channels...)
 }
 
 // For variations, some variations are better than others, this function returns the best one
@@ -448,6 +721,13 @@ func (m *BotAlertsModule) compileTemplates() {
 		templateTypeRaid:         make(templateCache),
 		templateTypeCheer:        make(templateCache),
 		templateTypeGift:         make(templateCache),
+		templateTypeRedemption:   make(templateCache),
+		templateTypeHypeTrain:    make(templateCache),
+		templateTypeHypeTrainEnd: make(templateCache),
+		templateTypePoll:         make(templateCache),
+		templateTypePrediction:   make(templateCache),
+		templateTypeOnline:       make(templateCache),
+		templateTypeOffline:      make(templateCache),
 	}
 
 	// Add base templates
@@ -456,6 +736,13 @@ func (m *BotAlertsModule) compileTemplates() {
 	m.addTemplatesForType(templateTypeRaid, m.Config.Raid.Messages)
 	m.addTemplatesForType(templateTypeCheer, m.Config.Cheer.Messages)
 	m.addTemplatesForType(templateTypeGift, m.Config.GiftSub.Messages)
+	m.addTemplatesForType(templateTypeRedemption, m.Config.Redemption.Messages)
+	m.addTemplatesForType(templateTypeHypeTrain, m.Config.HypeTrain.Messages)
+	m.addTemplatesForType(templateTypeHypeTrainEnd, m.Config.HypeTrain.EndMessages)
+	m.addTemplatesForType(templateTypePoll, m.Config.Poll.Messages)
+	m.addTemplatesForType(templateTypePrediction, m.Config.Prediction.Messages)
+	m.addTemplatesForType(templateTypeOnline, m.Config.StreamOnline.Messages)
+	m.addTemplatesForType(templateTypeOffline, m.Config.StreamOffline.Messages)
 
 	// Add variations
 	for _, variation := range m.Config.Subscription.Variations {
@@ -470,6 +757,18 @@ func (m *BotAlertsModule) compileTemplates() {
 	for _, variation := range m.Config.GiftSub.Variations {
 		m.addTemplatesForType(templateTypeGift, variation.Messages)
 	}
+	for _, variation := range m.Config.Redemption.Variations {
+		m.addTemplatesForType(templateTypeRedemption, variation.Messages)
+	}
+	for _, variation := range m.Config.HypeTrain.Variations {
+		m.addTemplatesForType(templateTypeHypeTrain, variation.Messages)
+	}
+	for _, variation := range m.Config.Poll.Variations {
+		m.addTemplatesForType(templateTypePoll, variation.Messages)
+	}
+	for _, variation := range m.Config.Prediction.Variations {
+		m.addTemplatesForType(templateTypePrediction, variation.Messages)
+	}
 }
 
 func (m *BotAlertsModule) addTemplate(templateList templateCache, message string) {
@@ -496,15 +795,24 @@ func (m *BotAlertsModule) Close() {
 	}
 }
 
-// writeTemplate renders the template and sends the message to the channel
-func writeTemplate(bot *Bot, tpl *template.Template, data interface{}) {
+// writeTemplate executes a template and writes the result to the given channels (or the main channel if none)
+func writeTemplate(bot *Bot, tpl *template.Template, data interface{}, priority MessagePriority, channels ...string) {
 	var buf bytes.Buffer
 	err := tpl.Execute(&buf, data)
 	if err != nil {
 		bot.logger.Error("Error executing template for bot alert", zap.Error(err))
 		return
 	}
-	bot.WriteMessage(buf.String())
+	for _, channel := range bot.resolveChannels(channels) {
+		bot.Say(channel, buf.String(), priority)
+	}
+}
+
+// writeMessage writes a message to all the channels alerts are enabled in
+func (m *BotAlertsModule) writeMessage(message string) {
+	for _, channel := range m.bot.resolveChannels(m.Config.Channels) {
+		m.bot.WriteMessageTo(channel, message)
+	}
 }
 
 type subMixedEvent struct {
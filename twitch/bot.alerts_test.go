@@ -0,0 +1,217 @@
+package twitch
+
+import (
+	"testing"
+
+	"github.com/nicklaw5/helix/v2"
+)
+
+// newTestAlerts creates an alert module with the given config, without loading it from the database
+func newTestAlerts(t *testing.T, config BotAlertsConfig) (*BotAlertsModule, *fakeIRCBot) {
+	bot, fake, _ := newTestBot(t, BotConfig{Channel: "main", ModeratorRateLimit: true})
+	mod := &BotAlertsModule{
+		Config:      config,
+		bot:         bot,
+		pendingSubs: make(map[string]subMixedEvent),
+	}
+	mod.compileTemplates()
+	return mod, fake
+}
+
+// alertsSent waits for the given number of alerts and returns them, the module writes "end" after
+// the alerts being checked so that nothing else was sent
+func alertsSent(t *testing.T, mod *BotAlertsModule, fake *fakeIRCBot, count int) []string {
+	mod.writeMessage("end")
+	waitFor(t, "alerts", func() bool {
+		sent := fake.Sent()
+		return len(sent) > 0 && sent[len(sent)-1].message == "end"
+	})
+
+	var messages []string
+	for _, message := range fake.Sent() {
+		if message.message != "end" {
+			messages = append(messages, message.message)
+		}
+	}
+	if len(messages) != count {
+		t.Fatalf("expected %d alerts, got %v", count, messages)
+	}
+	return messages
+}
+
+func TestRedemptionAlertVariations(t *testing.T) {
+	var config BotAlertsConfig
+	config.Redemption.Enabled = true
+	config.Redemption.Messages = []string{"{{.UserName}} redeemed {{.Reward.Title}}"}
+	hydrate := "hydrate"
+	cheap, expensive := 0, 1000
+	config.Redemption.Variations = []redemptionVariation{
+		{MinCost: &cheap, Messages: []string{"{{.UserName}} got something cheap"}},
+		{MinCost: &expensive, Messages: []string{"{{.UserName}} splurged on {{.Reward.Title}}"}},
+		{Reward: &hydrate, Messages: []string{"{{.UserName}} wants you to drink water"}},
+	}
+	mod, fake := newTestAlerts(t, config)
+
+	redemption := func(user string, id string, title string, cost int) helix.EventSubChannelPointsCustomRewardRedemptionEvent {
+		ev := helix.EventSubChannelPointsCustomRewardRedemptionEvent{UserName: user}
+		ev.Reward.ID = id
+		ev.Reward.Title = title
+		ev.Reward.Cost = cost
+		return ev
+	}
+	// Rewards can be matched by title (case-insensitive) or ID, over any cost variation
+	mod.onRedemption(redemption("A", "reward-1", "Hydrate", 5000))
+	mod.onRedemption(redemption("B", "hydrate", "Drink", 10))
+	mod.onRedemption(redemption("C", "reward-2", "Emote only", 2000))
+	mod.onRedemption(redemption("D", "reward-3", "Free", 0))
+
+	expected := []string{
+		"A wants you to drink water",
+		"B wants you to drink water",
+		"C splurged on Emote only",
+		"D got something cheap",
+	}
+	for i, message := range alertsSent(t, mod, fake, len(expected)) {
+		if message != expected[i] {
+			t.Fatalf("expected %q, got %q", expected[i], message)
+		}
+	}
+}
+
+func TestHypeTrainAlertLevels(t *testing.T) {
+	var config BotAlertsConfig
+	config.HypeTrain.Enabled = true
+	config.HypeTrain.Messages = []string{"Hype train level {{.Level}}"}
+	high := 3
+	config.HypeTrain.Variations = []hypeTrainVariation{
+		{MinLevel: &high, Messages: []string{"HUGE hype train, level {{.Level}}"}},
+	}
+	mod, fake := newTestAlerts(t, config)
+
+	// Progress events come for every contribution, only new levels are written
+	mod.onHypeTrainProgress(helix.EventSubHypeTrainProgressEvent{Level: 1}, true)
+	mod.onHypeTrainProgress(helix.EventSubHypeTrainProgressEvent{Level: 1}, false)
+	mod.onHypeTrainProgress(helix.EventSubHypeTrainProgressEvent{Level: 2}, false)
+	mod.onHypeTrainProgress(helix.EventSubHypeTrainProgressEvent{Level: 2}, false)
+	mod.onHypeTrainProgress(helix.EventSubHypeTrainProgressEvent{Level: 3}, false)
+	// Events can arrive late, levels never go back
+	mod.onHypeTrainProgress(helix.EventSubHypeTrainProgressEvent{Level: 2}, false)
+	// A new train starts over
+	mod.onHypeTrainProgress(helix.EventSubHypeTrainProgressEvent{Level: 1}, true)
+
+	expected := []string{
+		"Hype train level 1",
+		"Hype train level 2",
+		"HUGE hype train, level 3",
+		"Hype train level 1",
+	}
+	for i, message := range alertsSent(t, mod, fake, len(expected)) {
+		if message != expected[i] {
+			t.Fatalf("expected %q, got %q", expected[i], message)
+		}
+	}
+}
+
+func TestPollEndAlert(t *testing.T) {
+	var config BotAlertsConfig
+	config.Poll.Enabled = true
+	config.Poll.Messages = []string{"{{.Title}}: {{.Winner.Title}} won with {{.Winner.Votes}} of {{.TotalVotes}} votes"}
+	many := 100
+	config.Poll.Variations = []pollVariation{
+		{MinVotes: &many, Messages: []string{"{{.Title}}: {{.Winner.Title}} won by a landslide"}},
+	}
+	mod, fake := newTestAlerts(t, config)
+
+	mod.onPollEnd(helix.EventSubChannelPollEndEvent{
+		Title:  "Next game",
+		Status: "completed",
+		Choices: []helix.PollChoice{
+			{Title: "Celeste", Votes: 10},
+			{Title: "Hades", Votes: 25},
+			{Title: "Tetris", Votes: 5},
+		},
+	})
+	mod.onPollEnd(helix.EventSubChannelPollEndEvent{
+		Title:  "Snack",
+		Status: "completed",
+		Choices: []helix.PollChoice{
+			{Title: "Chips", Votes: 60},
+			{Title: "Fruit", Votes: 40},
+		},
+	})
+	// Ties go to the first choice with the most votes
+	mod.onPollEnd(helix.EventSubChannelPollEndEvent{
+		Title:  "Tie",
+		Status: "completed",
+		Choices: []helix.PollChoice{
+			{Title: "Low", Votes: 1},
+			{Title: "First", Votes: 7},
+			{Title: "Second", Votes: 7},
+		},
+	})
+	// Polls that were not completed have no winner
+	mod.onPollEnd(helix.EventSubChannelPollEndEvent{
+		Title:   "Terminated",
+		Status:  "terminated",
+		Choices: []helix.PollChoice{{Title: "Nope", Votes: 3}},
+	})
+
+	expected := []string{
+		"Next game: Hades won with 25 of 40 votes",
+		"Snack: Chips won by a landslide",
+		"Tie: First won with 7 of 15 votes",
+	}
+	for i, message := range alertsSent(t, mod, fake, len(expected)) {
+		if message != expected[i] {
+			t.Fatalf("expected %q, got %q", expected[i], message)
+		}
+	}
+}
+
+func TestPredictionEndAlert(t *testing.T) {
+	var config BotAlertsConfig
+	config.Prediction.Enabled = true
+	config.Prediction.Messages = []string{"{{.Title}}: {{.Winner.Title}} won ({{.TotalPoints}} points)"}
+	many := 10000
+	config.Prediction.Variations = []predictionVariation{
+		{MinPoints: &many, Messages: []string{"{{.Title}}: {{.Winner.Title}} won a fortune"}},
+	}
+	mod, fake := newTestAlerts(t, config)
+
+	outcomes := []helix.EventSubOutcome{
+		{ID: "outcome-1", Title: "Yes", ChannelPoints: 300},
+		{ID: "outcome-2", Title: "No", ChannelPoints: 500},
+	}
+	// The winner is the resolved outcome, not the one with the most points
+	mod.onPredictionEnd(helix.EventSubChannelPredictionEndEvent{
+		Title:            "Will we win?",
+		Status:           "resolved",
+		WinningOutcomeID: "outcome-1",
+		Outcomes:         outcomes,
+	})
+	mod.onPredictionEnd(helix.EventSubChannelPredictionEndEvent{
+		Title:            "Big one",
+		Status:           "resolved",
+		WinningOutcomeID: "outcome-2",
+		Outcomes: []helix.EventSubOutcome{
+			{ID: "outcome-1", Title: "Yes", ChannelPoints: 9000},
+			{ID: "outcome-2", Title: "No", ChannelPoints: 1000},
+		},
+	})
+	// Canceled predictions have no winner
+	mod.onPredictionEnd(helix.EventSubChannelPredictionEndEvent{
+		Title:    "Canceled",
+		Status:   "canceled",
+		Outcomes: outcomes,
+	})
+
+	expected := []string{
+		"Will we win?: Yes won (800 points)",
+		"Big one: No won a fortune",
+	}
+	for i, message := range alertsSent(t, mod, fake, len(expected)) {
+		if message != expected[i] {
+			t.Fatalf("expected %q, got %q", expected[i], message)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package twitch
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+
+	irc "github.com/gempir/go-twitch-irc/v4"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+// onClearChatHandler handles chat clears, timeouts and bans
+func (b *Bot) onClearChatHandler(message irc.ClearChatMessage) {
+	if message.TargetUserID == "" && message.TargetUsername == "" {
+		b.logger.Info("Chat was cleared", zap.String("channel", message.Channel))
+		b.removeFromHistory(message.Channel, func(irc.PrivateMessage) bool { return true })
+	} else {
+		b.logger.Debug("User messages were cleared", zap.String("channel", message.Channel), zap.String("username", message.TargetUsername), zap.Int("ban-duration", message.BanDuration))
+		b.removeFromHistory(message.Channel, func(msg irc.PrivateMessage) bool {
+			if message.TargetUserID != "" {
+				return msg.User.ID == message.TargetUserID
+			}
+			return strings.EqualFold(msg.User.Name, message.TargetUsername)
+		})
+	}
+
+	writeChatEvent(b, message.Channel, ChatClearEventKey, ChatClearHistoryKey, message)
+}
+
+// onClearMessageHandler handles single chat messages being deleted
+func (b *Bot) onClearMessageHandler(message irc.ClearMessage) {
+	b.removeFromHistory(message.Channel, func(msg irc.PrivateMessage) bool {
+		return msg.ID == message.TargetMsgID
+	})
+
+	writeChatEvent(b, message.Channel, MessageDeletedEventKey, MessageDeletedHistoryKey, message)
+}
+
+// onUserNoticeHandler handles chat notices (subs, gifts, raids, announcements etc.)
+func (b *Bot) onUserNoticeHandler(message irc.UserNoticeMessage) {
+	writeChatEvent(b, message.Channel, UserNoticeEventKey, UserNoticeHistoryKey, message)
+}
+
+// onRoomStateHandler keeps track of the chat settings, updates only contain the settings that changed
+func (b *Bot) onRoomStateHandler(message irc.RoomStateMessage) {
+	channel := normalizeChannel(message.Channel)
+	if current, ok := b.roomState.GetKey(channel); ok {
+		state := maps.Clone(current.State)
+		if state == nil {
+			state = make(map[string]int)
+		}
+		maps.Copy(state, message.State)
+		message.State = state
+	}
+	b.roomState.SetKey(channel, message)
+
+	key := b.channelKey(RoomStateKey, channel)
+	if err := b.api.db.PutJSON(key, message); err != nil {
+		b.logger.Warn("Could not save room state", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// removeFromHistory removes the messages matching remove from the chat history of a channel
+func (b *Bot) removeFromHistory(channel string, remove func(irc.PrivateMessage) bool) {
+	channel = normalizeChannel(channel)
+	history, ok := b.chatHistory.GetKey(channel)
+	if !ok {
+		return
+	}
+	filtered := slices.DeleteFunc(slices.Clone(history), remove)
+	if len(filtered) == len(history) {
+		return
+	}
+	b.chatHistory.SetKey(channel, filtered)
+	b.histories.Put(b.channelKey(ChatHistoryKey, channel), filtered)
+}
+
+// writeChatEvent sends a chat event and adds it to its history, using the extra channel keys if needed
+func writeChatEvent[T any](b *Bot, channel string, eventKey string, historyKey string, event T) {
+	eventKey = b.channelKey(eventKey, channel)
+	err := b.api.db.PutJSON(eventKey, event)
+	if err != nil {
+		b.logger.Warn("Could not save chat event to key", zap.String("key", eventKey), zap.Error(err))
+	}
+
+	if b.Config.ChatHistory <= 0 {
+		return
+	}
+	// The history is only read from the database the first time, then kept in memory
+	historyKey = b.channelKey(historyKey, channel)
+	var history []T
+	if cached, ok := b.history.GetKey(historyKey); ok {
+		history, _ = cached.([]T)
+	} else {
+		err = b.api.db.GetJSON(historyKey, &history)
+		if err != nil && !errors.Is(err, database.ErrEmptyKey) {
+			b.logger.Warn("Could not read chat event history", zap.String("key", historyKey), zap.Error(err))
+		}
+	}
+	if len(history) >= b.Config.ChatHistory {
+		history = history[len(history)-b.Config.ChatHistory+1:]
+	}
+	history = append(history, event)
+	b.history.SetKey(historyKey, history)
+	b.histories.Put(historyKey, history)
+}
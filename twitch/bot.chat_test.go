@@ -0,0 +1,156 @@
+package twitch
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	irc "github.com/gempir/go-twitch-irc/v4"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+func testMessageFrom(channel string, id string, userID string, text string) irc.PrivateMessage {
+	message := testMessage(channel, text)
+	message.ID = id
+	message.User.ID = userID
+	message.User.Name = "user" + userID
+	return message
+}
+
+func TestBotChatDeletions(t *testing.T) {
+	bot, _, db := newTestBot(t, BotConfig{
+		Channel:       "main",
+		ExtraChannels: []string{"costreamer"},
+		ChatHistory:   10,
+	})
+
+	bot.onMessageHandler(testMessageFrom("main", "1", "100", "hello"))
+	bot.onMessageHandler(testMessageFrom("main", "2", "200", "spam"))
+	bot.onMessageHandler(testMessageFrom("main", "3", "100", "bad word"))
+	bot.onMessageHandler(testMessageFrom("main", "4", "100", "sorry"))
+	bot.onMessageHandler(testMessageFrom("costreamer", "5", "200", "spam"))
+
+	history := func(channel string) []string {
+		bot.histories.Flush()
+		var messages []irc.PrivateMessage
+		if err := db.GetJSON(bot.channelKey(ChatHistoryKey, channel), &messages); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, message := range messages {
+			ids = append(ids, message.ID)
+		}
+		return ids
+	}
+
+	// Single message deleted
+	bot.onClearMessageHandler(irc.ClearMessage{Channel: "main", Login: "user100", TargetMsgID: "3"})
+	if ids := history("main"); len(ids) != 3 || ids[2] != "4" {
+		t.Fatalf("deleted message is still in history: %v", ids)
+	}
+	var deleted irc.ClearMessage
+	if err := db.GetJSON(MessageDeletedEventKey, &deleted); err != nil {
+		t.Fatal(err)
+	}
+	if deleted.TargetMsgID != "3" {
+		t.Fatalf("unexpected deletion event: %+v", deleted)
+	}
+
+	// User timed out, only their messages in that channel are removed
+	bot.onClearChatHandler(irc.ClearChatMessage{Channel: "main", TargetUserID: "200", TargetUsername: "user200", BanDuration: 600})
+	if ids := history("main"); len(ids) != 2 || ids[0] != "1" || ids[1] != "4" {
+		t.Fatalf("timed out user's messages are still in history: %v", ids)
+	}
+	if ids := history("costreamer"); len(ids) != 1 {
+		t.Fatalf("messages in other channels were removed: %v", ids)
+	}
+
+	// Whole chat cleared
+	bot.onClearChatHandler(irc.ClearChatMessage{Channel: "main"})
+	if ids := history("main"); len(ids) != 0 {
+		t.Fatalf("chat history was not cleared: %v", ids)
+	}
+
+	bot.histories.Flush()
+	var clears []irc.ClearChatMessage
+	if err := db.GetJSON(ChatClearHistoryKey, &clears); err != nil {
+		t.Fatal(err)
+	}
+	if len(clears) != 2 || clears[0].TargetUsername != "user200" || clears[0].BanDuration != 600 {
+		t.Fatalf("unexpected chat clear history: %+v", clears)
+	}
+
+	// Events in extra channels use their own keys
+	bot.onClearMessageHandler(irc.ClearMessage{Channel: "costreamer", TargetMsgID: "5"})
+	if err := db.GetJSON(ChannelMessageDeletedEventPrefix+"costreamer", &deleted); err != nil {
+		t.Fatal(err)
+	}
+	if ids := history("costreamer"); len(ids) != 0 {
+		t.Fatalf("deleted message is still in history: %v", ids)
+	}
+}
+
+func TestBotChatHistoryBatched(t *testing.T) {
+	bot, _, db := newTestBot(t, BotConfig{Channel: "main", ChatHistory: 3})
+
+	for i := 1; i <= 5; i++ {
+		bot.onMessageHandler(testMessageFrom("main", strconv.Itoa(i), "100", "hello"))
+	}
+
+	// Nothing is written until the history is flushed
+	var messages []irc.PrivateMessage
+	if err := db.GetJSON(ChatHistoryKey, &messages); !errors.Is(err, database.ErrEmptyKey) {
+		t.Fatalf("chat history was written on every message: %v (%v)", messages, err)
+	}
+
+	bot.histories.Flush()
+	if err := db.GetJSON(ChatHistoryKey, &messages); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 || messages[0].ID != "3" || messages[2].ID != "5" {
+		t.Fatalf("unexpected chat history: %+v", messages)
+	}
+}
+
+func TestBotUserNotice(t *testing.T) {
+	bot, _, db := newTestBot(t, BotConfig{Channel: "main", ChatHistory: 2})
+
+	for _, msgID := range []string{"sub", "raid", "announcement"} {
+		bot.onUserNoticeHandler(irc.UserNoticeMessage{Channel: "main", MsgID: msgID})
+	}
+
+	var notice irc.UserNoticeMessage
+	if err := db.GetJSON(UserNoticeEventKey, &notice); err != nil {
+		t.Fatal(err)
+	}
+	if notice.MsgID != "announcement" {
+		t.Fatalf("unexpected notice event: %+v", notice)
+	}
+	bot.histories.Flush()
+	var notices []irc.UserNoticeMessage
+	if err := db.GetJSON(UserNoticeHistoryKey, &notices); err != nil {
+		t.Fatal(err)
+	}
+	if len(notices) != 2 || notices[0].MsgID != "raid" {
+		t.Fatalf("unexpected notice history: %+v", notices)
+	}
+}
+
+func TestBotRoomState(t *testing.T) {
+	bot, _, db := newTestBot(t, BotConfig{Channel: "main"})
+
+	bot.onRoomStateHandler(irc.RoomStateMessage{Channel: "main", RoomID: "1", State: map[string]int{
+		"emote-only": 0, "followers-only": -1, "r9k": 0, "slow": 0, "subs-only": 0,
+	}})
+	// Updates only have the settings that changed
+	bot.onRoomStateHandler(irc.RoomStateMessage{Channel: "main", RoomID: "1", State: map[string]int{"slow": 30}})
+
+	var state irc.RoomStateMessage
+	if err := db.GetJSON(RoomStateKey, &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.State) != 5 || state.State["slow"] != 30 || state.State["followers-only"] != -1 {
+		t.Fatalf("unexpected room state: %+v", state.State)
+	}
+}
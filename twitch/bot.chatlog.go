@@ -0,0 +1,423 @@
+package twitch
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	"git.sr.ht/~ashkeel/containers/sync"
+	irc "github.com/gempir/go-twitch-irc/v4"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+const BotChatLogKey = "twitch/bot-modules/chat-log/config"
+
+const (
+	// ChatLogPrefix is where logged messages are stored, as <day>/<channel>/<time>-<id>,
+	// with a copy for each user in <day>/@users/<user id>/<time>-<id>
+	ChatLogPrefix  = "twitch/chat-log/"
+	ChatLogDaysKey = "twitch/chat-log-days"
+
+	ChatLogQueryRPC  = "twitch/@query-chat-log"
+	ChatLogResultKey = "twitch/chat-log-result"
+)
+
+const (
+	chatLogDayFormat   = "2006-01-02"
+	chatLogUsersFolder = "@users"
+
+	// Defaults for chat log queries
+	chatLogDefaultRange = 7 * 24 * time.Hour
+	chatLogDefaultLimit = 100
+	chatLogMaxLimit     = 1000
+)
+
+type BotChatLogConfig struct {
+	// Save every chat message in the chat log
+	Enabled bool `json:"enabled" desc:"Save every chat message in the chat log"`
+
+	// How many days to keep messages for (0 to keep them forever)
+	RetentionDays int `json:"retention_days" desc:"How many days to keep messages for (0 to keep them forever)"`
+}
+
+// ChatLogEntry is a chat message saved in the chat log
+type ChatLogEntry struct {
+	// Message ID
+	ID string `json:"id" desc:"Message ID"`
+
+	// Channel the message was sent in
+	Channel string `json:"channel" desc:"Channel the message was sent in"`
+
+	// Twitch user ID of the chatter
+	UserID string `json:"user_id" desc:"Twitch user ID of the chatter"`
+
+	// Username of the chatter when the message was sent
+	UserLogin string `json:"user_login" desc:"Username of the chatter when the message was sent"`
+
+	// Display name of the chatter when the message was sent
+	DisplayName string `json:"display_name" desc:"Display name of the chatter when the message was sent"`
+
+	// Message text
+	Message string `json:"message" desc:"Message text"`
+
+	// When the message was sent
+	Time time.Time `json:"time" desc:"When the message was sent"`
+}
+
+// ChatLogQuery is a search in the chat log, all set filters must match
+type ChatLogQuery struct {
+	// Optional ID, copied in the result to tell results apart
+	RequestID string `json:"request_id,omitempty" desc:"Optional ID, copied in the result to tell results apart"`
+
+	// Only return messages from this channel (all channels if empty)
+	Channel string `json:"channel,omitempty" desc:"Only return messages from this channel (all channels if empty)"`
+
+	// Only return messages from this user (username or user ID), even if they changed name since
+	User string `json:"user,omitempty" desc:"Only return messages from this user (username or user ID), even if they changed name since"`
+
+	// Only return messages containing all these words (case insensitive)
+	Text string `json:"text,omitempty" desc:"Only return messages containing all these words (case insensitive)"`
+
+	// Only return messages sent after this time (defaults to 7 days before the end of the search)
+	From *time.Time `json:"from,omitempty" desc:"Only return messages sent after this time (defaults to 7 days before the end of the search)"`
+
+	// Only return messages sent before this time (defaults to now)
+	To *time.Time `json:"to,omitempty" desc:"Only return messages sent before this time (defaults to now)"`
+
+	// Maximum number of messages to return, newest first (defaults to 100, at most 1000)
+	Limit int `json:"limit,omitempty" desc:"Maximum number of messages to return, newest first (defaults to 100, at most 1000)"`
+}
+
+// ChatLogQueryResult contains the messages found by a chat log query
+type ChatLogQueryResult struct {
+	// ID of the query, if set
+	RequestID string `json:"request_id,omitempty" desc:"ID of the query, if set"`
+
+	// Messages found, newest first
+	Entries []ChatLogEntry `json:"entries" desc:"Messages found, newest first"`
+
+	// True if more messages matched the query than the limit allowed
+	More bool `json:"more" desc:"True if more messages matched the query than the limit allowed"`
+
+	// Error message if the query failed
+	Error string `json:"error,omitempty" desc:"Error message if the query failed"`
+}
+
+type BotChatLogModule struct {
+	Config *sync.RWSync[BotChatLogConfig]
+
+	bot  *Bot
+	mu   stdsync.Mutex
+	days []string
+	done chan struct{}
+
+	cancelConfigSub database.CancelFunc
+	cancelQuerySub  database.CancelFunc
+}
+
+func SetupChatLog(bot *Bot) *BotChatLogModule {
+	mod := &BotChatLogModule{
+		Config: sync.NewRWSync(BotChatLogConfig{}),
+		bot:    bot,
+		done:   make(chan struct{}),
+	}
+
+	// Load config from database
+	var config BotChatLogConfig
+	err := bot.api.db.GetJSON(BotChatLogKey, &config)
+	if err != nil {
+		bot.logger.Debug("Config load error", zap.Error(err))
+		config = BotChatLogConfig{
+			Enabled:       false,
+			RetentionDays: 30,
+		}
+		// Save default config
+		err = bot.api.db.PutJSON(BotChatLogKey, config)
+		if err != nil {
+			bot.logger.Warn("Could not save default config for chat log", zap.Error(err))
+		}
+	}
+	mod.Config.Set(config)
+
+	err = bot.api.db.GetJSON(ChatLogDaysKey, &mod.days)
+	if err != nil && !errors.Is(err, database.ErrEmptyKey) {
+		bot.logger.Warn("Could not load chat log days", zap.Error(err))
+	}
+
+	err, mod.cancelConfigSub = bot.api.db.SubscribeKey(BotChatLogKey, func(value string) {
+		var config BotChatLogConfig
+		err := json.UnmarshalFromString(value, &config)
+		if err != nil {
+			bot.logger.Debug("Error reloading chat log config", zap.Error(err))
+			return
+		}
+		mod.Config.Set(config)
+		bot.logger.Info("Reloaded chat log config")
+		mod.applyRetention(time.Now())
+	})
+	if err != nil {
+		bot.logger.Error("Could not set-up chat log reload subscription", zap.Error(err))
+	}
+
+	err, mod.cancelQuerySub = bot.api.db.SubscribeKey(ChatLogQueryRPC, mod.handleQueryRPC)
+	if err != nil {
+		bot.logger.Error("Could not set-up chat log query subscription", zap.Error(err))
+	}
+
+	go mod.runRetention()
+
+	return mod
+}
+
+func (m *BotChatLogModule) Close() {
+	if m.cancelConfigSub != nil {
+		m.cancelConfigSub()
+	}
+	if m.cancelQuerySub != nil {
+		m.cancelQuerySub()
+	}
+	close(m.done)
+}
+
+// OnMessage saves a chat message to the log, with its copy in the user index
+func (m *BotChatLogModule) OnMessage(message irc.PrivateMessage) {
+	if !m.Config.Get().Enabled {
+		return
+	}
+
+	entry := ChatLogEntry{
+		ID:          message.ID,
+		Channel:     normalizeChannel(message.Channel),
+		UserID:      message.User.ID,
+		UserLogin:   message.User.Name,
+		DisplayName: message.User.DisplayName,
+		Message:     message.Message,
+		Time:        message.Time,
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	day := entry.Time.UTC().Format(chatLogDayFormat)
+	if err := m.addDay(day); err != nil {
+		m.bot.logger.Warn("Could not save chat log days", zap.Error(err))
+	}
+
+	name := chatLogEntryName(entry)
+	entries := map[string]any{
+		ChatLogPrefix + day + "/" + entry.Channel + "/" + name: entry,
+	}
+	if entry.UserID != "" {
+		entries[ChatLogPrefix+day+"/"+chatLogUsersFolder+"/"+entry.UserID+"/"+name] = entry
+	}
+	if err := m.bot.api.db.PutJSONBulk(entries); err != nil {
+		m.bot.logger.Warn("Could not save message to chat log", zap.Error(err))
+	}
+}
+
+// chatLogEntryName returns a name that sorts entries by time
+func chatLogEntryName(entry ChatLogEntry) string {
+	return fmt.Sprintf("%013d-%s", entry.Time.UnixMilli(), entry.ID)
+}
+
+func (m *BotChatLogModule) addDay(day string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slices.Contains(m.days, day) {
+		return nil
+	}
+	m.days = append(m.days, day)
+	slices.Sort(m.days)
+	return m.bot.api.db.PutJSON(ChatLogDaysKey, m.days)
+}
+
+func (m *BotChatLogModule) runRetention() {
+	m.applyRetention(time.Now())
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.applyRetention(now)
+		}
+	}
+}
+
+// applyRetention removes the days that are older than the retention period
+func (m *BotChatLogModule) applyRetention(now time.Time) {
+	retention := m.Config.Get().RetentionDays
+	if retention <= 0 {
+		return
+	}
+	cutoff := now.UTC().AddDate(0, 0, -retention).Format(chatLogDayFormat)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []string
+	for _, day := range m.days {
+		if day >= cutoff {
+			kept = append(kept, day)
+			continue
+		}
+		entries, err := m.bot.api.db.GetAll(ChatLogPrefix + day + "/")
+		if err != nil {
+			m.bot.logger.Warn("Could not read chat log for removal", zap.String("day", day), zap.Error(err))
+			kept = append(kept, day)
+			continue
+		}
+		for key := range entries {
+			if err := m.bot.api.db.RemoveKey(key); err != nil {
+				m.bot.logger.Warn("Could not remove chat log entry", zap.String("key", key), zap.Error(err))
+			}
+		}
+		m.bot.logger.Info("Removed old chat log", zap.String("day", day), zap.Int("entries", len(entries)))
+	}
+	if len(kept) == len(m.days) {
+		return
+	}
+	m.days = kept
+	if err := m.bot.api.db.PutJSON(ChatLogDaysKey, m.days); err != nil {
+		m.bot.logger.Warn("Could not save chat log days", zap.Error(err))
+	}
+}
+
+func (m *BotChatLogModule) handleQueryRPC(value string) {
+	var query ChatLogQuery
+	result := ChatLogQueryResult{}
+	if err := json.UnmarshalFromString(value, &query); err != nil {
+		result.Error = err.Error()
+	} else {
+		result = m.Query(query)
+	}
+	if err := m.bot.api.db.PutJSON(ChatLogResultKey, result); err != nil {
+		m.bot.logger.Warn("Could not save chat log query result", zap.Error(err))
+	}
+}
+
+// Query searches the chat log
+func (m *BotChatLogModule) Query(query ChatLogQuery) ChatLogQueryResult {
+	result := ChatLogQueryResult{RequestID: query.RequestID, Entries: []ChatLogEntry{}}
+
+	to := time.Now()
+	if query.To != nil {
+		to = *query.To
+	}
+	from := to.Add(-chatLogDefaultRange)
+	if query.From != nil {
+		from = *query.From
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = chatLogDefaultLimit
+	}
+	limit = min(limit, chatLogMaxLimit)
+	channel := normalizeChannel(query.Channel)
+	words := strings.Fields(strings.ToLower(query.Text))
+
+	// Messages from a user are read from their index, so they can be found by ID even after a name change
+	userID := ""
+	if query.User != "" {
+		user := normalizeChannel(query.User)
+		if isNumeric(user) {
+			userID = user
+		} else {
+			id, err := m.bot.api.userIDForLogin(user)
+			if err != nil {
+				result.Error = fmt.Sprintf("could not find user %s: %s", user, err)
+				return result
+			}
+			userID = id
+		}
+	}
+
+	m.mu.Lock()
+	days := slices.Clone(m.days)
+	m.mu.Unlock()
+
+	// Go through days from the newest, stopping as soon as there are enough messages
+	fromDay, toDay := from.UTC().Format(chatLogDayFormat), to.UTC().Format(chatLogDayFormat)
+	for i := len(days) - 1; i >= 0; i-- {
+		day := days[i]
+		if day < fromDay || day > toDay {
+			continue
+		}
+
+		prefix := ChatLogPrefix + day + "/"
+		switch {
+		case userID != "":
+			prefix += chatLogUsersFolder + "/" + userID + "/"
+		case channel != "":
+			prefix += channel + "/"
+		}
+		values, err := m.bot.api.db.GetAll(prefix)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			// Skip the user index when searching all channels
+			if userID == "" && strings.HasPrefix(key, ChatLogPrefix+day+"/"+chatLogUsersFolder+"/") {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		// Sort by time (the entry name), since keys from different channels can be mixed
+		slices.SortFunc(keys, func(a, b string) int {
+			return strings.Compare(a[strings.LastIndex(a, "/")+1:], b[strings.LastIndex(b, "/")+1:])
+		})
+
+		for j := len(keys) - 1; j >= 0; j-- {
+			var entry ChatLogEntry
+			if err := json.UnmarshalFromString(values[keys[j]], &entry); err != nil {
+				m.bot.logger.Warn("Could not decode chat log entry", zap.String("key", keys[j]), zap.Error(err))
+				continue
+			}
+			if entry.Time.Before(from) || entry.Time.After(to) {
+				continue
+			}
+			if channel != "" && entry.Channel != channel {
+				continue
+			}
+			if !containsAllWords(strings.ToLower(entry.Message), words) {
+				continue
+			}
+			if len(result.Entries) >= limit {
+				result.More = true
+				return result
+			}
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return result
+}
+
+func containsAllWords(text string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNumeric(str string) bool {
+	if str == "" {
+		return false
+	}
+	for _, char := range str {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package twitch
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestChatLog(t *testing.T) {
+	bot, _, db := newTestBot(t, BotConfig{
+		Channel:       "main",
+		ExtraChannels: []string{"costreamer"},
+	})
+	// Retention is applied later in the test, old messages must not be removed before that
+	bot.ChatLog.Config.Set(BotChatLogConfig{Enabled: true})
+
+	now := time.Now()
+	log := func(channel string, id string, userID string, text string, age time.Duration) {
+		message := testMessageFrom(channel, id, userID, text)
+		message.Time = now.Add(-age)
+		bot.onMessageHandler(message)
+	}
+	log("main", "1", "100", "Hello everyone", 3*time.Hour)
+	log("main", "2", "200", "buy followers at example dot com", 2*time.Hour)
+	log("costreamer", "3", "200", "buy FOLLOWERS now", time.Hour)
+	log("main", "4", "100", "who is selling followers?", time.Minute)
+	log("main", "5", "200", "old spam", 3*24*time.Hour)
+	log("main", "6", "200", "ancient spam", 40*24*time.Hour)
+
+	ids := func(result ChatLogQueryResult) []string {
+		if result.Error != "" {
+			t.Fatal(result.Error)
+		}
+		var ids []string
+		for _, entry := range result.Entries {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+	equal := func(found []string, expected ...string) bool {
+		return slices.Equal(found, expected)
+	}
+
+	// Full-text search, all channels, newest first
+	if found := ids(bot.ChatLog.Query(ChatLogQuery{Text: "buy followers"})); !equal(found, "3", "2") {
+		t.Fatalf("unexpected text search result: %v", found)
+	}
+	if found := ids(bot.ChatLog.Query(ChatLogQuery{Text: "followers", Channel: "#Main"})); !equal(found, "4", "2") {
+		t.Fatalf("unexpected channel search result: %v", found)
+	}
+
+	// Per-user history, last 7 days by default
+	if found := ids(bot.ChatLog.Query(ChatLogQuery{User: "200"})); !equal(found, "3", "2", "5") {
+		t.Fatalf("unexpected user history: %v", found)
+	}
+	from := now.Add(-50 * 24 * time.Hour)
+	result := bot.ChatLog.Query(ChatLogQuery{User: "200", From: &from, Limit: 3})
+	if found := ids(result); !equal(found, "3", "2", "5") || !result.More {
+		t.Fatalf("unexpected limited user history: %v (more: %v)", found, result.More)
+	}
+
+	// Old days are removed
+	bot.ChatLog.Config.Set(BotChatLogConfig{Enabled: true, RetentionDays: 30})
+	bot.ChatLog.applyRetention(now)
+	result = bot.ChatLog.Query(ChatLogQuery{User: "200", From: &from})
+	if found := ids(result); !equal(found, "3", "2", "5") {
+		t.Fatalf("old messages were not removed: %v", found)
+	}
+	old, err := db.GetAll(ChatLogPrefix + now.Add(-40*24*time.Hour).UTC().Format(chatLogDayFormat) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 0 {
+		t.Fatalf("old entries are still in the database: %v", old)
+	}
+
+	// Queries can be sent with RPC
+	bot.ChatLog.handleQueryRPC(`{"request_id":"abc","text":"hello"}`)
+	var rpcResult ChatLogQueryResult
+	if err := db.GetJSON(ChatLogResultKey, &rpcResult); err != nil {
+		t.Fatal(err)
+	}
+	if rpcResult.RequestID != "abc" || !equal(ids(rpcResult), "1") {
+		t.Fatalf("unexpected RPC result: %+v", rpcResult)
+	}
+}
+
+func TestChatLogDisabled(t *testing.T) {
+	bot, _, db := newTestBot(t, BotConfig{Channel: "main"})
+
+	bot.onMessageHandler(testMessageFrom("main", "1", "100", "hello"))
+
+	entries, err := db.GetAll(ChatLogPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("messages were logged with the chat log disabled: %v", entries)
+	}
+}
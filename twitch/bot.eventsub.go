@@ -0,0 +1,768 @@
+package twitch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	irc "github.com/gempir/go-twitch-irc/v4"
+	lru "github.com/hashicorp/golang-lru/v2"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/utils"
+)
+
+const (
+	chatMessageTopic       = "channel.chat.message"
+	chatClearTopic         = "channel.chat.clear"
+	chatClearUserTopic     = "channel.chat.clear_user_messages"
+	chatMessageDeleteTopic = "channel.chat.message_delete"
+	chatNotificationTopic  = "channel.chat.notification"
+	chatSettingsTopic      = "channel.chat_settings.update"
+
+	// All chat topics are on version 1
+	chatTopicVersion = "1"
+)
+
+// chatTopics are the EventSub topics needed to read chat, they only need the user:read:chat scope
+var chatTopics = []string{
+	chatMessageTopic,
+	chatClearTopic,
+	chatClearUserTopic,
+	chatMessageDeleteTopic,
+	chatNotificationTopic,
+	chatSettingsTopic,
+}
+
+var ErrChatMessageDropped = errors.New("chat message was dropped by Twitch")
+
+// eventSubChat is an IRCBot that reads chat with EventSub and sends messages with the Helix API, as the bot account.
+// It has its own EventSub connection since chat subscriptions must be made with the bot account's token.
+type eventSubChat struct {
+	api    *Client
+	logger *zap.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        stdsync.Mutex
+	channels  []string
+	sessionID string
+	seen      *lru.Cache[string, time.Time] // IDs of the chat notifications received
+
+	onConnect      func()
+	onMessage      func(irc.PrivateMessage)
+	onClearChat    func(irc.ClearChatMessage)
+	onClearMessage func(irc.ClearMessage)
+	onUserNotice   func(irc.UserNoticeMessage)
+	onRoomState    func(irc.RoomStateMessage)
+}
+
+func newEventSubChat(api *Client) *eventSubChat {
+	ctx, cancel := context.WithCancel(context.Background())
+	seen, _ := lru.New[string, time.Time](128)
+	return &eventSubChat{
+		api:    api,
+		logger: api.logger.With(zap.String("chat", "eventsub")),
+		ctx:    ctx,
+		cancel: cancel,
+		seen:   seen,
+
+		onConnect:      func() {},
+		onMessage:      func(irc.PrivateMessage) {},
+		onClearChat:    func(irc.ClearChatMessage) {},
+		onClearMessage: func(irc.ClearMessage) {},
+		onUserNotice:   func(irc.UserNoticeMessage) {},
+		onRoomState:    func(irc.RoomStateMessage) {},
+	}
+}
+
+func (e *eventSubChat) Join(channels ...string) {
+	e.mu.Lock()
+	var added []string
+	for _, channel := range channels {
+		channel = normalizeChannel(channel)
+		if channel == "" || slices.Contains(e.channels, channel) {
+			continue
+		}
+		e.channels = append(e.channels, channel)
+		added = append(added, channel)
+	}
+	sessionID := e.sessionID
+	e.mu.Unlock()
+
+	// Channels joined after connecting need to be subscribed to right away
+	if sessionID != "" {
+		for _, channel := range added {
+			if err := e.subscribe(channel, sessionID); err != nil {
+				e.logger.Error("Could not subscribe to chat events", zap.String("channel", channel), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Connect reads chat messages until Disconnect is called, reconnecting when needed
+func (e *eventSubChat) Connect() error {
+	session := &eventSubSession{
+		ctx:       e.ctx,
+		logger:    e.logger,
+		endpoint:  eventSubEndpoint(e.api.Config.Get()),
+		seen:      e.seen,
+		onWelcome: e.onWelcome,
+		onNotification: func(message EventSubWebsocketMessage) {
+			var notification NotificationMessagePayload
+			if err := json.Unmarshal(message.Payload, &notification); err != nil {
+				e.logger.Error("Error decoding chat notification", zap.Error(err))
+				return
+			}
+			if err := e.handleNotification(message.Metadata.SubscriptionType, notification, message.Metadata.MessageTimestamp); err != nil {
+				e.logger.Error("Error decoding chat event", zap.String("topic", message.Metadata.SubscriptionType), zap.Error(err))
+			}
+		},
+		onRevocation: func(EventSubWebsocketMessage) {
+			e.logger.Warn("Chat subscription was revoked by Twitch, is the bot account still authorized?")
+		},
+		onDisconnect: func(error) {
+			e.setSession("")
+		},
+	}
+	session.run()
+
+	e.setSession("")
+	return irc.ErrClientDisconnected
+}
+
+func (e *eventSubChat) Disconnect() error {
+	e.cancel()
+	return nil
+}
+
+func (e *eventSubChat) onWelcome(welcome WelcomeMessagePayload, reconnected bool) {
+	e.setSession(welcome.Session.Id)
+
+	// Subscriptions are carried over to the new session on reconnection
+	if !reconnected {
+		e.subscribeAll(welcome.Session.Id)
+	}
+	e.logger.Info("Connected to chat with EventSub", zap.String("session-id", welcome.Session.Id))
+	go e.onConnect()
+}
+
+// handleNotification converts chat events to the messages the IRC client would have received
+func (e *eventSubChat) handleNotification(topic string, notification NotificationMessagePayload, timestamp time.Time) error {
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	switch topic {
+	case chatMessageTopic:
+		var event chatMessageEvent
+		if err := json.Unmarshal(notification.Event, &event); err != nil {
+			return err
+		}
+		e.onMessage(event.toPrivateMessage(timestamp))
+	case chatClearTopic, chatClearUserTopic:
+		var event chatClearEvent
+		if err := json.Unmarshal(notification.Event, &event); err != nil {
+			return err
+		}
+		e.onClearChat(event.toClearChatMessage(timestamp))
+	case chatMessageDeleteTopic:
+		var event chatClearEvent
+		if err := json.Unmarshal(notification.Event, &event); err != nil {
+			return err
+		}
+		e.onClearMessage(event.toClearMessage())
+	case chatNotificationTopic:
+		var event chatNotificationEvent
+		if err := json.Unmarshal(notification.Event, &event); err != nil {
+			return err
+		}
+		e.onUserNotice(event.toUserNoticeMessage(timestamp))
+	case chatSettingsTopic:
+		var event chatSettingsEvent
+		if err := json.Unmarshal(notification.Event, &event); err != nil {
+			return err
+		}
+		e.onRoomState(event.toRoomStateMessage())
+	}
+	return nil
+}
+
+func (e *eventSubChat) setSession(sessionID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sessionID = sessionID
+}
+
+func (e *eventSubChat) subscribeAll(sessionID string) {
+	e.mu.Lock()
+	channels := append([]string{}, e.channels...)
+	e.mu.Unlock()
+
+	for _, channel := range channels {
+		if err := e.subscribe(channel, sessionID); err != nil {
+			e.logger.Error("Could not subscribe to chat events", zap.String("channel", channel), zap.Error(err))
+		}
+	}
+}
+
+func (e *eventSubChat) subscribe(channel string, sessionID string) error {
+	broadcasterID, err := e.api.userIDForLogin(channel)
+	if err != nil {
+		return err
+	}
+	client, err := e.api.GetBotClient(false)
+	if err != nil {
+		return err
+	}
+	user, err := e.api.GetBotUser()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, topic := range chatTopics {
+		resp, err := client.CreateEventSubSubscription(&helix.EventSubSubscription{
+			Type:    topic,
+			Version: chatTopicVersion,
+			Condition: helix.EventSubCondition{
+				BroadcasterUserID: broadcasterID,
+				UserID:            user.ID,
+			},
+			Transport: helix.EventSubTransport{
+				Method:    "websocket",
+				SessionID: sessionID,
+			},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", topic, err))
+			continue
+		}
+		if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusConflict {
+			errs = append(errs, fmt.Errorf("%s: %d: %s", topic, resp.StatusCode, resp.ErrorMessage))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *eventSubChat) Say(channel, message string) {
+	if err := e.send(channel, message, ""); err != nil {
+		e.logger.Error("Could not send chat message", zap.String("channel", channel), zap.Error(err))
+	}
+}
+
+func (e *eventSubChat) Reply(channel, messageID, message string) {
+	if err := e.send(channel, message, messageID); err != nil {
+		e.logger.Error("Could not send chat reply", zap.String("channel", channel), zap.Error(err))
+	}
+}
+
+type sendChatMessageRequest struct {
+	BroadcasterID        string `json:"broadcaster_id"`
+	SenderID             string `json:"sender_id"`
+	Message              string `json:"message"`
+	ReplyParentMessageID string `json:"reply_parent_message_id,omitempty"`
+}
+
+type sendChatMessageResponse struct {
+	Data []struct {
+		MessageID  string `json:"message_id"`
+		IsSent     bool   `json:"is_sent"`
+		DropReason *struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"drop_reason"`
+	} `json:"data"`
+	Message string `json:"message"`
+}
+
+// send sends a message with the Send Chat Message endpoint (not supported by helix yet)
+func (e *eventSubChat) send(channel string, message string, replyTo string) error {
+	broadcasterID, err := e.api.userIDForLogin(channel)
+	if err != nil {
+		return err
+	}
+	client, err := e.api.GetBotClient(false)
+	if err != nil {
+		return err
+	}
+	user, err := e.api.GetBotUser()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(sendChatMessageRequest{
+		BroadcasterID:        broadcasterID,
+		SenderID:             user.ID,
+		Message:              message,
+		ReplyParentMessageID: replyTo,
+	})
+	if err != nil {
+		return err
+	}
+
+	config := e.api.Config.Get()
+	baseURL := helix.DefaultAPIBaseURL
+	if config.APIBaseURL != "" {
+		baseURL = config.APIBaseURL
+	}
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, baseURL+"/chat/messages", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Client-Id", config.APIClientID)
+	req.Header.Set("Authorization", "Bearer "+client.GetUserAccessToken())
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer utils.Close(res.Body, e.logger)
+
+	var response sendChatMessageResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("could not decode response (%d): %w", res.StatusCode, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%d: %s", res.StatusCode, response.Message)
+	}
+	if len(response.Data) > 0 && !response.Data[0].IsSent {
+		if reason := response.Data[0].DropReason; reason != nil {
+			return fmt.Errorf("%w: %s (%s)", ErrChatMessageDropped, reason.Message, reason.Code)
+		}
+		return ErrChatMessageDropped
+	}
+	return nil
+}
+
+func (e *eventSubChat) OnConnect(handler func()) {
+	e.onConnect = handler
+}
+
+func (e *eventSubChat) OnPrivateMessage(handler func(irc.PrivateMessage)) {
+	e.onMessage = handler
+}
+
+func (e *eventSubChat) OnClearChatMessage(handler func(irc.ClearChatMessage)) {
+	e.onClearChat = handler
+}
+
+func (e *eventSubChat) OnClearMessage(handler func(irc.ClearMessage)) {
+	e.onClearMessage = handler
+}
+
+func (e *eventSubChat) OnUserNoticeMessage(handler func(irc.UserNoticeMessage)) {
+	e.onUserNotice = handler
+}
+
+func (e *eventSubChat) OnRoomStateMessage(handler func(irc.RoomStateMessage)) {
+	e.onRoomState = handler
+}
+
+// EventSub has no join/part notifications, these handlers are never called
+func (e *eventSubChat) OnUserJoinMessage(func(message irc.UserJoinMessage)) {}
+func (e *eventSubChat) OnUserPartMessage(func(message irc.UserPartMessage)) {}
+
+type chatBadge struct {
+	SetID string `json:"set_id"`
+	ID    string `json:"id"`
+	Info  string `json:"info"`
+}
+
+type chatMessageFragment struct {
+	Type  string `json:"type"`
+	Text  string `json:"text"`
+	Emote *struct {
+		ID string `json:"id"`
+	} `json:"emote"`
+}
+
+type chatMessageText struct {
+	Text      string                `json:"text"`
+	Fragments []chatMessageFragment `json:"fragments"`
+}
+
+type chatMessageEvent struct {
+	BroadcasterUserID    string          `json:"broadcaster_user_id"`
+	BroadcasterUserLogin string          `json:"broadcaster_user_login"`
+	ChatterUserID        string          `json:"chatter_user_id"`
+	ChatterUserLogin     string          `json:"chatter_user_login"`
+	ChatterUserName      string          `json:"chatter_user_name"`
+	MessageID            string          `json:"message_id"`
+	Message              chatMessageText `json:"message"`
+	Color                string          `json:"color"`
+	Badges               []chatBadge     `json:"badges"`
+	MessageType          string          `json:"message_type"`
+	Cheer                *struct {
+		Bits int `json:"bits"`
+	} `json:"cheer"`
+	Reply *struct {
+		ParentMessageID   string `json:"parent_message_id"`
+		ParentMessageBody string `json:"parent_message_body"`
+		ParentUserID      string `json:"parent_user_id"`
+		ParentUserName    string `json:"parent_user_name"`
+		ParentUserLogin   string `json:"parent_user_login"`
+		ThreadMessageID   string `json:"thread_message_id"`
+		ThreadUserLogin   string `json:"thread_user_login"`
+	} `json:"reply"`
+	ChannelPointsCustomRewardID string `json:"channel_points_custom_reward_id"`
+
+	// Only set for messages coming from another channel in a shared chat session
+	SourceBroadcasterUserID string      `json:"source_broadcaster_user_id"`
+	SourceMessageID         string      `json:"source_message_id"`
+	SourceBadges            []chatBadge `json:"source_badges"`
+}
+
+func badgeTags(badges []chatBadge) (string, string) {
+	var list, info []string
+	for _, badge := range badges {
+		list = append(list, badge.SetID+"/"+badge.ID)
+		if badge.Info != "" {
+			info = append(info, badge.SetID+"/"+badge.Info)
+		}
+	}
+	return strings.Join(list, ","), strings.Join(info, ",")
+}
+
+// badgeVersions returns the badges like the IRC client parses them
+func badgeVersions(badges []chatBadge) map[string]int {
+	versions := make(map[string]int)
+	for _, badge := range badges {
+		// Badge versions are numbers for most badges (e.g. subscriber months), 1 otherwise
+		version, err := strconv.Atoi(badge.ID)
+		if err != nil {
+			version = 1
+		}
+		versions[badge.SetID] = version
+	}
+	return versions
+}
+
+// toPrivateMessage converts the event to the same message the IRC client would have received, tags included
+func (ev chatMessageEvent) toPrivateMessage(timestamp time.Time) irc.PrivateMessage {
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	badgeList, badgeInfo := badgeTags(ev.Badges)
+
+	tags := map[string]string{
+		"id":           ev.MessageID,
+		"room-id":      ev.BroadcasterUserID,
+		"user-id":      ev.ChatterUserID,
+		"display-name": ev.ChatterUserName,
+		"color":        ev.Color,
+		"badges":       badgeList,
+		"badge-info":   badgeInfo,
+		"tmi-sent-ts":  strconv.FormatInt(timestamp.UnixMilli(), 10),
+	}
+	if ev.ChannelPointsCustomRewardID != "" {
+		tags["custom-reward-id"] = ev.ChannelPointsCustomRewardID
+	}
+	if ev.MessageType == "channel_points_highlighted" {
+		tags["msg-id"] = "highlighted-message"
+	}
+
+	message := irc.PrivateMessage{
+		User: irc.User{
+			ID:          ev.ChatterUserID,
+			Name:        ev.ChatterUserLogin,
+			DisplayName: ev.ChatterUserName,
+			Color:       ev.Color,
+			Badges:      badgeVersions(ev.Badges),
+		},
+		Type:           irc.PRIVMSG,
+		RawType:        "PRIVMSG",
+		Tags:           tags,
+		Message:        ev.Message.Text,
+		Channel:        ev.BroadcasterUserLogin,
+		RoomID:         ev.BroadcasterUserID,
+		ID:             ev.MessageID,
+		Time:           timestamp,
+		Emotes:         ev.Message.emotes(),
+		CustomRewardID: ev.ChannelPointsCustomRewardID,
+	}
+	if ev.Cheer != nil {
+		message.Bits = ev.Cheer.Bits
+		tags["bits"] = strconv.Itoa(ev.Cheer.Bits)
+	}
+	if ev.Reply != nil {
+		message.Reply = &irc.Reply{
+			ParentMsgID:       ev.Reply.ParentMessageID,
+			ParentUserID:      ev.Reply.ParentUserID,
+			ParentUserLogin:   ev.Reply.ParentUserLogin,
+			ParentDisplayName: ev.Reply.ParentUserName,
+			ParentMsgBody:     ev.Reply.ParentMessageBody,
+		}
+		tags["reply-parent-msg-id"] = ev.Reply.ParentMessageID
+		tags["reply-parent-user-id"] = ev.Reply.ParentUserID
+		tags["reply-parent-user-login"] = ev.Reply.ParentUserLogin
+		tags["reply-parent-display-name"] = ev.Reply.ParentUserName
+		tags["reply-parent-msg-body"] = ev.Reply.ParentMessageBody
+		tags["reply-thread-parent-msg-id"] = ev.Reply.ThreadMessageID
+		tags["reply-thread-parent-user-login"] = ev.Reply.ThreadUserLogin
+	}
+	if ev.SourceBroadcasterUserID != "" {
+		sourceBadges, sourceBadgeInfo := badgeTags(ev.SourceBadges)
+		tags["source-room-id"] = ev.SourceBroadcasterUserID
+		tags["source-id"] = ev.SourceMessageID
+		tags["source-badges"] = sourceBadges
+		tags["source-badge-info"] = sourceBadgeInfo
+	}
+	return message
+}
+
+// emotes returns the emotes in the message with their positions (in characters, like IRC)
+func (m chatMessageText) emotes() []*irc.Emote {
+	var emotes []*irc.Emote
+	byID := make(map[string]*irc.Emote)
+	position := 0
+	for _, fragment := range m.Fragments {
+		length := len([]rune(fragment.Text))
+		if fragment.Type == "emote" && fragment.Emote != nil {
+			emote, ok := byID[fragment.Emote.ID]
+			if !ok {
+				emote = &irc.Emote{Name: fragment.Text, ID: fragment.Emote.ID}
+				byID[fragment.Emote.ID] = emote
+				emotes = append(emotes, emote)
+			}
+			emote.Count++
+			emote.Positions = append(emote.Positions, irc.EmotePosition{Start: position, End: position + length - 1})
+		}
+		position += length
+	}
+	return emotes
+}
+
+// chatClearEvent is used for chat clears, user messages being cleared (timeouts and bans) and single messages being deleted
+type chatClearEvent struct {
+	BroadcasterUserID    string `json:"broadcaster_user_id"`
+	BroadcasterUserLogin string `json:"broadcaster_user_login"`
+	TargetUserID         string `json:"target_user_id"`
+	TargetUserLogin      string `json:"target_user_login"`
+	TargetUserName       string `json:"target_user_name"`
+	MessageID            string `json:"message_id"`
+}
+
+// toClearChatMessage converts the event to a CLEARCHAT message, EventSub doesn't tell timeouts and bans apart so BanDuration is always 0
+func (ev chatClearEvent) toClearChatMessage(timestamp time.Time) irc.ClearChatMessage {
+	tags := map[string]string{
+		"room-id":     ev.BroadcasterUserID,
+		"tmi-sent-ts": strconv.FormatInt(timestamp.UnixMilli(), 10),
+	}
+	if ev.TargetUserID != "" {
+		tags["target-user-id"] = ev.TargetUserID
+	}
+	return irc.ClearChatMessage{
+		Type:           irc.CLEARCHAT,
+		RawType:        "CLEARCHAT",
+		Tags:           tags,
+		Message:        ev.TargetUserLogin,
+		Channel:        ev.BroadcasterUserLogin,
+		RoomID:         ev.BroadcasterUserID,
+		Time:           timestamp,
+		TargetUserID:   ev.TargetUserID,
+		TargetUsername: ev.TargetUserLogin,
+	}
+}
+
+// toClearMessage converts the event to a CLEARMSG message, the deleted message's text is not included
+func (ev chatClearEvent) toClearMessage() irc.ClearMessage {
+	return irc.ClearMessage{
+		Type:    irc.CLEARMSG,
+		RawType: "CLEARMSG",
+		Tags: map[string]string{
+			"login":         ev.TargetUserLogin,
+			"room-id":       ev.BroadcasterUserID,
+			"target-msg-id": ev.MessageID,
+		},
+		Channel:     ev.BroadcasterUserLogin,
+		Login:       ev.TargetUserLogin,
+		TargetMsgID: ev.MessageID,
+	}
+}
+
+type chatNotificationEvent struct {
+	BroadcasterUserID    string          `json:"broadcaster_user_id"`
+	BroadcasterUserLogin string          `json:"broadcaster_user_login"`
+	ChatterUserID        string          `json:"chatter_user_id"`
+	ChatterUserLogin     string          `json:"chatter_user_login"`
+	ChatterUserName      string          `json:"chatter_user_name"`
+	ChatterIsAnonymous   bool            `json:"chatter_is_anonymous"`
+	Color                string          `json:"color"`
+	Badges               []chatBadge     `json:"badges"`
+	SystemMessage        string          `json:"system_message"`
+	MessageID            string          `json:"message_id"`
+	Message              chatMessageText `json:"message"`
+	NoticeType           string          `json:"notice_type"`
+
+	// Details of the notice, in a field named like the notice type
+	Details map[string]jsoniter.RawMessage `json:"-"`
+}
+
+// noticeMsgIDs maps EventSub notice types to the msg-id of the IRC USERNOTICE
+var noticeMsgIDs = map[string]string{
+	"sub":                "sub",
+	"resub":              "resub",
+	"sub_gift":           "subgift",
+	"community_sub_gift": "submysterygift",
+	"gift_paid_upgrade":  "giftpaidupgrade",
+	"prime_paid_upgrade": "primepaidupgrade",
+	"raid":               "raid",
+	"unraid":             "unraid",
+	"pay_it_forward":     "standardpayforward",
+	"announcement":       "announcement",
+	"bits_badge_tier":    "bitsbadgetier",
+	"charity_donation":   "charitydonation",
+}
+
+func (ev *chatNotificationEvent) UnmarshalJSON(data []byte) error {
+	type plain chatNotificationEvent
+	if err := json.Unmarshal(data, (*plain)(ev)); err != nil {
+		return err
+	}
+	var fields map[string]jsoniter.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if details, ok := fields[ev.NoticeType]; ok {
+		// Missing or null for notices without details
+		_ = json.Unmarshal(details, &ev.Details)
+	}
+	return nil
+}
+
+// toUserNoticeMessage converts the event to a USERNOTICE message, notice details are added as msg-param-* with EventSub's field names
+func (ev chatNotificationEvent) toUserNoticeMessage(timestamp time.Time) irc.UserNoticeMessage {
+	msgID, ok := noticeMsgIDs[ev.NoticeType]
+	if !ok {
+		msgID = ev.NoticeType
+	}
+	sourceMsgID := ""
+	if base, shared := strings.CutPrefix(ev.NoticeType, "shared_chat_"); shared {
+		msgID = "sharedchatnotice"
+		sourceMsgID, ok = noticeMsgIDs[base]
+		if !ok {
+			sourceMsgID = base
+		}
+	}
+
+	params := make(map[string]string)
+	for field, value := range ev.Details {
+		var text string
+		switch {
+		case len(value) == 0 || value[0] == '{' || value[0] == '[' || string(value) == "null":
+			continue
+		case value[0] == '"':
+			_ = json.Unmarshal(value, &text)
+		default:
+			text = string(value)
+		}
+		params["msg-param-"+strings.ReplaceAll(field, "_", "-")] = text
+	}
+
+	badgeList, badgeInfo := badgeTags(ev.Badges)
+	tags := map[string]string{
+		"id":           ev.MessageID,
+		"room-id":      ev.BroadcasterUserID,
+		"user-id":      ev.ChatterUserID,
+		"login":        ev.ChatterUserLogin,
+		"display-name": ev.ChatterUserName,
+		"color":        ev.Color,
+		"badges":       badgeList,
+		"badge-info":   badgeInfo,
+		"msg-id":       msgID,
+		"system-msg":   ev.SystemMessage,
+		"tmi-sent-ts":  strconv.FormatInt(timestamp.UnixMilli(), 10),
+	}
+	if sourceMsgID != "" {
+		tags["source-msg-id"] = sourceMsgID
+	}
+	for param, value := range params {
+		tags[param] = value
+	}
+
+	return irc.UserNoticeMessage{
+		User: irc.User{
+			ID:          ev.ChatterUserID,
+			Name:        ev.ChatterUserLogin,
+			DisplayName: ev.ChatterUserName,
+			Color:       ev.Color,
+			Badges:      badgeVersions(ev.Badges),
+		},
+		Type:      irc.USERNOTICE,
+		RawType:   "USERNOTICE",
+		Tags:      tags,
+		Message:   ev.Message.Text,
+		Channel:   ev.BroadcasterUserLogin,
+		RoomID:    ev.BroadcasterUserID,
+		ID:        ev.MessageID,
+		Time:      timestamp,
+		Emotes:    ev.Message.emotes(),
+		MsgID:     msgID,
+		MsgParams: params,
+		SystemMsg: ev.SystemMessage,
+	}
+}
+
+type chatSettingsEvent struct {
+	BroadcasterUserID           string `json:"broadcaster_user_id"`
+	BroadcasterUserLogin        string `json:"broadcaster_user_login"`
+	EmoteMode                   bool   `json:"emote_mode"`
+	FollowerMode                bool   `json:"follower_mode"`
+	FollowerModeDurationMinutes *int   `json:"follower_mode_duration_minutes"`
+	SlowMode                    bool   `json:"slow_mode"`
+	SlowModeWaitTimeSeconds     *int   `json:"slow_mode_wait_time_seconds"`
+	SubscriberMode              bool   `json:"subscriber_mode"`
+	UniqueChatMode              bool   `json:"unique_chat_mode"`
+}
+
+// toRoomStateMessage converts the event to a ROOMSTATE message, with all settings (like the one received when joining)
+func (ev chatSettingsEvent) toRoomStateMessage() irc.RoomStateMessage {
+	flag := func(enabled bool) int {
+		if enabled {
+			return 1
+		}
+		return 0
+	}
+	followers := -1
+	if ev.FollowerMode {
+		followers = 0
+		if ev.FollowerModeDurationMinutes != nil {
+			followers = *ev.FollowerModeDurationMinutes
+		}
+	}
+	slow := 0
+	if ev.SlowMode && ev.SlowModeWaitTimeSeconds != nil {
+		slow = *ev.SlowModeWaitTimeSeconds
+	}
+
+	state := map[string]int{
+		"emote-only":     flag(ev.EmoteMode),
+		"followers-only": followers,
+		"r9k":            flag(ev.UniqueChatMode),
+		"slow":           slow,
+		"subs-only":      flag(ev.SubscriberMode),
+	}
+	tags := map[string]string{"room-id": ev.BroadcasterUserID}
+	for name, value := range state {
+		tags[name] = strconv.Itoa(value)
+	}
+	return irc.RoomStateMessage{
+		Type:    irc.ROOMSTATE,
+		RawType: "ROOMSTATE",
+		Tags:    tags,
+		Channel: ev.BroadcasterUserLogin,
+		RoomID:  ev.BroadcasterUserID,
+		State:   state,
+	}
+}
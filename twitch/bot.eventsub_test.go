@@ -0,0 +1,273 @@
+package twitch
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~ashkeel/containers/sync"
+	irc "github.com/gempir/go-twitch-irc/v4"
+
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
+)
+
+func testChatMessageEvent(server *mock.Server, text string) map[string]any {
+	return map[string]any{
+		"broadcaster_user_id":    server.User.ID,
+		"broadcaster_user_login": server.User.Login,
+		"broadcaster_user_name":  server.User.DisplayName,
+		"chatter_user_id":        "1234",
+		"chatter_user_login":     "chatter",
+		"chatter_user_name":      "Chatter",
+		"message_id":             "message-1",
+		"message": map[string]any{
+			"text":      text,
+			"fragments": []map[string]any{{"type": "text", "text": text}},
+		},
+		"color":        "#FF0000",
+		"badges":       []map[string]any{{"set_id": "moderator", "id": "1", "info": ""}},
+		"message_type": "text",
+	}
+}
+
+func TestEventSubChat(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+	bot := newBot(client, BotConfig{Channel: server.User.Login, ChatTransport: ChatTransportEventSub})
+	t.Cleanup(func() { _ = bot.Close() })
+	if _, ok := bot.Client.(*eventSubChat); !ok {
+		t.Fatalf("expected EventSub chat client, got %T", bot.Client)
+	}
+	bot.customCommands.Set(map[string]BotCustomCommand{
+		"!ping": {Enabled: true, Response: "pong", AccessLevel: ALTModerators, ResponseType: ResponseTypeReply},
+	})
+	if err := bot.updateTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	go bot.Connect()
+
+	// Without a bot account, chat is read as the broadcaster
+	waitFor(t, "chat subscription", func() bool {
+		for _, subscription := range server.Subscriptions() {
+			if subscription.Type == chatMessageTopic && subscription.Condition.UserID == server.User.ID &&
+				subscription.Condition.BroadcasterUserID == server.User.ID {
+				return true
+			}
+		}
+		return false
+	})
+
+	if err := server.SendNotification(chatMessageTopic, testChatMessageEvent(server, "!ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent *mock.Request
+	waitFor(t, "command response", func() bool {
+		for _, request := range server.Requests() {
+			if request.Path == "/chat/messages" {
+				sent = &request
+				return true
+			}
+		}
+		return false
+	})
+	body := string(sent.Body)
+	if !strings.Contains(body, `"message":"pong"`) || !strings.Contains(body, `"reply_parent_message_id":"message-1"`) ||
+		!strings.Contains(body, `"sender_id":"`+server.User.ID+`"`) {
+		t.Fatalf("unexpected message sent: %s", body)
+	}
+
+	var message irc.PrivateMessage
+	if err := db.GetJSON(ChatEventKey, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.User.Name != "chatter" || message.Channel != server.User.Login || message.Message != "!ping" {
+		t.Fatalf("unexpected chat event: %+v", message)
+	}
+}
+
+func TestEventSubChatDuplicateMessages(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, _ := newMockClient(t, server)
+	chat := newEventSubChat(client)
+	t.Cleanup(func() { _ = chat.Disconnect() })
+
+	received := sync.NewSlice[string]()
+	chat.OnPrivateMessage(func(message irc.PrivateMessage) {
+		received.Push(message.Message)
+	})
+	chat.Join(server.User.Login)
+	go chat.Connect()
+
+	waitFor(t, "chat subscription", func() bool {
+		for _, subscription := range server.Subscriptions() {
+			if subscription.Type == chatMessageTopic {
+				return true
+			}
+		}
+		return false
+	})
+
+	// Twitch can deliver the same message more than once
+	for _, text := range []string{"first", "first again", "second"} {
+		id := "message-1"
+		if text == "second" {
+			id = "message-2"
+		}
+		if err := server.SendNotificationWithID(chatMessageTopic, id, testChatMessageEvent(server, text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "chat messages", func() bool { return received.Size() >= 2 })
+	if messages := received.Copy(); len(messages) != 2 || messages[0] != "first" || messages[1] != "second" {
+		t.Fatalf("expected duplicate message to be ignored, got %v", messages)
+	}
+}
+
+func TestChatMessageEventConversion(t *testing.T) {
+	var event chatMessageEvent
+	err := json.UnmarshalFromString(`{
+		"broadcaster_user_id": "1", "broadcaster_user_login": "streamer",
+		"chatter_user_id": "2", "chatter_user_login": "viewer", "chatter_user_name": "Viewer",
+		"message_id": "abc",
+		"message": {"text": "héllo Kappa Kappa", "fragments": [
+			{"type": "text", "text": "héllo "},
+			{"type": "emote", "text": "Kappa", "emote": {"id": "25"}},
+			{"type": "text", "text": " "},
+			{"type": "emote", "text": "Kappa", "emote": {"id": "25"}}
+		]},
+		"color": "#00FF00",
+		"badges": [{"set_id": "subscriber", "id": "12", "info": "14"}, {"set_id": "vip", "id": "1", "info": ""}],
+		"message_type": "text",
+		"cheer": {"bits": 100},
+		"reply": {"parent_message_id": "parent", "parent_message_body": "hi", "parent_user_id": "3",
+			"parent_user_name": "Other", "parent_user_login": "other", "thread_message_id": "thread", "thread_user_login": "other"},
+		"channel_points_custom_reward_id": null,
+		"source_broadcaster_user_id": "4", "source_message_id": "source", "source_badges": [{"set_id": "moderator", "id": "1", "info": ""}]
+	}`, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := event.toPrivateMessage(time.Now())
+	if getUserAccessLevel(message.User) != ALTVIP {
+		t.Fatalf("expected VIP access level, got %s (badges %v)", getUserAccessLevel(message.User), message.User.Badges)
+	}
+	if message.User.Badges["subscriber"] != 12 || message.Tags["badge-info"] != "subscriber/14" {
+		t.Fatalf("unexpected badges: %v %s", message.User.Badges, message.Tags["badge-info"])
+	}
+	if len(message.Emotes) != 1 || message.Emotes[0].Count != 2 || message.Emotes[0].Positions[0] != (irc.EmotePosition{Start: 6, End: 10}) {
+		t.Fatalf("unexpected emotes: %+v", message.Emotes[0])
+	}
+	if message.Bits != 100 {
+		t.Fatalf("expected 100 bits, got %d", message.Bits)
+	}
+	if message.Reply == nil || message.Reply.ParentMsgID != "parent" || message.Tags["reply-thread-parent-msg-id"] != "thread" {
+		t.Fatalf("unexpected reply: %+v", message.Reply)
+	}
+	if message.Tags["source-room-id"] != "4" || message.Tags["source-id"] != "source" || message.Tags["source-badges"] != "moderator/1" {
+		t.Fatalf("unexpected shared chat tags: %v", message.Tags)
+	}
+}
+
+func TestEventSubChatEvents(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+	bot := newBot(client, BotConfig{Channel: server.User.Login, ChatTransport: ChatTransportEventSub, ChatHistory: 10})
+	t.Cleanup(func() { _ = bot.Close() })
+	go bot.Connect()
+
+	waitFor(t, "chat subscriptions", func() bool {
+		count := 0
+		for _, subscription := range server.Subscriptions() {
+			if subscription.Condition.BroadcasterUserID == server.User.ID {
+				count++
+			}
+		}
+		return count >= len(chatTopics)
+	})
+
+	if err := server.SendNotification(chatMessageTopic, testChatMessageEvent(server, "delete me")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "chat message", func() bool {
+		history, _ := bot.chatHistory.GetKey(server.User.Login)
+		return len(history) == 1
+	})
+
+	err := server.SendNotification(chatMessageDeleteTopic, map[string]any{
+		"broadcaster_user_id":    server.User.ID,
+		"broadcaster_user_login": server.User.Login,
+		"broadcaster_user_name":  server.User.DisplayName,
+		"target_user_id":         "1234",
+		"target_user_login":      "chatter",
+		"target_user_name":       "Chatter",
+		"message_id":             "message-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "message deletion", func() bool {
+		var deleted irc.ClearMessage
+		return db.GetJSON(MessageDeletedEventKey, &deleted) == nil && deleted.TargetMsgID == "message-1"
+	})
+	if history, _ := bot.chatHistory.GetKey(server.User.Login); len(history) != 0 {
+		t.Fatalf("deleted message is still in history: %+v", history)
+	}
+}
+
+func TestChatNotificationConversion(t *testing.T) {
+	var event chatNotificationEvent
+	err := json.UnmarshalFromString(`{
+		"broadcaster_user_id": "1", "broadcaster_user_login": "streamer",
+		"chatter_user_id": "2", "chatter_user_login": "raider", "chatter_user_name": "Raider",
+		"chatter_is_anonymous": false, "color": "", "badges": [],
+		"system_message": "1000 raiders from Raider have joined!",
+		"message_id": "abc", "message": {"text": "", "fragments": []},
+		"notice_type": "raid",
+		"raid": {"user_id": "2", "user_name": "Raider", "user_login": "raider", "viewer_count": 1000000, "profile_image_url": "https://example.com"},
+		"sub": null
+	}`, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notice := event.toUserNoticeMessage(time.Now())
+	if notice.MsgID != "raid" || notice.Tags["msg-id"] != "raid" || notice.SystemMsg != "1000 raiders from Raider have joined!" {
+		t.Fatalf("unexpected notice: %+v", notice)
+	}
+	if notice.MsgParams["msg-param-viewer-count"] != "1000000" || notice.MsgParams["msg-param-user-login"] != "raider" {
+		t.Fatalf("unexpected notice params: %v", notice.MsgParams)
+	}
+	if notice.Channel != "streamer" || notice.User.Name != "raider" {
+		t.Fatalf("unexpected notice channel or user: %s %s", notice.Channel, notice.User.Name)
+	}
+}
+
+func TestChatSettingsConversion(t *testing.T) {
+	var event chatSettingsEvent
+	err := json.UnmarshalFromString(`{
+		"broadcaster_user_id": "1", "broadcaster_user_login": "streamer",
+		"emote_mode": false, "follower_mode": true, "follower_mode_duration_minutes": 10,
+		"slow_mode": false, "slow_mode_wait_time_seconds": null,
+		"subscriber_mode": true, "unique_chat_mode": false
+	}`, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := event.toRoomStateMessage()
+	expected := map[string]int{"emote-only": 0, "followers-only": 10, "r9k": 0, "slow": 0, "subs-only": 1}
+	for name, value := range expected {
+		if state.State[name] != value {
+			t.Fatalf("unexpected room state: %v", state.State)
+		}
+	}
+}
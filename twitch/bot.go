@@ -2,6 +2,7 @@ package twitch
 
 import (
 	"errors"
+	"slices"
 	"strings"
 	"text/template"
 	"time"
@@ -29,6 +30,10 @@ type IRCBot interface {
 	OnPrivateMessage(handler func(irc.PrivateMessage))
 	OnUserJoinMessage(handler func(message irc.UserJoinMessage))
 	OnUserPartMessage(handler func(message irc.UserPartMessage))
+	OnClearChatMessage(handler func(message irc.ClearChatMessage))
+	OnClearMessage(handler func(message irc.ClearMessage))
+	OnUserNoticeMessage(handler func(message irc.UserNoticeMessage))
+	OnRoomStateMessage(handler func(message irc.RoomStateMessage))
 }
 
 type Bot struct {
@@ -37,14 +42,20 @@ type Bot struct {
 
 	api         *Client
 	username    string
+	channels    []string
 	logger      *zap.Logger
 	lastMessage *sync.RWSync[time.Time]
-	chatHistory *sync.Slice[irc.PrivateMessage]
+	chatHistory *sync.Map[string, []irc.PrivateMessage]
+	history     *sync.Map[string, any] // Other chat event histories, by key
+	histories   *historyWriter
+	roomState   *sync.Map[string, irc.RoomStateMessage]
+	queue       *sendQueue
 
 	commands        *sync.Map[string, BotCommand]
 	customCommands  *sync.Map[string, BotCustomCommand]
 	customTemplates *sync.Map[string, *template.Template]
-	customFunctions template.FuncMap
+	customFunctions template.FuncMap       // Built-in functions, only set up once
+	extraFunctions  *sync.Map[string, any] // Functions added by other modules
 
 	OnConnect *utils.SyncList[BotConnectHandler]
 	OnMessage *utils.SyncList[BotMessageHandler]
@@ -54,8 +65,10 @@ type Bot struct {
 	cancelWriteRPCSub      database.CancelFunc
 
 	// Module specific vars
-	Timers *BotTimerModule
-	Alerts *BotAlertsModule
+	Timers  *BotTimerModule
+	Alerts  *BotAlertsModule
+	ChatLog *BotChatLogModule
+	Viewers *BotViewersModule
 }
 
 type BotConnectHandler interface {
@@ -63,6 +76,7 @@ type BotConnectHandler interface {
 	HandleBotConnect()
 }
 
+// BotMessageHandler receives chat messages from the main channel
 type BotMessageHandler interface {
 	utils.Comparable
 	HandleBotMessage(message irc.PrivateMessage)
@@ -70,12 +84,29 @@ type BotMessageHandler interface {
 
 func (b *Bot) Migrate(old *Bot) {
 	utils.MergeSyncMap(b.commands, old.commands)
+	utils.MergeSyncMap(b.extraFunctions, old.extraFunctions)
 	// Get registered commands and handlers from old bot
 	b.OnConnect.Copy(old.OnConnect)
 	b.OnMessage.Copy(old.OnMessage)
 }
 
 func newBot(api *Client, config BotConfig) *Bot {
+	if config.ChatTransport == ChatTransportEventSub {
+		// Messages are sent as the bot account (or the broadcaster), use its name to recognize them
+		if user, err := api.GetBotUser(); err == nil {
+			config.Username = user.Login
+		} else {
+			api.logger.Error("Could not look up bot account for EventSub chat", zap.Error(err))
+		}
+		return newBotWithClient(newEventSubChat(api), api, config)
+	}
+
+	// Log in as the bot account if authorized, with the configured token otherwise
+	if login, token, ok := api.botChatCredentials(); ok {
+		config.Username = login
+		config.Token = token
+	}
+
 	// Create client
 	client := irc.NewClient(config.Username, config.Token)
 
@@ -88,13 +119,19 @@ func newBotWithClient(client IRCBot, api *Client, config BotConfig) *Bot {
 		Config: config,
 
 		username:        strings.ToLower(config.Username), // Normalize username
+		channels:        botChannels(config),
 		logger:          api.logger,
 		api:             api,
 		lastMessage:     sync.NewRWSync(time.Now()),
 		commands:        sync.NewMap[string, BotCommand](),
 		customCommands:  sync.NewMap[string, BotCustomCommand](),
 		customTemplates: sync.NewMap[string, *template.Template](),
-		chatHistory:     sync.NewSlice[irc.PrivateMessage](),
+		extraFunctions:  sync.NewMap[string, any](),
+		chatHistory:     sync.NewMap[string, []irc.PrivateMessage](),
+		history:         sync.NewMap[string, any](),
+		histories:       newHistoryWriter(api.db, api.logger),
+		roomState:       sync.NewMap[string, irc.RoomStateMessage](),
+		queue:           newSendQueue(client, api.logger, botRateLimit(config), config.DropDuplicateMessages),
 
 		OnConnect: utils.NewSyncList[BotConnectHandler](),
 		OnMessage: utils.NewSyncList[BotMessageHandler](),
@@ -104,13 +141,19 @@ func newBotWithClient(client IRCBot, api *Client, config BotConfig) *Bot {
 	client.OnPrivateMessage(bot.onMessageHandler)
 	client.OnUserJoinMessage(bot.onJoinHandler)
 	client.OnUserPartMessage(bot.onPartHandler)
+	client.OnClearChatMessage(bot.onClearChatHandler)
+	client.OnClearMessage(bot.onClearMessageHandler)
+	client.OnUserNoticeMessage(bot.onUserNoticeHandler)
+	client.OnRoomStateMessage(bot.onRoomStateHandler)
 
-	bot.Client.Join(config.Channel)
+	bot.Client.Join(bot.channels...)
 	bot.setupFunctions()
 
 	// Load modules
 	bot.Timers = SetupTimers(bot)
 	bot.Alerts = SetupAlerts(bot)
+	bot.ChatLog = SetupChatLog(bot)
+	bot.Viewers = SetupViewers(bot)
 
 	// Load custom commands
 	var customCommands map[string]BotCustomCommand
@@ -161,12 +204,28 @@ func (b *Bot) onPartHandler(message irc.UserPartMessage) {
 }
 
 func (b *Bot) onMessageHandler(message irc.PrivateMessage) {
-	for _, handler := range b.OnMessage.Items() {
-		if handler != nil {
-			handler.HandleBotMessage(message)
+	// Modules (like loyalty) only work with the main channel
+	mainChannel := b.IsMainChannel(message.Channel)
+	if mainChannel {
+		// Update the viewer registry first, so other modules see up-to-date viewers
+		if b.Viewers != nil {
+			b.Viewers.OnMessage(message)
+		}
+		if b.api.sessions != nil {
+			b.api.sessions.OnChatMessage()
+		}
+		for _, handler := range b.OnMessage.Items() {
+			if handler != nil {
+				handler.HandleBotMessage(message)
+			}
 		}
 	}
 
+	// Log every message, even the ones ignored below
+	if b.ChatLog != nil {
+		b.ChatLog.OnMessage(message)
+	}
+
 	// Ignore messages for a while or twitch will get mad!
 	if time.Now().Before(b.lastMessage.Get().Add(time.Second * time.Duration(b.Config.CommandCooldown))) {
 		b.logger.Debug("Message received too soon, ignoring")
@@ -176,7 +235,7 @@ func (b *Bot) onMessageHandler(message irc.PrivateMessage) {
 	lowercaseMessage := strings.TrimSpace(strings.ToLower(message.Message))
 
 	// Check if it's a command
-	if strings.HasPrefix(lowercaseMessage, "!") {
+	if mainChannel && strings.HasPrefix(lowercaseMessage, "!") {
 		// Run through supported commands
 		for cmd, data := range b.commands.Copy() {
 			if !data.Enabled {
@@ -196,7 +255,7 @@ func (b *Bot) onMessageHandler(message irc.PrivateMessage) {
 
 	// Run through custom commands
 	for cmd, data := range b.customCommands.Copy() {
-		if !data.Enabled {
+		if !data.Enabled || !b.commandEnabledIn(data, message.Channel) {
 			continue
 		}
 		lc := strings.ToLower(cmd)
@@ -211,20 +270,20 @@ func (b *Bot) onMessageHandler(message irc.PrivateMessage) {
 		b.lastMessage.Set(time.Now())
 	}
 
-	err := b.api.db.PutJSON(ChatEventKey, message)
+	eventKey := b.channelKey(ChatEventKey, message.Channel)
+	err := b.api.db.PutJSON(eventKey, message)
 	if err != nil {
-		b.logger.Warn("Could not save chat message to key", zap.String("key", ChatEventKey), zap.Error(err))
+		b.logger.Warn("Could not save chat message to key", zap.String("key", eventKey), zap.Error(err))
 	}
 	if b.Config.ChatHistory > 0 {
-		history := b.chatHistory.Get()
+		channel := normalizeChannel(message.Channel)
+		history, _ := b.chatHistory.GetKey(channel)
 		if len(history) >= b.Config.ChatHistory {
 			history = history[len(history)-b.Config.ChatHistory+1:]
 		}
-		b.chatHistory.Set(append(history, message))
-		err = b.api.db.PutJSON(ChatHistoryKey, b.chatHistory.Get())
-		if err != nil {
-			b.logger.Warn("Could not save message to chat history", zap.Error(err))
-		}
+		history = append(history, message)
+		b.chatHistory.SetKey(channel, history)
+		b.histories.Put(b.channelKey(ChatHistoryKey, channel), history)
 	}
 
 	if b.Timers != nil {
@@ -232,6 +291,84 @@ func (b *Bot) onMessageHandler(message irc.PrivateMessage) {
 	}
 }
 
+// isCommand returns true if the message would trigger a command
+func (b *Bot) isCommand(message string) bool {
+	lowercaseMessage := strings.TrimSpace(strings.ToLower(message))
+	if strings.HasPrefix(lowercaseMessage, "!") {
+		return true
+	}
+	parts := strings.SplitN(lowercaseMessage, " ", 2)
+	for cmd, data := range b.customCommands.Copy() {
+		if data.Enabled && strings.ToLower(cmd) == parts[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// botChannels returns the normalized names of all the channels to join, the main channel is always first
+func botChannels(config BotConfig) []string {
+	channels := []string{normalizeChannel(config.Channel)}
+	for _, channel := range config.ExtraChannels {
+		channel = normalizeChannel(channel)
+		if channel == "" || slices.Contains(channels, channel) {
+			continue
+		}
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+func normalizeChannel(channel string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(channel), "#"))
+}
+
+// Channels returns all the channels the bot joins, starting with the main one
+func (b *Bot) Channels() []string {
+	return slices.Clone(b.channels)
+}
+
+func (b *Bot) IsMainChannel(channel string) bool {
+	channel = normalizeChannel(channel)
+	return channel == "" || channel == b.channels[0]
+}
+
+// channelKey returns the key to use for a channel, keys for the main channel don't have the channel name
+func (b *Bot) channelKey(key string, channel string) string {
+	if b.IsMainChannel(channel) {
+		return key
+	}
+	return key + "/" + normalizeChannel(channel)
+}
+
+// resolveChannels returns the joined channels out of a list, the main channel if the list is empty
+func (b *Bot) resolveChannels(channels []string) []string {
+	if len(channels) == 0 {
+		return b.channels[:1]
+	}
+	var resolved []string
+	for _, channel := range channels {
+		channel = normalizeChannel(channel)
+		if slices.Contains(b.channels, channel) && !slices.Contains(resolved, channel) {
+			resolved = append(resolved, channel)
+		}
+	}
+	return resolved
+}
+
+func (b *Bot) commandEnabledIn(command BotCustomCommand, channel string) bool {
+	if len(command.Channels) == 0 {
+		return true
+	}
+	channel = normalizeChannel(channel)
+	for _, enabled := range command.Channels {
+		if normalizeChannel(enabled) == channel {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *Bot) onConnectHandler() {
 	for _, handler := range b.OnConnect.Items() {
 		if handler != nil {
@@ -256,6 +393,14 @@ func (b *Bot) Close() error {
 	if b.Alerts != nil {
 		b.Alerts.Close()
 	}
+	if b.ChatLog != nil {
+		b.ChatLog.Close()
+	}
+	if b.Viewers != nil {
+		b.Viewers.Close()
+	}
+	b.queue.Close()
+	b.histories.Flush()
 	return b.Client.Disconnect()
 }
 
@@ -273,7 +418,7 @@ func (b *Bot) updateCommands(value string) {
 }
 
 func (b *Bot) handleWritePlainMessageRPC(value string) {
-	b.Client.Say(b.Config.Channel, value)
+	b.WriteMessage(value)
 }
 
 func (b *Bot) handleWriteMessageRPC(value string) {
@@ -283,41 +428,92 @@ func (b *Bot) handleWriteMessageRPC(value string) {
 		b.logger.Warn("Failed to decode write message request", zap.Error(err))
 		return
 	}
+	channel := b.channels[0]
+	if request.Channel != "" {
+		channel = normalizeChannel(request.Channel)
+		if !slices.Contains(b.channels, channel) {
+			b.logger.Warn("Cannot send message to a channel the bot hasn't joined", zap.String("channel", channel))
+			return
+		}
+	}
 	if request.ReplyTo != nil && *request.ReplyTo != "" {
-		b.Client.Reply(b.Config.Channel, *request.ReplyTo, request.Message)
+		b.Reply(channel, *request.ReplyTo, request.Message, MessagePriorityNormal)
 		return
 	}
 	if request.WhisperTo != nil && *request.WhisperTo != "" {
-		client, err := b.api.GetUserClient(false)
-		reply, err := client.SendUserWhisper(&helix.SendUserWhisperParams{
-			FromUserID: b.api.User.ID,
-			ToUserID:   *request.WhisperTo,
-			Message:    request.Message,
-		})
-		if reply.Error != "" {
-			b.logger.Error("Failed to send whisper", zap.String("code", reply.Error), zap.String("message", reply.ErrorMessage))
-		}
-		if err != nil {
-			b.logger.Error("Failed to send whisper", zap.Error(err))
-		}
+		b.sendWhisper(*request.WhisperTo, request.Message)
 		return
 	}
 	if request.Announce {
-		client, err := b.api.GetUserClient(false)
-		reply, err := client.SendChatAnnouncement(&helix.SendChatAnnouncementParams{
-			BroadcasterID: b.api.User.ID,
-			ModeratorID:   b.api.User.ID,
-			Message:       request.Message,
-		})
-		if reply.Error != "" {
-			b.logger.Error("Failed to send announcement", zap.String("code", reply.Error), zap.String("message", reply.ErrorMessage))
-		}
-		if err != nil {
-			b.logger.Error("Failed to send announcement", zap.Error(err))
-		}
+		b.sendAnnouncement(channel, request.Message)
+		return
+	}
+	b.Say(channel, request.Message, MessagePriorityNormal)
+}
+
+// sendWhisper sends a whisper to a user (by ID) from the bot account
+func (b *Bot) sendWhisper(to string, message string) {
+	client, err := b.api.GetBotClient(false)
+	if err != nil {
+		b.logger.Error("Failed to get API client for whisper", zap.Error(err))
+		return
+	}
+	from, err := b.api.GetBotUser()
+	if err != nil {
+		b.logger.Error("Failed to look up bot user for whisper", zap.Error(err))
+		return
+	}
+	reply, err := client.SendUserWhisper(&helix.SendUserWhisperParams{
+		FromUserID: from.ID,
+		ToUserID:   to,
+		Message:    message,
+	})
+	if err != nil {
+		b.logger.Error("Failed to send whisper", zap.Error(err))
+		return
+	}
+	if reply.Error != "" {
+		b.logger.Error("Failed to send whisper", zap.String("code", reply.Error), zap.String("message", reply.ErrorMessage))
+	}
+}
+
+// sendAnnouncement sends an announcement to a channel from the bot account, which must be a moderator there
+func (b *Bot) sendAnnouncement(channel string, message string) {
+	broadcasterID, err := b.channelUserID(channel)
+	if err != nil {
+		b.logger.Error("Failed to look up channel for announcement", zap.String("channel", channel), zap.Error(err))
 		return
 	}
-	b.Client.Say(b.Config.Channel, request.Message)
+	client, err := b.api.GetBotClient(false)
+	if err != nil {
+		b.logger.Error("Failed to get API client for announcement", zap.Error(err))
+		return
+	}
+	moderator, err := b.api.GetBotUser()
+	if err != nil {
+		b.logger.Error("Failed to look up bot user for announcement", zap.Error(err))
+		return
+	}
+	reply, err := client.SendChatAnnouncement(&helix.SendChatAnnouncementParams{
+		BroadcasterID: broadcasterID,
+		ModeratorID:   moderator.ID,
+		Message:       message,
+	})
+	if err != nil {
+		b.logger.Error("Failed to send announcement", zap.Error(err))
+		return
+	}
+	if reply.Error != "" {
+		b.logger.Error("Failed to send announcement", zap.String("code", reply.Error), zap.String("message", reply.ErrorMessage))
+	}
+}
+
+// channelUserID returns the user ID of a channel's owner
+func (b *Bot) channelUserID(channel string) (string, error) {
+	if b.IsMainChannel(channel) {
+		return b.api.User.ID, nil
+	}
+	return b.api.userIDForLogin(channel)
 }
 
 func (b *Bot) updateTemplates() error {
@@ -343,8 +539,41 @@ func (b *Bot) Connect() {
 	}
 }
 
+// WriteMessage writes a message to the main channel
 func (b *Bot) WriteMessage(message string) {
-	b.Client.Say(b.Config.Channel, message)
+	b.Say(b.channels[0], message, MessagePriorityNormal)
+}
+
+// WriteMessageTo writes a message to one of the joined channels (the main one if empty)
+func (b *Bot) WriteMessageTo(channel string, message string) {
+	b.Say(channel, message, MessagePriorityNormal)
+}
+
+// Say queues a message for one of the joined channels (the main one if empty),
+// messages are sent in order of priority without going over Twitch's rate limits
+func (b *Bot) Say(channel string, message string, priority MessagePriority) {
+	if channel == "" {
+		channel = b.channels[0]
+	}
+	b.queue.push(priority, queuedMessage{channel: normalizeChannel(channel), message: message})
+}
+
+// Reply queues a reply to a chat message, see Say
+func (b *Bot) Reply(channel string, messageID string, message string, priority MessagePriority) {
+	if channel == "" {
+		channel = b.channels[0]
+	}
+	b.queue.push(priority, queuedMessage{channel: normalizeChannel(channel), replyTo: messageID, message: message})
+}
+
+// botRateLimit returns how many messages the bot can send every 30 seconds
+func botRateLimit(config BotConfig) int {
+	// The broadcaster is always allowed the higher limit in their own channel
+	broadcaster := len(config.ExtraChannels) == 0 && strings.EqualFold(config.Username, normalizeChannel(config.Channel))
+	if config.ModeratorRateLimit || broadcaster {
+		return chatRateModerator
+	}
+	return chatRateUser
 }
 
 func (b *Bot) RegisterCommand(trigger string, command BotCommand) {
@@ -0,0 +1,60 @@
+package twitch
+
+import (
+	stdsync "sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+// How often chat histories are written to the database, busy chats would rewrite them on every message otherwise
+const historyFlushInterval = 2 * time.Second
+
+// historyWriter batches writes to history keys, only the last value of each key is saved
+type historyWriter struct {
+	db     *database.LocalDBClient
+	logger *zap.Logger
+
+	mu      stdsync.Mutex
+	pending map[string]any
+	timer   *time.Timer
+}
+
+func newHistoryWriter(db *database.LocalDBClient, logger *zap.Logger) *historyWriter {
+	return &historyWriter{
+		db:      db,
+		logger:  logger,
+		pending: make(map[string]any),
+	}
+}
+
+// Put schedules a write of the history to key, the value must not be modified afterwards
+func (w *historyWriter) Put(key string, history any) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[key] = history
+	if w.timer == nil {
+		w.timer = time.AfterFunc(historyFlushInterval, w.Flush)
+	}
+}
+
+// Flush writes all pending histories right away
+func (w *historyWriter) Flush() {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]any)
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.mu.Unlock()
+
+	for key, history := range pending {
+		if err := w.db.PutJSON(key, history); err != nil {
+			w.logger.Warn("Could not save chat history", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
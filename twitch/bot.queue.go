@@ -0,0 +1,232 @@
+package twitch
+
+import (
+	stdsync "sync"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// MessagePriority decides which queued chat messages are sent first when the bot is rate limited
+type MessagePriority int
+
+const (
+	// MessagePriorityLow is for messages nobody is waiting for (timers)
+	MessagePriorityLow MessagePriority = iota
+	// MessagePriorityNormal is for alerts and messages sent through RPC
+	MessagePriorityNormal
+	// MessagePriorityHigh is for responses to chat commands
+	MessagePriorityHigh
+
+	messagePriorityCount = int(MessagePriorityHigh) + 1
+)
+
+const (
+	// Twitch chat limits: 20 messages every 30 seconds, 100 if the bot is a moderator or the broadcaster
+	chatRateWindow    = 30 * time.Second
+	chatRateUser      = 20
+	chatRateModerator = 100
+
+	// Messages longer than this are rejected by Twitch
+	maxChatMessageLength = 500
+
+	// Identical messages sent to the same channel within this window are dropped (if enabled)
+	chatDedupeWindow = 30 * time.Second
+
+	// Maximum number of queued messages per priority, the oldest ones are dropped past this
+	maxQueuedMessages = 100
+)
+
+type queuedMessage struct {
+	channel string
+	replyTo string
+	message string
+}
+
+type lastQueuedMessage struct {
+	replyTo string
+	message string
+	time    time.Time
+}
+
+// rateWindow allows up to limit messages in any window of time, like Twitch counts them.
+// A token bucket refilling at the same rate would allow bursts of almost twice the limit
+// within a window, which Twitch punishes by ignoring the bot for a while
+type rateWindow struct {
+	limit  int
+	window time.Duration
+	sent   []time.Time // Send times of the messages in the current window, oldest first
+}
+
+func newRateWindow(limit int, window time.Duration) *rateWindow {
+	return &rateWindow{
+		limit:  limit,
+		window: window,
+	}
+}
+
+// wait returns how long until another message can be sent
+func (r *rateWindow) wait(now time.Time) time.Duration {
+	for len(r.sent) > 0 && now.Sub(r.sent[0]) >= r.window {
+		r.sent = r.sent[1:]
+	}
+	if len(r.sent) < r.limit {
+		return 0
+	}
+	return r.sent[0].Add(r.window).Sub(now)
+}
+
+func (r *rateWindow) take(now time.Time) {
+	r.sent = append(r.sent, now)
+}
+
+// sendQueue holds outgoing chat messages and writes them to chat without exceeding the rate limit
+type sendQueue struct {
+	client IRCBot
+	logger *zap.Logger
+
+	mu     stdsync.Mutex
+	queues [messagePriorityCount][]queuedMessage
+	last   map[string]lastQueuedMessage
+	dedupe bool
+	limit  *rateWindow
+
+	notify chan struct{}
+	done   chan struct{}
+	closed stdsync.Once
+	wg     stdsync.WaitGroup
+}
+
+func newSendQueue(client IRCBot, logger *zap.Logger, rateLimit int, dedupe bool) *sendQueue {
+	queue := &sendQueue{
+		client: client,
+		logger: logger,
+		last:   make(map[string]lastQueuedMessage),
+		dedupe: dedupe,
+		limit:  newRateWindow(rateLimit, chatRateWindow),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	queue.wg.Add(1)
+	go queue.run()
+	return queue
+}
+
+// push queues a message, splitting it if it's too long and dropping it if it was just sent (if enabled)
+func (q *sendQueue) push(priority MessagePriority, message queuedMessage) {
+	if message.message == "" {
+		return
+	}
+	if priority < MessagePriorityLow || priority > MessagePriorityHigh {
+		priority = MessagePriorityNormal
+	}
+
+	q.mu.Lock()
+	now := time.Now()
+	if last, ok := q.last[message.channel]; ok && q.dedupe && last.message == message.message && last.replyTo == message.replyTo && now.Sub(last.time) < chatDedupeWindow {
+		q.mu.Unlock()
+		q.logger.Debug("Dropping duplicate chat message", zap.String("channel", message.channel), zap.String("message", message.message))
+		return
+	}
+	q.last[message.channel] = lastQueuedMessage{replyTo: message.replyTo, message: message.message, time: now}
+
+	for _, part := range splitChatMessage(message.message) {
+		if len(q.queues[priority]) >= maxQueuedMessages {
+			q.logger.Warn("Too many queued chat messages, dropping the oldest one", zap.String("channel", q.queues[priority][0].channel))
+			q.queues[priority] = q.queues[priority][1:]
+		}
+		q.queues[priority] = append(q.queues[priority], queuedMessage{channel: message.channel, replyTo: message.replyTo, message: part})
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the next message to send, if rate limits allow it, or returns how long to wait
+func (q *sendQueue) pop() (queuedMessage, time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for priority := messagePriorityCount - 1; priority >= 0; priority-- {
+		if len(q.queues[priority]) == 0 {
+			continue
+		}
+		if wait := q.limit.wait(now); wait > 0 {
+			return queuedMessage{}, wait, false
+		}
+		message := q.queues[priority][0]
+		q.queues[priority] = q.queues[priority][1:]
+		q.limit.take(now)
+		return message, 0, true
+	}
+	return queuedMessage{}, 0, false
+}
+
+func (q *sendQueue) run() {
+	defer q.wg.Done()
+	for {
+		message, wait, ok := q.pop()
+		if ok {
+			if message.replyTo != "" {
+				q.client.Reply(message.channel, message.replyTo, message.message)
+			} else {
+				q.client.Say(message.channel, message.message)
+			}
+			continue
+		}
+
+		// Nothing to send, wait for new messages (or for the rate limit to allow sending)
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-q.notify:
+		case <-timer:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Close stops sending messages, anything still queued is discarded
+func (q *sendQueue) Close() {
+	q.closed.Do(func() {
+		close(q.done)
+	})
+	q.wg.Wait()
+}
+
+// splitChatMessage splits a message in parts Twitch will accept, preferably on spaces
+func splitChatMessage(message string) []string {
+	runes := []rune(message)
+	if len(runes) <= maxChatMessageLength {
+		return []string{message}
+	}
+
+	var parts []string
+	for len(runes) > maxChatMessageLength {
+		cut := maxChatMessageLength
+		for i := maxChatMessageLength; i > maxChatMessageLength/2; i-- {
+			if unicode.IsSpace(runes[i]) {
+				cut = i
+				break
+			}
+		}
+		parts = append(parts, string(runes[:cut]))
+		// Skip the whitespace the message was split on
+		for cut < len(runes) && unicode.IsSpace(runes[cut]) {
+			cut++
+		}
+		runes = runes[cut:]
+	}
+	if len(runes) > 0 {
+		parts = append(parts, string(runes))
+	}
+	return parts
+}
@@ -0,0 +1,151 @@
+package twitch
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func newTestSendQueue(t *testing.T, rateLimit int, dedupe bool) *sendQueue {
+	// Not started, messages are taken out with pop
+	return &sendQueue{
+		client: &fakeIRCBot{},
+		logger: zaptest.NewLogger(t),
+		last:   make(map[string]lastQueuedMessage),
+		dedupe: dedupe,
+		limit:  newRateWindow(rateLimit, chatRateWindow),
+	}
+}
+
+func TestSendQueuePriority(t *testing.T) {
+	queue := newTestSendQueue(t, 1, false)
+	queue.push(MessagePriorityLow, queuedMessage{channel: "main", message: "timer"})
+	queue.push(MessagePriorityNormal, queuedMessage{channel: "main", message: "alert"})
+	queue.push(MessagePriorityHigh, queuedMessage{channel: "main", replyTo: "abc", message: "pong"})
+
+	message, _, ok := queue.pop()
+	if !ok || message.message != "pong" || message.replyTo != "abc" {
+		t.Fatalf("expected command response to be sent first, got %+v", message)
+	}
+
+	// Over the limit, the next message must wait
+	_, wait, ok := queue.pop()
+	if ok || wait <= 0 {
+		t.Fatal("expected to be rate limited")
+	}
+
+	queue.limit = newRateWindow(2, chatRateWindow)
+	first, _, _ := queue.pop()
+	second, _, _ := queue.pop()
+	if first.message != "alert" || second.message != "timer" {
+		t.Fatalf("messages sent in the wrong order: %s, %s", first.message, second.message)
+	}
+}
+
+func TestSendQueueDedupe(t *testing.T) {
+	queue := newTestSendQueue(t, chatRateUser, true)
+	queue.push(MessagePriorityNormal, queuedMessage{channel: "main", message: "hello"})
+	queue.push(MessagePriorityNormal, queuedMessage{channel: "main", message: "hello"})
+	queue.push(MessagePriorityNormal, queuedMessage{channel: "costreamer", message: "hello"})
+	queue.push(MessagePriorityNormal, queuedMessage{channel: "main", message: "world"})
+	queue.push(MessagePriorityNormal, queuedMessage{channel: "main", message: "hello"})
+
+	if len(queue.queues[MessagePriorityNormal]) != 4 {
+		t.Fatalf("expected only the consecutive duplicate to be dropped, got %+v", queue.queues[MessagePriorityNormal])
+	}
+
+	// Old messages can be sent again
+	queue.last["main"] = lastQueuedMessage{message: "hello", time: time.Now().Add(-chatDedupeWindow)}
+	queue.push(MessagePriorityNormal, queuedMessage{channel: "main", message: "hello"})
+	if len(queue.queues[MessagePriorityNormal]) != 5 {
+		t.Fatal("expected message to be queued after the dedupe window")
+	}
+
+	// Repeated messages are sent unless dropping them was enabled
+	queue = newTestSendQueue(t, chatRateUser, false)
+	queue.push(MessagePriorityNormal, queuedMessage{channel: "main", message: "hello"})
+	queue.push(MessagePriorityNormal, queuedMessage{channel: "main", message: "hello"})
+	if len(queue.queues[MessagePriorityNormal]) != 2 {
+		t.Fatalf("expected duplicate to be queued, got %+v", queue.queues[MessagePriorityNormal])
+	}
+}
+
+func TestSendQueueRateLimit(t *testing.T) {
+	bot, fake, _ := newTestBot(t, BotConfig{Channel: "main", Username: "bot"})
+
+	for i := 0; i < chatRateUser+5; i++ {
+		bot.Say("", strings.Repeat("a", i+1), MessagePriorityNormal)
+	}
+	waitFor(t, "messages to be sent", func() bool { return len(fake.Sent()) >= chatRateUser })
+
+	// Give the queue a chance to go over the limit
+	time.Sleep(100 * time.Millisecond)
+	if sent := len(fake.Sent()); sent != chatRateUser {
+		t.Fatalf("expected %d messages to be sent before rate limiting, got %d", chatRateUser, sent)
+	}
+
+	// Sending as fast as allowed for a few windows must never go over the limit in any window
+	limit := newRateWindow(chatRateUser, chatRateWindow)
+	start := time.Now()
+	var sent []time.Time
+	for now := start; now.Before(start.Add(3 * chatRateWindow)); now = now.Add(100 * time.Millisecond) {
+		for limit.wait(now) == 0 {
+			limit.take(now)
+			sent = append(sent, now)
+		}
+	}
+	for i, from := range sent {
+		count := 0
+		for _, other := range sent[i:] {
+			if other.Sub(from) < chatRateWindow {
+				count++
+			}
+		}
+		if count > chatRateUser {
+			t.Fatalf("%d messages sent in the window starting at %s", count, from.Sub(start))
+		}
+	}
+	if len(sent) != 3*chatRateUser {
+		t.Fatalf("expected %d messages over three windows, got %d", 3*chatRateUser, len(sent))
+	}
+}
+
+func TestBotRateLimit(t *testing.T) {
+	if limit := botRateLimit(BotConfig{Channel: "main", Username: "bot"}); limit != chatRateUser {
+		t.Fatalf("expected user rate limit, got %d", limit)
+	}
+	if limit := botRateLimit(BotConfig{Channel: "#Main", Username: "main"}); limit != chatRateModerator {
+		t.Fatalf("expected broadcaster rate limit, got %d", limit)
+	}
+	if limit := botRateLimit(BotConfig{Channel: "main", Username: "bot", ModeratorRateLimit: true}); limit != chatRateModerator {
+		t.Fatalf("expected moderator rate limit, got %d", limit)
+	}
+}
+
+func TestSplitChatMessage(t *testing.T) {
+	words := strings.TrimSpace(strings.Repeat("word ", 250))
+	parts := splitChatMessage(words)
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+	for _, part := range parts {
+		if len([]rune(part)) > maxChatMessageLength || strings.HasPrefix(part, " ") || strings.HasSuffix(part, " ") {
+			t.Fatalf("invalid part: %q", part)
+		}
+	}
+	if strings.Join(parts, " ") != words {
+		t.Fatal("words were lost while splitting")
+	}
+
+	// No spaces to split on, cut at the limit (counting characters, not bytes)
+	parts = splitChatMessage(strings.Repeat("é", 600))
+	if len(parts) != 2 || len([]rune(parts[0])) != maxChatMessageLength || len([]rune(parts[1])) != 100 {
+		t.Fatalf("unexpected parts: %d", len(parts))
+	}
+
+	if parts := splitChatMessage("short"); len(parts) != 1 || parts[0] != "short" {
+		t.Fatalf("short message was changed: %v", parts)
+	}
+}
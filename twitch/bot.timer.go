@@ -2,10 +2,14 @@ package twitch
 
 import (
 	"math/rand"
+	"sort"
+	"strings"
+	"text/template"
 	"time"
 
 	"git.sr.ht/~ashkeel/containers/sync"
 	irc "github.com/gempir/go-twitch-irc/v4"
+	"github.com/nicklaw5/helix/v2"
 	"go.uber.org/zap"
 
 	"git.sr.ht/~ashkeel/strimertul/database"
@@ -15,6 +19,20 @@ const BotTimersKey = "twitch/bot-modules/timers/config"
 
 type BotTimersConfig struct {
 	Timers map[string]BotTimer `json:"timers" desc:"List of timers as a dictionary"`
+
+	// Timer groups, only one timer from each group can trigger at a time
+	Groups map[string]BotTimerGroup `json:"groups,omitempty" desc:"Timer groups, only one timer from each group can trigger at a time"`
+
+	// How many minutes of chat to consider when measuring chat activity (defaults to 5)
+	ActivityWindow int `json:"activity_window,omitempty" desc:"How many minutes of chat to consider when measuring chat activity (defaults to 5)"`
+
+	// Users whose messages don't count towards chat activity (e.g. other bots)
+	ActivityIgnoredUsers []string `json:"activity_ignored_users,omitempty" desc:"Users whose messages don't count towards chat activity (e.g. other bots)"`
+}
+
+type BotTimerGroup struct {
+	// Minimum amount of time (in seconds) between two timers of the group triggering
+	Cooldown int `json:"cooldown" desc:"Minimum amount of time (in seconds) between two timers of the group triggering"`
 }
 
 type BotTimer struct {
@@ -24,39 +42,107 @@ type BotTimer struct {
 	// Timer name (must be unique)
 	Name string `json:"name" desc:"Timer name (must be unique)"`
 
-	// Minimum chat messages in the last 5 minutes for timer to trigger
-	MinimumChatActivity int `json:"minimum_chat_activity" desc:"Minimum chat messages in the last 5 minutes for timer to trigger"`
+	// Minimum chat messages in the activity window for timer to trigger
+	MinimumChatActivity int `json:"minimum_chat_activity" desc:"Minimum chat messages in the activity window for timer to trigger"`
+
+	// Minimum unique chatters in the activity window for timer to trigger
+	MinimumChatters int `json:"minimum_chatters,omitempty" desc:"Minimum unique chatters in the activity window for timer to trigger"`
 
 	// Minimum amount of time (in seconds) that needs to pass before it triggers again
 	MinimumDelay int `json:"minimum_delay" desc:"Minimum amount of time (in seconds) that needs to pass before it triggers again"`
 
 	// Messages to write (randomly chosen)
 	Messages []string `json:"messages" desc:"Messages to write (randomly chosen)"`
+
+	// Cron expression (minute hour day month weekday) of when the timer should trigger, replaces the minimum delay
+	Cron string `json:"cron,omitempty" desc:"Cron expression (minute hour day month weekday) of when the timer should trigger, replaces the minimum delay"`
+
+	// If set, trigger once per stream this many seconds after the stream started, replaces the minimum delay
+	StreamOffset int `json:"stream_offset,omitempty" desc:"If set, trigger once per stream this many seconds after the stream started, replaces the minimum delay"`
+
+	// Only trigger when the stream is in this state (leave empty to always trigger)
+	StreamState TimerStreamState `json:"stream_state,omitempty" desc:"Only trigger when the stream is in this state (leave empty to always trigger)"`
+
+	// Only trigger when streaming one of these categories (name or ID)
+	Categories []string `json:"categories,omitempty" desc:"Only trigger when streaming one of these categories (name or ID)"`
+
+	// How to pick the message to write
+	Rotation TimerRotation `json:"rotation,omitempty" desc:"How to pick the message to write"`
+
+	// Group the timer belongs to (leave empty for none)
+	Group string `json:"group,omitempty" desc:"Group the timer belongs to (leave empty for none)"`
+
+	// Maximum random delay (in seconds) to add before writing the message
+	Jitter int `json:"jitter,omitempty" desc:"Maximum random delay (in seconds) to add before writing the message"`
+
+	// Channels to write the timer in (leave empty for the main channel), chat activity is checked separately for each
+	Channels []string `json:"channels,omitempty" desc:"Channels to write the timer in (leave empty for the main channel), chat activity is checked separately for each"`
 }
 
+type TimerStreamState string
+
+const (
+	TimerStreamStateAny     TimerStreamState = ""
+	TimerStreamStateLive    TimerStreamState = "live"
+	TimerStreamStateOffline TimerStreamState = "offline"
+)
+
+type TimerRotation string
+
+const (
+	// Every message is used once, in random order, before any is repeated (default)
+	TimerRotationShuffle    TimerRotation = "shuffle"
+	TimerRotationRandom     TimerRotation = "random"
+	TimerRotationSequential TimerRotation = "sequential"
+)
+
+// shuffleBag holds the messages of a timer that haven't been used yet
+type shuffleBag struct {
+	remaining []int
+	size      int
+	last      int
+}
+
+// TimerTemplateData is the data available to timer message templates
+type TimerTemplateData struct {
+	Timer  string
+	Live   bool
+	Stream helix.Stream
+}
+
+// Default length (in minutes) of the chat activity window
 const AverageMessageWindow = 5
 
 type BotTimerModule struct {
 	Config BotTimersConfig
 
-	bot         *Bot
-	lastTrigger *sync.Map[string, time.Time]
-	messages    *sync.Slice[int]
+	bot            *Bot
+	lastTrigger    *sync.Map[string, time.Time]
+	offsetTriggers *sync.Map[string, string]
+	nextMessage    *sync.Map[string, int]
+	bags           *sync.Map[string, shuffleBag]
+	groupTrigger   *sync.Map[string, time.Time]
+	activity       map[string]*activityTracker
+	templates      *sync.RWSync[map[string]*template.Template]
 
 	cancelTimerSub database.CancelFunc
 }
 
 func SetupTimers(bot *Bot) *BotTimerModule {
 	mod := &BotTimerModule{
-		bot:         bot,
-		lastTrigger: sync.NewMap[string, time.Time](),
-		messages:    sync.NewSlice[int](),
+		bot:            bot,
+		lastTrigger:    sync.NewMap[string, time.Time](),
+		offsetTriggers: sync.NewMap[string, string](),
+		nextMessage:    sync.NewMap[string, int](),
+		bags:           sync.NewMap[string, shuffleBag](),
+		groupTrigger:   sync.NewMap[string, time.Time](),
+		activity:       make(map[string]*activityTracker),
+		templates:      sync.NewRWSync(make(map[string]*template.Template)),
 	}
 
-	// Fill messages with zero values
-	// (This can probably be done faster)
-	for i := 0; i < AverageMessageWindow; i += 1 {
-		mod.messages.Push(0)
+	// Chat activity is tracked separately for every channel
+	for _, channel := range bot.channels {
+		mod.activity[channel] = &activityTracker{}
 	}
 
 	// Load config from database
@@ -79,6 +165,7 @@ func SetupTimers(bot *Bot) *BotTimerModule {
 			bot.logger.Debug("Error reloading timer config", zap.Error(err))
 		} else {
 			bot.logger.Info("Reloaded timer config")
+			mod.compileTemplates()
 		}
 	})
 	if err != nil {
@@ -86,6 +173,7 @@ func SetupTimers(bot *Bot) *BotTimerModule {
 	}
 
 	bot.logger.Debug("Loaded timers", zap.Int("timers", len(mod.Config.Timers)))
+	mod.compileTemplates()
 
 	// Start goroutine for clearing message counters and running timers
 	go mod.runTimers()
@@ -101,38 +189,150 @@ func (m *BotTimerModule) runTimers() {
 		timeUntilNextTick := nextTick.Sub(currentTime)
 		time.Sleep(timeUntilNextTick)
 
-		err := m.bot.api.db.PutJSON(ChatActivityKey, m.messages.Get())
-		if err != nil {
-			m.bot.logger.Warn("Error saving chat activity", zap.Error(err))
-		}
-
 		// Calculate activity
 		activity := m.currentChatActivity()
-
-		// Reset timer
-		index := time.Now().Minute() % AverageMessageWindow
-		messages := m.messages.Get()
-		messages[index] = 0
-		m.messages.Set(messages)
+		for channel, channelActivity := range activity {
+			err := m.bot.api.db.PutJSON(m.bot.channelKey(ChatActivityKey, channel), channelActivity)
+			if err != nil {
+				m.bot.logger.Warn("Error saving chat activity", zap.String("channel", channel), zap.Error(err))
+			}
+		}
 
 		// Run timers
-		for name, timer := range m.Config.Timers {
-			m.ProcessTimer(name, timer, activity)
+		m.processTimers(activity)
+	}
+}
+
+func (m *BotTimerModule) processTimers(activity map[string]ChatActivity) {
+	config := m.Config
+	now := time.Now()
+
+	// Timers that have waited the longest go first, so they get precedence within their group
+	names := make([]string, 0, len(config.Timers))
+	for name := range config.Timers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		first, _ := m.lastTrigger.GetKey(names[i])
+		second, _ := m.lastTrigger.GetKey(names[j])
+		return first.Before(second)
+	})
+
+	triggeredGroups := make(map[string]bool)
+	for _, name := range names {
+		timer := config.Timers[name]
+		if timer.Group != "" {
+			if triggeredGroups[timer.Group] {
+				continue
+			}
+			lastGroupTrigger, _ := m.groupTrigger.GetKey(timer.Group)
+			cooldown := time.Duration(config.Groups[timer.Group].Cooldown) * time.Second
+			if now.Sub(lastGroupTrigger) < cooldown {
+				continue
+			}
+		}
+
+		if !m.ProcessTimer(name, timer, activity) || timer.Group == "" {
+			continue
 		}
+		triggeredGroups[timer.Group] = true
+		m.groupTrigger.SetKey(timer.Group, now)
 	}
 }
 
-func (m *BotTimerModule) ProcessTimer(name string, timer BotTimer, activity int) {
+// ProcessTimer writes the timer's message if all its conditions are met, returns true if it triggered
+func (m *BotTimerModule) ProcessTimer(name string, timer BotTimer, activity map[string]ChatActivity) bool {
 	// Must be enabled
-	if !timer.Enabled {
-		return
+	if !timer.Enabled || len(timer.Messages) < 1 {
+		return false
+	}
+
+	// Check stream state and category
+	live := m.bot.api.IsLive()
+	switch timer.StreamState {
+	case TimerStreamStateLive:
+		if !live {
+			return false
+		}
+	case TimerStreamStateOffline:
+		if live {
+			return false
+		}
+	}
+	stream, _ := m.bot.api.CurrentStream()
+	if len(timer.Categories) > 0 && !matchesCategory(stream, timer.Categories) {
+		return false
+	}
+
+	now := time.Now()
+	if !m.isDue(name, timer, stream, now) {
+		return false
+	}
+
+	// Make sure chat activity is high enough, in at least one of the timer's channels
+	var channels []string
+	for _, channel := range m.bot.resolveChannels(timer.Channels) {
+		channelActivity := activity[channel]
+		if channelActivity.Messages < timer.MinimumChatActivity || channelActivity.Chatters < timer.MinimumChatters {
+			continue
+		}
+		channels = append(channels, channel)
+	}
+	if len(channels) < 1 {
+		return false
+	}
+
+	// Write message to chat, after a random delay if jitter is set
+	message := m.pickMessage(name, timer)
+	data := TimerTemplateData{
+		Timer:  name,
+		Live:   live,
+		Stream: stream,
+	}
+	if timer.Jitter > 0 {
+		delay := time.Duration(rand.Int63n(int64(timer.Jitter)*int64(time.Second) + 1))
+		time.AfterFunc(delay, func() {
+			m.writeMessage(message, data, channels)
+		})
+	} else {
+		m.writeMessage(message, data, channels)
+	}
+
+	// Update last trigger
+	m.lastTrigger.SetKey(name, now)
+	if timer.StreamOffset > 0 {
+		m.offsetTriggers.SetKey(name, stream.ID)
+	}
+	return true
+}
+
+// isDue checks if the timer's schedule says it should trigger now
+func (m *BotTimerModule) isDue(name string, timer BotTimer, stream helix.Stream, now time.Time) bool {
+	// Offset timers trigger once per stream
+	if timer.StreamOffset > 0 {
+		if stream.ID == "" {
+			return false
+		}
+		if lastStream, _ := m.offsetTriggers.GetKey(name); lastStream == stream.ID {
+			return false
+		}
+		return now.Sub(stream.StartedAt) >= time.Duration(timer.StreamOffset)*time.Second
+	}
+
+	if timer.Cron != "" {
+		schedule, err := parseCron(timer.Cron)
+		if err != nil {
+			return false
+		}
+		// Ticks happen as close as possible to the start of a minute, but could be slightly early
+		return schedule.Matches(now.Round(time.Minute))
 	}
 
 	// Check if enough time has passed
 	lastTriggeredTime, ok := m.lastTrigger.GetKey(name)
 	if !ok {
 		// If it's the first time we're checking it, start the cooldown
-		lastTriggeredTime = time.Now()
+		lastTriggeredTime = now
 		m.lastTrigger.SetKey(name, lastTriggeredTime)
 	}
 
@@ -141,24 +341,90 @@ func (m *BotTimerModule) ProcessTimer(name string, timer BotTimer, activity int)
 		minDelay = 60
 	}
 
-	now := time.Now()
-	if now.Sub(lastTriggeredTime) < time.Duration(minDelay)*time.Second {
-		return
+	return now.Sub(lastTriggeredTime) >= time.Duration(minDelay)*time.Second
+}
+
+func matchesCategory(stream helix.Stream, categories []string) bool {
+	if stream.GameID == "" {
+		return false
+	}
+	for _, category := range categories {
+		if category == stream.GameID || strings.EqualFold(category, stream.GameName) {
+			return true
+		}
 	}
+	return false
+}
 
-	// Make sure chat activity is high enough
-	if activity < timer.MinimumChatActivity {
-		return
+// pickMessage chooses the next message to write for a timer
+func (m *BotTimerModule) pickMessage(name string, timer BotTimer) string {
+	switch timer.Rotation {
+	case TimerRotationRandom:
+		return timer.Messages[rand.Intn(len(timer.Messages))]
+	case TimerRotationSequential:
+		index, _ := m.nextMessage.GetKey(name)
+		index %= len(timer.Messages)
+		m.nextMessage.SetKey(name, index+1)
+		return timer.Messages[index]
+	default:
+		bag, ok := m.bags.GetKey(name)
+		if !ok {
+			bag.last = -1
+		}
+		bag = bag.next(len(timer.Messages))
+		m.bags.SetKey(name, bag)
+		return timer.Messages[bag.last]
 	}
+}
 
-	// Pick a random message
-	message := timer.Messages[rand.Intn(len(timer.Messages))]
+// next takes a message out of the bag, refilling it if it's empty or the message list changed
+func (b shuffleBag) next(size int) shuffleBag {
+	if b.size != size {
+		b.remaining = nil
+		b.size = size
+	}
+	if len(b.remaining) < 1 {
+		b.remaining = rand.Perm(size)
+		// Don't repeat the last message right after a refill
+		if size > 1 && b.remaining[0] == b.last {
+			b.remaining[0], b.remaining[size-1] = b.remaining[size-1], b.remaining[0]
+		}
+	}
+	b.last = b.remaining[0]
+	b.remaining = b.remaining[1:]
+	return b
+}
 
-	// Write message to chat
-	m.bot.WriteMessage(message)
+func (m *BotTimerModule) writeMessage(message string, data TimerTemplateData, channels []string) {
+	tpl, ok := m.templates.Get()[message]
+	if !ok {
+		// Template failed to compile, write it as-is
+		for _, channel := range channels {
+			m.bot.Say(channel, message, MessagePriorityLow)
+		}
+		return
+	}
+	writeTemplate(m.bot, tpl, data, MessagePriorityLow, channels...)
+}
 
-	// Update last trigger
-	m.lastTrigger.SetKey(name, now)
+func (m *BotTimerModule) compileTemplates() {
+	templates := make(map[string]*template.Template)
+	for name, timer := range m.Config.Timers {
+		if timer.Cron != "" {
+			if _, err := parseCron(timer.Cron); err != nil {
+				m.bot.logger.Warn("Invalid cron expression for timer, it will never trigger", zap.String("timer", name), zap.Error(err))
+			}
+		}
+		for _, message := range timer.Messages {
+			tpl, err := m.bot.MakeTemplate(message)
+			if err != nil {
+				m.bot.logger.Error("Error compiling timer template", zap.String("timer", name), zap.Error(err))
+				continue
+			}
+			templates[message] = tpl
+		}
+	}
+	m.templates.Set(templates)
 }
 
 func (m *BotTimerModule) Close() {
@@ -167,15 +433,34 @@ func (m *BotTimerModule) Close() {
 	}
 }
 
-func (m *BotTimerModule) currentChatActivity() int {
-	total := 0
-	for _, v := range m.messages.Get() {
-		total += v
+// currentChatActivity returns the chat activity of every channel
+func (m *BotTimerModule) currentChatActivity() map[string]ChatActivity {
+	window := m.Config.ActivityWindow
+	if window < 1 {
+		window = AverageMessageWindow
 	}
-	return total
+	now := time.Now()
+	activity := make(map[string]ChatActivity, len(m.activity))
+	for channel, tracker := range m.activity {
+		activity[channel] = tracker.Activity(now, window)
+	}
+	return activity
 }
 
 func (m *BotTimerModule) OnMessage(message irc.PrivateMessage) {
-	index := message.Time.Minute() % AverageMessageWindow
-	m.messages.SetIndex(index, 1)
+	// Messages from the bot and commands are not chat activity
+	user := strings.ToLower(message.User.Name)
+	if user == m.bot.username || m.bot.isCommand(message.Message) {
+		return
+	}
+	for _, ignored := range m.Config.ActivityIgnoredUsers {
+		if strings.EqualFold(ignored, user) {
+			return
+		}
+	}
+	tracker, ok := m.activity[normalizeChannel(message.Channel)]
+	if !ok {
+		return
+	}
+	tracker.Add(user, message.Time)
 }
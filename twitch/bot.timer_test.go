@@ -0,0 +1,35 @@
+package twitch
+
+import "testing"
+
+func TestShuffleBag(t *testing.T) {
+	const size = 5
+	bag := shuffleBag{last: -1}
+	previous := -1
+	for round := 0; round < 20; round++ {
+		seen := make(map[int]bool)
+		for i := 0; i < size; i++ {
+			bag = bag.next(size)
+			if seen[bag.last] {
+				t.Fatalf("message %d repeated before the bag was emptied", bag.last)
+			}
+			if bag.last == previous {
+				t.Fatalf("message %d picked twice in a row", bag.last)
+			}
+			seen[bag.last] = true
+			previous = bag.last
+		}
+	}
+}
+
+func TestShuffleBagResize(t *testing.T) {
+	bag := shuffleBag{last: -1}
+	bag = bag.next(10)
+	bag = bag.next(2)
+	if bag.last >= 2 {
+		t.Fatalf("picked message %d from a list of 2", bag.last)
+	}
+	if len(bag.remaining) != 1 {
+		t.Fatalf("expected bag to be refilled with 2 messages, %d remaining", len(bag.remaining))
+	}
+}
@@ -0,0 +1,337 @@
+package twitch
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	irc "github.com/gempir/go-twitch-irc/v4"
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+const (
+	// ViewerPrefix is followed by the Twitch user ID of the viewer
+	ViewerPrefix = "twitch/viewers/"
+	// ViewerLoginPrefix is followed by a username, its value is the user ID of who has that name
+	ViewerLoginPrefix = "twitch/viewer-logins/"
+
+	FirstTimeChatterEventKey = "twitch/ev/first-time-chatter"
+	ReturningChatterEventKey = "twitch/ev/returning-chatter"
+
+	SetViewerNotesRPC = "twitch/@set-viewer-notes"
+)
+
+const commandLastSeen = "!lastseen"
+
+var ErrViewerNotFound = errors.New("viewer not found")
+
+// Viewer is everything strimertul remembers about a viewer of the main channel
+type Viewer struct {
+	// Twitch user ID, it never changes
+	ID string `json:"id" desc:"Twitch user ID, it never changes"`
+
+	// Current username
+	Login string `json:"login" desc:"Current username"`
+
+	// Current display name
+	DisplayName string `json:"display_name" desc:"Current display name"`
+
+	// Previous usernames and display names, oldest first
+	NameHistory []ViewerName `json:"name_history,omitempty" desc:"Previous usernames and display names, oldest first"`
+
+	// When the viewer was first seen (in chat or in an event)
+	FirstSeen time.Time `json:"first_seen" desc:"When the viewer was first seen (in chat or in an event)"`
+
+	// When the viewer last wrote in chat
+	LastSeen time.Time `json:"last_seen" desc:"When the viewer last wrote in chat"`
+
+	// How many messages the viewer wrote in chat
+	MessageCount int `json:"message_count" desc:"How many messages the viewer wrote in chat"`
+
+	// Whether the viewer was subscribed last time they were seen
+	Subscriber bool `json:"subscriber" desc:"Whether the viewer was subscribed last time they were seen"`
+
+	// Whether the viewer follows the channel (only known for follows received while strimertul was running)
+	Follower bool `json:"follower" desc:"Whether the viewer follows the channel (only known for follows received while strimertul was running)"`
+
+	// When the viewer followed the channel
+	FollowedAt *time.Time `json:"followed_at,omitempty" desc:"When the viewer followed the channel"`
+
+	// Notes written by the streamer or moderators
+	Notes string `json:"notes,omitempty" desc:"Notes written by the streamer or moderators"`
+}
+
+// ViewerName is a name a viewer had in the past
+type ViewerName struct {
+	// Username
+	Login string `json:"login" desc:"Username"`
+
+	// Display name
+	DisplayName string `json:"display_name" desc:"Display name"`
+
+	// When the viewer stopped using this name (roughly, it's when the new name was first seen)
+	Until time.Time `json:"until" desc:"When the viewer stopped using this name (roughly, it's when the new name was first seen)"`
+}
+
+// ViewerChatEvent is sent when a viewer writes in chat for the first time, or for the first time in a stream
+type ViewerChatEvent struct {
+	// Viewer info, already updated with the message
+	Viewer Viewer `json:"viewer" desc:"Viewer info, already updated with the message"`
+
+	// When the viewer last wrote in chat before this message (missing for first-time chatters)
+	PreviouslySeen *time.Time `json:"previously_seen,omitempty" desc:"When the viewer last wrote in chat before this message (missing for first-time chatters)"`
+
+	// The chat message
+	Message irc.PrivateMessage `json:"message" desc:"The chat message"`
+}
+
+// SetViewerNotesRequest is the payload of the set viewer notes RPC
+type SetViewerNotesRequest struct {
+	// Twitch user ID of the viewer
+	UserID string `json:"user_id" desc:"Twitch user ID of the viewer"`
+
+	// New notes, replacing the old ones
+	Notes string `json:"notes" desc:"New notes, replacing the old ones"`
+}
+
+// BotViewersModule keeps a registry of the viewers of the main channel, by user ID so renames don't lose anything
+type BotViewersModule struct {
+	bot *Bot
+	mu  stdsync.Mutex
+
+	cancelEventSubSub database.CancelFunc
+	cancelNotesSub    database.CancelFunc
+}
+
+func SetupViewers(bot *Bot) *BotViewersModule {
+	mod := &BotViewersModule{
+		bot: bot,
+	}
+
+	var err error
+	err, mod.cancelEventSubSub = bot.api.db.SubscribeKey(EventSubEventKey, mod.onEventSubEvent)
+	if err != nil {
+		bot.logger.Error("Could not subscribe to EventSub events for viewer registry", zap.Error(err))
+	}
+	err, mod.cancelNotesSub = bot.api.db.SubscribeKey(SetViewerNotesRPC, mod.handleSetNotesRPC)
+	if err != nil {
+		bot.logger.Error("Could not set-up viewer notes subscription", zap.Error(err))
+	}
+
+	bot.RegisterCommand(commandLastSeen, BotCommand{
+		Description: "See when a viewer last wrote in chat",
+		Usage:       commandLastSeen + " <user>",
+		AccessLevel: ALTEveryone,
+		Handler:     mod.cmdLastSeen,
+		Enabled:     true,
+	})
+
+	return mod
+}
+
+func (m *BotViewersModule) Close() {
+	if m.cancelEventSubSub != nil {
+		m.cancelEventSubSub()
+	}
+	if m.cancelNotesSub != nil {
+		m.cancelNotesSub()
+	}
+}
+
+// Get returns a viewer by user ID
+func (m *BotViewersModule) Get(userID string) (Viewer, error) {
+	var viewer Viewer
+	err := m.bot.api.db.GetJSON(ViewerPrefix+userID, &viewer)
+	if errors.Is(err, database.ErrEmptyKey) {
+		return viewer, ErrViewerNotFound
+	}
+	return viewer, err
+}
+
+// GetByLogin returns the viewer who last used a username
+func (m *BotViewersModule) GetByLogin(login string) (Viewer, error) {
+	var userID string
+	err := m.bot.api.db.GetJSON(ViewerLoginPrefix+normalizeChannel(login), &userID)
+	if err != nil || userID == "" {
+		return Viewer{}, ErrViewerNotFound
+	}
+	return m.Get(userID)
+}
+
+// OnMessage updates the registry with a chat message and sends first-time/returning chatter events
+func (m *BotViewersModule) OnMessage(message irc.PrivateMessage) {
+	if message.User.ID == "" || strings.EqualFold(message.User.Name, m.bot.username) {
+		return
+	}
+	now := message.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var previous Viewer
+	viewer, err := m.update(message.User.ID, message.User.Name, message.User.DisplayName, now, func(viewer *Viewer) {
+		previous = *viewer
+		viewer.LastSeen = now
+		viewer.MessageCount++
+		_, subscriber := message.User.Badges["subscriber"]
+		_, founder := message.User.Badges["founder"]
+		viewer.Subscriber = subscriber || founder
+	})
+	if err != nil {
+		m.bot.logger.Warn("Could not update viewer", zap.String("user-id", message.User.ID), zap.Error(err))
+		return
+	}
+
+	if previous.MessageCount == 0 {
+		m.writeEvent(FirstTimeChatterEventKey, ViewerChatEvent{Viewer: viewer, Message: message})
+		return
+	}
+
+	// Viewers are returning on their first message of a stream
+	if stream, live := m.bot.api.CurrentStream(); live && previous.LastSeen.Before(stream.StartedAt) {
+		m.writeEvent(ReturningChatterEventKey, ViewerChatEvent{Viewer: viewer, PreviouslySeen: &previous.LastSeen, Message: message})
+	}
+}
+
+func (m *BotViewersModule) writeEvent(key string, event ViewerChatEvent) {
+	if err := m.bot.api.db.PutJSON(key, event); err != nil {
+		m.bot.logger.Warn("Could not save viewer event", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// update changes a viewer (creating them if needed) and keeps their names up to date
+func (m *BotViewersModule) update(userID string, login string, displayName string, now time.Time, fn func(viewer *Viewer)) (Viewer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	viewer, err := m.Get(userID)
+	switch {
+	case errors.Is(err, ErrViewerNotFound):
+		viewer = Viewer{ID: userID, FirstSeen: now}
+	case err != nil:
+		return viewer, err
+	}
+
+	login = normalizeChannel(login)
+	oldLogin := viewer.Login
+	if login != "" && (login != viewer.Login || displayName != viewer.DisplayName) {
+		if viewer.Login != "" {
+			viewer.NameHistory = append(viewer.NameHistory, ViewerName{Login: viewer.Login, DisplayName: viewer.DisplayName, Until: now})
+		}
+		viewer.Login = login
+		viewer.DisplayName = displayName
+	}
+	fn(&viewer)
+
+	entries := map[string]any{ViewerPrefix + userID: viewer}
+	if viewer.Login != oldLogin {
+		entries[ViewerLoginPrefix+viewer.Login] = userID
+	}
+	if err := m.bot.api.db.PutJSONBulk(entries); err != nil {
+		return viewer, err
+	}
+	return viewer, nil
+}
+
+func (m *BotViewersModule) onEventSubEvent(value string) {
+	var ev eventSubNotification
+	err := json.UnmarshalFromString(value, &ev)
+	if err != nil {
+		m.bot.logger.Warn("Error parsing webhook payload", zap.Error(err))
+		return
+	}
+	// Test and replayed events are not from real viewers
+	if ev.Synthetic {
+		return
+	}
+
+	now := time.Now()
+	switch ev.Subscription.Type {
+	case helix.EventSubTypeChannelFollow:
+		var followEv helix.EventSubChannelFollowEvent
+		if err := json.Unmarshal(ev.Event, &followEv); err != nil {
+			m.bot.logger.Warn("Error parsing follow event", zap.Error(err))
+			return
+		}
+		_, err = m.update(followEv.UserID, followEv.UserLogin, followEv.UserName, now, func(viewer *Viewer) {
+			followedAt := followEv.FollowedAt.Time
+			viewer.Follower = true
+			viewer.FollowedAt = &followedAt
+		})
+	case helix.EventSubTypeChannelSubscription, helix.EventSubTypeChannelSubscriptionMessage:
+		var subEv helix.EventSubChannelSubscribeEvent
+		if err := json.Unmarshal(ev.Event, &subEv); err != nil {
+			m.bot.logger.Warn("Error parsing subscription event", zap.Error(err))
+			return
+		}
+		_, err = m.update(subEv.UserID, subEv.UserLogin, subEv.UserName, now, func(viewer *Viewer) {
+			viewer.Subscriber = true
+		})
+	default:
+		return
+	}
+	if err != nil {
+		m.bot.logger.Warn("Could not update viewer", zap.String("event", ev.Subscription.Type), zap.Error(err))
+	}
+}
+
+func (m *BotViewersModule) handleSetNotesRPC(value string) {
+	var request SetViewerNotesRequest
+	if err := json.UnmarshalFromString(value, &request); err != nil {
+		m.bot.logger.Warn("Failed to decode set viewer notes request", zap.Error(err))
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	viewer, err := m.Get(request.UserID)
+	if err != nil {
+		m.bot.logger.Warn("Could not set viewer notes", zap.String("user-id", request.UserID), zap.Error(err))
+		return
+	}
+	viewer.Notes = request.Notes
+	if err := m.bot.api.db.PutJSON(ViewerPrefix+viewer.ID, viewer); err != nil {
+		m.bot.logger.Warn("Could not save viewer notes", zap.Error(err))
+	}
+}
+
+func (m *BotViewersModule) cmdLastSeen(bot *Bot, message irc.PrivateMessage) {
+	parts := strings.Fields(message.Message)
+	if len(parts) < 2 {
+		bot.Say(message.Channel, fmt.Sprintf("Usage: %s <user>", commandLastSeen), MessagePriorityHigh)
+		return
+	}
+	login := normalizeChannel(strings.TrimLeft(parts[1], "@"))
+
+	viewer, err := m.GetByLogin(login)
+	if err != nil || viewer.LastSeen.IsZero() {
+		bot.Say(message.Channel, fmt.Sprintf("I haven't seen %s in chat yet!", login), MessagePriorityHigh)
+		return
+	}
+	bot.Say(message.Channel, fmt.Sprintf("%s was last seen in chat %s", viewer.DisplayName, formatTimeAgo(time.Since(viewer.LastSeen))), MessagePriorityHigh)
+}
+
+// formatTimeAgo formats a duration in the past with its largest unit
+func formatTimeAgo(duration time.Duration) string {
+	plural := func(amount int, unit string) string {
+		if amount == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", amount, unit)
+	}
+	switch {
+	case duration < time.Minute:
+		return "just now"
+	case duration < time.Hour:
+		return plural(int(duration/time.Minute), "minute")
+	case duration < 24*time.Hour:
+		return plural(int(duration/time.Hour), "hour")
+	default:
+		return plural(int(duration/(24*time.Hour)), "day")
+	}
+}
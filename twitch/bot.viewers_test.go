@@ -0,0 +1,135 @@
+package twitch
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+)
+
+func TestViewerRegistry(t *testing.T) {
+	bot, _, db := newTestBot(t, BotConfig{Channel: "main", Username: "bot"})
+
+	message := testMessageFrom("main", "1", "100", "hello")
+	message.User.DisplayName = "User100"
+	message.Time = time.Now().Add(-2 * time.Hour)
+	bot.onMessageHandler(message)
+
+	var event ViewerChatEvent
+	if err := db.GetJSON(FirstTimeChatterEventKey, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Viewer.ID != "100" || event.Viewer.MessageCount != 1 || event.Message.ID != "1" {
+		t.Fatalf("unexpected first-time chatter event: %+v", event)
+	}
+
+	// Same viewer with a new name, during a stream that started after their last message
+	bot.api.streamInfo.Set([]helix.Stream{{ID: "stream", StartedAt: time.Now().Add(-time.Hour)}})
+	renamed := testMessageFrom("main", "2", "100", "I changed name")
+	renamed.User.Name = "newname"
+	renamed.User.DisplayName = "NewName"
+	bot.onMessageHandler(renamed)
+
+	if err := db.GetJSON(ReturningChatterEventKey, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Message.ID != "2" || event.PreviouslySeen == nil {
+		t.Fatalf("unexpected returning chatter event: %+v", event)
+	}
+
+	viewer, err := bot.Viewers.GetByLogin("NewName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if viewer.ID != "100" || viewer.MessageCount != 2 || len(viewer.NameHistory) != 1 || viewer.NameHistory[0].Login != "user100" {
+		t.Fatalf("unexpected viewer: %+v", viewer)
+	}
+	if !viewer.FirstSeen.Equal(message.Time) {
+		t.Fatalf("first seen changed: %s", viewer.FirstSeen)
+	}
+
+	// Only the first message of a stream is a returning chatter
+	if err := db.PutJSON(ReturningChatterEventKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	bot.onMessageHandler(testMessageFrom("main", "3", "100", "still here"))
+	var again *ViewerChatEvent
+	if err := db.GetJSON(ReturningChatterEventKey, &again); err != nil {
+		t.Fatal(err)
+	}
+	if again != nil {
+		t.Fatalf("returning chatter event sent twice: %+v", again)
+	}
+
+	// Messages in extra channels and from the bot itself are not counted
+	bot.onMessageHandler(testMessageFrom("other", "4", "100", "hello"))
+	self := testMessageFrom("main", "5", "999", "beep boop")
+	self.User.Name = "bot"
+	bot.onMessageHandler(self)
+	if viewer, _ := bot.Viewers.Get("100"); viewer.MessageCount != 3 {
+		t.Fatalf("expected 3 messages, got %d", viewer.MessageCount)
+	}
+	if _, err := bot.Viewers.Get("999"); err != ErrViewerNotFound {
+		t.Fatalf("bot was added to the registry: %v", err)
+	}
+}
+
+func TestViewerEvents(t *testing.T) {
+	bot, _, _ := newTestBot(t, BotConfig{Channel: "main"})
+
+	bot.Viewers.onEventSubEvent(`{"subscription":{"type":"channel.follow"},"event":{"user_id":"200","user_login":"follower","user_name":"Follower","followed_at":"2024-01-02T03:04:05Z"}}`)
+	bot.Viewers.onEventSubEvent(`{"subscription":{"type":"channel.subscribe"},"event":{"user_id":"200","user_login":"follower","user_name":"Follower","tier":"1000"}}`)
+	bot.Viewers.handleSetNotesRPC(`{"user_id":"200","notes":"very nice"}`)
+
+	viewer, err := bot.Viewers.Get("200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !viewer.Follower || viewer.FollowedAt == nil || viewer.FollowedAt.Year() != 2024 || !viewer.Subscriber {
+		t.Fatalf("follow and subscription were not recorded: %+v", viewer)
+	}
+	if viewer.Notes != "very nice" || viewer.MessageCount != 0 {
+		t.Fatalf("unexpected viewer: %+v", viewer)
+	}
+
+	// Test events don't add viewers
+	bot.Viewers.onEventSubEvent(`{"subscription":{"type":"channel.follow"},"event":{"user_id":"300","user_login":"tester","user_name":"Tester"},"synthetic":true}`)
+	if _, err := bot.Viewers.Get("300"); err == nil {
+		t.Fatal("viewer from a test event was added")
+	}
+}
+
+func TestLastSeenCommand(t *testing.T) {
+	bot, fake, _ := newTestBot(t, BotConfig{Channel: "main"})
+
+	message := testMessageFrom("main", "1", "100", "hello")
+	message.Time = time.Now().Add(-3 * time.Hour)
+	bot.onMessageHandler(message)
+
+	bot.Viewers.cmdLastSeen(bot, testMessage("main", "!lastseen @User100"))
+	bot.Viewers.cmdLastSeen(bot, testMessage("main", "!lastseen nobody"))
+
+	waitFor(t, "command responses", func() bool { return len(fake.Sent()) >= 2 })
+	sent := fake.Sent()
+	if !strings.Contains(sent[0].message, "3 hours ago") {
+		t.Fatalf("unexpected response: %s", sent[0].message)
+	}
+	if !strings.Contains(sent[1].message, "haven't seen nobody") {
+		t.Fatalf("unexpected response: %s", sent[1].message)
+	}
+}
+
+func TestFormatTimeAgo(t *testing.T) {
+	cases := map[time.Duration]string{
+		10 * time.Second: "just now",
+		time.Minute:      "1 minute ago",
+		90 * time.Minute: "1 hour ago",
+		50 * time.Hour:   "2 days ago",
+	}
+	for duration, expected := range cases {
+		if formatted := formatTimeAgo(duration); formatted != expected {
+			t.Errorf("expected %q for %s, got %q", expected, duration, formatted)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package twitch
+
+import (
+	"bytes"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	irc "github.com/gempir/go-twitch-irc/v4"
+	"go.uber.org/zap/zaptest"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+	"git.sr.ht/~ashkeel/strimertul/webserver"
+)
+
+type sentMessage struct {
+	channel string
+	message string
+}
+
+// fakeIRCBot is an IRCBot that records what the bot does instead of connecting to Twitch
+type fakeIRCBot struct {
+	mu        stdsync.Mutex
+	joined    []string
+	sent      []sentMessage
+	token     string
+	onMessage func(irc.PrivateMessage)
+}
+
+func (f *fakeIRCBot) Join(channel ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.joined = append(f.joined, channel...)
+}
+
+func (f *fakeIRCBot) Connect() error    { return nil }
+func (f *fakeIRCBot) Disconnect() error { return nil }
+
+func (f *fakeIRCBot) SetIRCToken(token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = token
+}
+
+func (f *fakeIRCBot) Say(channel, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, sentMessage{channel, message})
+}
+
+func (f *fakeIRCBot) Reply(channel, _, message string) {
+	f.Say(channel, message)
+}
+
+func (f *fakeIRCBot) OnConnect(func())                                    {}
+func (f *fakeIRCBot) OnPrivateMessage(handler func(irc.PrivateMessage))   { f.onMessage = handler }
+func (f *fakeIRCBot) OnUserJoinMessage(func(message irc.UserJoinMessage)) {}
+func (f *fakeIRCBot) OnUserPartMessage(func(message irc.UserPartMessage)) {}
+func (f *fakeIRCBot) OnClearChatMessage(func(irc.ClearChatMessage))       {}
+func (f *fakeIRCBot) OnClearMessage(func(irc.ClearMessage))               {}
+func (f *fakeIRCBot) OnUserNoticeMessage(func(irc.UserNoticeMessage))     {}
+func (f *fakeIRCBot) OnRoomStateMessage(func(irc.RoomStateMessage))       {}
+
+func (f *fakeIRCBot) Sent() []sentMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]sentMessage{}, f.sent...)
+}
+
+func newTestBot(t *testing.T, config BotConfig) (*Bot, *fakeIRCBot, *database.LocalDBClient) {
+	logger := zaptest.NewLogger(t)
+	db, _ := database.CreateInMemoryLocalClient(t)
+	t.Cleanup(func() { database.CleanupLocalClient(db) })
+
+	server, err := webserver.NewServer(db, logger, webserver.DefaultServerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newClient(Config{}, db, server, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeIRCBot{}
+	bot := newBotWithClient(fake, client, config)
+	t.Cleanup(func() { _ = bot.Close() })
+	return bot, fake, db
+}
+
+func testMessage(channel string, text string) irc.PrivateMessage {
+	message := TestMessageData
+	message.Channel = channel
+	message.Message = text
+	message.Time = time.Now()
+	return message
+}
+
+func TestBotJoinsAllChannels(t *testing.T) {
+	bot, fake, _ := newTestBot(t, BotConfig{
+		Channel:       "MainChannel",
+		ExtraChannels: []string{"#costreamer", "maInchannel", "", "other"},
+	})
+
+	expected := []string{"mainchannel", "costreamer", "other"}
+	if len(fake.joined) != len(expected) {
+		t.Fatalf("expected to join %v, joined %v", expected, fake.joined)
+	}
+	for i, channel := range expected {
+		if fake.joined[i] != channel {
+			t.Fatalf("expected to join %v, joined %v", expected, fake.joined)
+		}
+	}
+	if !bot.IsMainChannel("#MainChannel") || bot.IsMainChannel("costreamer") {
+		t.Fatal("main channel not detected correctly")
+	}
+}
+
+func TestBotCustomCommandChannels(t *testing.T) {
+	bot, fake, _ := newTestBot(t, BotConfig{
+		Channel:       "main",
+		ExtraChannels: []string{"costreamer"},
+	})
+	bot.customCommands.Set(map[string]BotCustomCommand{
+		"!everywhere": {Enabled: true, Response: "everywhere", AccessLevel: ALTEveryone},
+		"!costream":   {Enabled: true, Response: "costream", AccessLevel: ALTEveryone, Channels: []string{"CoStreamer"}},
+	})
+	if err := bot.updateTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	bot.onMessageHandler(testMessage("main", "!costream"))
+	bot.onMessageHandler(testMessage("costreamer", "!costream"))
+	bot.lastMessage.Set(time.Time{})
+	bot.onMessageHandler(testMessage("main", "!everywhere"))
+
+	waitFor(t, "command responses", func() bool {
+		return len(fake.Sent()) >= 2
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	sent := fake.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 responses, got %v", sent)
+	}
+	for _, message := range sent {
+		if message.message == "costream" && message.channel != "costreamer" {
+			t.Fatalf("command restricted to costreamer answered in %s", message.channel)
+		}
+	}
+}
+
+func TestBotChannelKeys(t *testing.T) {
+	bot, _, db := newTestBot(t, BotConfig{
+		Channel:       "main",
+		ExtraChannels: []string{"costreamer"},
+		ChatHistory:   5,
+	})
+
+	bot.onMessageHandler(testMessage("main", "hello main"))
+	bot.onMessageHandler(testMessage("costreamer", "hello costreamer"))
+	bot.onMessageHandler(testMessage("costreamer", "hello again"))
+
+	bot.histories.Flush()
+	var mainHistory, extraHistory []irc.PrivateMessage
+	if err := db.GetJSON(ChatHistoryKey, &mainHistory); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GetJSON(ChannelChatHistoryPrefix+"costreamer", &extraHistory); err != nil {
+		t.Fatal(err)
+	}
+	if len(mainHistory) != 1 || len(extraHistory) != 2 {
+		t.Fatalf("expected separate histories, got %d for main and %d for costreamer", len(mainHistory), len(extraHistory))
+	}
+
+	var event irc.PrivateMessage
+	if err := db.GetJSON(ChannelChatEventPrefix+"costreamer", &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Message != "hello again" {
+		t.Fatalf("unexpected chat event for costreamer: %s", event.Message)
+	}
+}
+
+func TestBotWriteMessageChannel(t *testing.T) {
+	bot, fake, _ := newTestBot(t, BotConfig{
+		Channel:       "main",
+		ExtraChannels: []string{"costreamer"},
+	})
+
+	bot.handleWriteMessageRPC(`{"message":"to main"}`)
+	bot.handleWriteMessageRPC(`{"message":"to costreamer","channel":"CoStreamer"}`)
+	bot.handleWriteMessageRPC(`{"message":"to nowhere","channel":"notjoined"}`)
+
+	waitFor(t, "messages to be sent", func() bool { return len(fake.Sent()) >= 2 })
+	sent := fake.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 messages, got %v", sent)
+	}
+	if sent[0] != (sentMessage{"main", "to main"}) || sent[1] != (sentMessage{"costreamer", "to costreamer"}) {
+		t.Fatalf("messages sent to the wrong channels: %v", sent)
+	}
+}
+
+func TestBotTemplateFunctions(t *testing.T) {
+	bot, _, _ := newTestBot(t, BotConfig{Channel: "main"})
+
+	// Modules add functions while templates are being rendered
+	var wg stdsync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			bot.SetTemplateFunction("extra", func() string { return "extra" })
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if _, err := bot.MakeTemplate(`{{ user . }}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	tpl, err := bot.MakeTemplate(`{{ extra }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, nil); err != nil || buf.String() != "extra" {
+		t.Fatalf("expected added function to be called, got %q (%v)", buf.String(), err)
+	}
+
+	bot.RemoveTemplateFunction("extra")
+	if _, err := bot.MakeTemplate(`{{ extra }}`); err == nil {
+		t.Fatal("removed function can still be used")
+	}
+	if _, err := bot.MakeTemplate(`{{ user . }}`); err != nil {
+		t.Fatalf("built-in functions were removed: %s", err)
+	}
+}
@@ -1,11 +1,17 @@
 package twitch
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
 )
 
 type AuthResponse struct {
@@ -16,46 +22,157 @@ type AuthResponse struct {
 	Time         time.Time
 }
 
+// OAuth state of the bot account authorization, the broadcaster one has none
+const botAuthState = "bot"
+
+// Scopes needed by the bot account, for chatting, whispers and announcements
+var botScopes = []string{
+	"user_read",
+	"chat:read",
+	"chat:edit",
+	"whispers:read",
+	"whispers:edit",
+	"user:manage:whispers",
+	"moderator:manage:announcements",
+	"moderator:read:chatters",
+}
+
+// Scopes needed by the account the chatbot uses when chatting through EventSub
+var chatScopes = []string{
+	"user:read:chat",
+	"user:write:chat",
+}
+
+// GetAuthorizationURL returns the URL to authorize the broadcaster account
 func (c *Client) GetAuthorizationURL() string {
+	return c.authorizationURL(c.broadcasterScopes(), "", false)
+}
+
+// GetBotAuthorizationURL returns the URL to authorize the bot account
+func (c *Client) GetBotAuthorizationURL() string {
+	// Force the login page, the user is probably logged in with the broadcaster account
+	return c.authorizationURL(c.botAccountScopes(), botAuthState, true)
+}
+
+// broadcasterScopes returns the scopes needed by the broadcaster account, which chats if there is no bot account
+func (c *Client) broadcasterScopes() []string {
+	scopes := requiredScopes(c.Config.Get())
+	if !c.usesEventSubChat() || c.hasBotAccount() {
+		return scopes
+	}
+	scopes = append(scopes, chatScopes...)
+	slices.Sort(scopes)
+	return scopes
+}
+
+// botAccountScopes returns the scopes needed by the bot account
+func (c *Client) botAccountScopes() []string {
+	if !c.usesEventSubChat() {
+		return botScopes
+	}
+	return append(slices.Clone(botScopes), chatScopes...)
+}
+
+// usesEventSubChat returns true if the chatbot is enabled and chats through EventSub instead of IRC
+func (c *Client) usesEventSubChat() bool {
+	if !c.Config.Get().EnableBot {
+		return false
+	}
+	var config BotConfig
+	if err := c.db.GetJSON(BotConfigKey, &config); err != nil {
+		return false
+	}
+	return config.ChatTransport == ChatTransportEventSub
+}
+
+// hasBotAccount returns true if a bot account was authorized
+func (c *Client) hasBotAccount() bool {
+	var auth AuthResponse
+	return c.db.GetJSON(BotAuthKey, &auth) == nil
+}
+
+func (c *Client) authorizationURL(scopes []string, state string, forceVerify bool) string {
 	if c.API == nil {
 		return "twitch-not-configured"
 	}
-	return c.API.GetAuthorizationURL(&helix.AuthorizationURLParams{
+	authURL := c.API.GetAuthorizationURL(&helix.AuthorizationURLParams{
 		ResponseType: "code",
-		Scopes:       []string{"bits:read channel:read:subscriptions channel:read:redemptions channel:read:polls channel:read:predictions channel:read:hype_train user_read chat:read chat:edit channel:moderate whispers:read whispers:edit moderator:read:chatters moderator:read:followers user:manage:whispers moderator:manage:announcements"},
+		Scopes:       scopes,
+		State:        state,
+		ForceVerify:  forceVerify,
 	})
+	if custom := c.Config.Get().AuthBaseURL; custom != "" {
+		authURL = strings.Replace(authURL, helix.AuthBaseURL, custom, 1)
+	}
+	return authURL
 }
 
+// GetUserClient returns an API client authenticated as the broadcaster
 func (c *Client) GetUserClient(forceRefresh bool) (*helix.Client, error) {
-	var authResp AuthResponse
-	err := c.db.GetJSON(AuthKey, &authResp)
+	return c.getClientForKey(AuthKey, forceRefresh)
+}
+
+// GetBotClient returns an API client authenticated as the bot account, or as the broadcaster if there is no bot account
+func (c *Client) GetBotClient(forceRefresh bool) (*helix.Client, error) {
+	client, err := c.getClientForKey(BotAuthKey, forceRefresh)
+	if errors.Is(err, database.ErrEmptyKey) {
+		return c.GetUserClient(forceRefresh)
+	}
+	return client, err
+}
+
+func (c *Client) getClientForKey(key string, forceRefresh bool) (*helix.Client, error) {
+	authResp, err := c.loadToken(key, forceRefresh)
 	if err != nil {
 		return nil, err
 	}
-	// Handle token expiration
-	if forceRefresh || time.Now().After(authResp.Time.Add(time.Duration(authResp.ExpiresIn)*time.Second)) {
-		// Refresh tokens
-		refreshed, err := c.API.RefreshUserAccessToken(authResp.RefreshToken)
-		if err != nil {
-			return nil, err
-		}
-		authResp.AccessToken = refreshed.Data.AccessToken
-		authResp.RefreshToken = refreshed.Data.RefreshToken
-		authResp.Time = time.Now().Add(time.Duration(refreshed.Data.ExpiresIn) * time.Second)
-
-		// Save new token pair
-		err = c.db.PutJSON(AuthKey, authResp)
-		if err != nil {
-			return nil, err
-		}
+
+	options := helixOptions(c.Config.Get())
+	options.UserAccessToken = authResp.AccessToken
+	return helix.NewClient(options)
+}
+
+// GetBotUser returns the user of the bot account, or the broadcaster if there is no bot account
+func (c *Client) GetBotUser() (helix.User, error) {
+	if user := c.botUser.Get(); user.ID != "" {
+		return user, nil
 	}
 
-	config := c.Config.Get()
-	return helix.NewClient(&helix.Options{
-		ClientID:        config.APIClientID,
-		ClientSecret:    config.APIClientSecret,
-		UserAccessToken: authResp.AccessToken,
-	})
+	client, err := c.getClientForKey(BotAuthKey, false)
+	if errors.Is(err, database.ErrEmptyKey) {
+		return c.GetLoggedUser()
+	}
+	if err != nil {
+		return helix.User{}, fmt.Errorf("failed getting API client for bot: %w", err)
+	}
+
+	users, err := client.GetUsers(&helix.UsersParams{})
+	if err != nil {
+		return helix.User{}, fmt.Errorf("failed looking up bot user: %w", err)
+	}
+	if len(users.Data.Users) < 1 {
+		return helix.User{}, fmt.Errorf("no users found")
+	}
+	c.botUser.Set(users.Data.Users[0])
+
+	return users.Data.Users[0], nil
+}
+
+// botChatCredentials returns the login and IRC token of the bot account, ok is false if there is no bot account
+func (c *Client) botChatCredentials() (login string, token string, ok bool) {
+	client, err := c.getClientForKey(BotAuthKey, false)
+	if err != nil {
+		if !errors.Is(err, database.ErrEmptyKey) {
+			c.logger.Error("Could not get bot account credentials, using the configured token", zap.Error(err))
+		}
+		return "", "", false
+	}
+	user, err := c.GetBotUser()
+	if err != nil {
+		c.logger.Error("Could not look up bot account, using the configured token", zap.Error(err))
+		return "", "", false
+	}
+	return user.Login, "oauth:" + client.GetUserAccessToken(), true
 }
 
 func (c *Client) GetLoggedUser() (helix.User, error) {
@@ -81,6 +198,12 @@ func (c *Client) GetLoggedUser() (helix.User, error) {
 }
 
 func (c *Client) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// The state tells which account is being authorized
+	key := AuthKey
+	if req.URL.Query().Get("state") == botAuthState {
+		key = BotAuthKey
+	}
+
 	// Get code from params
 	code := req.URL.Query().Get("code")
 	if code == "" {
@@ -96,7 +219,11 @@ func (c *Client) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = c.db.PutJSON(AuthKey, AuthResponse{
+	if key == BotAuthKey {
+		// Bot account might have changed
+		c.botUser.Set(helix.User{})
+	}
+	err = c.db.PutJSON(key, AuthResponse{
 		AccessToken:  userTokenResponse.Data.AccessToken,
 		RefreshToken: userTokenResponse.Data.RefreshToken,
 		ExpiresIn:    userTokenResponse.Data.ExpiresIn,
@@ -0,0 +1,151 @@
+package twitch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
+)
+
+func TestBotAuthorizationURL(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, _ := newMockClient(t, server)
+
+	broadcasterURL, err := url.Parse(client.GetAuthorizationURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broadcasterURL.Query().Get("state") != "" {
+		t.Fatal("broadcaster authorization must not have a state")
+	}
+
+	botURL, err := url.Parse(client.GetBotAuthorizationURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if botURL.Query().Get("state") != botAuthState || botURL.Query().Get("force_verify") != "true" {
+		t.Fatalf("unexpected bot authorization URL: %s", botURL)
+	}
+	if !strings.Contains(botURL.Query().Get("scope"), "chat:edit") || strings.Contains(botURL.Query().Get("scope"), "bits:read") {
+		t.Fatalf("unexpected bot scopes: %s", botURL.Query().Get("scope"))
+	}
+}
+
+func TestBotAccountAuthentication(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+
+	// Without a bot account, the broadcaster is used
+	user, err := client.GetBotUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != server.User.ID {
+		t.Fatalf("expected broadcaster as bot user, got %s", user.Login)
+	}
+	if _, _, ok := client.botChatCredentials(); ok {
+		t.Fatal("expected no bot chat credentials without a bot account")
+	}
+
+	// Authorize the bot account through the callback
+	recorder := httptest.NewRecorder()
+	client.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, CallbackRoute+"?code="+mock.BotAuthCode+"&state="+botAuthState, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("callback failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	var botAuth, broadcasterAuth AuthResponse
+	if err := db.GetJSON(BotAuthKey, &botAuth); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GetJSON(AuthKey, &broadcasterAuth); err != nil {
+		t.Fatal(err)
+	}
+	if botAuth.AccessToken != mock.BotAccessToken || broadcasterAuth.AccessToken != mock.AccessToken {
+		t.Fatalf("tokens saved to the wrong keys: bot=%s broadcaster=%s", botAuth.AccessToken, broadcasterAuth.AccessToken)
+	}
+
+	user, err = client.GetBotUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != server.BotUser.ID {
+		t.Fatalf("expected bot account, got %s", user.Login)
+	}
+	login, token, ok := client.botChatCredentials()
+	if !ok || login != server.BotUser.Login || token != "oauth:"+mock.BotAccessToken {
+		t.Fatalf("unexpected bot chat credentials: %s %s", login, token)
+	}
+
+	// Whispers are sent from the bot account
+	bot := newBotWithClient(&fakeIRCBot{}, client, BotConfig{Channel: server.User.Login})
+	defer func() { _ = bot.Close() }()
+	bot.handleWriteMessageRPC(`{"message":"psst","whisper_to":"1234"}`)
+
+	found := false
+	for _, request := range server.Requests() {
+		if request.Path == "/whispers" {
+			found = true
+			if request.Query.Get("from_user_id") != server.BotUser.ID {
+				t.Fatalf("whisper sent from %s instead of the bot account", request.Query.Get("from_user_id"))
+			}
+		}
+	}
+	if !found {
+		t.Fatal("whisper was not sent")
+	}
+}
+
+func TestBotAuthChanges(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+	manager := &Manager{client: client}
+
+	recorder := httptest.NewRecorder()
+	client.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, CallbackRoute+"?code="+mock.BotAuthCode+"&state="+botAuthState, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("callback failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	fake := &fakeIRCBot{}
+	bot := newBotWithClient(fake, client, BotConfig{Channel: server.User.Login, Username: server.BotUser.Login})
+	client.Bot = bot
+
+	// A refreshed token for the same account doesn't restart the bot
+	var auth AuthResponse
+	if err := db.GetJSON(BotAuthKey, &auth); err != nil {
+		t.Fatal(err)
+	}
+	auth.Time = time.Now()
+	if err := db.PutJSON(BotAuthKey, auth); err != nil {
+		t.Fatal(err)
+	}
+	manager.onBotAuthChanged()
+	if client.Bot != bot {
+		t.Fatal("bot was restarted after a token refresh")
+	}
+	fake.mu.Lock()
+	token := fake.token
+	fake.mu.Unlock()
+	if token != "oauth:"+mock.BotAccessToken {
+		t.Fatalf("refreshed token was not given to the bot, got %q", token)
+	}
+
+	// A different account does
+	bot.username = "someoneelse"
+	manager.onBotAuthChanged()
+	if client.Bot == bot {
+		_ = bot.Close()
+		t.Fatal("bot was not restarted after the bot account changed")
+	}
+}
@@ -1,139 +1,107 @@
 package twitch
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
-	"git.sr.ht/~ashkeel/strimertul/utils"
-
-	"github.com/gorilla/websocket"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/nicklaw5/helix/v2"
 	"go.uber.org/zap"
 )
 
-const websocketEndpoint = "wss://eventsub.wss.twitch.tv/ws"
+var ErrEventNotFound = errors.New("event not found")
 
-func (c *Client) eventSubLoop(userClient *helix.Client) {
-	endpoint := websocketEndpoint
-	var err error
-	var connection *websocket.Conn
-	for endpoint != "" {
-		endpoint, connection, err = c.connectWebsocket(endpoint, connection, userClient)
-		if err != nil {
-			c.logger.Error("EventSub websocket read error", zap.Error(err))
-		}
-	}
-	if connection != nil {
-		utils.Close(connection, c.logger)
+func (c *Client) eventSubLoop() {
+	defer c.loops.Done()
+
+	session := &eventSubSession{
+		ctx:      c.ctx,
+		logger:   c.logger,
+		endpoint: eventSubEndpoint(c.Config.Get()),
+		// Duplicates are checked in processEvent, which also handles webhook notifications
+		onWelcome: c.onWelcome,
+		onNotification: func(message EventSubWebsocketMessage) {
+			c.updateEventSubStatus(func(status *EventSubStatus) {
+				status.LastEvent = message.Metadata.MessageTimestamp
+			})
+			go c.processEvent(message)
+		},
+		onRevocation: c.onRevocation,
+		onDisconnect: func(err error) {
+			c.updateEventSubStatus(func(status *EventSubStatus) {
+				status.Connected = false
+				status.SessionID = ""
+				status.Error = err.Error()
+			})
+		},
 	}
+	session.run()
+
+	c.updateEventSubStatus(func(status *EventSubStatus) {
+		status.Connected = false
+		status.SessionID = ""
+	})
 }
 
-func readLoop(connection *websocket.Conn, recv chan<- []byte, wsErr chan<- error) {
-	for {
-		messageType, messageData, err := connection.ReadMessage()
-		if err != nil {
-			wsErr <- err
-			close(recv)
-			close(wsErr)
-			return
-		}
-		if messageType != websocket.TextMessage {
-			continue
-		}
+func (c *Client) onWelcome(welcome WelcomeMessagePayload, reconnected bool) {
+	c.updateEventSubStatus(func(status *EventSubStatus) {
+		status.Connected = true
+		status.SessionID = welcome.Session.Id
+		status.ConnectedAt = welcome.Session.ConnectedAt
+		status.KeepaliveTimeout = welcome.Session.KeepaliveTimeoutSeconds
+		status.Error = ""
+	})
 
-		recv <- messageData
+	// Subscriptions are carried over to the new session on reconnection
+	if reconnected {
+		c.savedSubscriptions[welcome.Session.Id] = true
+		return
 	}
-}
 
-func (c *Client) connectWebsocket(url string, oldConnection *websocket.Conn, userClient *helix.Client) (string, *websocket.Conn, error) {
-	connection, _, err := websocket.DefaultDialer.Dial(url, nil)
+	// Add subscription to websocket session, the token might have been refreshed since the last session
+	userClient, err := c.GetUserClient(false)
 	if err != nil {
-		c.logger.Error("Could not establish a connection to the EventSub websocket", zap.Error(err))
-		return "", nil, err
+		c.logger.Error("Could not get API client to add subscriptions", zap.Error(err))
+		return
 	}
-
-	received := make(chan []byte, 10)
-	wsErr := make(chan error, 1)
-
-	go readLoop(connection, received, wsErr)
-
-	for {
-		// Wait for next message or closing/error
-		var messageData []byte
-		select {
-		case <-c.ctx.Done():
-			return "", nil, nil
-		case err = <-wsErr:
-			return url, nil, err // Return the endpoint so we can reconnect
-		case messageData = <-received:
-		}
-
-		var wsMessage EventSubWebsocketMessage
-		err = json.Unmarshal(messageData, &wsMessage)
-		if err != nil {
-			c.logger.Error("Error decoding EventSub message", zap.Error(err))
-			continue
-		}
-
-		reconnectURL, err, done := c.processMessage(wsMessage, oldConnection, userClient)
-		if done {
-			return reconnectURL, connection, err
-		}
+	err = c.addSubscriptionsForSession(userClient, welcome.Session.Id)
+	if err != nil {
+		c.logger.Error("Could not add subscriptions", zap.Error(err))
 	}
 }
 
-func (c *Client) processMessage(wsMessage EventSubWebsocketMessage, oldConnection *websocket.Conn, userClient *helix.Client) (string, error, bool) {
-	switch wsMessage.Metadata.MessageType {
-	case "session_keepalive":
-		// Nothing to do
-	case "session_welcome":
-		var welcomeData WelcomeMessagePayload
-		err := json.Unmarshal(wsMessage.Payload, &welcomeData)
-		if err != nil {
-			c.logger.Error("Error decoding EventSub welcome message", zap.String("message-type", wsMessage.Metadata.MessageType), zap.Error(err))
-			break
-		}
-		c.logger.Info("Connection to EventSub websocket established", zap.String("session-id", welcomeData.Session.Id))
-
-		// We can only close the old connection once the new one has been established
-		if oldConnection != nil {
-			utils.Close(oldConnection, c.logger)
-		}
+func (c *Client) onRevocation(message EventSubWebsocketMessage) {
+	var revocationData NotificationMessagePayload
+	err := json.Unmarshal(message.Payload, &revocationData)
+	if err != nil {
+		c.logger.Error("Error decoding EventSub revocation", zap.Error(err))
+		return
+	}
+	c.logger.Warn("EventSub subscription was revoked by Twitch", zap.String("topic", revocationData.Subscription.Type), zap.String("status", revocationData.Subscription.Status))
+}
 
-		// Add subscription to websocket session
-		err = c.addSubscriptionsForSession(userClient, welcomeData.Session.Id)
-		if err != nil {
-			c.logger.Error("Could not add subscriptions", zap.Error(err))
-			break
-		}
-	case "session_reconnect":
-		var reconnectData WelcomeMessagePayload
-		err := json.Unmarshal(wsMessage.Payload, &reconnectData)
-		if err != nil {
-			c.logger.Error("Error decoding EventSub session reconnect parameters", zap.String("message-type", wsMessage.Metadata.MessageType), zap.Error(err))
-			break
-		}
-		c.logger.Info("EventSub websocket requested a reconnection", zap.String("session-id", reconnectData.Session.Id), zap.String("reconnect-url", reconnectData.Session.ReconnectUrl))
+// updateEventSubStatus changes the EventSub connection status and publishes it for the UI
+func (c *Client) updateEventSubStatus(update func(status *EventSubStatus)) {
+	status := c.eventSubStatus.Get()
+	update(&status)
+	c.eventSubStatus.Set(status)
 
-		return reconnectData.Session.ReconnectUrl, nil, true
-	case "notification":
-		go c.processEvent(wsMessage)
-	case "revocation":
-		// TODO idk what to do here
+	err := c.db.PutJSON(EventSubStatusKey, status)
+	if err != nil {
+		c.logger.Warn("Could not save EventSub status", zap.Error(err))
 	}
-	return "", nil, false
 }
 
 func (c *Client) processEvent(message EventSubWebsocketMessage) {
-	// Check if we processed this already
+	// Check if we processed this already (Twitch can send the same message more than once)
 	if message.Metadata.MessageId != "" {
-		if c.eventCache.Contains(message.Metadata.MessageId) {
+		if found, _ := c.eventCache.ContainsOrAdd(message.Metadata.MessageId, message.Metadata.MessageTimestamp); found {
 			c.logger.Debug("Received duplicate event, ignoring", zap.String("message-id", message.Metadata.MessageId))
 			return
 		}
 	}
-	defer c.eventCache.Add(message.Metadata.MessageId, message.Metadata.MessageTimestamp)
 
 	// Decode data
 	var notificationData NotificationMessagePayload
@@ -143,10 +111,7 @@ func (c *Client) processEvent(message EventSubWebsocketMessage) {
 	}
 	notificationData.Date = time.Now()
 
-	err = c.db.PutJSON(EventSubEventKey, notificationData)
-	if err != nil {
-		c.logger.Error("Error storing event to database", zap.String("key", EventSubEventKey), zap.Error(err))
-	}
+	c.emitEvent(notificationData)
 
 	var archive []NotificationMessagePayload
 	err = c.db.GetJSON(EventSubHistoryKey, &archive)
@@ -163,34 +128,108 @@ func (c *Client) processEvent(message EventSubWebsocketMessage) {
 	}
 }
 
+// emitEvent sends a notification to everything that handles EventSub events (alerts, overlays etc)
+func (c *Client) emitEvent(notification NotificationMessagePayload) {
+	err := c.db.PutJSON(EventSubEventKey, notification)
+	if err != nil {
+		c.logger.Error("Error storing event to database", zap.String("key", EventSubEventKey), zap.Error(err))
+	}
+}
+
+// ReplayEvent sends again an event from the EventSub history
+func (c *Client) ReplayEvent(index int) error {
+	var archive []NotificationMessagePayload
+	if err := c.db.GetJSON(EventSubHistoryKey, &archive); err != nil {
+		return err
+	}
+	if index < 0 || index >= len(archive) {
+		return fmt.Errorf("%w: no event at index %d", ErrEventNotFound, index)
+	}
+
+	c.logger.Info("Replaying event", zap.String("type", archive[index].Subscription.Type), zap.Int("index", index))
+	event := archive[index]
+	event.Synthetic = true
+	c.emitEvent(event)
+	return nil
+}
+
 func (c *Client) addSubscriptionsForSession(userClient *helix.Client, session string) error {
 	if c.savedSubscriptions[session] {
 		// Already subscribed
 		return nil
 	}
 
-	transport := helix.EventSubTransport{
+	err := c.subscribe(userClient, helix.EventSubTransport{
 		Method:    "websocket",
 		SessionID: session,
+	})
+	if err != nil {
+		return err
+	}
+	c.savedSubscriptions[session] = true
+	return nil
+}
+
+// subscribe creates subscriptions for all the selected topics that don't already exist for a transport,
+// subscriptions to topics that are not selected anymore are removed
+func (c *Client) subscribe(api *helix.Client, transport helix.EventSubTransport) error {
+	topics, unsupported := selectedTopics(c.Config.Get())
+	if len(unsupported) > 0 {
+		c.logger.Warn("Ignoring unsupported EventSub topics", zap.Strings("topics", unsupported))
+	}
+
+	// Check for subscriptions that already exist for this transport
+	existing := make(map[string]bool)
+	response, err := api.GetEventSubSubscriptions(&helix.EventSubSubscriptionsParams{
+		Status: helix.EventSubStatusEnabled,
+	})
+	if err != nil {
+		c.logger.Warn("Could not get existing EventSub subscriptions", zap.Error(err))
+	} else {
+		for _, sub := range response.Data.EventSubSubscriptions {
+			if !sameTransport(sub.Transport, transport) {
+				continue
+			}
+			if _, ok := topics[sub.Type]; ok {
+				existing[sub.Type] = true
+				continue
+			}
+			if _, err := api.RemoveEventSubSubscription(sub.ID); err != nil {
+				c.logger.Warn("Could not remove EventSub subscription", zap.String("topic", sub.Type), zap.Error(err))
+			}
+		}
 	}
-	for topic, version := range subscriptionVersions {
-		sub, err := userClient.CreateEventSubSubscription(&helix.EventSubSubscription{
+
+	var errs []error
+	for topic, version := range topics {
+		if existing[topic] {
+			continue
+		}
+		sub, err := api.CreateEventSubSubscription(&helix.EventSubSubscription{
 			Type:      topic,
 			Version:   version,
 			Status:    "enabled",
 			Transport: transport,
 			Condition: topicCondition(topic, c.User.ID),
 		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error subscribing to %s: %w", topic, err))
+			continue
+		}
+		if sub.StatusCode == http.StatusConflict {
+			// Already subscribed, nothing to do
+			continue
+		}
 		if sub.Error != "" || sub.ErrorMessage != "" {
 			c.logger.Error("EventSub Subscription error", zap.String("topic", topic), zap.String("topic-version", version), zap.String("err", sub.Error), zap.String("message", sub.ErrorMessage))
-			return fmt.Errorf("%s: %s", sub.Error, sub.ErrorMessage)
-		}
-		if err != nil {
-			return fmt.Errorf("error subscribing to %s: %w", topic, err)
+			errs = append(errs, fmt.Errorf("%s: %s", sub.Error, sub.ErrorMessage))
 		}
 	}
-	c.savedSubscriptions[session] = true
-	return nil
+	return errors.Join(errs...)
+}
+
+func sameTransport(a, b helix.EventSubTransport) bool {
+	return a.Method == b.Method && a.SessionID == b.SessionID && a.Callback == b.Callback
 }
 
 func topicCondition(topic string, id string) helix.EventSubCondition {
@@ -230,6 +269,8 @@ type NotificationMessagePayload struct {
 	Subscription helix.EventSubSubscription `json:"subscription"`
 	Event        jsoniter.RawMessage        `json:"event"`
 	Date         time.Time                  `json:"date,omitempty"`
+	// Set on test and replayed events, which must not be counted as things that happened on stream
+	Synthetic bool `json:"synthetic,omitempty" desc:"True for test and replayed events"`
 }
 
 type EventSubMetadata struct {
@@ -239,30 +280,3 @@ type EventSubMetadata struct {
 	SubscriptionType    string    `json:"subscription_type"`
 	SubscriptionVersion string    `json:"subscription_version"`
 }
-
-var subscriptionVersions = map[string]string{
-	helix.EventSubTypeChannelUpdate:                             "1",
-	helix.EventSubTypeChannelFollow:                             "2",
-	helix.EventSubTypeChannelSubscription:                       "1",
-	helix.EventSubTypeChannelSubscriptionGift:                   "1",
-	helix.EventSubTypeChannelSubscriptionMessage:                "1",
-	helix.EventSubTypeChannelCheer:                              "1",
-	helix.EventSubTypeChannelRaid:                               "1",
-	helix.EventSubTypeChannelPollBegin:                          "1",
-	helix.EventSubTypeChannelPollProgress:                       "1",
-	helix.EventSubTypeChannelPollEnd:                            "1",
-	helix.EventSubTypeChannelPredictionBegin:                    "1",
-	helix.EventSubTypeChannelPredictionProgress:                 "1",
-	helix.EventSubTypeChannelPredictionLock:                     "1",
-	helix.EventSubTypeChannelPredictionEnd:                      "1",
-	helix.EventSubTypeHypeTrainBegin:                            "1",
-	helix.EventSubTypeHypeTrainProgress:                         "1",
-	helix.EventSubTypeHypeTrainEnd:                              "1",
-	helix.EventSubTypeChannelPointsCustomRewardAdd:              "1",
-	helix.EventSubTypeChannelPointsCustomRewardUpdate:           "1",
-	helix.EventSubTypeChannelPointsCustomRewardRemove:           "1",
-	helix.EventSubTypeChannelPointsCustomRewardRedemptionAdd:    "1",
-	helix.EventSubTypeChannelPointsCustomRewardRedemptionUpdate: "1",
-	helix.EventSubTypeStreamOnline:                              "1",
-	helix.EventSubTypeStreamOffline:                             "1",
-}
@@ -0,0 +1,244 @@
+package twitch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+var ErrUnsupportedEventType = errors.New("unsupported EventSub subscription type")
+
+// sampleEvent returns an example event payload for a subscription type, as sent by Twitch
+func (c *Client) sampleEvent(topic string) (any, error) {
+	if _, ok := subscriptionVersions[topic]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEventType, topic)
+	}
+
+	now := helix.Time{Time: time.Now()}
+	user := TestMessageData.User
+	broadcasterID, broadcasterLogin, broadcasterName := c.User.ID, c.User.Login, c.User.DisplayName
+	pollChoices := []helix.PollChoice{
+		{ID: "choice-1", Title: "Yes", Votes: 12},
+		{ID: "choice-2", Title: "No", Votes: 8},
+	}
+	outcomes := []helix.EventSubOutcome{
+		{ID: "outcome-1", Title: "Win", Color: "blue", Users: 10, ChannelPoints: 15000},
+		{ID: "outcome-2", Title: "Lose", Color: "pink", Users: 5, ChannelPoints: 5000},
+	}
+	contribution := helix.EventSubContribution{UserID: user.ID, UserLogin: user.Name, UserName: user.DisplayName, Type: "bits", Total: 500}
+
+	switch topic {
+	case helix.EventSubTypeChannelFollow:
+		return helix.EventSubChannelFollowEvent{
+			UserID: user.ID, UserLogin: user.Name, UserName: user.DisplayName,
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			FollowedAt: now,
+		}, nil
+	case helix.EventSubTypeChannelSubscription:
+		return helix.EventSubChannelSubscribeEvent{
+			UserID: user.ID, UserLogin: user.Name, UserName: user.DisplayName,
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Tier: "1000",
+		}, nil
+	case helix.EventSubTypeChannelSubscriptionMessage:
+		return helix.EventSubChannelSubscriptionMessageEvent{
+			UserID: user.ID, UserLogin: user.Name, UserName: user.DisplayName,
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Tier:             "1000",
+			Message:          helix.EventSubMessage{Text: "Hello from the past!"},
+			CumulativeMonths: 12, StreakMonths: 3, DurationMonths: 1,
+		}, nil
+	case helix.EventSubTypeChannelSubscriptionGift:
+		return helix.EventSubChannelSubscriptionGiftEvent{
+			UserID: user.ID, UserLogin: user.Name, UserName: user.DisplayName,
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Total: 5, Tier: "1000", CumulativeTotal: 20,
+		}, nil
+	case helix.EventSubTypeChannelCheer:
+		return helix.EventSubChannelCheerEvent{
+			UserID: user.ID, UserLogin: user.Name, UserName: user.DisplayName,
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Message: "Cheer100 test cheer", Bits: 100,
+		}, nil
+	case helix.EventSubTypeChannelRaid:
+		return helix.EventSubChannelRaidEvent{
+			FromBroadcasterUserID: user.ID, FromBroadcasterUserLogin: user.Name, FromBroadcasterUserName: user.DisplayName,
+			ToBroadcasterUserID: broadcasterID, ToBroadcasterUserLogin: broadcasterLogin, ToBroadcasterUserName: broadcasterName,
+			Viewers: 42,
+		}, nil
+	case helix.EventSubTypeChannelPointsCustomRewardRedemptionAdd, helix.EventSubTypeChannelPointsCustomRewardRedemptionUpdate:
+		return helix.EventSubChannelPointsCustomRewardRedemptionEvent{
+			ID:     "test-redemption",
+			UserID: user.ID, UserLogin: user.Name, UserName: user.DisplayName,
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			UserInput:  "Test input",
+			Status:     "unfulfilled",
+			Reward:     helix.EventSubReward{ID: "test-reward", Title: "Test reward", Cost: 1000},
+			RedeemedAt: now,
+		}, nil
+	case helix.EventSubTypeHypeTrainBegin:
+		return helix.EventSubHypeTrainBeginEvent{
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Total: 500, Progress: 500, Goal: 1500,
+			TopContributions: []helix.EventSubContribution{contribution}, LastContribution: contribution,
+			StartedAt: now, ExpiresAt: helix.Time{Time: now.Add(5 * time.Minute)},
+		}, nil
+	case helix.EventSubTypeHypeTrainProgress:
+		return helix.EventSubHypeTrainProgressEvent{
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Level: 2, Total: 2000, Progress: 500, Goal: 1800,
+			TopContributions: []helix.EventSubContribution{contribution}, LastContribution: contribution,
+			StartedAt: now, ExpiresAt: helix.Time{Time: now.Add(5 * time.Minute)},
+		}, nil
+	case helix.EventSubTypeHypeTrainEnd:
+		return helix.EventSubHypeTrainEndEvent{
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Level: 2, Total: 2000,
+			TopContributions: []helix.EventSubContribution{contribution},
+			StartedAt:        now,
+			ExpiresAt:        now,
+			CooldownEndsAt:   helix.Time{Time: now.Add(time.Hour)},
+		}, nil
+	case helix.EventSubTypeChannelPollBegin, helix.EventSubTypeChannelPollProgress:
+		return helix.EventSubChannelPollBeginEvent{
+			ID:                "test-poll",
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Title: "Test poll", Choices: pollChoices,
+			StartedAt: now, EndsAt: helix.Time{Time: now.Add(time.Minute)},
+		}, nil
+	case helix.EventSubTypeChannelPollEnd:
+		return helix.EventSubChannelPollEndEvent{
+			ID:                "test-poll",
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Title: "Test poll", Choices: pollChoices, Status: "completed",
+			StartedAt: now, EndedAt: now,
+		}, nil
+	case helix.EventSubTypeChannelPredictionBegin, helix.EventSubTypeChannelPredictionProgress:
+		return helix.EventSubChannelPredictionBeginEvent{
+			ID:                "test-prediction",
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Title: "Test prediction", Outcomes: outcomes,
+			StartedAt: now, LocksAt: helix.Time{Time: now.Add(time.Minute)},
+		}, nil
+	case helix.EventSubTypeChannelPredictionLock:
+		return helix.EventSubChannelPredictionLockEvent{
+			ID:                "test-prediction",
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Title: "Test prediction", Outcomes: outcomes, Status: "locked",
+			StartedAt: now, LockedAt: now,
+		}, nil
+	case helix.EventSubTypeChannelPredictionEnd:
+		return helix.EventSubChannelPredictionEndEvent{
+			ID:                "test-prediction",
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Title: "Test prediction", Outcomes: outcomes, Status: "resolved", WinningOutcomeID: "outcome-1",
+			StartedAt: now, EndedAt: now,
+		}, nil
+	case helix.EventSubTypeStreamOnline:
+		return helix.EventSubStreamOnlineEvent{
+			ID:                "test-stream",
+			BroadcasterUserID: broadcasterID, BroadcasterUserLogin: broadcasterLogin, BroadcasterUserName: broadcasterName,
+			Type: "live", StartedAt: now,
+		}, nil
+	default:
+		// Every other event at least has the broadcaster fields
+		return map[string]any{
+			"broadcaster_user_id":    broadcasterID,
+			"broadcaster_user_login": broadcasterLogin,
+			"broadcaster_user_name":  broadcasterName,
+		}, nil
+	}
+}
+
+// TestEvent sends a fake EventSub notification, with fields in the sample event replaced by the ones in overrides
+func (c *Client) TestEvent(topic string, overrides map[string]any) error {
+	sample, err := c.sampleEvent(topic)
+	if err != nil {
+		return err
+	}
+
+	// Convert sample to a generic object so fields can be replaced
+	data, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	var event map[string]any
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	mergeEventFields(event, overrides)
+	data, err = json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	c.logger.Info("Sending test event", zap.String("type", topic))
+	c.emitEvent(NotificationMessagePayload{
+		Subscription: helix.EventSubSubscription{
+			ID:        "test-event",
+			Type:      topic,
+			Version:   subscriptionVersions[topic],
+			Status:    "enabled",
+			Condition: topicCondition(topic, c.User.ID),
+			CreatedAt: helix.Time{Time: time.Now()},
+		},
+		Event:     data,
+		Date:      time.Now(),
+		Synthetic: true,
+	})
+	return nil
+}
+
+// mergeEventFields replaces fields in event with the ones in overrides, nested objects are merged as well
+func mergeEventFields(event map[string]any, overrides map[string]any) {
+	for key, value := range overrides {
+		nestedOverride, ok := value.(map[string]any)
+		if !ok {
+			event[key] = value
+			continue
+		}
+		nestedEvent, ok := event[key].(map[string]any)
+		if !ok {
+			event[key] = value
+			continue
+		}
+		mergeEventFields(nestedEvent, nestedOverride)
+	}
+}
+
+func (c *Client) setupEventRPCs() {
+	err, cancelTestSub := c.db.SubscribeKey(TestAlertRPC, func(value string) {
+		var request TestAlertRequest
+		if err := json.UnmarshalFromString(value, &request); err != nil {
+			c.logger.Warn("Invalid test alert request", zap.Error(err))
+			return
+		}
+		if err := c.TestEvent(request.Type, request.Event); err != nil {
+			c.logger.Warn("Could not send test event", zap.String("type", request.Type), zap.Error(err))
+		}
+	})
+	if err != nil {
+		c.logger.Error("Could not setup test alert RPC subscription", zap.Error(err))
+	}
+
+	err, cancelReplaySub := c.db.SubscribeKey(ReplayEventRPC, func(value string) {
+		var index int
+		if err := json.UnmarshalFromString(value, &index); err != nil {
+			c.logger.Warn("Invalid replay event request", zap.Error(err))
+			return
+		}
+		if err := c.ReplayEvent(index); err != nil {
+			c.logger.Warn("Could not replay event", zap.Int("index", index), zap.Error(err))
+		}
+	})
+	if err != nil {
+		c.logger.Error("Could not setup replay event RPC subscription", zap.Error(err))
+	}
+
+	c.cancelEventRPCSubs = []database.CancelFunc{cancelTestSub, cancelReplaySub}
+}
@@ -0,0 +1,46 @@
+package twitch
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+func TestTestEvent(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	db, _ := database.CreateInMemoryLocalClient(t)
+	defer database.CleanupLocalClient(db)
+
+	client := &Client{db: db, logger: logger}
+	err := client.TestEvent("channel.raid", map[string]any{
+		"viewers": 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notification NotificationMessagePayload
+	if err := db.GetJSON(EventSubEventKey, &notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.Subscription.Type != "channel.raid" || !notification.Synthetic {
+		t.Fatalf("expected synthetic raid event, got %+v", notification)
+	}
+	var event struct {
+		Viewers  int    `json:"viewers"`
+		FromUser string `json:"from_broadcaster_user_login"`
+	}
+	if err := json.Unmarshal(notification.Event, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Viewers != 1000 || event.FromUser != TestMessageData.User.Name {
+		t.Fatalf("unexpected event data: %+v", event)
+	}
+
+	if err := client.TestEvent("channel.not-a-thing", nil); !errors.Is(err, ErrUnsupportedEventType) {
+		t.Fatalf("expected unsupported event type error, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package twitch
+
+import (
+	"slices"
+
+	"github.com/nicklaw5/helix/v2"
+)
+
+var subscriptionVersions = map[string]string{
+	helix.EventSubTypeChannelUpdate:                             "1",
+	helix.EventSubTypeChannelFollow:                             "2",
+	helix.EventSubTypeChannelSubscription:                       "1",
+	helix.EventSubTypeChannelSubscriptionGift:                   "1",
+	helix.EventSubTypeChannelSubscriptionMessage:                "1",
+	helix.EventSubTypeChannelCheer:                              "1",
+	helix.EventSubTypeChannelRaid:                               "1",
+	helix.EventSubTypeChannelPollBegin:                          "1",
+	helix.EventSubTypeChannelPollProgress:                       "1",
+	helix.EventSubTypeChannelPollEnd:                            "1",
+	helix.EventSubTypeChannelPredictionBegin:                    "1",
+	helix.EventSubTypeChannelPredictionProgress:                 "1",
+	helix.EventSubTypeChannelPredictionLock:                     "1",
+	helix.EventSubTypeChannelPredictionEnd:                      "1",
+	helix.EventSubTypeHypeTrainBegin:                            "1",
+	helix.EventSubTypeHypeTrainProgress:                         "1",
+	helix.EventSubTypeHypeTrainEnd:                              "1",
+	helix.EventSubTypeChannelPointsCustomRewardAdd:              "1",
+	helix.EventSubTypeChannelPointsCustomRewardUpdate:           "1",
+	helix.EventSubTypeChannelPointsCustomRewardRemove:           "1",
+	helix.EventSubTypeChannelPointsCustomRewardRedemptionAdd:    "1",
+	helix.EventSubTypeChannelPointsCustomRewardRedemptionUpdate: "1",
+	helix.EventSubTypeStreamOnline:                              "1",
+	helix.EventSubTypeStreamOffline:                             "1",
+}
+
+// Scopes needed by the chatbot and the other features that don't depend on EventSub
+var baseScopes = []string{
+	"user_read",
+	"chat:read",
+	"chat:edit",
+	"channel:moderate",
+	"whispers:read",
+	"whispers:edit",
+	"moderator:read:chatters",
+	"user:manage:whispers",
+	"moderator:manage:announcements",
+}
+
+// Scopes needed by each EventSub subscription type, types not listed here don't need any
+var topicScopes = map[string][]string{
+	helix.EventSubTypeChannelFollow:                             {"moderator:read:followers"},
+	helix.EventSubTypeChannelSubscription:                       {"channel:read:subscriptions"},
+	helix.EventSubTypeChannelSubscriptionGift:                   {"channel:read:subscriptions"},
+	helix.EventSubTypeChannelSubscriptionMessage:                {"channel:read:subscriptions"},
+	helix.EventSubTypeChannelCheer:                              {"bits:read"},
+	helix.EventSubTypeChannelPollBegin:                          {"channel:read:polls"},
+	helix.EventSubTypeChannelPollProgress:                       {"channel:read:polls"},
+	helix.EventSubTypeChannelPollEnd:                            {"channel:read:polls"},
+	helix.EventSubTypeChannelPredictionBegin:                    {"channel:read:predictions"},
+	helix.EventSubTypeChannelPredictionProgress:                 {"channel:read:predictions"},
+	helix.EventSubTypeChannelPredictionLock:                     {"channel:read:predictions"},
+	helix.EventSubTypeChannelPredictionEnd:                      {"channel:read:predictions"},
+	helix.EventSubTypeHypeTrainBegin:                            {"channel:read:hype_train"},
+	helix.EventSubTypeHypeTrainProgress:                         {"channel:read:hype_train"},
+	helix.EventSubTypeHypeTrainEnd:                              {"channel:read:hype_train"},
+	helix.EventSubTypeChannelPointsCustomRewardAdd:              {"channel:read:redemptions"},
+	helix.EventSubTypeChannelPointsCustomRewardUpdate:           {"channel:read:redemptions"},
+	helix.EventSubTypeChannelPointsCustomRewardRemove:           {"channel:read:redemptions"},
+	helix.EventSubTypeChannelPointsCustomRewardRedemptionAdd:    {"channel:read:redemptions"},
+	helix.EventSubTypeChannelPointsCustomRewardRedemptionUpdate: {"channel:read:redemptions"},
+}
+
+// selectedTopics returns the subscription types (and their version) to subscribe to, unsupported types are returned separately
+func selectedTopics(config Config) (map[string]string, []string) {
+	if len(config.EventSubTopics) == 0 {
+		return subscriptionVersions, nil
+	}
+
+	topics := make(map[string]string)
+	var unsupported []string
+	for _, topic := range config.EventSubTopics {
+		version, ok := subscriptionVersions[topic]
+		if !ok {
+			unsupported = append(unsupported, topic)
+			continue
+		}
+		topics[topic] = version
+	}
+	return topics, unsupported
+}
+
+// requiredScopes returns the OAuth scopes needed for the selected subscription types
+func requiredScopes(config Config) []string {
+	scopes := slices.Clone(baseScopes)
+	topics, _ := selectedTopics(config)
+	for topic := range topics {
+		for _, scope := range topicScopes[topic] {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	slices.Sort(scopes)
+	return scopes
+}
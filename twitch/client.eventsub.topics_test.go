@@ -0,0 +1,73 @@
+package twitch
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/nicklaw5/helix/v2"
+
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
+)
+
+func TestSelectedTopics(t *testing.T) {
+	topics, unsupported := selectedTopics(Config{})
+	if len(topics) != len(subscriptionVersions) || len(unsupported) > 0 {
+		t.Fatalf("expected all topics when none are selected, got %d", len(topics))
+	}
+
+	topics, unsupported = selectedTopics(Config{
+		EventSubTopics: []string{helix.EventSubTypeChannelFollow, helix.EventSubTypeChannelRaid, "channel.nonexistent"},
+	})
+	if len(topics) != 2 || topics[helix.EventSubTypeChannelFollow] != "2" {
+		t.Fatalf("unexpected topics: %v", topics)
+	}
+	if len(unsupported) != 1 || unsupported[0] != "channel.nonexistent" {
+		t.Fatalf("expected unsupported topic to be reported, got %v", unsupported)
+	}
+}
+
+func TestRequiredScopes(t *testing.T) {
+	scopes := requiredScopes(Config{
+		EventSubTopics: []string{helix.EventSubTypeChannelCheer, helix.EventSubTypeChannelPollBegin, helix.EventSubTypeChannelPollEnd},
+	})
+	for _, scope := range append([]string{"bits:read", "channel:read:polls"}, baseScopes...) {
+		if !slices.Contains(scopes, scope) {
+			t.Errorf("expected scope %s to be required", scope)
+		}
+	}
+	for _, scope := range []string{"channel:read:subscriptions", "moderator:read:followers"} {
+		if slices.Contains(scopes, scope) {
+			t.Errorf("scope %s should not be required", scope)
+		}
+	}
+	if len(scopes) != len(baseScopes)+2 {
+		t.Errorf("expected no duplicate scopes, got %v", scopes)
+	}
+
+	// All topics must need every scope
+	scopes = requiredScopes(Config{})
+	for topic, topicScope := range topicScopes {
+		for _, scope := range topicScope {
+			if !slices.Contains(scopes, scope) {
+				t.Errorf("scope %s for %s missing when all topics are selected", scope, topic)
+			}
+		}
+	}
+}
+
+func TestSelectedTopicsSubscriptions(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	topics := []string{helix.EventSubTypeChannelFollow, helix.EventSubTypeStreamOnline}
+	newMockClientWithConfig(t, server, Config{EventSubTopics: topics})
+
+	waitFor(t, "subscriptions", func() bool {
+		return len(server.Subscriptions()) == len(topics)
+	})
+	for _, sub := range server.Subscriptions() {
+		if !slices.Contains(topics, sub.Type) {
+			t.Fatalf("subscribed to unselected topic %s", sub.Type)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package twitch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	// Notifications older than this are rejected to prevent replay attacks
+	webhookMaxAge = 10 * time.Minute
+
+	// Maximum size of a webhook request body
+	webhookMaxBodySize = 1 << 20
+)
+
+var ErrWebhookNotConfigured = errors.New("webhook callback URL and secret must be set to use the webhook transport")
+
+// startWebhook serves the webhook route and subscribes to the selected topics with the webhook transport
+func (c *Client) startWebhook() error {
+	config := c.Config.Get()
+	if config.WebhookCallbackURL == "" || config.WebhookSecret == "" {
+		return ErrWebhookNotConfigured
+	}
+
+	c.server.RegisterRoute(WebhookRoute, http.HandlerFunc(c.serveWebhook))
+
+	// Webhook subscriptions must be created with an app access token
+	c.loops.Add(1)
+	go func() {
+		defer c.loops.Done()
+		err := c.subscribe(c.API, helix.EventSubTransport{
+			Method:   "webhook",
+			Callback: config.WebhookCallbackURL,
+			Secret:   config.WebhookSecret,
+		})
+		if err != nil {
+			c.logger.Error("Could not add webhook subscriptions", zap.Error(err))
+		}
+		c.updateEventSubStatus(func(status *EventSubStatus) {
+			status.Connected = err == nil
+			status.ConnectedAt = time.Now()
+			status.Error = ""
+			if err != nil {
+				status.Error = err.Error()
+			}
+		})
+	}()
+	return nil
+}
+
+func (c *Client) serveWebhook(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, webhookMaxBodySize))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyWebhookSignature(c.Config.Get().WebhookSecret, req.Header, body) {
+		c.logger.Warn("Received webhook notification with invalid signature", zap.String("remote-addr", req.RemoteAddr))
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, req.Header.Get("Twitch-Eventsub-Message-Timestamp"))
+	if err != nil || time.Since(timestamp) > webhookMaxAge {
+		http.Error(w, "invalid or expired timestamp", http.StatusForbidden)
+		return
+	}
+
+	// Webhook notifications have the same payload as websocket ones, with metadata in the headers
+	message := EventSubWebsocketMessage{
+		Metadata: EventSubMetadata{
+			MessageId:           req.Header.Get("Twitch-Eventsub-Message-Id"),
+			MessageType:         req.Header.Get("Twitch-Eventsub-Message-Type"),
+			MessageTimestamp:    timestamp,
+			SubscriptionType:    req.Header.Get("Twitch-Eventsub-Subscription-Type"),
+			SubscriptionVersion: req.Header.Get("Twitch-Eventsub-Subscription-Version"),
+		},
+		Payload: body,
+	}
+
+	switch message.Metadata.MessageType {
+	case "webhook_callback_verification":
+		var verification struct {
+			Challenge string `json:"challenge"`
+		}
+		if err := json.Unmarshal(body, &verification); err != nil {
+			http.Error(w, "invalid verification payload", http.StatusBadRequest)
+			return
+		}
+		c.logger.Info("Verified EventSub webhook subscription", zap.String("topic", message.Metadata.SubscriptionType))
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, verification.Challenge)
+	case "notification":
+		c.updateEventSubStatus(func(status *EventSubStatus) {
+			status.LastEvent = timestamp
+		})
+		go c.processEvent(message)
+		w.WriteHeader(http.StatusNoContent)
+	case "revocation":
+		c.onRevocation(message)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unknown message type", http.StatusBadRequest)
+	}
+}
+
+// verifyWebhookSignature checks that a webhook notification was signed by Twitch with our secret
+func verifyWebhookSignature(secret string, header http.Header, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header.Get("Twitch-Eventsub-Message-Id")))
+	mac.Write([]byte(header.Get("Twitch-Eventsub-Message-Timestamp")))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(header.Get("Twitch-Eventsub-Message-Signature")))
+}
@@ -0,0 +1,111 @@
+package twitch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~ashkeel/containers/sync"
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap/zaptest"
+
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
+)
+
+const (
+	testWebhookCallback = "https://strimertul.example.com/twitch/eventsub"
+	testWebhookSecret   = "webhook-test-secret"
+)
+
+func webhookRequest(messageType string, timestamp time.Time, body string, secret string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, WebhookRoute, strings.NewReader(body))
+	id := "message-" + timestamp.Format(time.RFC3339Nano)
+	ts := timestamp.Format(time.RFC3339Nano)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + ts + body))
+
+	req.Header.Set("Twitch-Eventsub-Message-Id", id)
+	req.Header.Set("Twitch-Eventsub-Message-Timestamp", ts)
+	req.Header.Set("Twitch-Eventsub-Message-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set("Twitch-Eventsub-Message-Type", messageType)
+	req.Header.Set("Twitch-Eventsub-Subscription-Type", helix.EventSubTypeChannelFollow)
+	req.Header.Set("Twitch-Eventsub-Subscription-Version", "2")
+	return req
+}
+
+func TestWebhookTransport(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClientWithConfig(t, server, Config{
+		EventSubTransport:  EventSubTransportWebhook,
+		EventSubTopics:     []string{helix.EventSubTypeChannelFollow},
+		WebhookCallbackURL: testWebhookCallback,
+		WebhookSecret:      testWebhookSecret,
+	})
+
+	waitFor(t, "webhook subscription", func() bool {
+		return len(server.Subscriptions()) == 1
+	})
+	sub := server.Subscriptions()[0]
+	if sub.Transport.Method != "webhook" || sub.Transport.Callback != testWebhookCallback {
+		t.Fatalf("unexpected transport: %+v", sub.Transport)
+	}
+	if len(server.Sessions()) > 0 {
+		t.Fatal("websocket should not be used with the webhook transport")
+	}
+
+	// Callback verification must answer with the challenge
+	recorder := httptest.NewRecorder()
+	client.serveWebhook(recorder, webhookRequest("webhook_callback_verification", time.Now(), `{"challenge":"pogchamp-kappa-360noscope"}`, testWebhookSecret))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "pogchamp-kappa-360noscope" {
+		t.Fatalf("unexpected verification response: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Notifications are processed like websocket ones
+	body := `{"subscription":{"type":"channel.follow","version":"2"},"event":{"user_id":"1234","user_name":"Follower"}}`
+	recorder = httptest.NewRecorder()
+	client.serveWebhook(recorder, webhookRequest("notification", time.Now(), body, testWebhookSecret))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected notification to be accepted, got %d", recorder.Code)
+	}
+	var notification NotificationMessagePayload
+	waitFor(t, "notification", func() bool {
+		return db.GetJSON(EventSubEventKey, &notification) == nil
+	})
+	if notification.Subscription.Type != helix.EventSubTypeChannelFollow {
+		t.Fatalf("expected follow event, got %s", notification.Subscription.Type)
+	}
+}
+
+func TestWebhookRejectsInvalidRequests(t *testing.T) {
+	client := &Client{
+		Config: sync.NewRWSync(Config{WebhookSecret: testWebhookSecret}),
+		logger: zaptest.NewLogger(t),
+	}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+	}{
+		{"wrong secret", webhookRequest("notification", time.Now(), `{}`, "not-the-right-secret")},
+		{"expired", webhookRequest("notification", time.Now().Add(-time.Hour), `{}`, testWebhookSecret)},
+		{"tampered", func() *http.Request {
+			req := webhookRequest("notification", time.Now(), `{}`, testWebhookSecret)
+			req.Body = httptest.NewRequest(http.MethodPost, WebhookRoute, strings.NewReader(`{"evil":true}`)).Body
+			return req
+		}()},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		client.serveWebhook(recorder, test.req)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("%s: expected request to be rejected, got %d", test.name, recorder.Code)
+		}
+	}
+}
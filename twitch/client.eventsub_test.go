@@ -0,0 +1,208 @@
+package twitch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap/zaptest"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
+	"git.sr.ht/~ashkeel/strimertul/webserver"
+)
+
+func newMockClient(t *testing.T, server *mock.Server) (*Client, *database.LocalDBClient) {
+	return newMockClientWithConfig(t, server, Config{})
+}
+
+// newMockClientWithConfig creates a client connected to the mock server, with extra options taken from config
+func newMockClientWithConfig(t *testing.T, server *mock.Server, config Config) (*Client, *database.LocalDBClient) {
+	logger := zaptest.NewLogger(t)
+	db, _ := database.CreateInMemoryLocalClient(t)
+	t.Cleanup(func() { database.CleanupLocalClient(db) })
+
+	webServer, err := webserver.NewServer(db, logger, webserver.DefaultServerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.PutJSON(AuthKey, AuthResponse{
+		AccessToken:  mock.AccessToken,
+		RefreshToken: mock.RefreshToken,
+		ExpiresIn:    14400,
+		Time:         time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Enabled = true
+	config.APIClientID = "mock"
+	config.APIClientSecret = "mock"
+	config.EventSubEndpoint = server.EventSubURL()
+	config.APIBaseURL = server.APIBaseURL()
+	config.AuthBaseURL = server.AuthBaseURL()
+	client, err := newClient(config, db, webServer, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client, db
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventSubWithMockServer(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+	if client.User.ID != server.User.ID {
+		t.Fatalf("expected user to be looked up from mock server, got %+v", client.User)
+	}
+
+	waitFor(t, "subscriptions", func() bool {
+		return len(server.Subscriptions()) == len(subscriptionVersions)
+	})
+
+	err := server.SendNotification(helix.EventSubTypeChannelFollow, helix.EventSubChannelFollowEvent{
+		UserID:    "1234",
+		UserLogin: "follower",
+		UserName:  "Follower",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notification NotificationMessagePayload
+	waitFor(t, "notification", func() bool {
+		return db.GetJSON(EventSubEventKey, &notification) == nil
+	})
+	if notification.Subscription.Type != helix.EventSubTypeChannelFollow {
+		t.Fatalf("expected follow event, got %s", notification.Subscription.Type)
+	}
+}
+
+func TestEventSubReconnect(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, _ := newMockClient(t, server)
+	waitFor(t, "subscriptions", func() bool {
+		return len(server.Subscriptions()) == len(subscriptionVersions)
+	})
+	oldSession := client.eventSubStatus.Get().SessionID
+
+	if err := server.SendReconnect(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "new session", func() bool {
+		status := client.eventSubStatus.Get()
+		return status.Connected && status.SessionID != "" && status.SessionID != oldSession
+	})
+	waitFor(t, "old session to be closed", func() bool {
+		return len(server.Sessions()) == 1
+	})
+
+	// Subscriptions must be carried over, not created again
+	newSession := client.eventSubStatus.Get().SessionID
+	subscriptions := server.Subscriptions()
+	if len(subscriptions) != len(subscriptionVersions) {
+		t.Fatalf("expected %d subscriptions, got %d", len(subscriptionVersions), len(subscriptions))
+	}
+	for _, sub := range subscriptions {
+		if sub.Transport.SessionID != newSession {
+			t.Fatalf("subscription %s still belongs to session %s", sub.Type, sub.Transport.SessionID)
+		}
+	}
+}
+
+func TestEventSubNewSessionToken(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+	waitFor(t, "subscriptions", func() bool {
+		return len(server.Subscriptions()) == len(subscriptionVersions)
+	})
+	waitFor(t, "first token check", func() bool {
+		var status AuthStatus
+		return db.GetJSON(AuthStatusKey, &status) == nil
+	})
+	oldSession := client.eventSubStatus.Get().SessionID
+
+	// Tokens get refreshed while connected, a new session must subscribe with the current one
+	err := db.PutJSON(AuthKey, AuthResponse{
+		AccessToken:  "refreshed-token",
+		RefreshToken: mock.RefreshToken,
+		ExpiresIn:    14400,
+		Time:         time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.DropSessions()
+	waitFor(t, "new subscriptions", func() bool {
+		status := client.eventSubStatus.Get()
+		return status.SessionID != oldSession && len(server.Subscriptions()) == len(subscriptionVersions)
+	})
+
+	for _, request := range server.Requests() {
+		var sub helix.EventSubSubscription
+		if request.Path != "/eventsub/subscriptions" || json.Unmarshal(request.Body, &sub) != nil || sub.Transport.SessionID == oldSession {
+			continue
+		}
+		if request.Token != "refreshed-token" {
+			t.Fatalf("subscription for the new session made with token %q", request.Token)
+		}
+	}
+}
+
+func TestEventSubDuplicateMessages(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+
+	payload, _ := json.Marshal(NotificationMessagePayload{
+		Subscription: helix.EventSubSubscription{Type: helix.EventSubTypeChannelFollow},
+	})
+	message := EventSubWebsocketMessage{Payload: payload}
+	message.Metadata.MessageId = "duplicate-message"
+	message.Metadata.MessageType = "notification"
+	message.Metadata.MessageTimestamp = time.Now()
+
+	client.processEvent(message)
+	client.processEvent(message)
+
+	var archive []NotificationMessagePayload
+	if err := db.GetJSON(EventSubHistoryKey, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if len(archive) != 1 {
+		t.Fatalf("expected duplicate message to be ignored, got %d events", len(archive))
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	for attempt := 0; attempt < 30; attempt++ {
+		expected := reconnectBackoffMax
+		if attempt < 16 {
+			expected = min(reconnectBackoffMin<<attempt, reconnectBackoffMax)
+		}
+		delay := reconnectBackoff(attempt)
+		if delay < expected/2 || delay > expected {
+			t.Fatalf("attempt %d: expected delay between %s and %s, got %s", attempt, expected/2, expected, delay)
+		}
+	}
+}
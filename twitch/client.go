@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	stdsync "sync"
 	"time"
 
 	"git.sr.ht/~ashkeel/containers/sync"
@@ -18,9 +22,19 @@ import (
 
 var json = jsoniter.ConfigFastest
 
+var ErrAPINotConfigured = errors.New("twitch integration is not enabled")
+
+// Maximum amount of users that can be looked up with a single Helix request
+const maxUsersPerRequest = 100
+
 type Manager struct {
 	client     *Client
+	alerts     *AlertQueue
+	sessions   *StreamSessionTracker
 	cancelSubs func()
+
+	// Config and account changes replace the client and bot from different subscriptions
+	botMux stdsync.Mutex
 }
 
 func NewManager(db *database.LocalDBClient, server *webserver.WebServer, logger *zap.Logger) (*Manager, error) {
@@ -47,6 +61,8 @@ func NewManager(db *database.LocalDBClient, server *webserver.WebServer, logger
 	if err != nil {
 		return nil, fmt.Errorf("failed to create twitch client: %w", err)
 	}
+	sessions := NewStreamSessionTracker(db, logger)
+	client.sessions = sessions
 
 	if config.EnableBot {
 		client.Bot = newBot(client, botConfig)
@@ -54,7 +70,9 @@ func NewManager(db *database.LocalDBClient, server *webserver.WebServer, logger
 	}
 
 	manager := &Manager{
-		client: client,
+		client:   client,
+		alerts:   NewAlertQueue(db, logger),
+		sessions: sessions,
 	}
 
 	// Listen for client config changes
@@ -65,6 +83,9 @@ func NewManager(db *database.LocalDBClient, server *webserver.WebServer, logger
 			return
 		}
 
+		manager.botMux.Lock()
+		defer manager.botMux.Unlock()
+
 		var updatedClient *Client
 		updatedClient, err = newClient(newConfig, db, server, logger)
 		if err != nil {
@@ -95,27 +116,20 @@ func NewManager(db *database.LocalDBClient, server *webserver.WebServer, logger
 			return
 		}
 
-		if manager.client.Bot != nil {
-			err = manager.client.Bot.Close()
-			if err != nil {
-				manager.client.logger.Warn("Failed to disconnect old bot from Twitch IRC", zap.Error(err))
-			}
-		}
-
-		if manager.client.Config.Get().EnableBot {
-			bot := newBot(manager.client, newBotConfig)
-			go bot.Connect()
-			manager.client.Bot = bot
-		} else {
-			manager.client.Bot = nil
-		}
-
-		manager.client.logger.Info("Reloaded/restarted Twitch bot")
+		manager.restartBot(newBotConfig)
 	})
 	if err != nil {
 		client.logger.Error("Could not setup twitch bot config reload subscription", zap.Error(err))
 	}
 
+	// The bot logs in as the bot account, so it must restart when that changes
+	err, cancelBotAuthSub := db.SubscribeKey(BotAuthKey, func(string) {
+		manager.onBotAuthChanged()
+	})
+	if err != nil {
+		client.logger.Error("Could not setup twitch bot account reload subscription", zap.Error(err))
+	}
+
 	manager.cancelSubs = func() {
 		if cancelConfigSub != nil {
 			cancelConfigSub()
@@ -123,17 +137,84 @@ func NewManager(db *database.LocalDBClient, server *webserver.WebServer, logger
 		if cancelBotSub != nil {
 			cancelBotSub()
 		}
+		if cancelBotAuthSub != nil {
+			cancelBotAuthSub()
+		}
 	}
 
 	return manager, nil
 }
 
+// onBotAuthChanged restarts the bot if it must log in as a different account, refreshed tokens
+// for the same account are given to the running bot instead
+func (m *Manager) onBotAuthChanged() {
+	m.botMux.Lock()
+	defer m.botMux.Unlock()
+
+	if bot := m.client.Bot; bot != nil {
+		login, token, ok := m.client.botChatCredentials()
+		if ok && strings.EqualFold(login, bot.username) {
+			// The IRC client needs the new token for when it reconnects
+			if tokenClient, ok := bot.Client.(interface{ SetIRCToken(string) }); ok {
+				tokenClient.SetIRCToken(token)
+			}
+			return
+		}
+	}
+
+	config := defaultBotConfig()
+	if err := m.client.db.GetJSON(BotConfigKey, &config); err != nil && !errors.Is(err, database.ErrEmptyKey) {
+		m.client.logger.Error("Failed to get bot config", zap.Error(err))
+		return
+	}
+	m.restartBotLocked(config)
+}
+
+func (m *Manager) restartBot(config BotConfig) {
+	m.botMux.Lock()
+	defer m.botMux.Unlock()
+
+	m.restartBotLocked(config)
+}
+
+// restartBotLocked replaces the running bot, botMux must be held when calling this
+func (m *Manager) restartBotLocked(config BotConfig) {
+	if m.client.Bot != nil {
+		err := m.client.Bot.Close()
+		if err != nil {
+			m.client.logger.Warn("Failed to disconnect old bot from Twitch IRC", zap.Error(err))
+		}
+	}
+
+	if m.client.Config.Get().EnableBot {
+		bot := newBot(m.client, config)
+		go bot.Connect()
+		m.client.Bot = bot
+	} else {
+		m.client.Bot = nil
+	}
+
+	m.client.logger.Info("Reloaded/restarted Twitch bot")
+}
+
 func (m *Manager) Client() *Client {
 	return m.client
 }
 
+// Alerts returns the queue of alerts for overlays
+func (m *Manager) Alerts() *AlertQueue {
+	return m.alerts
+}
+
+// Sessions returns the tracker of stream sessions
+func (m *Manager) Sessions() *StreamSessionTracker {
+	return m.sessions
+}
+
 func (m *Manager) Close() error {
 	m.cancelSubs()
+	m.alerts.Close()
+	m.sessions.Close()
 
 	if err := m.client.Close(); err != nil {
 		return err
@@ -148,28 +229,43 @@ type Client struct {
 	db         *database.LocalDBClient
 	API        *helix.Client
 	User       helix.User
+	botUser    *sync.RWSync[helix.User]
 	logger     *zap.Logger
 	eventCache *lru.Cache[string, time.Time]
+	sessions   *StreamSessionTracker
 	server     *webserver.WebServer
 	ctx        context.Context
 	cancel     context.CancelFunc
 
+	cancelEventRPCSubs []database.CancelFunc
+	loops              stdsync.WaitGroup
+	tokenLocks         map[string]*stdsync.Mutex
+	authStatus         *sync.RWSync[AuthStatus]
+
 	restart            chan bool
 	streamOnline       *sync.RWSync[bool]
+	streamInfo         *sync.RWSync[[]helix.Stream]
+	eventSubStatus     *sync.RWSync[EventSubStatus]
 	savedSubscriptions map[string]bool
 }
 
 func (c *Client) Merge(old *Client) {
 	// Copy bot instance and some params
 	c.streamOnline.Set(old.streamOnline.Get())
+	c.streamInfo.Set(old.streamInfo.Get())
+	c.sessions = old.sessions
 	c.Bot = old.Bot
 	c.ensureRoute()
 }
 
 // Hacky function to deal with sync issues when restarting client
 func (c *Client) ensureRoute() {
-	if c.Config.Get().Enabled {
+	config := c.Config.Get()
+	if config.Enabled {
 		c.server.RegisterRoute(CallbackRoute, c)
+		if config.EventSubTransport == EventSubTransportWebhook && config.WebhookSecret != "" {
+			c.server.RegisterRoute(WebhookRoute, http.HandlerFunc(c.serveWebhook))
+		}
 	}
 }
 
@@ -187,6 +283,11 @@ func newClient(config Config, db *database.LocalDBClient, server *webserver.WebS
 		logger:             logger.With(zap.String("service", "twitch")),
 		restart:            make(chan bool, 128),
 		streamOnline:       sync.NewRWSync(false),
+		botUser:            sync.NewRWSync(helix.User{}),
+		streamInfo:         sync.NewRWSync([]helix.Stream{}),
+		eventSubStatus:     sync.NewRWSync(EventSubStatus{}),
+		authStatus:         sync.NewRWSync(AuthStatus{}),
+		tokenLocks:         newTokenLocks(),
 		eventCache:         eventCache,
 		savedSubscriptions: make(map[string]bool),
 		ctx:                ctx,
@@ -196,12 +297,14 @@ func newClient(config Config, db *database.LocalDBClient, server *webserver.WebS
 
 	baseurl, err := client.baseURL()
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
 	if config.Enabled {
 		api, err := getHelixAPI(config, baseurl)
 		if err != nil {
+			cancel()
 			return nil, fmt.Errorf("failed to create twitch client: %w", err)
 		}
 
@@ -216,36 +319,50 @@ func newClient(config Config, db *database.LocalDBClient, server *webserver.WebS
 				client.logger.Error("No users found, please authenticate in Twitch configuration -> Events")
 			} else {
 				client.User = users.Data.Users[0]
-				go client.eventSubLoop(userClient)
+				if config.EventSubTransport == EventSubTransportWebhook {
+					if err := client.startWebhook(); err != nil {
+						client.logger.Error("Could not start EventSub webhook", zap.Error(err))
+					}
+				} else {
+					client.loops.Add(1)
+					go client.eventSubLoop()
+				}
 			}
 		} else {
 			client.logger.Warn("Twitch user not identified, this will break most features")
 		}
 
+		client.loops.Add(1)
+		go client.runTokenManager()
+
 		go client.runStatusPoll()
 	}
 
+	// Only subscribe once nothing can fail anymore, or the subscriptions would be left behind
+	client.setupEventRPCs()
+
 	return client, nil
 }
 
 func (c *Client) runStatusPoll() {
 	c.logger.Info("Started polling for stream status")
 	for {
-		// Make sure we're configured and connected properly first
-		if !c.Config.Get().Enabled || c.Bot == nil || c.Bot.Config.Channel == "" {
-			continue
-		}
-
 		// Check if streamer is online, if possible
 		func() {
+			// Make sure we're configured and connected properly first
+			if !c.Config.Get().Enabled || c.User.ID == "" {
+				return
+			}
+
 			status, err := c.API.GetStreams(&helix.StreamsParams{
-				UserLogins: []string{c.Bot.Config.Channel}, // TODO Replace with something non bot dependant
+				UserIDs: []string{c.User.ID},
 			})
 			if err != nil {
 				c.logger.Error("Error checking stream status", zap.Error(err))
 				return
 			} else {
 				c.streamOnline.Set(len(status.Data.Streams) > 0)
+				c.streamInfo.Set(status.Data.Streams)
 			}
 
 			err = c.db.PutJSON(StreamInfoKey, status.Data.Streams)
@@ -267,11 +384,9 @@ func getHelixAPI(config Config, baseurl string) (*helix.Client, error) {
 	redirectURI := getRedirectURI(baseurl)
 
 	// Create Twitch client
-	api, err := helix.NewClient(&helix.Options{
-		ClientID:     config.APIClientID,
-		ClientSecret: config.APIClientSecret,
-		RedirectURI:  redirectURI,
-	})
+	options := helixOptions(config)
+	options.RedirectURI = redirectURI
+	api, err := helix.NewClient(options)
 	if err != nil {
 		return nil, err
 	}
@@ -287,6 +402,39 @@ func getHelixAPI(config Config, baseurl string) (*helix.Client, error) {
 	return api, nil
 }
 
+// helixOptions returns the options for a Helix client, using the custom endpoints if configured
+func helixOptions(config Config) *helix.Options {
+	options := &helix.Options{
+		ClientID:     config.APIClientID,
+		ClientSecret: config.APIClientSecret,
+		APIBaseURL:   config.APIBaseURL,
+	}
+	// The auth endpoint can't be changed in helix, so requests to it must be redirected
+	if config.AuthBaseURL != "" {
+		options.HTTPClient = &http.Client{
+			Transport: authRedirectTransport{baseURL: config.AuthBaseURL},
+		}
+	}
+	return options
+}
+
+type authRedirectTransport struct {
+	baseURL string
+}
+
+func (t authRedirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rest, ok := strings.CutPrefix(req.URL.String(), helix.AuthBaseURL); ok {
+		target, err := url.Parse(t.baseURL + rest)
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.URL = target
+		req.Host = target.Host
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 func (c *Client) baseURL() (string, error) {
 	var severConfig struct {
 		Bind string `json:"bind"`
@@ -299,9 +447,71 @@ func (c *Client) IsLive() bool {
 	return c.streamOnline.Get()
 }
 
+// CurrentStream returns the info for the ongoing stream, the second value is false if the channel is offline
+func (c *Client) CurrentStream() (helix.Stream, bool) {
+	streams := c.streamInfo.Get()
+	if len(streams) < 1 {
+		return helix.Stream{}, false
+	}
+	return streams[0], true
+}
+
+// userIDForLogin returns the ID of a user from their login
+func (c *Client) userIDForLogin(login string) (string, error) {
+	login = normalizeChannel(login)
+	if c.User.ID != "" && strings.EqualFold(c.User.Login, login) {
+		return c.User.ID, nil
+	}
+	users, err := c.API.GetUsers(&helix.UsersParams{Logins: []string{login}})
+	if err != nil {
+		return "", err
+	}
+	if len(users.Data.Users) < 1 {
+		return "", fmt.Errorf("user %s not found", login)
+	}
+	return users.Data.Users[0].ID, nil
+}
+
+// UserIDsForLogins returns the IDs of the given users, keyed by (lowercase) login.
+// Logins that don't belong to any existing user are left out of the result.
+func (c *Client) UserIDsForLogins(logins []string) (map[string]string, error) {
+	if c.API == nil {
+		return nil, ErrAPINotConfigured
+	}
+
+	ids := make(map[string]string)
+	for start := 0; start < len(logins); start += maxUsersPerRequest {
+		batch := make([]string, 0, maxUsersPerRequest)
+		for _, login := range logins[start:min(start+maxUsersPerRequest, len(logins))] {
+			batch = append(batch, normalizeChannel(login))
+		}
+		users, err := c.API.GetUsers(&helix.UsersParams{Logins: batch})
+		if err != nil {
+			return nil, err
+		}
+		if users.StatusCode >= 400 {
+			return nil, fmt.Errorf("%d: %s", users.StatusCode, users.ErrorMessage)
+		}
+		for _, user := range users.Data.Users {
+			ids[strings.ToLower(user.Login)] = user.ID
+		}
+	}
+	return ids, nil
+}
+
 func (c *Client) Close() error {
 	c.server.UnregisterRoute(CallbackRoute)
-	defer c.cancel()
+	c.server.UnregisterRoute(WebhookRoute)
+	c.cancel()
+
+	// Wait for the EventSub connection or webhook setup and token manager to be closed
+	c.loops.Wait()
+
+	for _, cancelSub := range c.cancelEventRPCSubs {
+		if cancelSub != nil {
+			cancelSub()
+		}
+	}
 
 	if c.Bot != nil {
 		if err := c.Bot.Close(); err != nil {
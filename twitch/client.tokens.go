@@ -0,0 +1,187 @@
+package twitch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	stdsync "sync"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+const (
+	// Twitch requires apps to validate their tokens every hour
+	tokenValidateInterval = time.Hour
+
+	// How often to check if tokens are about to expire
+	tokenCheckInterval = 5 * time.Minute
+
+	// Tokens are refreshed when they are this close to expiring
+	tokenRefreshMargin = 15 * time.Minute
+)
+
+var ErrTokenRefreshFailed = errors.New("could not refresh token")
+
+// newTokenLocks creates the locks that make sure each token is only refreshed once at a time
+func newTokenLocks() map[string]*stdsync.Mutex {
+	return map[string]*stdsync.Mutex{
+		AuthKey:    {},
+		BotAuthKey: {},
+	}
+}
+
+// ExpiresAt returns when the access token expires
+func (a AuthResponse) ExpiresAt() time.Time {
+	return a.Time.Add(time.Duration(a.ExpiresIn) * time.Second)
+}
+
+// loadToken returns the token saved in a key, refreshing it first if it's about to expire (or if force is true).
+// Only one caller at a time can refresh a token, the others will get the refreshed one.
+func (c *Client) loadToken(key string, force bool) (AuthResponse, error) {
+	requested := time.Now()
+
+	lock := c.tokenLocks[key]
+	lock.Lock()
+	defer lock.Unlock()
+
+	var auth AuthResponse
+	err := c.db.GetJSON(key, &auth)
+	if err != nil {
+		return auth, err
+	}
+
+	// If the token was refreshed while waiting for the lock, there's no need to do it again
+	if force && auth.Time.After(requested) {
+		return auth, nil
+	}
+	if !force && time.Now().Add(tokenRefreshMargin).Before(auth.ExpiresAt()) {
+		return auth, nil
+	}
+
+	refreshed, err := c.API.RefreshUserAccessToken(auth.RefreshToken)
+	if err != nil {
+		return auth, err
+	}
+	if refreshed.StatusCode != http.StatusOK || refreshed.Data.AccessToken == "" {
+		return auth, fmt.Errorf("%w: %s", ErrTokenRefreshFailed, refreshed.ErrorMessage)
+	}
+	auth.AccessToken = refreshed.Data.AccessToken
+	auth.RefreshToken = refreshed.Data.RefreshToken
+	auth.ExpiresIn = refreshed.Data.ExpiresIn
+	auth.Time = time.Now()
+	if len(refreshed.Data.Scopes) > 0 {
+		auth.Scope = refreshed.Data.Scopes
+	}
+
+	// Save new token pair
+	err = c.db.PutJSON(key, auth)
+	return auth, err
+}
+
+// runTokenManager keeps tokens refreshed and validated, publishing their status
+func (c *Client) runTokenManager() {
+	defer c.loops.Done()
+
+	var lastValidation time.Time
+	for {
+		validate := time.Since(lastValidation) >= tokenValidateInterval
+		c.checkTokens(validate)
+		if validate {
+			lastValidation = time.Now()
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(tokenCheckInterval):
+		}
+	}
+}
+
+// checkTokens refreshes tokens that are about to expire, validates them if validate is true and publishes their status
+func (c *Client) checkTokens(validate bool) AuthStatus {
+	previous := c.authStatus.Get()
+	status := AuthStatus{
+		Broadcaster: c.checkToken(AuthKey, c.broadcasterScopes(), previous.Broadcaster, validate),
+		Bot:         c.checkToken(BotAuthKey, c.botAccountScopes(), previous.Bot, validate),
+	}
+	c.authStatus.Set(status)
+
+	err := c.db.PutJSON(AuthStatusKey, status)
+	if err != nil {
+		c.logger.Warn("Could not save auth status", zap.Error(err))
+	}
+	return status
+}
+
+func (c *Client) checkToken(key string, required []string, previous TokenStatus, validate bool) TokenStatus {
+	auth, err := c.loadToken(key, false)
+	if err != nil {
+		if errors.Is(err, database.ErrEmptyKey) {
+			// The broadcaster account is required, the bot account is optional
+			return TokenStatus{NeedsReauth: key == AuthKey}
+		}
+		c.logger.Error("Could not refresh token", zap.String("key", key), zap.Error(err))
+		return TokenStatus{NeedsReauth: true, Error: err.Error()}
+	}
+
+	status := previous
+	status.Authenticated = true
+	status.ExpiresAt = auth.ExpiresAt()
+	status.Error = ""
+	scopes := auth.Scope
+
+	if validate {
+		valid, response, err := c.validateToken(auth.AccessToken)
+		if err != nil {
+			// Twitch might just be unreachable, try again later
+			c.logger.Warn("Could not validate token", zap.String("key", key), zap.Error(err))
+			status.Error = err.Error()
+			return status
+		}
+		if !valid {
+			// Token might have been invalidated early (e.g. password change), a refresh could still work
+			c.logger.Info("Token is not valid anymore, refreshing", zap.String("key", key))
+			auth, err = c.loadToken(key, true)
+			if err == nil {
+				valid, response, err = c.validateToken(auth.AccessToken)
+			}
+			if err != nil || !valid {
+				c.logger.Error("Token was revoked, the account must be authorized again", zap.String("key", key), zap.Error(err))
+				status = TokenStatus{NeedsReauth: true, Error: "token was revoked"}
+				return status
+			}
+		}
+		status.Login = response.Data.Login
+		status.ExpiresAt = auth.ExpiresAt()
+		status.LastValidated = time.Now()
+		scopes = response.Data.Scopes
+	}
+
+	// Newer features might need scopes the token was not granted
+	status.MissingScopes = nil
+	for _, scope := range required {
+		if !slices.Contains(scopes, scope) {
+			status.MissingScopes = append(status.MissingScopes, scope)
+		}
+	}
+	if len(status.MissingScopes) > 0 {
+		c.logger.Warn("Token is missing scopes, some features won't work until the account is authorized again", zap.String("key", key), zap.Strings("scopes", status.MissingScopes))
+	}
+	status.NeedsReauth = len(status.MissingScopes) > 0
+	return status
+}
+
+// validateToken checks a token with Twitch, using a separate client since helix swaps the token of the client while validating
+func (c *Client) validateToken(token string) (bool, *helix.ValidateTokenResponse, error) {
+	api, err := helix.NewClient(helixOptions(c.Config.Get()))
+	if err != nil {
+		return false, nil, err
+	}
+	return api.ValidateToken(token)
+}
@@ -0,0 +1,217 @@
+package twitch
+
+import (
+	"slices"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
+)
+
+// stopBackgroundLoops stops the client's own token checks so they can't race with the test
+func stopBackgroundLoops(client *Client) {
+	client.cancel()
+	client.loops.Wait()
+}
+
+func TestTokenStatus(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+	server.SetScopes(botScopes)
+
+	client, db := newMockClient(t, server)
+	stopBackgroundLoops(client)
+
+	status := client.checkTokens(true)
+	if !status.Broadcaster.Authenticated || status.Broadcaster.Login != server.User.Login {
+		t.Fatalf("expected broadcaster to be authenticated, got %+v", status.Broadcaster)
+	}
+	if status.Bot.Authenticated || status.Bot.NeedsReauth {
+		t.Fatalf("bot account is optional and not authorized, got %+v", status.Bot)
+	}
+
+	// Granted scopes are not enough for the enabled EventSub topics
+	if !status.Broadcaster.NeedsReauth || len(status.Broadcaster.MissingScopes) == 0 {
+		t.Fatalf("expected missing scopes, got %+v", status.Broadcaster)
+	}
+
+	server.SetScopes(requiredScopes(client.Config.Get()))
+	status = client.checkTokens(true)
+	if status.Broadcaster.NeedsReauth || len(status.Broadcaster.MissingScopes) > 0 {
+		t.Fatalf("expected no missing scopes, got %+v", status.Broadcaster)
+	}
+
+	var saved AuthStatus
+	if err := db.GetJSON(AuthStatusKey, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Broadcaster.Authenticated || saved.Broadcaster.NeedsReauth {
+		t.Fatalf("auth status was not saved, got %+v", saved)
+	}
+}
+
+func TestTokenRefreshBeforeExpiry(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+	stopBackgroundLoops(client)
+
+	// Token is about to expire, it must be refreshed
+	err := db.PutJSON(AuthKey, AuthResponse{
+		AccessToken:  "old-token",
+		RefreshToken: mock.RefreshToken,
+		ExpiresIn:    60,
+		Time:         time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshes := server.Refreshes()
+
+	status := client.checkTokens(false)
+	if !status.Broadcaster.Authenticated || time.Until(status.Broadcaster.ExpiresAt) < time.Hour {
+		t.Fatalf("expected token to be refreshed, got %+v", status.Broadcaster)
+	}
+	if server.Refreshes() != refreshes+1 {
+		t.Fatalf("expected one refresh, got %d", server.Refreshes()-refreshes)
+	}
+
+	var auth AuthResponse
+	if err := db.GetJSON(AuthKey, &auth); err != nil {
+		t.Fatal(err)
+	}
+	if auth.AccessToken != mock.AccessToken || auth.ExpiresIn != 14400 {
+		t.Fatalf("refreshed token was not saved, got %+v", auth)
+	}
+
+	// A fresh token is left alone
+	client.checkTokens(false)
+	if server.Refreshes() != refreshes+1 {
+		t.Fatal("token was refreshed even if not expiring")
+	}
+}
+
+func TestTokenRevoked(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+	stopBackgroundLoops(client)
+
+	// Access token was revoked but the refresh token still works
+	err := db.PutJSON(AuthKey, AuthResponse{
+		AccessToken:  "revoked-token",
+		RefreshToken: mock.RefreshToken,
+		ExpiresIn:    14400,
+		Time:         time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := client.checkTokens(true)
+	if !status.Broadcaster.Authenticated || status.Broadcaster.Error != "" {
+		t.Fatalf("expected token to be recovered with a refresh, got %+v", status.Broadcaster)
+	}
+
+	// Both tokens were revoked, the user must authorize again
+	err = db.PutJSON(AuthKey, AuthResponse{
+		AccessToken:  "revoked-token",
+		RefreshToken: "revoked-refresh-token",
+		ExpiresIn:    14400,
+		Time:         time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = client.checkTokens(true)
+	if status.Broadcaster.Authenticated || !status.Broadcaster.NeedsReauth {
+		t.Fatalf("expected account to need authorization, got %+v", status.Broadcaster)
+	}
+
+	// The revoked token must not be overwritten with an empty one
+	var auth AuthResponse
+	if err := db.GetJSON(AuthKey, &auth); err != nil {
+		t.Fatal(err)
+	}
+	if auth.RefreshToken != "revoked-refresh-token" {
+		t.Fatalf("token was overwritten after a failed refresh: %+v", auth)
+	}
+}
+
+func TestTokenRefreshSingleFlight(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClient(t, server)
+	stopBackgroundLoops(client)
+	err := db.PutJSON(AuthKey, AuthResponse{
+		AccessToken:  "old-token",
+		RefreshToken: mock.RefreshToken,
+		ExpiresIn:    60,
+		Time:         time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshes := server.Refreshes()
+
+	var wg stdsync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetUserClient(false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if server.Refreshes() != refreshes+1 {
+		t.Fatalf("expected a single refresh, got %d", server.Refreshes()-refreshes)
+	}
+}
+
+func TestChatScopes(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, db := newMockClientWithConfig(t, server, Config{EnableBot: true})
+	stopBackgroundLoops(client)
+	server.SetScopes(append(requiredScopes(client.Config.Get()), botScopes...))
+
+	// IRC chat doesn't need the chat scopes
+	status := client.checkTokens(true)
+	if status.Broadcaster.NeedsReauth {
+		t.Fatalf("chat scopes required without EventSub chat, got %+v", status.Broadcaster)
+	}
+
+	// Without a bot account, the broadcaster chats
+	if err := db.PutJSON(BotConfigKey, BotConfig{ChatTransport: ChatTransportEventSub}); err != nil {
+		t.Fatal(err)
+	}
+	status = client.checkTokens(true)
+	if !slices.Equal(status.Broadcaster.MissingScopes, chatScopes) {
+		t.Fatalf("expected broadcaster to need chat scopes, got %+v", status.Broadcaster)
+	}
+
+	// With a bot account, only the bot needs them
+	err := db.PutJSON(BotAuthKey, AuthResponse{
+		AccessToken:  mock.BotAccessToken,
+		RefreshToken: mock.BotRefreshToken,
+		ExpiresIn:    14400,
+		Time:         time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = client.checkTokens(true)
+	if status.Broadcaster.NeedsReauth {
+		t.Fatalf("broadcaster doesn't chat with a bot account, got %+v", status.Broadcaster)
+	}
+	if !slices.Equal(status.Bot.MissingScopes, chatScopes) {
+		t.Fatalf("expected bot account to need chat scopes, got %+v", status.Bot)
+	}
+}
@@ -1,11 +1,15 @@
 package twitch
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/nicklaw5/helix/v2"
 	"go.uber.org/zap/zaptest"
 
 	"git.sr.ht/~ashkeel/strimertul/database"
+	"git.sr.ht/~ashkeel/strimertul/twitch/mock"
 	"git.sr.ht/~ashkeel/strimertul/webserver"
 )
 
@@ -25,3 +29,43 @@ func TestNewClient(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestUserIDsForLogins(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	client, _ := newMockClient(t, server)
+
+	// Enough logins to need more than one request
+	logins := []string{strings.ToUpper(server.User.Login)}
+	for i := 0; i < 150; i++ {
+		logins = append(logins, fmt.Sprintf("viewer%d", i))
+	}
+	ids, err := client.UserIDsForLogins(logins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(logins) {
+		t.Fatalf("expected %d users, got %d", len(logins), len(ids))
+	}
+	if ids[server.User.Login] != server.User.ID || ids["viewer149"] != "mock-viewer149" {
+		t.Fatalf("unexpected user IDs: %v", ids)
+	}
+}
+
+func TestStatusPoll(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+
+	// Stream status is found by user ID, with or without a bot
+	server.SetStreams([]helix.Stream{
+		{ID: "other", UserID: "someone-else"},
+		{ID: "stream1", UserID: server.User.ID},
+	})
+	client, _ := newMockClient(t, server)
+
+	waitFor(t, "stream status", client.IsLive)
+	if stream, _ := client.CurrentStream(); stream.ID != "stream1" {
+		t.Fatalf("expected the broadcaster's stream, got %+v", stream)
+	}
+}
@@ -63,41 +63,46 @@ func cmdCustom(bot *Bot, cmd string, data BotCustomCommand, message irc.PrivateM
 
 	switch data.ResponseType {
 	case ResponseTypeDefault, ResponseTypeChat:
-		bot.Client.Say(message.Channel, buf.String())
+		bot.Say(message.Channel, buf.String(), MessagePriorityHigh)
 	case ResponseTypeReply:
-		bot.Client.Reply(message.Channel, message.ID, buf.String())
+		bot.Reply(message.Channel, message.ID, buf.String(), MessagePriorityHigh)
 	case ResponseTypeWhisper:
-		client, err := bot.api.GetUserClient(false)
-		reply, err := client.SendUserWhisper(&helix.SendUserWhisperParams{
-			FromUserID: bot.api.User.ID,
-			ToUserID:   message.User.ID,
-			Message:    buf.String(),
-		})
-		if reply.Error != "" {
-			bot.logger.Error("Failed to send whisper", zap.String("code", reply.Error), zap.String("message", reply.ErrorMessage))
-		}
-		if err != nil {
-			bot.logger.Error("Failed to send whisper", zap.Error(err))
-		}
-
+		bot.sendWhisper(message.User.ID, buf.String())
 	case ResponseTypeAnnounce:
-		client, err := bot.api.GetUserClient(false)
-		reply, err := client.SendChatAnnouncement(&helix.SendChatAnnouncementParams{
-			BroadcasterID: bot.api.User.ID,
-			ModeratorID:   bot.api.User.ID,
-			Message:       buf.String(),
-		})
-		if reply.Error != "" {
-			bot.logger.Error("Failed to send announcement", zap.String("code", reply.Error), zap.String("message", reply.ErrorMessage))
-		}
-		if err != nil {
-			bot.logger.Error("Failed to send announcement", zap.Error(err))
-		}
+		bot.sendAnnouncement(message.Channel, buf.String())
 	}
 }
 
 func (b *Bot) MakeTemplate(message string) (*template.Template, error) {
-	return template.New("").Funcs(sprig.TxtFuncMap()).Funcs(b.customFunctions).Parse(message)
+	return template.New("").Funcs(sprig.TxtFuncMap()).Funcs(b.customFunctions).Funcs(b.extraFunctions.Copy()).Parse(message)
+}
+
+// SetTemplateFunction adds (or replaces) a function available to all bot templates.
+// Templates are recompiled so that the ones using the new function can be parsed.
+func (b *Bot) SetTemplateFunction(name string, fn any) {
+	b.extraFunctions.SetKey(name, fn)
+	b.recompileTemplates()
+}
+
+// RemoveTemplateFunction removes a function added with SetTemplateFunction
+func (b *Bot) RemoveTemplateFunction(name string) {
+	if _, ok := b.extraFunctions.GetKey(name); !ok {
+		return
+	}
+	b.extraFunctions.DeleteKey(name)
+	b.recompileTemplates()
+}
+
+func (b *Bot) recompileTemplates() {
+	if err := b.updateTemplates(); err != nil {
+		b.logger.Error("Failed to update custom commands templates", zap.Error(err))
+	}
+	if b.Alerts != nil {
+		b.Alerts.compileTemplates()
+	}
+	if b.Timers != nil {
+		b.Timers.compileTemplates()
+	}
 }
 
 var TestMessageData = irc.PrivateMessage{
@@ -0,0 +1,132 @@
+package twitch
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCron = errors.New("invalid cron expression")
+
+// cronSchedule is a parsed cron expression (minute, hour, day of month, month, day of week)
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	// Standard cron behavior: if both day fields are restricted, either can match
+	anyDay     bool
+	anyWeekday bool
+}
+
+type cronField struct {
+	min, max int
+}
+
+var cronFields = []cronField{
+	{0, 59}, // Minute
+	{0, 23}, // Hour
+	{1, 31}, // Day of month
+	{1, 12}, // Month
+	{0, 7},  // Day of week (0 and 7 are both Sunday)
+}
+
+func parseCron(expr string) (cronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return cronSchedule{}, fmt.Errorf("%w: expected %d fields, got %d", ErrInvalidCron, len(cronFields), len(parts))
+	}
+
+	var bits [5]uint64
+	for i, part := range parts {
+		var err error
+		bits[i], err = parseCronField(part, cronFields[i])
+		if err != nil {
+			return cronSchedule{}, err
+		}
+	}
+
+	// Sunday can be either 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return cronSchedule{
+		minutes:    bits[0],
+		hours:      bits[1],
+		days:       bits[2],
+		months:     bits[3],
+		weekdays:   bits[4],
+		anyDay:     parts[2] == "*",
+		anyWeekday: parts[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, limits cronField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		// Get step, if specified
+		step := 1
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("%w: invalid step in %q", ErrInvalidCron, item)
+			}
+		}
+
+		// Get range
+		start, end := limits.min, limits.max
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			start, err = strconv.Atoi(startPart)
+			if err != nil {
+				return 0, fmt.Errorf("%w: invalid value in %q", ErrInvalidCron, item)
+			}
+			end = start
+			if isRange {
+				end, err = strconv.Atoi(endPart)
+				if err != nil {
+					return 0, fmt.Errorf("%w: invalid range in %q", ErrInvalidCron, item)
+				}
+			} else if hasStep {
+				// "5/15" means "from 5 onwards, every 15"
+				end = limits.max
+			}
+		}
+		if start < limits.min || end > limits.max || start > end {
+			return 0, fmt.Errorf("%w: %q is out of range (%d-%d)", ErrInvalidCron, item, limits.min, limits.max)
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+// Matches returns true if the schedule should trigger at the given time (minute precision)
+func (c cronSchedule) Matches(t time.Time) bool {
+	if c.minutes&(1<<t.Minute()) == 0 || c.hours&(1<<t.Hour()) == 0 || c.months&(1<<int(t.Month())) == 0 {
+		return false
+	}
+
+	dayMatches := c.days&(1<<t.Day()) != 0
+	weekdayMatches := c.weekdays&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekdayMatches
+	case c.anyWeekday:
+		return dayMatches
+	default:
+		return dayMatches || weekdayMatches
+	}
+}
@@ -0,0 +1,57 @@
+package twitch
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		time    time.Time
+		matches bool
+	}{
+		{"* * * * *", time.Date(2023, 11, 12, 15, 4, 0, 0, time.UTC), true},
+		{"*/15 * * * *", time.Date(2023, 11, 12, 15, 30, 0, 0, time.UTC), true},
+		{"*/15 * * * *", time.Date(2023, 11, 12, 15, 31, 0, 0, time.UTC), false},
+		{"5/15 * * * *", time.Date(2023, 11, 12, 15, 20, 0, 0, time.UTC), true},
+		{"0 9-17 * * *", time.Date(2023, 11, 12, 12, 0, 0, 0, time.UTC), true},
+		{"0 9-17 * * *", time.Date(2023, 11, 12, 18, 0, 0, 0, time.UTC), false},
+		{"30 20 * * 1,3,5", time.Date(2023, 11, 13, 20, 30, 0, 0, time.UTC), true},  // Monday
+		{"30 20 * * 1,3,5", time.Date(2023, 11, 14, 20, 30, 0, 0, time.UTC), false}, // Tuesday
+		{"0 0 * * 7", time.Date(2023, 11, 12, 0, 0, 0, 0, time.UTC), true},          // Sunday
+		{"0 0 1 * 1", time.Date(2023, 11, 13, 0, 0, 0, 0, time.UTC), true},          // Day of month or Monday
+		{"0 0 1 * 1", time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 1 6 *", time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", test.expr, err)
+		}
+		if schedule.Matches(test.time) != test.matches {
+			t.Errorf("expected %q to return %t for %s", test.expr, test.matches, test.time)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+
+	for _, expr := range invalid {
+		if _, err := parseCron(expr); !errors.Is(err, ErrInvalidCron) {
+			t.Errorf("expected %q to be invalid, got %v", expr, err)
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package twitch
 
+import "time"
+
 const CallbackRoute = "/twitch/callback"
 
+const WebhookRoute = "/twitch/eventsub"
+
 const ConfigKey = "twitch/config"
 
 // Config is the general configuration for the Twitch subsystem
@@ -17,8 +21,36 @@ type Config struct {
 
 	// Twitch API App Client Secret
 	APIClientSecret string `json:"api_client_secret" desc:"Twitch API App Client Secret"`
+
+	// Custom EventSub websocket endpoint, for testing (leave empty to use Twitch's)
+	EventSubEndpoint string `json:"eventsub_endpoint,omitempty" desc:"Custom EventSub websocket endpoint, for testing (leave empty to use Twitch's)"`
+
+	// Custom Helix API base URL, for testing (leave empty to use Twitch's)
+	APIBaseURL string `json:"api_base_url,omitempty" desc:"Custom Helix API base URL, for testing (leave empty to use Twitch's)"`
+
+	// Custom OAuth base URL, for testing (leave empty to use Twitch's)
+	AuthBaseURL string `json:"auth_base_url,omitempty" desc:"Custom OAuth base URL, for testing (leave empty to use Twitch's)"`
+
+	// EventSub subscription types to listen to (leave empty for all supported types)
+	EventSubTopics []string `json:"eventsub_topics,omitempty" desc:"EventSub subscription types to listen to (leave empty for all supported types)"`
+
+	// How to receive EventSub notifications (websocket if empty)
+	EventSubTransport EventSubTransportType `json:"eventsub_transport,omitempty" desc:"How to receive EventSub notifications (websocket if empty)"`
+
+	// Public HTTPS URL that Twitch will send webhook notifications to, must be routed to /twitch/eventsub
+	WebhookCallbackURL string `json:"webhook_callback_url,omitempty" desc:"Public HTTPS URL that Twitch will send webhook notifications to, must be routed to /twitch/eventsub"`
+
+	// Secret for signing webhook notifications (10 to 100 characters)
+	WebhookSecret string `json:"webhook_secret,omitempty" desc:"Secret for signing webhook notifications (10 to 100 characters)"`
 }
 
+type EventSubTransportType string
+
+const (
+	EventSubTransportWebsocket EventSubTransportType = "websocket"
+	EventSubTransportWebhook   EventSubTransportType = "webhook"
+)
+
 const StreamInfoKey = "twitch/stream-info"
 
 const BotConfigKey = "twitch/bot-config"
@@ -34,19 +66,63 @@ type BotConfig struct {
 	// Twitch channel to join and use
 	Channel string `json:"channel" desc:"Twitch channel to join and use"`
 
+	// Other Twitch channels to join, custom commands, timers and alerts can be enabled for them separately
+	ExtraChannels []string `json:"extra_channels,omitempty" desc:"Other Twitch channels to join, custom commands, timers and alerts can be enabled for them separately"`
+
 	// How many messages to keep in twitch/chat-history
 	ChatHistory int `json:"chat_history" desc:"How many messages to keep in twitch/chat-history"`
 
 	// Global command cooldown in seconds
 	CommandCooldown int `json:"command_cooldown" desc:"Global command cooldown in seconds"`
+
+	// Send up to 100 messages every 30 seconds instead of 20, only enable if the bot is a moderator in every joined channel
+	ModeratorRateLimit bool `json:"moderator_rate_limit,omitempty" desc:"Send up to 100 messages every 30 seconds instead of 20, only enable if the bot is a moderator in every joined channel"`
+
+	// Drop messages identical to the last one sent in the same channel less than 30 seconds ago, which Twitch rejects if the bot is not a moderator
+	DropDuplicateMessages bool `json:"drop_duplicate_messages,omitempty" desc:"Drop messages identical to the last one sent in the same channel less than 30 seconds ago, which Twitch rejects if the bot is not a moderator"`
+
+	// How the chatbot reads and writes chat (IRC if empty), EventSub needs the bot account (or the broadcaster) to be authorized
+	ChatTransport ChatTransportType `json:"chat_transport,omitempty" desc:"How the chatbot reads and writes chat (IRC if empty), EventSub needs the bot account (or the broadcaster) to be authorized"`
 }
 
+type ChatTransportType string
+
+const (
+	ChatTransportIRC      ChatTransportType = "irc"
+	ChatTransportEventSub ChatTransportType = "eventsub"
+)
+
 const (
 	ChatEventKey    = "twitch/ev/chat-message"
 	ChatHistoryKey  = "twitch/chat-history"
 	ChatActivityKey = "twitch/chat-activity"
 )
 
+const (
+	ChatClearEventKey        = "twitch/ev/chat-clear"
+	ChatClearHistoryKey      = "twitch/chat-clear-history"
+	MessageDeletedEventKey   = "twitch/ev/message-deleted"
+	MessageDeletedHistoryKey = "twitch/message-deleted-history"
+	UserNoticeEventKey       = "twitch/ev/user-notice"
+	UserNoticeHistoryKey     = "twitch/user-notice-history"
+	RoomStateKey             = "twitch/room-state"
+)
+
+// Chat keys for extra channels are the same as the main channel's, followed by the channel name
+const (
+	ChannelChatEventPrefix    = ChatEventKey + "/"
+	ChannelChatHistoryPrefix  = ChatHistoryKey + "/"
+	ChannelChatActivityPrefix = ChatActivityKey + "/"
+
+	ChannelChatClearEventPrefix        = ChatClearEventKey + "/"
+	ChannelChatClearHistoryPrefix      = ChatClearHistoryKey + "/"
+	ChannelMessageDeletedEventPrefix   = MessageDeletedEventKey + "/"
+	ChannelMessageDeletedHistoryPrefix = MessageDeletedHistoryKey + "/"
+	ChannelUserNoticeEventPrefix       = UserNoticeEventKey + "/"
+	ChannelUserNoticeHistoryPrefix     = UserNoticeHistoryKey + "/"
+	ChannelRoomStatePrefix             = RoomStateKey + "/"
+)
+
 type ResponseType string
 
 const (
@@ -73,6 +149,9 @@ type BotCustomCommand struct {
 
 	// How to respond to the user
 	ResponseType ResponseType `json:"response_type" desc:"How to respond to the user"`
+
+	// Channels the command can be used in (leave empty for all channels)
+	Channels []string `json:"channels,omitempty" desc:"Channels the command can be used in (leave empty for all channels)"`
 }
 
 const CustomCommandsKey = "twitch/bot-custom-commands"
@@ -90,11 +169,49 @@ type WriteMessageRequest struct {
 	ReplyTo   *string `json:"reply_to" desc:"If specified, send as reply to a message ID"`
 	WhisperTo *string `json:"whisper_to" desc:"If specified, send as whisper to user ID"`
 	Announce  bool    `json:"announce" desc:"If true, send as announcement"`
+	Channel   string  `json:"channel,omitempty" desc:"Channel to send the message to (main channel if empty)"`
 }
 
 const BotCounterPrefix = "twitch/bot-counters/"
 
-const AuthKey = "twitch/auth-keys"
+const (
+	AuthKey       = "twitch/auth-keys"
+	BotAuthKey    = "twitch/bot-auth-keys"
+	AuthStatusKey = "twitch/auth-status"
+)
+
+// AuthStatus is the state of the tokens of both Twitch accounts
+type AuthStatus struct {
+	// Status of the broadcaster account token
+	Broadcaster TokenStatus `json:"broadcaster" desc:"Status of the broadcaster account token"`
+
+	// Status of the bot account token
+	Bot TokenStatus `json:"bot" desc:"Status of the bot account token"`
+}
+
+// TokenStatus is the state of an account token
+type TokenStatus struct {
+	// Whether there is a working token for the account
+	Authenticated bool `json:"authenticated" desc:"Whether there is a working token for the account"`
+
+	// Login of the account the token belongs to
+	Login string `json:"login,omitempty" desc:"Login of the account the token belongs to"`
+
+	// When the token expires (it gets refreshed automatically before that)
+	ExpiresAt time.Time `json:"expires_at" desc:"When the token expires (it gets refreshed automatically before that)"`
+
+	// When the token was last validated with Twitch
+	LastValidated time.Time `json:"last_validated" desc:"When the token was last validated with Twitch"`
+
+	// Scopes needed by enabled features that the token doesn't have
+	MissingScopes []string `json:"missing_scopes,omitempty" desc:"Scopes needed by enabled features that the token doesn't have"`
+
+	// True if the account must be authorized again (token revoked or missing scopes)
+	NeedsReauth bool `json:"needs_reauth" desc:"True if the account must be authorized again (token revoked or missing scopes)"`
+
+	// Last error while checking or refreshing the token
+	Error string `json:"error,omitempty" desc:"Last error while checking or refreshing the token"`
+}
 
 const (
 	EventSubEventKey   = "twitch/ev/eventsub-event"
@@ -102,3 +219,218 @@ const (
 )
 
 const EventSubHistorySize = 100
+
+const EventSubStatusKey = "twitch/eventsub-status"
+
+// EventSubStatus is the state of the connection to the EventSub websocket
+type EventSubStatus struct {
+	// Whether the websocket is connected and has a session
+	Connected bool `json:"connected" desc:"Whether the websocket is connected and has a session"`
+
+	// ID of the current session
+	SessionID string `json:"session_id" desc:"ID of the current session"`
+
+	// When the current session was established
+	ConnectedAt time.Time `json:"connected_at" desc:"When the current session was established"`
+
+	// Seconds without messages after which the connection is considered dead
+	KeepaliveTimeout int `json:"keepalive_timeout" desc:"Seconds without messages after which the connection is considered dead"`
+
+	// When the last event notification was received
+	LastEvent time.Time `json:"last_event" desc:"When the last event notification was received"`
+
+	// Last connection error, if any
+	Error string `json:"error,omitempty" desc:"Last connection error, if any"`
+}
+
+const (
+	TestAlertRPC   = "twitch/@test-alert"
+	ReplayEventRPC = "twitch/@replay-event"
+)
+
+// TestAlertRequest is an RPC to send a fake EventSub notification
+type TestAlertRequest struct {
+	// EventSub subscription type of the event (e.g. channel.follow)
+	Type string `json:"type" desc:"EventSub subscription type of the event (e.g. channel.follow)"`
+
+	// Fields to replace in the sample event, nested objects are merged
+	Event map[string]any `json:"event,omitempty" desc:"Fields to replace in the sample event, nested objects are merged"`
+}
+
+const (
+	AlertEventKey   = "twitch/ev/alert"
+	AlertQueueKey   = "twitch/alert-queue"
+	AlertHistoryKey = "twitch/alert-history"
+	AckAlertRPC     = "twitch/@ack-alert"
+	SkipAlertRPC    = "twitch/@skip-alert"
+	ReplayAlertRPC  = "twitch/@replay-alert"
+)
+
+const (
+	// How many alerts can wait in the queue before the oldest ones get dropped
+	AlertQueueMaxSize = 100
+
+	// How many shown alerts to keep for replays
+	AlertHistorySize = 50
+)
+
+type AlertType string
+
+const (
+	AlertTypeFollow       AlertType = "follow"
+	AlertTypeSubscription AlertType = "subscription"
+	AlertTypeGiftSub      AlertType = "gift_sub"
+	AlertTypeRaid         AlertType = "raid"
+	AlertTypeCheer        AlertType = "cheer"
+	AlertTypeRedemption   AlertType = "redemption"
+	AlertTypeHypeTrain    AlertType = "hype_train"
+	AlertTypePoll         AlertType = "poll"
+	AlertTypePrediction   AlertType = "prediction"
+)
+
+// Alert is an EventSub notification normalized for overlays
+type Alert struct {
+	// Unique ID of the alert
+	ID string `json:"id" desc:"Unique ID of the alert"`
+
+	// Alert type
+	Type AlertType `json:"type" desc:"Alert type"`
+
+	// Display name of the user that triggered the alert (empty if anonymous or not applicable)
+	User string `json:"user" desc:"Display name of the user that triggered the alert (empty if anonymous or not applicable)"`
+
+	// ID of the user that triggered the alert
+	UserID string `json:"user_id" desc:"ID of the user that triggered the alert"`
+
+	// Amount for the alert (bits, viewers, months, gifted subs, reward cost, hype train level, votes or points)
+	Amount int `json:"amount" desc:"Amount for the alert (bits, viewers, months, gifted subs, reward cost, hype train level, votes or points)"`
+
+	// Message attached to the alert (sub/cheer message, redemption input, poll/prediction title)
+	Message string `json:"message" desc:"Message attached to the alert (sub/cheer message, redemption input, poll/prediction title)"`
+
+	// Kind of alert within its type (e.g. new/resub for subscriptions, anonymous for gifts, reward title for redemptions, winner for polls and predictions)
+	Variation string `json:"variation" desc:"Kind of alert within its type (e.g. new/resub for subscriptions, anonymous for gifts, reward title for redemptions, winner for polls and predictions)"`
+
+	// When the alert was received
+	Date time.Time `json:"date" desc:"When the alert was received"`
+
+	// True if this is a replay of a previous alert
+	Replay bool `json:"replay" desc:"True if this is a replay of a previous alert"`
+
+	// True if the alert was skipped instead of acknowledged
+	Skipped bool `json:"skipped,omitempty" desc:"True if the alert was skipped instead of acknowledged"`
+
+	// Original EventSub notification
+	Event NotificationMessagePayload `json:"event" desc:"Original EventSub notification"`
+}
+
+const (
+	// StreamSessionPrefix is followed by the stream ID, sessions are saved when the stream starts and updated until it ends
+	StreamSessionPrefix     = "twitch/stream-sessions/"
+	CurrentStreamSessionKey = "twitch/stream-session"
+	StreamSessionQueryRPC   = "twitch/@query-stream-sessions"
+	StreamSessionResultKey  = "twitch/stream-sessions-result"
+)
+
+// StreamSession is a summary of a single stream, from start to end
+type StreamSession struct {
+	// Twitch stream ID
+	ID string `json:"id" desc:"Twitch stream ID"`
+
+	// When the stream started
+	StartedAt time.Time `json:"started_at" desc:"When the stream started"`
+
+	// When the stream ended (missing if it's still live)
+	EndedAt *time.Time `json:"ended_at,omitempty" desc:"When the stream ended (missing if it's still live)"`
+
+	// Last time the stream was known to be live
+	LastSeen time.Time `json:"last_seen" desc:"Last time the stream was known to be live"`
+
+	// Title and category, with every change made during the stream
+	Changes []StreamSessionChange `json:"changes" desc:"Title and category, with every change made during the stream"`
+
+	// Highest viewer count
+	PeakViewers int `json:"peak_viewers" desc:"Highest viewer count"`
+
+	// Average viewer count
+	AverageViewers float64 `json:"average_viewers" desc:"Average viewer count"`
+
+	// How many times the viewer count was checked
+	ViewerSamples int `json:"viewer_samples" desc:"How many times the viewer count was checked"`
+
+	// New followers
+	Follows int `json:"follows" desc:"New followers"`
+
+	// New subscriptions and resubscriptions (not counting gifted ones)
+	Subscriptions int `json:"subscriptions" desc:"New subscriptions and resubscriptions (not counting gifted ones)"`
+
+	// Gifted subscriptions
+	GiftedSubscriptions int `json:"gifted_subscriptions" desc:"Gifted subscriptions"`
+
+	// Bits cheered
+	Bits int `json:"bits" desc:"Bits cheered"`
+
+	// Incoming raids
+	Raids int `json:"raids" desc:"Incoming raids"`
+
+	// Viewers brought by raids
+	RaidViewers int `json:"raid_viewers" desc:"Viewers brought by raids"`
+
+	// Messages in the main channel's chat
+	ChatMessages int `json:"chat_messages" desc:"Messages in the main channel's chat"`
+
+	// Loyalty points given to viewers
+	LoyaltyPoints int64 `json:"loyalty_points" desc:"Loyalty points given to viewers"`
+}
+
+// StreamSessionChange is the stream title and category from a point in time
+type StreamSessionChange struct {
+	// When the change was seen
+	Time time.Time `json:"time" desc:"When the change was seen"`
+
+	// Stream title
+	Title string `json:"title" desc:"Stream title"`
+
+	// Category ID
+	CategoryID string `json:"category_id" desc:"Category ID"`
+
+	// Category name
+	Category string `json:"category" desc:"Category name"`
+}
+
+// StreamSessionQuery is a search for past (and current) streams
+type StreamSessionQuery struct {
+	// Optional ID, copied in the result to tell results apart
+	RequestID string `json:"request_id,omitempty" desc:"Optional ID, copied in the result to tell results apart"`
+
+	// Only return streams that started after this time
+	From *time.Time `json:"from,omitempty" desc:"Only return streams that started after this time"`
+
+	// Only return streams that started before this time
+	To *time.Time `json:"to,omitempty" desc:"Only return streams that started before this time"`
+
+	// Maximum number of streams to return, newest first (defaults to 50)
+	Limit int `json:"limit,omitempty" desc:"Maximum number of streams to return, newest first (defaults to 50)"`
+}
+
+// StreamSessionQueryResult contains the streams found by a stream session query
+type StreamSessionQueryResult struct {
+	// ID of the query, if set
+	RequestID string `json:"request_id,omitempty" desc:"ID of the query, if set"`
+
+	// Streams found, newest first
+	Sessions []StreamSession `json:"sessions" desc:"Streams found, newest first"`
+
+	// True if more streams matched the query than the limit allowed
+	More bool `json:"more" desc:"True if more streams matched the query than the limit allowed"`
+
+	// Error message if the query failed
+	Error string `json:"error,omitempty" desc:"Error message if the query failed"`
+}
+
+type StreamSessionExportFormat string
+
+const (
+	StreamSessionExportCSV  StreamSessionExportFormat = "csv"
+	StreamSessionExportJSON StreamSessionExportFormat = "json"
+)
@@ -34,17 +34,107 @@ var Keys = interfaces.KeyMap{
 		Tags:        []interfaces.KeyTag{interfaces.TagHistory},
 	},
 	ChatActivityKey: interfaces.KeyDef{
-		Description: "Number of chat messages in the last minute",
-		Type:        reflect.TypeOf(0),
+		Description: "Chat messages and unique chatters in the activity window (excluding bots and commands)",
+		Type:        reflect.TypeOf(ChatActivity{}),
+	},
+	ChannelChatEventPrefix: interfaces.KeyDef{
+		Description: "On chat message received in an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf(irc.PrivateMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	ChannelChatHistoryPrefix: interfaces.KeyDef{
+		Description: "Last chat messages received in an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf([]irc.PrivateMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagHistory},
+	},
+	ChannelChatActivityPrefix: interfaces.KeyDef{
+		Description: "Chat activity of an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf(ChatActivity{}),
+	},
+	ChatClearEventKey: interfaces.KeyDef{
+		Description: "On chat cleared by a moderator, or on a user being timed out or banned (all their messages are removed from the chat history)",
+		Type:        reflect.TypeOf(irc.ClearChatMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	ChatClearHistoryKey: interfaces.KeyDef{
+		Description: "Last chat clears, timeouts and bans",
+		Type:        reflect.TypeOf([]irc.ClearChatMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagHistory},
+	},
+	MessageDeletedEventKey: interfaces.KeyDef{
+		Description: "On chat message deleted by a moderator (it's also removed from the chat history)",
+		Type:        reflect.TypeOf(irc.ClearMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	MessageDeletedHistoryKey: interfaces.KeyDef{
+		Description: "Last deleted chat messages",
+		Type:        reflect.TypeOf([]irc.ClearMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagHistory},
+	},
+	UserNoticeEventKey: interfaces.KeyDef{
+		Description: "On chat notice received (subs, gifts, raids, announcements etc.)",
+		Type:        reflect.TypeOf(irc.UserNoticeMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	UserNoticeHistoryKey: interfaces.KeyDef{
+		Description: "Last chat notices received",
+		Type:        reflect.TypeOf([]irc.UserNoticeMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagHistory},
+	},
+	RoomStateKey: interfaces.KeyDef{
+		Description: "Current chat settings (emote-only, followers-only, slow, subs-only and unique chat modes)",
+		Type:        reflect.TypeOf(irc.RoomStateMessage{}),
+	},
+	ChannelChatClearEventPrefix: interfaces.KeyDef{
+		Description: "On chat cleared, or user timed out or banned, in an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf(irc.ClearChatMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	ChannelChatClearHistoryPrefix: interfaces.KeyDef{
+		Description: "Last chat clears, timeouts and bans in an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf([]irc.ClearChatMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagHistory},
+	},
+	ChannelMessageDeletedEventPrefix: interfaces.KeyDef{
+		Description: "On chat message deleted in an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf(irc.ClearMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	ChannelMessageDeletedHistoryPrefix: interfaces.KeyDef{
+		Description: "Last deleted chat messages in an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf([]irc.ClearMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagHistory},
+	},
+	ChannelUserNoticeEventPrefix: interfaces.KeyDef{
+		Description: "On chat notice received in an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf(irc.UserNoticeMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	ChannelUserNoticeHistoryPrefix: interfaces.KeyDef{
+		Description: "Last chat notices received in an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf([]irc.UserNoticeMessage{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagHistory},
+	},
+	ChannelRoomStatePrefix: interfaces.KeyDef{
+		Description: "Current chat settings of an extra channel (followed by the channel name)",
+		Type:        reflect.TypeOf(irc.RoomStateMessage{}),
 	},
 	CustomCommandsKey: interfaces.KeyDef{
 		Description: "Chatbot custom commands",
 		Type:        reflect.TypeOf(map[string]BotCustomCommand{}),
 	},
 	AuthKey: interfaces.KeyDef{
-		Description: "User access token for the twitch subsystem",
+		Description: "Broadcaster access token for the twitch subsystem",
+		Type:        reflect.TypeOf(AuthResponse{}),
+	},
+	BotAuthKey: interfaces.KeyDef{
+		Description: "Bot account access token, used for chat, whispers and announcements (the broadcaster's is used if missing)",
 		Type:        reflect.TypeOf(AuthResponse{}),
 	},
+	AuthStatusKey: interfaces.KeyDef{
+		Description: "Status of the broadcaster and bot account tokens, tells if they need to be authorized again",
+		Type:        reflect.TypeOf(AuthStatus{}),
+	},
 	EventSubEventKey: interfaces.KeyDef{
 		Description: "On Eventsub event received",
 		Type:        reflect.TypeOf(NotificationMessagePayload{}),
@@ -73,6 +163,110 @@ var Keys = interfaces.KeyMap{
 		Type:        reflect.TypeOf(WriteMessageRequest{}),
 		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
 	},
+	EventSubStatusKey: interfaces.KeyDef{
+		Description: "Status of the connection to the EventSub websocket",
+		Type:        reflect.TypeOf(EventSubStatus{}),
+	},
+	TestAlertRPC: interfaces.KeyDef{
+		Description: "Send a fake EventSub notification of any supported type, as if it came from Twitch",
+		Type:        reflect.TypeOf(TestAlertRequest{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	ReplayEventRPC: interfaces.KeyDef{
+		Description: "Send again an event from the EventSub history (by index)",
+		Type:        reflect.TypeOf(0),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	AlertEventKey: interfaces.KeyDef{
+		Description: "Alert that overlays should show, a new one is sent once the previous is acknowledged or skipped",
+		Type:        reflect.TypeOf(Alert{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	AlertQueueKey: interfaces.KeyDef{
+		Description: "Alerts waiting to be shown, the first one is the one currently on screen",
+		Type:        reflect.TypeOf([]Alert{}),
+	},
+	AlertHistoryKey: interfaces.KeyDef{
+		Description: "Last alerts that were shown or skipped",
+		Type:        reflect.TypeOf([]Alert{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagHistory},
+	},
+	StreamSessionPrefix: interfaces.KeyDef{
+		Description: "Summary of a stream (followed by the stream ID), updated while the stream is live",
+		Type:        reflect.TypeOf(StreamSession{}),
+	},
+	CurrentStreamSessionKey: interfaces.KeyDef{
+		Description: "Summary of the ongoing stream (null if offline)",
+		Type:        reflect.TypeOf(StreamSession{}),
+	},
+	StreamSessionQueryRPC: interfaces.KeyDef{
+		Description: "Search past streams (result is written to " + StreamSessionResultKey + ")",
+		Type:        reflect.TypeOf(StreamSessionQuery{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	StreamSessionResultKey: interfaces.KeyDef{
+		Description: "Result of the last stream session query",
+		Type:        reflect.TypeOf(StreamSessionQueryResult{}),
+	},
+	AckAlertRPC: interfaces.KeyDef{
+		Description: "Mark the alert currently on screen (by ID) as shown, moving on to the next one",
+		Type:        reflect.TypeOf(""),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	SkipAlertRPC: interfaces.KeyDef{
+		Description: "Remove an alert (by ID, or the current one if empty) from the queue without showing it",
+		Type:        reflect.TypeOf(""),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	ReplayAlertRPC: interfaces.KeyDef{
+		Description: "Add a copy of an alert from the history (by ID) back to the queue",
+		Type:        reflect.TypeOf(""),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	BotChatLogKey: interfaces.KeyDef{
+		Description: "Configuration of the persistent chat log",
+		Type:        reflect.TypeOf(BotChatLogConfig{}),
+	},
+	ChatLogPrefix: interfaces.KeyDef{
+		Description: "Persistent chat log, followed by the day (UTC), the channel and the message time and ID. Use " + ChatLogQueryRPC + " to search it",
+		Type:        reflect.TypeOf(ChatLogEntry{}),
+	},
+	ChatLogDaysKey: interfaces.KeyDef{
+		Description: "Days (UTC, as YYYY-MM-DD) with messages in the chat log",
+		Type:        reflect.TypeOf([]string{}),
+	},
+	ChatLogQueryRPC: interfaces.KeyDef{
+		Description: "Search the chat log by text, user, channel and time (results are written to " + ChatLogResultKey + ")",
+		Type:        reflect.TypeOf(ChatLogQuery{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
+	ChatLogResultKey: interfaces.KeyDef{
+		Description: "Result of the last chat log search",
+		Type:        reflect.TypeOf(ChatLogQueryResult{}),
+	},
+	ViewerPrefix: interfaces.KeyDef{
+		Description: "Viewer registry, followed by the Twitch user ID of the viewer",
+		Type:        reflect.TypeOf(Viewer{}),
+	},
+	ViewerLoginPrefix: interfaces.KeyDef{
+		Description: "User ID of the viewer who last used a username, followed by the username",
+		Type:        reflect.TypeOf(""),
+	},
+	FirstTimeChatterEventKey: interfaces.KeyDef{
+		Description: "On a viewer writing in the main channel's chat for the first time",
+		Type:        reflect.TypeOf(ViewerChatEvent{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	ReturningChatterEventKey: interfaces.KeyDef{
+		Description: "On a viewer who chatted before writing in the main channel's chat for the first time in the current stream",
+		Type:        reflect.TypeOf(ViewerChatEvent{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagEvent},
+	},
+	SetViewerNotesRPC: interfaces.KeyDef{
+		Description: "Change the notes of a viewer in the viewer registry",
+		Type:        reflect.TypeOf(SetViewerNotesRequest{}),
+		Tags:        []interfaces.KeyTag{interfaces.TagRPC},
+	},
 }
 
 var Enums = interfaces.EnumMap{
@@ -93,4 +287,49 @@ var Enums = interfaces.EnumMap{
 			ResponseTypeAnnounce,
 		},
 	},
+	"AlertType": interfaces.Enum{
+		Values: []any{
+			AlertTypeFollow,
+			AlertTypeSubscription,
+			AlertTypeGiftSub,
+			AlertTypeRaid,
+			AlertTypeCheer,
+			AlertTypeRedemption,
+			AlertTypeHypeTrain,
+			AlertTypePoll,
+			AlertTypePrediction,
+		},
+	},
+	"EventSubTransportType": interfaces.Enum{
+		Values: []any{
+			EventSubTransportWebsocket,
+			EventSubTransportWebhook,
+		},
+	},
+	"StreamSessionExportFormat": interfaces.Enum{
+		Values: []any{
+			StreamSessionExportCSV,
+			StreamSessionExportJSON,
+		},
+	},
+	"ChatTransportType": interfaces.Enum{
+		Values: []any{
+			ChatTransportIRC,
+			ChatTransportEventSub,
+		},
+	},
+	"TimerStreamState": interfaces.Enum{
+		Values: []any{
+			TimerStreamStateAny,
+			TimerStreamStateLive,
+			TimerStreamStateOffline,
+		},
+	},
+	"TimerRotation": interfaces.Enum{
+		Values: []any{
+			TimerRotationShuffle,
+			TimerRotationRandom,
+			TimerRotationSequential,
+		},
+	},
 }
@@ -0,0 +1,228 @@
+package twitch
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/utils"
+)
+
+const websocketEndpoint = "wss://eventsub.wss.twitch.tv/ws"
+
+const (
+	// How long to wait for the welcome message after connecting
+	welcomeTimeout = 10 * time.Second
+
+	// Extra time on top of the keepalive timeout before a silent connection is considered dead
+	keepaliveGrace = 5 * time.Second
+
+	// Minimum and maximum wait between reconnection attempts
+	reconnectBackoffMin = time.Second
+	reconnectBackoffMax = 2 * time.Minute
+)
+
+var (
+	ErrKeepaliveTimeout  = errors.New("no message received within the keepalive timeout")
+	ErrWebsocketShutdown = errors.New("websocket closed by client")
+)
+
+// eventSubSession keeps an EventSub websocket session open until its context is done, reconnecting when needed.
+// Both the client (for events) and the chatbot (for chat, as the bot account) have one.
+type eventSubSession struct {
+	ctx      context.Context
+	logger   *zap.Logger
+	endpoint string
+	// IDs of the notifications received, Twitch can send the same one more than once.
+	// If nil, duplicates are left to onNotification to deal with
+	seen *lru.Cache[string, time.Time]
+
+	// onWelcome is called when a session is ready, reconnected is true if it replaced a session
+	// Twitch asked us to move away from, in which case subscriptions were carried over
+	onWelcome      func(welcome WelcomeMessagePayload, reconnected bool)
+	onNotification func(message EventSubWebsocketMessage)
+	onRevocation   func(message EventSubWebsocketMessage)
+	// onDisconnect is called when the session is lost, before trying to start a new one
+	onDisconnect func(err error)
+}
+
+// eventSubEndpoint returns the EventSub websocket to connect to
+func eventSubEndpoint(config Config) string {
+	if config.EventSubEndpoint != "" {
+		return config.EventSubEndpoint
+	}
+	return websocketEndpoint
+}
+
+// run connects to EventSub and processes messages until the context is done
+func (s *eventSubSession) run() {
+	endpoint := s.endpoint
+	var connection *websocket.Conn
+	attempts := 0
+	for {
+		reconnectURL, newConnection, welcomed, err := s.connect(endpoint, connection)
+		if s.ctx.Err() != nil {
+			break
+		}
+		if welcomed {
+			attempts = 0
+		}
+
+		// Twitch asked us to move to a new connection, the current one stays open until the new one is ready
+		if reconnectURL != "" {
+			endpoint, connection = reconnectURL, newConnection
+			continue
+		}
+
+		s.logger.Error("EventSub websocket error", zap.Error(err))
+		s.onDisconnect(err)
+
+		// Start from a new session, waiting a bit more after every failed attempt
+		endpoint, connection = s.endpoint, nil
+		delay := reconnectBackoff(attempts)
+		attempts++
+		s.logger.Info("Reconnecting to EventSub websocket", zap.Duration("delay", delay), zap.Int("attempt", attempts))
+		select {
+		case <-s.ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+
+	if connection != nil {
+		utils.Close(connection, s.logger)
+	}
+}
+
+// reconnectBackoff returns how long to wait before a reconnection attempt, exponential with jitter
+func reconnectBackoff(attempt int) time.Duration {
+	backoff := reconnectBackoffMax
+	if attempt < 16 {
+		backoff = min(reconnectBackoffMin<<attempt, reconnectBackoffMax)
+	}
+	// Wait between half and the full backoff, so clients don't all reconnect at the same time
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func readLoop(connection *websocket.Conn, recv chan<- []byte, wsErr chan<- error, done <-chan struct{}) {
+	defer close(recv)
+	for {
+		messageType, messageData, err := connection.ReadMessage()
+		if err != nil {
+			wsErr <- err
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		select {
+		case recv <- messageData:
+		case <-done:
+			return
+		}
+	}
+}
+
+// connect connects to an EventSub websocket and processes messages until the connection drops or Twitch asks for a reconnection.
+// In the latter case, the URL to reconnect to and the connection (which must be closed once the new one is ready) are returned.
+func (s *eventSubSession) connect(url string, oldConnection *websocket.Conn) (string, *websocket.Conn, bool, error) {
+	connection, _, err := websocket.DefaultDialer.DialContext(s.ctx, url, nil)
+	if err != nil {
+		if oldConnection != nil {
+			utils.Close(oldConnection, s.logger)
+		}
+		if s.ctx.Err() != nil {
+			return "", nil, false, ErrWebsocketShutdown
+		}
+		s.logger.Error("Could not establish a connection to the EventSub websocket", zap.Error(err))
+		return "", nil, false, err
+	}
+
+	received := make(chan []byte, 10)
+	wsErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go readLoop(connection, received, wsErr, done)
+
+	// The connection is considered dead if nothing (not even a keepalive) is received in time
+	watchdog := time.NewTimer(welcomeTimeout)
+	defer watchdog.Stop()
+
+	welcomed := false
+	keepalive := 0
+	for {
+		// Wait for next message or closing/error
+		var messageData []byte
+		select {
+		case <-s.ctx.Done():
+			utils.Close(connection, s.logger)
+			return "", nil, welcomed, ErrWebsocketShutdown
+		case err = <-wsErr:
+			utils.Close(connection, s.logger)
+			return "", nil, welcomed, err
+		case <-watchdog.C:
+			utils.Close(connection, s.logger)
+			return "", nil, welcomed, ErrKeepaliveTimeout
+		case messageData = <-received:
+		}
+
+		var wsMessage EventSubWebsocketMessage
+		err = json.Unmarshal(messageData, &wsMessage)
+		if err != nil {
+			s.logger.Error("Error decoding EventSub message", zap.Error(err))
+			continue
+		}
+
+		switch wsMessage.Metadata.MessageType {
+		case "session_keepalive":
+			// Nothing to do
+		case "session_welcome":
+			var welcomeData WelcomeMessagePayload
+			if err := json.Unmarshal(wsMessage.Payload, &welcomeData); err != nil {
+				s.logger.Error("Error decoding EventSub welcome message", zap.String("message-type", wsMessage.Metadata.MessageType), zap.Error(err))
+				break
+			}
+			welcomed = true
+			keepalive = welcomeData.Session.KeepaliveTimeoutSeconds
+			s.logger.Info("Connection to EventSub websocket established", zap.String("session-id", welcomeData.Session.Id))
+
+			// We can only close the old connection once the new one has been established
+			reconnected := oldConnection != nil
+			if reconnected {
+				utils.Close(oldConnection, s.logger)
+				oldConnection = nil
+			}
+			s.onWelcome(welcomeData, reconnected)
+		case "session_reconnect":
+			var reconnectData WelcomeMessagePayload
+			if err := json.Unmarshal(wsMessage.Payload, &reconnectData); err != nil {
+				s.logger.Error("Error decoding EventSub session reconnect parameters", zap.String("message-type", wsMessage.Metadata.MessageType), zap.Error(err))
+				break
+			}
+			s.logger.Info("EventSub websocket requested a reconnection", zap.String("session-id", reconnectData.Session.Id), zap.String("reconnect-url", reconnectData.Session.ReconnectUrl))
+			return reconnectData.Session.ReconnectUrl, connection, welcomed, nil
+		case "notification":
+			// Check if we processed this already (Twitch can send the same message more than once)
+			if id := wsMessage.Metadata.MessageId; id != "" && s.seen != nil {
+				if found, _ := s.seen.ContainsOrAdd(id, wsMessage.Metadata.MessageTimestamp); found {
+					s.logger.Debug("Received duplicate event, ignoring", zap.String("message-id", id))
+					break
+				}
+			}
+			s.onNotification(wsMessage)
+		case "revocation":
+			s.onRevocation(wsMessage)
+		}
+
+		// Any message counts as a sign of life
+		if keepalive > 0 {
+			watchdog.Reset(time.Duration(keepalive)*time.Second + keepaliveGrace)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package mock
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nicklaw5/helix/v2"
+)
+
+var ErrNoSubscription = errors.New("no active subscription for this event type")
+
+type session struct {
+	id   string
+	conn *websocket.Conn
+
+	writeMu sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (s *session) send(message any) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(message)
+}
+
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.done)
+		_ = s.conn.Close()
+	})
+}
+
+type metadata struct {
+	MessageID           string    `json:"message_id"`
+	MessageType         string    `json:"message_type"`
+	MessageTimestamp    time.Time `json:"message_timestamp"`
+	SubscriptionType    string    `json:"subscription_type,omitempty"`
+	SubscriptionVersion string    `json:"subscription_version,omitempty"`
+}
+
+type message struct {
+	Metadata metadata `json:"metadata"`
+	Payload  any      `json:"payload"`
+}
+
+type sessionPayload struct {
+	Session struct {
+		ID                      string    `json:"id"`
+		Status                  string    `json:"status"`
+		ConnectedAt             time.Time `json:"connected_at"`
+		KeepaliveTimeoutSeconds int       `json:"keepalive_timeout_seconds"`
+		ReconnectURL            string    `json:"reconnect_url,omitempty"`
+	} `json:"session"`
+}
+
+type subscriptionPayload struct {
+	Subscription helix.EventSubSubscription `json:"subscription"`
+	Event        any                        `json:"event,omitempty"`
+}
+
+func newMessage(messageType string, payload any) message {
+	return message{
+		Metadata: metadata{
+			MessageID:        randomID(),
+			MessageType:      messageType,
+			MessageTimestamp: time.Now(),
+		},
+		Payload: payload,
+	}
+}
+
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	sess := &session{
+		id:   randomID(),
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	// Subscriptions of the old session are moved to the new one on reconnect
+	if oldID := r.URL.Query().Get("reconnect"); oldID != "" {
+		for index, subscription := range s.subscriptions {
+			if subscription.Transport.SessionID == oldID {
+				s.subscriptions[index].Transport.SessionID = sess.id
+			}
+		}
+	}
+	s.sessions[sess.id] = sess
+	keepalive := s.KeepaliveInterval
+	s.mu.Unlock()
+
+	var welcome sessionPayload
+	welcome.Session.ID = sess.id
+	welcome.Session.Status = "connected"
+	welcome.Session.ConnectedAt = time.Now()
+	welcome.Session.KeepaliveTimeoutSeconds = int(keepalive / time.Second)
+	if err := sess.send(newMessage("session_welcome", welcome)); err != nil {
+		s.removeSession(sess)
+		return
+	}
+
+	go s.keepalive(sess, keepalive)
+
+	// Read until the client goes away, we don't expect any message from it
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			s.removeSession(sess)
+			return
+		}
+	}
+}
+
+func (s *Server) keepalive(sess *session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-ticker.C:
+			if err := sess.send(newMessage("session_keepalive", struct{}{})); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// removeSession closes a session, websocket subscriptions of a closed session stop existing
+func (s *Server) removeSession(sess *session) {
+	sess.close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[sess.id]; !ok {
+		return
+	}
+	delete(s.sessions, sess.id)
+	subscriptions := s.subscriptions[:0]
+	for _, subscription := range s.subscriptions {
+		if subscription.Transport.SessionID != sess.id {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	s.subscriptions = subscriptions
+}
+
+// SendNotification sends an event to every session subscribed to the given type
+func (s *Server) SendNotification(topic string, event any) error {
+	return s.SendNotificationWithID(topic, "", event)
+}
+
+// SendNotificationWithID works like SendNotification with a fixed message ID (random if empty),
+// using the same ID twice simulates Twitch delivering a message more than once
+func (s *Server) SendNotificationWithID(topic string, messageID string, event any) error {
+	s.mu.Lock()
+	type target struct {
+		session      *session
+		subscription helix.EventSubSubscription
+	}
+	var targets []target
+	for _, subscription := range s.subscriptions {
+		if subscription.Type != topic {
+			continue
+		}
+		if sess, ok := s.sessions[subscription.Transport.SessionID]; ok {
+			targets = append(targets, target{sess, subscription})
+		}
+	}
+	s.mu.Unlock()
+
+	if len(targets) < 1 {
+		return ErrNoSubscription
+	}
+	for _, target := range targets {
+		msg := newMessage("notification", subscriptionPayload{
+			Subscription: target.subscription,
+			Event:        event,
+		})
+		if messageID != "" {
+			msg.Metadata.MessageID = messageID
+		}
+		msg.Metadata.SubscriptionType = target.subscription.Type
+		msg.Metadata.SubscriptionVersion = target.subscription.Version
+		if err := target.session.send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendRevocation revokes all subscriptions of the given type, notifying the sessions they belonged to
+func (s *Server) SendRevocation(topic string, status string) error {
+	s.mu.Lock()
+	var revoked []helix.EventSubSubscription
+	subscriptions := s.subscriptions[:0]
+	for _, subscription := range s.subscriptions {
+		if subscription.Type == topic {
+			subscription.Status = status
+			revoked = append(revoked, subscription)
+		} else {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	s.subscriptions = subscriptions
+	sessions := make(map[string]*session)
+	for id, sess := range s.sessions {
+		sessions[id] = sess
+	}
+	s.mu.Unlock()
+
+	if len(revoked) < 1 {
+		return ErrNoSubscription
+	}
+	for _, subscription := range revoked {
+		sess, ok := sessions[subscription.Transport.SessionID]
+		if !ok {
+			continue
+		}
+		msg := newMessage("revocation", subscriptionPayload{Subscription: subscription})
+		msg.Metadata.SubscriptionType = subscription.Type
+		msg.Metadata.SubscriptionVersion = subscription.Version
+		if err := sess.send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendReconnect asks all connected sessions to move to a new connection, as Twitch does before maintenance
+func (s *Server) SendReconnect() error {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		var reconnect sessionPayload
+		reconnect.Session.ID = sess.id
+		reconnect.Session.Status = "reconnecting"
+		reconnect.Session.ConnectedAt = time.Now()
+		reconnect.Session.ReconnectURL = s.EventSubURL() + "?reconnect=" + sess.id
+		if err := sess.send(newMessage("session_reconnect", reconnect)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropSessions closes all EventSub connections without warning, like a network issue would
+func (s *Server) DropSessions() {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		s.removeSession(sess)
+	}
+}
+
+// Sessions returns the IDs of all connected EventSub sessions
+func (s *Server) Sessions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,392 @@
+// Package mock implements a fake Twitch server for offline development and tests.
+//
+// It speaks the EventSub websocket protocol and stubs the Helix and OAuth
+// endpoints used by strimertul, so a twitch.Client can be pointed to it by
+// setting the custom endpoints in its configuration.
+package mock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nicklaw5/helix/v2"
+)
+
+var json = jsoniter.ConfigFastest
+
+const (
+	AccessToken  = "mock-access-token"
+	RefreshToken = "mock-refresh-token"
+	AuthCode     = "mock-auth-code"
+
+	// Tokens of the bot account, given when authorizing with force_verify (like logging in with a different account)
+	BotAccessToken  = "mock-bot-access-token"
+	BotRefreshToken = "mock-bot-refresh-token"
+	BotAuthCode     = "mock-bot-auth-code"
+)
+
+// Request is a request that changed something on the mock server
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   []byte
+	Token  string // Access token the request was made with
+}
+
+// Server is a fake Twitch server
+type Server struct {
+	// User returned by the users endpoint and used as broadcaster
+	User helix.User
+
+	// User returned by the users endpoint when using the bot account's token
+	BotUser helix.User
+
+	// How often to send keepalive messages on EventSub sessions
+	KeepaliveInterval time.Duration
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu            sync.Mutex
+	streams       []helix.Stream
+	chatters      []helix.ChatChatter
+	scopes        []string
+	refreshes     int
+	subscriptions []helix.EventSubSubscription
+	sessions      map[string]*session
+	requests      []Request
+}
+
+// NewServer starts a new mock server on a random local port
+func NewServer() *Server {
+	s := &Server{
+		User: helix.User{
+			ID:          "603448316",
+			Login:       "ashkeelvt",
+			DisplayName: "AshKeelVT",
+			Type:        "",
+		},
+		BotUser: helix.User{
+			ID:          "987654321",
+			Login:       "strimertulbot",
+			DisplayName: "StrimertulBot",
+		},
+		KeepaliveInterval: 10 * time.Second,
+		sessions:          make(map[string]*session),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleWebsocket)
+	mux.HandleFunc("/oauth2/", s.handleAuth)
+	mux.HandleFunc("/helix/", s.handleHelix)
+	s.server = httptest.NewServer(mux)
+
+	return s
+}
+
+// APIBaseURL returns the base URL of the fake Helix API
+func (s *Server) APIBaseURL() string {
+	return s.server.URL + "/helix"
+}
+
+// AuthBaseURL returns the base URL of the fake OAuth endpoints
+func (s *Server) AuthBaseURL() string {
+	return s.server.URL + "/oauth2"
+}
+
+// EventSubURL returns the URL of the fake EventSub websocket
+func (s *Server) EventSubURL() string {
+	return "ws" + strings.TrimPrefix(s.server.URL, "http") + "/ws"
+}
+
+// SetStreams sets the streams returned by the streams endpoint, an empty list means the channel is offline
+func (s *Server) SetStreams(streams []helix.Stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams = streams
+}
+
+// SetChatters sets the users returned by the chatters endpoint
+func (s *Server) SetChatters(chatters []helix.ChatChatter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chatters = chatters
+}
+
+// SetScopes sets the scopes granted to all tokens
+func (s *Server) SetScopes(scopes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scopes = scopes
+}
+
+// Refreshes returns how many times a token was refreshed
+func (s *Server) Refreshes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshes
+}
+
+// Subscriptions returns all the active EventSub subscriptions
+func (s *Server) Subscriptions() []helix.EventSubSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]helix.EventSubSubscription{}, s.subscriptions...)
+}
+
+// Requests returns all requests that weren't simple lookups (whispers, announcements, subscriptions etc)
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+func (s *Server) Close() {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.close()
+	}
+	s.server.Close()
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/oauth2") {
+	case "/authorize":
+		// Skip the login screen and go right back to the app
+		redirect, err := url.Parse(r.URL.Query().Get("redirect_uri"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid redirect_uri")
+			return
+		}
+		query := redirect.Query()
+		code := AuthCode
+		if r.URL.Query().Get("force_verify") == "true" {
+			code = BotAuthCode
+		}
+		query.Set("code", code)
+		query.Set("scope", r.URL.Query().Get("scope"))
+		if state := r.URL.Query().Get("state"); state != "" {
+			query.Set("state", state)
+		}
+		redirect.RawQuery = query.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	case "/token":
+		accessToken, refreshToken := AccessToken, RefreshToken
+		if r.FormValue("code") == BotAuthCode || r.FormValue("refresh_token") == BotRefreshToken {
+			accessToken, refreshToken = BotAccessToken, BotRefreshToken
+		} else if refresh := r.FormValue("refresh_token"); refresh != "" && refresh != RefreshToken {
+			writeError(w, http.StatusBadRequest, "Invalid refresh token")
+			return
+		}
+		if r.FormValue("grant_type") == "refresh_token" {
+			s.mu.Lock()
+			s.refreshes++
+			s.mu.Unlock()
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token":  accessToken,
+			"refresh_token": refreshToken,
+			"expires_in":    14400,
+			"scope":         s.grantedScopes(),
+			"token_type":    "bearer",
+		})
+	case "/validate":
+		// Only the tokens given by the mock server are valid
+		var user helix.User
+		switch token := strings.Fields(r.Header.Get("Authorization")); {
+		case len(token) == 2 && token[1] == AccessToken:
+			user = s.User
+		case len(token) == 2 && token[1] == BotAccessToken:
+			user = s.BotUser
+		default:
+			writeError(w, http.StatusUnauthorized, "invalid access token")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"client_id":  "mock",
+			"login":      user.Login,
+			"user_id":    user.ID,
+			"scopes":     s.grantedScopes(),
+			"expires_in": 14400,
+		})
+	case "/revoke":
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusNotFound, "unknown auth endpoint")
+	}
+}
+
+func (s *Server) grantedScopes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.scopes...)
+}
+
+func (s *Server) handleHelix(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/helix")
+	if r.Method != http.MethodGet {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{
+			Method: r.Method,
+			Path:   path,
+			Query:  r.URL.Query(),
+			Body:   body,
+			Token:  strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+		})
+		s.mu.Unlock()
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+	}
+
+	switch {
+	case path == "/users" && r.Method == http.MethodGet:
+		if logins := r.URL.Query()["login"]; len(logins) > 0 {
+			writeJSON(w, http.StatusOK, helix.ManyUsers{Users: s.usersByLogin(logins)})
+			return
+		}
+		user := s.User
+		if r.Header.Get("Authorization") == "Bearer "+BotAccessToken {
+			user = s.BotUser
+		}
+		writeJSON(w, http.StatusOK, helix.ManyUsers{Users: []helix.User{user}})
+	case path == "/streams" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		streams := []helix.Stream{}
+		for _, stream := range s.streams {
+			if ids := r.URL.Query()["user_id"]; len(ids) == 0 || slices.Contains(ids, stream.UserID) {
+				streams = append(streams, stream)
+			}
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, helix.ManyStreams{Streams: streams})
+	case path == "/chat/chatters" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		chatters := append([]helix.ChatChatter{}, s.chatters...)
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, helix.ManyChatChatters{Chatters: chatters, Total: len(chatters)})
+	case path == "/chat/announcements" && r.Method == http.MethodPost,
+		path == "/whispers" && r.Method == http.MethodPost:
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/chat/messages" && r.Method == http.MethodPost:
+		writeJSON(w, http.StatusOK, map[string]any{
+			"data": []map[string]any{{"message_id": randomID(), "is_sent": true}},
+		})
+	case path == "/eventsub/subscriptions":
+		s.handleSubscriptions(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "endpoint not implemented by mock server")
+	}
+}
+
+// usersByLogin returns the mock users with the given logins, other logins get a made up user
+func (s *Server) usersByLogin(logins []string) []helix.User {
+	var users []helix.User
+	for _, login := range logins {
+		switch strings.ToLower(login) {
+		case s.User.Login:
+			users = append(users, s.User)
+		case s.BotUser.Login:
+			users = append(users, s.BotUser)
+		default:
+			users = append(users, helix.User{ID: "mock-" + login, Login: login, DisplayName: login})
+		}
+	}
+	return users
+}
+
+func (s *Server) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		subscriptions := s.Subscriptions()
+		writeJSON(w, http.StatusOK, helix.ManyEventSubSubscriptions{
+			Total:                 len(subscriptions),
+			MaxTotalCost:          10000,
+			EventSubSubscriptions: subscriptions,
+		})
+	case http.MethodPost:
+		var subscription helix.EventSubSubscription
+		if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid subscription")
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if subscription.Transport.Method == "websocket" {
+			if _, ok := s.sessions[subscription.Transport.SessionID]; !ok {
+				writeError(w, http.StatusBadRequest, "websocket session not found")
+				return
+			}
+		}
+		for _, existing := range s.subscriptions {
+			if existing.Type == subscription.Type && existing.Condition == subscription.Condition &&
+				existing.Transport.SessionID == subscription.Transport.SessionID && existing.Transport.Callback == subscription.Transport.Callback {
+				writeError(w, http.StatusConflict, "subscription already exists")
+				return
+			}
+		}
+
+		// Like Twitch, never send back the webhook secret
+		subscription.Transport.Secret = ""
+		subscription.ID = randomID()
+		subscription.Status = "enabled"
+		subscription.CreatedAt = helix.Time{Time: time.Now()}
+		s.subscriptions = append(s.subscriptions, subscription)
+		writeJSON(w, http.StatusAccepted, helix.ManyEventSubSubscriptions{
+			Total:                 len(s.subscriptions),
+			MaxTotalCost:          10000,
+			EventSubSubscriptions: []helix.EventSubSubscription{subscription},
+		})
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for index, subscription := range s.subscriptions {
+			if subscription.ID == id {
+				s.subscriptions = append(s.subscriptions[:index], s.subscriptions[index+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "subscription not found")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{
+		"error":   http.StatusText(status),
+		"status":  status,
+		"message": message,
+	})
+}
+
+func randomID() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,434 @@
+package twitch
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+var ErrUnknownExportFormat = errors.New("unknown export format")
+
+const (
+	// Helix can take a while to list a stream that just started, so polls don't end sessions younger than this
+	streamSessionStartGrace = 5 * time.Minute
+
+	// If a stream was last seen live longer than this, it ended around that time (e.g. strimertul was closed)
+	streamSessionLostAfter = 3 * time.Minute
+
+	streamSessionDefaultLimit = 50
+)
+
+// StreamSessionTracker records every stream from start to end, using EventSub
+// stream.online/stream.offline events with the stream status polling as fallback
+type StreamSessionTracker struct {
+	db     *database.LocalDBClient
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	current *StreamSession
+
+	cancelSubs []database.CancelFunc
+}
+
+func NewStreamSessionTracker(db *database.LocalDBClient, logger *zap.Logger) *StreamSessionTracker {
+	tracker := &StreamSessionTracker{
+		db:     db,
+		logger: logger,
+	}
+
+	// Resume the stream that was live before the last shutdown
+	if err := db.GetJSON(CurrentStreamSessionKey, &tracker.current); err != nil && !errors.Is(err, database.ErrEmptyKey) {
+		logger.Warn("Could not load current stream session", zap.Error(err))
+	}
+
+	subscriptions := map[string]func(string){
+		EventSubEventKey:      tracker.onEventSubEvent,
+		StreamInfoKey:         tracker.onStreamInfo,
+		StreamSessionQueryRPC: tracker.handleQueryRPC,
+	}
+	for key, handler := range subscriptions {
+		err, cancel := db.SubscribeKey(key, handler)
+		if err != nil {
+			logger.Error("Could not setup stream session subscription", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		tracker.cancelSubs = append(tracker.cancelSubs, cancel)
+	}
+
+	return tracker
+}
+
+func (t *StreamSessionTracker) Close() {
+	for _, cancel := range t.cancelSubs {
+		if cancel != nil {
+			cancel()
+		}
+	}
+
+	// Chat messages are only counted in memory until the next save
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil {
+		t.save()
+	}
+}
+
+// Current returns the session of the ongoing stream, the second value is false if there is none
+func (t *StreamSessionTracker) Current() (StreamSession, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current == nil {
+		return StreamSession{}, false
+	}
+	return *t.current, true
+}
+
+// OnChatMessage counts a message written in the main channel
+func (t *StreamSessionTracker) OnChatMessage() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil {
+		t.current.ChatMessages++
+	}
+}
+
+// AddLoyaltyPoints adds to the points given to viewers during the ongoing stream
+func (t *StreamSessionTracker) AddLoyaltyPoints(points int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current == nil {
+		return
+	}
+	t.current.LoyaltyPoints += points
+	t.save()
+}
+
+func (t *StreamSessionTracker) onStreamInfo(value string) {
+	var streams []helix.Stream
+	if err := json.UnmarshalFromString(value, &streams); err != nil {
+		t.logger.Warn("Could not decode stream info", zap.Error(err))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if len(streams) < 1 {
+		// Only end streams that Helix had time to notice
+		if t.current != nil && now.Sub(t.current.StartedAt) > streamSessionStartGrace {
+			t.end(t.lastLive(now))
+		}
+		return
+	}
+
+	stream := streams[0]
+	if !t.start(stream.ID, stream.StartedAt, now) {
+		return
+	}
+	t.current.LastSeen = now
+	t.current.PeakViewers = max(t.current.PeakViewers, stream.ViewerCount)
+	t.current.AverageViewers = (t.current.AverageViewers*float64(t.current.ViewerSamples) + float64(stream.ViewerCount)) / float64(t.current.ViewerSamples+1)
+	t.current.ViewerSamples++
+	t.change(now, stream.Title, stream.GameID, stream.GameName)
+	t.save()
+}
+
+func (t *StreamSessionTracker) onEventSubEvent(value string) {
+	var ev eventSubNotification
+	if err := json.UnmarshalFromString(value, &ev); err != nil {
+		t.logger.Warn("Error parsing webhook payload", zap.Error(err))
+		return
+	}
+	// Test and replayed events didn't happen on stream
+	if ev.Synthetic {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var err error
+	switch ev.Subscription.Type {
+	case helix.EventSubTypeStreamOnline:
+		var onlineEv helix.EventSubStreamOnlineEvent
+		if err = json.Unmarshal(ev.Event, &onlineEv); err == nil {
+			t.start(onlineEv.ID, onlineEv.StartedAt.Time, now)
+		}
+	case helix.EventSubTypeStreamOffline:
+		if t.current != nil {
+			t.end(now)
+		}
+		return
+	case helix.EventSubTypeChannelUpdate:
+		var updateEv helix.EventSubChannelUpdateEvent
+		if err = json.Unmarshal(ev.Event, &updateEv); err == nil && t.current != nil {
+			t.change(now, updateEv.Title, updateEv.CategoryID, updateEv.CategoryName)
+		}
+	case helix.EventSubTypeChannelFollow:
+		if t.current != nil {
+			t.current.Follows++
+		}
+	case helix.EventSubTypeChannelSubscription:
+		var subEv helix.EventSubChannelSubscribeEvent
+		// Gifted subscriptions are counted from the gift event
+		if err = json.Unmarshal(ev.Event, &subEv); err == nil && t.current != nil && !subEv.IsGift {
+			t.current.Subscriptions++
+		}
+	case helix.EventSubTypeChannelSubscriptionMessage:
+		if t.current != nil {
+			t.current.Subscriptions++
+		}
+	case helix.EventSubTypeChannelSubscriptionGift:
+		var giftEv helix.EventSubChannelSubscriptionGiftEvent
+		if err = json.Unmarshal(ev.Event, &giftEv); err == nil && t.current != nil {
+			t.current.GiftedSubscriptions += giftEv.Total
+		}
+	case helix.EventSubTypeChannelCheer:
+		var cheerEv helix.EventSubChannelCheerEvent
+		if err = json.Unmarshal(ev.Event, &cheerEv); err == nil && t.current != nil {
+			t.current.Bits += cheerEv.Bits
+		}
+	case helix.EventSubTypeChannelRaid:
+		var raidEv helix.EventSubChannelRaidEvent
+		if err = json.Unmarshal(ev.Event, &raidEv); err == nil && t.current != nil {
+			t.current.Raids++
+			t.current.RaidViewers += raidEv.Viewers
+		}
+	default:
+		return
+	}
+	if err != nil {
+		t.logger.Warn("Error parsing event for stream session", zap.String("event", ev.Subscription.Type), zap.Error(err))
+		return
+	}
+	if t.current != nil {
+		t.current.LastSeen = now
+		t.save()
+	}
+}
+
+// start begins a new session, unless it's the stream being tracked already. Returns false if the
+// stream already ended, Helix keeps listing streams for a few minutes after they go offline.
+// Must be called with the lock held
+func (t *StreamSessionTracker) start(id string, startedAt time.Time, now time.Time) bool {
+	if t.current != nil {
+		if t.current.ID == id {
+			return true
+		}
+		// We missed the end of the previous stream
+		t.end(t.lastLive(now))
+	}
+	var ended StreamSession
+	if err := t.db.GetJSON(StreamSessionPrefix+id, &ended); err == nil && ended.EndedAt != nil {
+		return false
+	}
+	if startedAt.IsZero() {
+		startedAt = now
+	}
+
+	t.current = &StreamSession{
+		ID:        id,
+		StartedAt: startedAt,
+		LastSeen:  now,
+		Changes:   []StreamSessionChange{},
+	}
+	t.logger.Info("Stream started, tracking new stream session", zap.String("stream-id", id))
+	t.save()
+	return true
+}
+
+// lastLive returns when the current stream most likely ended, if we didn't get told about it. Must be called with the lock held
+func (t *StreamSessionTracker) lastLive(now time.Time) time.Time {
+	if now.Sub(t.current.LastSeen) > streamSessionLostAfter {
+		return t.current.LastSeen
+	}
+	return now
+}
+
+// end closes the current session. Must be called with the lock held
+func (t *StreamSessionTracker) end(endedAt time.Time) {
+	t.current.EndedAt = &endedAt
+
+	session := *t.current
+	t.current = nil
+	err := t.db.PutJSONBulk(map[string]any{
+		StreamSessionPrefix + session.ID: session,
+		CurrentStreamSessionKey:          nil,
+	})
+	if err != nil {
+		t.logger.Error("Could not save stream session", zap.String("stream-id", session.ID), zap.Error(err))
+	}
+	t.logger.Info("Stream ended, stream session saved", zap.String("stream-id", session.ID))
+}
+
+// change records a new title or category, if they are different from the last ones. Must be called with the lock held
+func (t *StreamSessionTracker) change(now time.Time, title string, categoryID string, category string) {
+	if count := len(t.current.Changes); count > 0 {
+		last := t.current.Changes[count-1]
+		if last.Title == title && last.CategoryID == categoryID {
+			return
+		}
+	}
+	t.current.Changes = append(t.current.Changes, StreamSessionChange{
+		Time:       now,
+		Title:      title,
+		CategoryID: categoryID,
+		Category:   category,
+	})
+}
+
+// save writes the current session to the database. Must be called with the lock held
+func (t *StreamSessionTracker) save() {
+	err := t.db.PutJSONBulk(map[string]any{
+		StreamSessionPrefix + t.current.ID: t.current,
+		CurrentStreamSessionKey:            t.current,
+	})
+	if err != nil {
+		t.logger.Error("Could not save stream session", zap.String("stream-id", t.current.ID), zap.Error(err))
+	}
+}
+
+// Sessions returns all the recorded streams, newest first
+func (t *StreamSessionTracker) Sessions() ([]StreamSession, error) {
+	values, err := t.db.GetAll(StreamSessionPrefix)
+	if err != nil && !errors.Is(err, database.ErrEmptyKey) {
+		return nil, err
+	}
+
+	sessions := make([]StreamSession, 0, len(values))
+	for key, value := range values {
+		var session StreamSession
+		if err := json.UnmarshalFromString(value, &session); err != nil {
+			return nil, fmt.Errorf("invalid stream session in %s: %w", key, err)
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.After(sessions[j].StartedAt)
+	})
+	return sessions, nil
+}
+
+// Query returns the recorded streams matching a query, newest first
+func (t *StreamSessionTracker) Query(query StreamSessionQuery) StreamSessionQueryResult {
+	result := StreamSessionQueryResult{
+		RequestID: query.RequestID,
+		Sessions:  []StreamSession{},
+	}
+
+	sessions, err := t.Sessions()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = streamSessionDefaultLimit
+	}
+	for _, session := range sessions {
+		if query.From != nil && session.StartedAt.Before(*query.From) {
+			continue
+		}
+		if query.To != nil && session.StartedAt.After(*query.To) {
+			continue
+		}
+		if len(result.Sessions) >= limit {
+			result.More = true
+			break
+		}
+		result.Sessions = append(result.Sessions, session)
+	}
+	return result
+}
+
+func (t *StreamSessionTracker) handleQueryRPC(value string) {
+	var query StreamSessionQuery
+	result := StreamSessionQueryResult{}
+	if err := json.UnmarshalFromString(value, &query); err != nil {
+		result.Error = err.Error()
+	} else {
+		result = t.Query(query)
+	}
+	if err := t.db.PutJSON(StreamSessionResultKey, result); err != nil {
+		t.logger.Warn("Could not save stream session query result", zap.Error(err))
+	}
+}
+
+// Export writes all the recorded streams, newest first, as CSV or JSON
+func (t *StreamSessionTracker) Export(out io.Writer, format StreamSessionExportFormat) error {
+	sessions, err := t.Sessions()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case StreamSessionExportJSON:
+		return json.NewEncoder(out).Encode(sessions)
+	case StreamSessionExportCSV:
+		return exportSessionsCSV(out, sessions)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownExportFormat, format)
+	}
+}
+
+func exportSessionsCSV(out io.Writer, sessions []StreamSession) error {
+	writer := csv.NewWriter(out)
+	err := writer.Write([]string{
+		"id", "started_at", "ended_at", "duration_seconds", "title", "category",
+		"peak_viewers", "average_viewers", "follows", "subscriptions", "gifted_subscriptions",
+		"bits", "raids", "raid_viewers", "chat_messages", "loyalty_points",
+	})
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		// Streams that are still live are counted until now
+		endedAt, end := "", time.Now()
+		if session.EndedAt != nil {
+			end = *session.EndedAt
+			endedAt = end.Format(time.RFC3339)
+		}
+		// Only the last title and category are exported, the JSON export has all of them
+		var title, category string
+		if len(session.Changes) > 0 {
+			last := session.Changes[len(session.Changes)-1]
+			title, category = last.Title, last.Category
+		}
+		err := writer.Write([]string{
+			session.ID,
+			session.StartedAt.Format(time.RFC3339),
+			endedAt,
+			strconv.FormatInt(int64(end.Sub(session.StartedAt)/time.Second), 10),
+			title,
+			category,
+			strconv.Itoa(session.PeakViewers),
+			strconv.FormatFloat(session.AverageViewers, 'f', 1, 64),
+			strconv.Itoa(session.Follows),
+			strconv.Itoa(session.Subscriptions),
+			strconv.Itoa(session.GiftedSubscriptions),
+			strconv.Itoa(session.Bits),
+			strconv.Itoa(session.Raids),
+			strconv.Itoa(session.RaidViewers),
+			strconv.Itoa(session.ChatMessages),
+			strconv.FormatInt(session.LoyaltyPoints, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,202 @@
+package twitch
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"go.uber.org/zap/zaptest"
+
+	"git.sr.ht/~ashkeel/strimertul/database"
+)
+
+func newTestSessionTracker(t *testing.T) (*StreamSessionTracker, *database.LocalDBClient) {
+	db, _ := database.CreateInMemoryLocalClient(t)
+	t.Cleanup(func() { database.CleanupLocalClient(db) })
+
+	tracker := NewStreamSessionTracker(db, zaptest.NewLogger(t))
+	t.Cleanup(tracker.Close)
+	return tracker, db
+}
+
+func streamInfo(t *testing.T, streams ...helix.Stream) string {
+	data, err := json.MarshalToString(streams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStreamSessionTracking(t *testing.T) {
+	tracker, db := newTestSessionTracker(t)
+
+	started := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	tracker.onEventSubEvent(fmt.Sprintf(`{"subscription":{"type":"stream.online"},"event":{"id":"stream1","type":"live","started_at":%q}}`, started.Format(time.RFC3339)))
+
+	// Helix doesn't list the stream yet, that must not end it
+	tracker.onStreamInfo(streamInfo(t))
+	tracker.onStreamInfo(streamInfo(t, helix.Stream{ID: "stream1", StartedAt: started, Title: "Hello", GameID: "1", GameName: "Chatting", ViewerCount: 10}))
+	tracker.onStreamInfo(streamInfo(t, helix.Stream{ID: "stream1", StartedAt: started, Title: "Hello", GameID: "1", GameName: "Chatting", ViewerCount: 30}))
+	tracker.onEventSubEvent(`{"subscription":{"type":"channel.update"},"event":{"title":"Playing games","category_id":"2","category_name":"Games"}}`)
+
+	for _, event := range []string{
+		`{"subscription":{"type":"channel.follow"},"event":{"user_id":"1"}}`,
+		`{"subscription":{"type":"channel.subscribe"},"event":{"user_id":"2","is_gift":false}}`,
+		`{"subscription":{"type":"channel.subscribe"},"event":{"user_id":"3","is_gift":true}}`,
+		`{"subscription":{"type":"channel.subscription.gift"},"event":{"user_id":"4","total":5}}`,
+		`{"subscription":{"type":"channel.subscription.message"},"event":{"user_id":"5"}}`,
+		`{"subscription":{"type":"channel.cheer"},"event":{"user_id":"6","bits":100}}`,
+		`{"subscription":{"type":"channel.raid"},"event":{"from_broadcaster_user_id":"7","viewers":42}}`,
+		// Test and replayed events are not counted
+		`{"subscription":{"type":"channel.cheer"},"event":{"user_id":"6","bits":5000},"synthetic":true}`,
+		`{"subscription":{"type":"stream.offline"},"event":{},"synthetic":true}`,
+	} {
+		tracker.onEventSubEvent(event)
+	}
+	tracker.OnChatMessage()
+	tracker.OnChatMessage()
+	tracker.AddLoyaltyPoints(250)
+
+	var current StreamSession
+	if err := db.GetJSON(CurrentStreamSessionKey, &current); err != nil {
+		t.Fatal(err)
+	}
+	if current.ID != "stream1" || !current.StartedAt.Equal(started) || current.EndedAt != nil {
+		t.Fatalf("unexpected current session: %+v", current)
+	}
+
+	tracker.onEventSubEvent(`{"subscription":{"type":"stream.offline"},"event":{}}`)
+	if _, live := tracker.Current(); live {
+		t.Fatal("session is still live after the stream went offline")
+	}
+
+	var session StreamSession
+	if err := db.GetJSON(StreamSessionPrefix+"stream1", &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.EndedAt == nil {
+		t.Fatal("session has no end time")
+	}
+	if session.PeakViewers != 30 || session.AverageViewers != 20 || session.ViewerSamples != 2 {
+		t.Fatalf("unexpected viewer stats: %+v", session)
+	}
+	if len(session.Changes) != 2 || session.Changes[0].Category != "Chatting" || session.Changes[1].Title != "Playing games" {
+		t.Fatalf("unexpected title/category changes: %+v", session.Changes)
+	}
+	if session.Follows != 1 || session.Subscriptions != 2 || session.GiftedSubscriptions != 5 || session.Bits != 100 ||
+		session.Raids != 1 || session.RaidViewers != 42 || session.ChatMessages != 2 || session.LoyaltyPoints != 250 {
+		t.Fatalf("unexpected stream stats: %+v", session)
+	}
+
+	// Nothing is counted while offline
+	tracker.OnChatMessage()
+	tracker.onEventSubEvent(`{"subscription":{"type":"channel.follow"},"event":{"user_id":"8"}}`)
+	if err := db.GetJSON(StreamSessionPrefix+"stream1", &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.ChatMessages != 2 || session.Follows != 1 {
+		t.Fatalf("offline activity was added to the last stream: %+v", session)
+	}
+}
+
+func TestStreamSessionPolling(t *testing.T) {
+	tracker, db := newTestSessionTracker(t)
+
+	// Stream found by polling only, without any EventSub event
+	started := time.Now().Add(-time.Hour)
+	tracker.onStreamInfo(streamInfo(t, helix.Stream{ID: "stream1", StartedAt: started, ViewerCount: 5}))
+
+	// A different stream means the first one ended without us noticing
+	tracker.onStreamInfo(streamInfo(t, helix.Stream{ID: "stream2", StartedAt: time.Now(), ViewerCount: 5}))
+	if current, live := tracker.Current(); !live || current.ID != "stream2" {
+		t.Fatalf("expected stream2 to be live, got %+v", current)
+	}
+
+	// Once Helix had time to list the stream, an empty list means it's offline
+	tracker.mu.Lock()
+	tracker.current.StartedAt = time.Now().Add(-10 * time.Minute)
+	tracker.mu.Unlock()
+	tracker.onStreamInfo(streamInfo(t))
+	if _, live := tracker.Current(); live {
+		t.Fatal("session is still live after the stream disappeared")
+	}
+
+	result := tracker.Query(StreamSessionQuery{Limit: 1})
+	if result.Error != "" {
+		t.Fatal(result.Error)
+	}
+	if len(result.Sessions) != 1 || result.Sessions[0].ID != "stream2" || !result.More {
+		t.Fatalf("unexpected query result: %+v", result)
+	}
+	to := time.Now().Add(-30 * time.Minute)
+	tracker.handleQueryRPC(fmt.Sprintf(`{"request_id":"abc","to":%q}`, to.Format(time.RFC3339Nano)))
+	if err := db.GetJSON(StreamSessionResultKey, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.RequestID != "abc" || len(result.Sessions) != 1 || result.Sessions[0].ID != "stream1" || result.More {
+		t.Fatalf("unexpected RPC result: %+v", result)
+	}
+}
+
+func TestStreamSessionStalePoll(t *testing.T) {
+	tracker, db := newTestSessionTracker(t)
+
+	started := time.Now().Add(-2 * time.Hour)
+	stream := helix.Stream{ID: "stream1", StartedAt: started, ViewerCount: 40}
+	tracker.onStreamInfo(streamInfo(t, stream))
+	tracker.onEventSubEvent(`{"subscription":{"type":"stream.offline"},"event":{}}`)
+
+	// Helix still lists the stream for a while after it went offline
+	tracker.onStreamInfo(streamInfo(t, stream))
+	if _, live := tracker.Current(); live {
+		t.Fatal("ended stream was started again")
+	}
+	tracker.onStreamInfo(streamInfo(t))
+
+	var session StreamSession
+	if err := db.GetJSON(StreamSessionPrefix+"stream1", &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.EndedAt == nil || session.PeakViewers != 40 || session.ViewerSamples != 1 {
+		t.Fatalf("ended session was overwritten: %+v", session)
+	}
+}
+
+func TestStreamSessionExport(t *testing.T) {
+	tracker, _ := newTestSessionTracker(t)
+
+	started := time.Now().Add(-2 * time.Hour)
+	tracker.onStreamInfo(streamInfo(t, helix.Stream{ID: "stream1", StartedAt: started, Title: "Hello, world", GameName: "Chatting", ViewerCount: 7}))
+	tracker.onEventSubEvent(`{"subscription":{"type":"stream.offline"},"event":{}}`)
+
+	var out bytes.Buffer
+	if err := tracker.Export(&out, StreamSessionExportCSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1][0] != "stream1" || rows[1][4] != "Hello, world" || rows[1][6] != "7" {
+		t.Fatalf("unexpected CSV export: %v", rows)
+	}
+
+	out.Reset()
+	if err := tracker.Export(&out, StreamSessionExportJSON); err != nil {
+		t.Fatal(err)
+	}
+	var sessions []StreamSession
+	if err := json.Unmarshal(out.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].PeakViewers != 7 {
+		t.Fatalf("unexpected JSON export: %+v", sessions)
+	}
+
+	if err := tracker.Export(&out, "xml"); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}